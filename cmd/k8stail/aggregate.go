@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/pflag"
+
+	"github.com/banzaicloud/log-socket/internal"
+)
+
+// aggregationOptions holds the flags asking the service to stream counts of records instead of the records
+type aggregationOptions struct {
+	fields []string
+	window time.Duration
+}
+
+func (o *aggregationOptions) addFlags(fs *pflag.FlagSet) {
+	fs.StringSliceVar(&o.fields, "aggregate", nil, "receive the number of records grouped by these fields (e.g. kubernetes.pod_name,level) per window instead of the records")
+	fs.DurationVar(&o.window, "window", 0, "length of the windows records are counted in with --aggregate (10s by default)")
+}
+
+func (o *aggregationOptions) enabled() bool {
+	return len(o.fields) > 0
+}
+
+// query returns the query parameters requesting aggregation
+func (o *aggregationOptions) query() url.Values {
+	res := url.Values{}
+	if o.enabled() {
+		res.Set(internal.AggregateQueryKey, strings.Join(o.fields, ","))
+	}
+	if o.window != 0 {
+		res.Set(internal.WindowQueryKey, o.window.String())
+	}
+	return res
+}
+
+// aggregateTable renders the rows of aggregate messages as a table, which is redrawn in place on terminals
+type aggregateTable struct {
+	fields  []string
+	out     io.Writer
+	refresh bool
+}
+
+func (t *aggregateTable) render(msg internal.ControlMessage) error {
+	if t.refresh {
+		// move the cursor home and clear the screen
+		if _, err := io.WriteString(t.out, "\x1b[H\x1b[2J"); err != nil {
+			return err
+		}
+	}
+	if msg.Start != nil && msg.End != nil {
+		if _, err := fmt.Fprintf(t.out, "%s - %s\n", msg.Start.Local().Format("15:04:05"), msg.End.Local().Format("15:04:05")); err != nil {
+			return err
+		}
+	}
+	tw := tabwriter.NewWriter(t.out, 0, 8, 2, ' ', 0)
+	for _, f := range t.fields {
+		fmt.Fprintf(tw, "%s\t", strings.ToUpper(f))
+	}
+	fmt.Fprintln(tw, "COUNT")
+	for _, row := range msg.Rows {
+		for _, f := range t.fields {
+			v := row.Group[f]
+			if v == "" {
+				v = "-"
+			}
+			fmt.Fprintf(tw, "%s\t", v)
+		}
+		fmt.Fprintln(tw, row.Count)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if !t.refresh {
+		_, err := fmt.Fprintln(t.out)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	authv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/transport"
+)
+
+// kubeconfigAuthHeaders returns the HTTP headers the kubeconfig's credentials add to requests sent to the API server.
+// This covers static tokens, token files, auth provider plugins (e.g. OIDC), exec plugins and impersonation, but not client certificates, which are part of the TLS config.
+func kubeconfigAuthHeaders(cfg *rest.Config) (http.Header, error) {
+	tc, err := cfg.TransportConfig()
+	if err != nil {
+		return nil, err
+	}
+	capture := &headerCapture{}
+	rt, err := transport.HTTPWrappersForConfig(tc, capture)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodGet, cfg.Host, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	_ = resp.Body.Close()
+	return capture.header, nil
+}
+
+// requestServiceAccountToken mints a short-lived token for the specified service account and audience using the TokenRequest API
+func requestServiceAccountToken(cfg *rest.Config, serviceAccount string, audience string, ttl time.Duration) (string, error) {
+	elts := strings.SplitN(serviceAccount, "/", 2)
+	if len(elts) != 2 || elts[0] == "" || elts[1] == "" {
+		return "", fmt.Errorf("invalid service account reference %q (must be NAMESPACE/NAME)", serviceAccount)
+	}
+	cs, err := kubernetes.NewForConfig(cfg)
+	if err != nil {
+		return "", err
+	}
+	expirationSeconds := int64(ttl / time.Second)
+	tr, err := cs.CoreV1().ServiceAccounts(elts[0]).CreateToken(context.Background(), elts[1], &authv1.TokenRequest{
+		Spec: authv1.TokenRequestSpec{
+			Audiences:         []string{audience},
+			ExpirationSeconds: &expirationSeconds,
+		},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return "", err
+	}
+	if tr.Status.Token == "" {
+		return "", errors.New("token request returned an empty token")
+	}
+	return tr.Status.Token, nil
+}
+
+// headerCapture is a round tripper that records the headers of requests without sending them
+type headerCapture struct {
+	header http.Header
+}
+
+func (c *headerCapture) RoundTrip(req *http.Request) (*http.Response, error) {
+	c.header = req.Header.Clone()
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       http.NoBody,
+		Request:    req,
+	}, nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/banzaicloud/log-socket/internal"
+	"github.com/banzaicloud/log-socket/log"
+	loggingv1beta1 "github.com/banzaicloud/logging-operator/pkg/sdk/logging/api/v1beta1"
+)
+
+func newListFlowsCommand(global *globalOptions) *cobra.Command {
+	var allNamespaces bool
+
+	cmd := &cobra.Command{
+		Use:   "list-flows",
+		Short: "List the flows and cluster flows that can be tailed",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			logs := global.logs()
+
+			var ns string
+			if !allNamespaces {
+				var err error
+				if ns, err = global.kube.namespace(); err != nil {
+					log.Event(logs, "failed to determine namespace", log.Error(err))
+					os.Exit(2)
+				}
+			}
+
+			flows, err := listFlows(global.kube, ns, true, true)
+			if err != nil {
+				log.Event(logs, "failed to list flows", log.Error(err))
+				os.Exit(2)
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "KIND\tNAMESPACE\tNAME")
+			for _, flow := range flows {
+				fmt.Fprintf(w, "%s\t%s\t%s\n", flow.Kind, flow.Namespace, flow.Name)
+			}
+			if err := w.Flush(); err != nil {
+				log.Event(logs, "failed to write output", log.Error(err))
+				os.Exit(2)
+			}
+		},
+	}
+	cmd.Flags().BoolVarP(&allNamespaces, "all-namespaces", "A", false, "list flows in all namespaces")
+	return cmd
+}
+
+// listFlows lists flows and/or cluster flows in the specified namespace (or in all namespaces if ns is empty)
+func listFlows(kube *kubeOptions, ns string, flows bool, clusterFlows bool) (res []internal.FlowReference, err error) {
+	c, err := kube.client()
+	if err != nil {
+		return
+	}
+	ctx := context.Background()
+	var opts []client.ListOption
+	if ns != "" {
+		opts = append(opts, client.InNamespace(ns))
+	}
+	if flows {
+		var list loggingv1beta1.FlowList
+		if err = c.List(ctx, &list, opts...); err != nil {
+			return
+		}
+		for _, item := range list.Items {
+			res = append(res, internal.FlowReference{NamespacedName: client.ObjectKeyFromObject(&item), Kind: internal.FKFlow})
+		}
+	}
+	if clusterFlows {
+		var list loggingv1beta1.ClusterFlowList
+		if err = c.List(ctx, &list, opts...); err != nil {
+			return
+		}
+		for _, item := range list.Items {
+			res = append(res, internal.FlowReference{NamespacedName: client.ObjectKeyFromObject(&item), Kind: internal.FKClusterFlow})
+		}
+	}
+	return
+}
+
+// completeFlows returns shell completions for flow references of the specified kind
+func completeFlows(kube *kubeOptions, clusterFlow bool, toComplete string) ([]string, cobra.ShellCompDirective) {
+	flows, err := listFlows(kube, "", !clusterFlow, clusterFlow)
+	if err != nil {
+		cobra.CompDebugln(err.Error(), true)
+		return nil, cobra.ShellCompDirectiveError
+	}
+	var res []string
+	for _, flow := range flows {
+		if ref := flow.Namespace + "/" + flow.Name; strings.HasPrefix(ref, toComplete) {
+			res = append(res, ref)
+		}
+	}
+	return res, cobra.ShellCompDirectiveNoFileComp
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"github.com/spf13/pflag"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	loggingv1beta1 "github.com/banzaicloud/logging-operator/pkg/sdk/logging/api/v1beta1"
+)
+
+// kubeOptions holds the standard kubeconfig flags (--kubeconfig, --context, --namespace)
+type kubeOptions struct {
+	loadingRules *clientcmd.ClientConfigLoadingRules
+	overrides    clientcmd.ConfigOverrides
+}
+
+func newKubeOptions() *kubeOptions {
+	return &kubeOptions{
+		loadingRules: clientcmd.NewDefaultClientConfigLoadingRules(),
+	}
+}
+
+func (o *kubeOptions) addFlags(fs *pflag.FlagSet) {
+	fs.StringVar(&o.loadingRules.ExplicitPath, clientcmd.RecommendedConfigPathFlag, "", "path to the kubeconfig file to use")
+	fs.StringVar(&o.overrides.CurrentContext, clientcmd.FlagContext, "", "name of the kubeconfig context to use")
+	fs.StringVarP(&o.overrides.Context.Namespace, clientcmd.FlagNamespace, "n", "", "namespace of the flow (defaults to the namespace of the kubeconfig context)")
+}
+
+func (o *kubeOptions) clientConfig() clientcmd.ClientConfig {
+	return clientcmd.NewNonInteractiveDeferredLoadingClientConfig(o.loadingRules, &o.overrides)
+}
+
+func (o *kubeOptions) restConfig() (*rest.Config, error) {
+	return o.clientConfig().ClientConfig()
+}
+
+func (o *kubeOptions) namespace() (string, error) {
+	ns, _, err := o.clientConfig().Namespace()
+	return ns, err
+}
+
+func (o *kubeOptions) client() (client.Client, error) {
+	cfg, err := o.restConfig()
+	if err != nil {
+		return nil, err
+	}
+	s := runtime.NewScheme()
+	if err := corev1.AddToScheme(s); err != nil {
+		return nil, err
+	}
+	if err := loggingv1beta1.AddToScheme(s); err != nil {
+		return nil, err
+	}
+	return client.New(cfg, client.Options{Scheme: s})
+}
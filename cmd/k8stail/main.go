@@ -1,215 +1,57 @@
 package main
 
 import (
-	"context"
-	"crypto/tls"
-	"errors"
-	"fmt"
-	"io"
-	"net/http"
-	"net/url"
 	"os"
-	"os/signal"
-	pathpkg "path"
+	"path/filepath"
 	"strings"
-	"time"
 
-	"github.com/gorilla/websocket"
-	"github.com/spf13/pflag"
-	"github.com/wasmerio/wasmer-go/wasmer"
-	"k8s.io/client-go/rest"
-	ctrl "sigs.k8s.io/controller-runtime"
+	"github.com/spf13/cobra"
 
-	"github.com/banzaicloud/log-socket/internal"
 	"github.com/banzaicloud/log-socket/log"
 )
 
 func main() {
-	var authToken string
-	var clusterFlow bool
-	var listenAddr string
-	var plugins []string
-	var svcName string
-	var svcNamespace string
-	var svcPort string
-	var verbosity int
-	pflag.StringVarP(&authToken, "token", "t", "", "token used for authentication")
-	pflag.BoolVarP(&clusterFlow, "clusterflow", "c", false, "stream logs from a cluster flow instead of a regular flow")
-	pflag.StringVar(&listenAddr, "listen-addr", "", "address where the service accepts WebSocket listeners")
-	pflag.StringVarP(&svcNamespace, "namespace", "n", "default", "log socket service namespace")
-	pflag.StringSliceVar(&plugins, "plugin", nil, "plugins for processing incoming log records")
-	pflag.StringVarP(&svcPort, "port", "p", "10001", "log socket service listening port")
-	pflag.StringVarP(&svcName, "service", "s", "log-socket", "name of the service that accepts WebSocket listeners")
-	pflag.IntVarP(&verbosity, "verbosity", "v", verbosity, "log verbosity level")
-	pflag.Parse()
-
-	var logs log.Sink = log.WithVerbosityFilter(log.NewWriterSink(os.Stderr), verbosity)
-
-	if pflag.NArg() < 1 {
-		fmt.Fprintln(os.Stderr, "no flow reference specified")
-		pflag.Usage()
-		os.Exit(1)
-	}
-
-	flowRef := pflag.Arg(0)
-	elts := strings.SplitN(flowRef, "/", 2)
-	if len(elts) != 2 {
-		fmt.Fprintf(os.Stderr, "invalid flow reference %q\n", flowRef)
-		pflag.Usage()
+	if err := newRootCommand().Execute(); err != nil {
 		os.Exit(1)
 	}
-	flowNamespace, flowName := elts[0], elts[1]
-
-	var pipeline internal.Pipeline
-	if len(plugins) > 0 {
-		engine := wasmer.NewEngine()
-		store := wasmer.NewStore(engine)
-		for _, plugin := range plugins {
-			stage, err := internal.LoadStageFromFile(store, logs, plugin)
-			if err != nil {
-				log.Event(logs, "failed to load plugin", log.Error(err))
-				os.Exit(2)
-			}
-			pipeline = append(pipeline, stage)
-		}
-		log.Event(logs, "pipeline loaded", log.V(1), log.Fields{"pipeline": pipeline})
-	}
-
-	flowKind := "flow"
-	if clusterFlow {
-		flowKind = "clusterflow"
-	}
-
-	dialer := *websocket.DefaultDialer
-
-	path := pathpkg.Join("/", flowKind, flowNamespace, flowName)
-
-	var listenURL *url.URL
-	if listenAddr == "" {
-		cfg, err := ctrl.GetConfig()
-		if err != nil {
-			log.Event(logs, "failed to get kubeconfig", log.Error(err))
-			os.Exit(2)
-		}
-		tlsCfg, err := rest.TLSConfigFor(cfg)
-		if err != nil {
-			log.Event(logs, "failed to get TLS config for kubeconfig")
-			os.Exit(2)
-		}
-
-		dialer.TLSClientConfig = tlsCfg
-
-		listenURL, err = proxyURL(cfg, svcNamespace, "services", svcName, true, svcPort, path)
-		if err != nil {
-			log.Event(logs, "failed to generate K8s API server proxy URL for service", log.Error(err), log.Fields{
-				"kubeconfig": cfg,
-				"namespace":  svcNamespace,
-				"name":       svcName,
-				"port":       svcPort,
-				"path":       path,
-			})
-			os.Exit(2)
-		}
-	} else {
-		var err error
-		if !strings.Contains(listenAddr, "://") {
-			listenAddr = "wss://" + listenAddr
-		}
-		listenURL, err = url.Parse(listenAddr)
-		if err != nil {
-			log.Event(logs, "failed to parse listen address", log.Error(err))
-			os.Exit(2)
-		}
-		listenURL.Path = pathpkg.Join(listenURL.Path, path)
-	}
-
-	if listenURL.Scheme == "" {
-		listenURL.Scheme = "wss"
-	}
-
-	if listenURL.Scheme == "wss" {
-		if dialer.TLSClientConfig == nil {
-			dialer.TLSClientConfig = &tls.Config{}
-		}
-		dialer.TLSClientConfig.InsecureSkipVerify = true
-	}
-
-	wsConn, _, err := dialer.DialContext(context.Background(), listenURL.String(), http.Header{internal.AuthHeaderKey: []string{authToken}})
-	if err != nil {
-		log.Event(logs, "failed to open websocket connection", log.Error(err), log.Fields{"url": listenURL})
-		os.Exit(2)
-	}
-
-	log.Event(logs, "successfully connected to service", log.V(1), log.Fields{"addr": wsConn.UnderlyingConn().RemoteAddr()})
-
-	signals := make(chan os.Signal, 1)
-	signal.Notify(signals, os.Interrupt)
+}
 
-	go func() {
-		// TODO: defer exit
-		for {
-			msgTyp, reader, err := wsConn.NextReader()
-			if err != nil {
-				log.Event(logs, "failed to get next reader for websocket connection", log.Error(err))
-				return
-			}
-			switch msgTyp {
-			case websocket.BinaryMessage:
-				data, err := io.ReadAll(reader)
-				if err != nil {
-					log.Event(logs, "failed to read record data", log.V(1), log.Error(err))
-					continue
-				}
-				log.Event(logs, "new record", log.V(2), log.Fields{"data": data})
-				res, err := pipeline.ProcessRecord(data)
-				if err != nil {
-					log.Event(logs, "failed to process record", log.Fields{"record": string(data), "result": res}, log.Error(err))
-				}
-				for _, rec := range res {
-					if _, err := os.Stdout.Write(rec); err != nil {
-						log.Event(logs, "failed to write record to stdout", log.Error(err))
-					}
-					fmt.Fprintln(os.Stdout)
-				}
-			}
-		}
-	}()
+// globalOptions holds the flags shared by all commands
+type globalOptions struct {
+	kube      *kubeOptions
+	verbosity int
+}
 
-	signal := <-signals
-	log.Event(logs, "received signal", log.V(1), log.Fields{"signal": signal})
-	deadline := time.Now().Add(5 * time.Second)
-	if err := wsConn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, signal.String()), deadline); err != nil {
-		log.Event(logs, "an error occurred while writing close message to websocket", log.Error(err))
-		os.Exit(2)
-	}
+func (o *globalOptions) logs() log.Sink {
+	return log.WithVerbosityFilter(log.WithRedaction(log.NewWriterSink(os.Stderr), log.DefaultRedactor()), o.verbosity)
 }
 
-func proxyURL(cfg *rest.Config, namespace, resourceType, name string, tls bool, port string, path string) (uri *url.URL, err error) {
-	switch resourceType {
-	case "pods", "services":
-	default:
-		return nil, errors.New("invalid resource type")
+func newRootCommand() *cobra.Command {
+	opts := &globalOptions{
+		kube: newKubeOptions(),
 	}
 
-	uri, err = url.Parse(cfg.Host)
-	if err != nil {
-		return
+	cmd := &cobra.Command{
+		Use:   commandName(),
+		Short: "Stream the live output of logging-operator flows",
 	}
+	opts.kube.addFlags(cmd.PersistentFlags())
+	cmd.PersistentFlags().IntVarP(&opts.verbosity, "verbosity", "v", opts.verbosity, "log verbosity level")
 
-	apiPath := cfg.APIPath
-	if apiPath == "" {
-		apiPath = "/api/v1"
-	}
+	cmd.AddCommand(
+		newTailCommand(opts),
+		newListFlowsCommand(opts),
+		newStatusCommand(opts),
+		newReplayCommand(opts),
+		newPluginsCommand(opts),
+	)
+	return cmd
+}
 
-	resource := name
-	if tls {
-		resource = "https:" + resource
+// commandName returns the name the tool was invoked as, so that help and completion work when installed as a kubectl plugin (kubectl-logsocket)
+func commandName() string {
+	if base := filepath.Base(os.Args[0]); strings.HasPrefix(base, "kubectl-") {
+		return "kubectl " + strings.TrimPrefix(base, "kubectl-")
 	}
-	if port != "" {
-		resource = resource + ":" + port
-	}
-
-	uri.Path = pathpkg.Join(apiPath, "namespaces", namespace, resourceType, resource, "proxy", path)
-
-	return
+	return "k8stail"
 }
@@ -0,0 +1,703 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/pflag"
+	"github.com/wasmerio/wasmer-go/wasmer"
+	"k8s.io/apimachinery/pkg/api/resource"
+
+	"github.com/banzaicloud/log-socket/internal"
+	"github.com/banzaicloud/log-socket/log"
+)
+
+// processingOptions holds the flags controlling how received records are processed and output
+type processingOptions struct {
+	compressRotated   bool
+	dedupe            bool
+	dedupeInterval    time.Duration
+	excludeFields     []string
+	fields            []string
+	maxOpenFiles      int
+	multiline         string
+	multilineMaxAge   time.Duration
+	multilineMaxLines int
+	multilineTimeout  time.Duration
+	ordering          string
+	outDir            string
+	outputFormat      string
+	outputTemplate    string
+	pluginOpts        pluginOptions
+	plugins           []string
+	query             string
+	rotateInterval    time.Duration
+	rotateSize        string
+	routes            []string
+	splitBy           string
+	tickInterval      time.Duration
+	transformPosition string
+	workers           int
+}
+
+func (o *processingOptions) addFlags(fs *pflag.FlagSet) {
+	fs.BoolVar(&o.compressRotated, "compress", false, "gzip files in the output directory when they are closed")
+	fs.BoolVar(&o.dedupe, "dedupe", false, "collapse repeated messages into templates, emitting each template once and then periodic summaries of how many times it was seen")
+	fs.DurationVar(&o.dedupeInterval, "dedupe-interval", 10*time.Second, "how often summaries of repeated templates are emitted with --dedupe")
+	fs.StringSliceVar(&o.excludeFields, "exclude-fields", nil, "fields to remove from records (nested fields are referenced with dots, e.g. kubernetes.labels)")
+	fs.StringSliceVar(&o.fields, "fields", nil, "fields to keep in records (nested fields are referenced with dots, e.g. kubernetes.pod_name)")
+	fs.IntVar(&o.maxOpenFiles, "max-open-files", defaultMaxOpenFiles, "maximum number of files kept open in the output directory: the least recently written one is closed to open another one")
+	fs.StringVar(&o.multiline, "multiline", "", "join continuation lines into the record they continue, per pod and container: a preset ("+strings.Join(multilinePresetNames(), ", ")+") or a regular expression matching the first line of records")
+	fs.DurationVar(&o.multilineMaxAge, "multiline-max-age", internal.DefaultMultilineMaxAge, "how long to buffer records with --multiline at most, even if continuation lines keep coming (0 means unlimited)")
+	fs.IntVar(&o.multilineMaxLines, "multiline-max-lines", internal.DefaultMultilineMaxLines, "maximum number of lines joined into a record with --multiline (0 means unlimited)")
+	fs.DurationVar(&o.multilineTimeout, "multiline-timeout", internal.DefaultMultilineFlushTimeout, "how long to wait for continuation lines with --multiline")
+	fs.StringVar(&o.ordering, "ordering", string(internal.POStrict), fmt.Sprintf("the order records processed by several workers are output in: one of %v (strict keeps the order of all records, pod only the order of the records of each pod)", internal.PipelineOrderings))
+	fs.StringVar(&o.outDir, "out-dir", "", "write records to files in this directory instead of stdout")
+	fs.StringVarP(&o.outputFormat, "output", "o", outputAuto, "output format: one of "+strings.Join(outputFormats, ", ")+" (defaults to pretty for terminals and raw otherwise)")
+	fs.StringSliceVar(&o.plugins, "plugin", nil, "plugins for processing incoming log records")
+	o.pluginOpts.addFlags(fs)
+	fs.DurationVar(&o.rotateInterval, "rotate-interval", 0, "rotate files in the output directory after they have been open for this long (0 disables time-based rotation)")
+	fs.StringVar(&o.rotateSize, "rotate-size", "", "rotate files in the output directory when they reach this size, e.g. 100Mi (empty disables size-based rotation)")
+	fs.StringArrayVar(&o.routes, "route", nil, "where the records plugins send to a named output go, as NAME=TARGET where TARGET is stdout, stderr, discard or a file records are appended to (records of outputs without a route go to the default output)")
+	fs.StringVarP(&o.query, "query", "q", "", "jq expression evaluated on each record, emitting a record for each result")
+	fs.StringVar(&o.splitBy, "split-by", splitByPod, "how to split records into files in the output directory: pod or container")
+	fs.DurationVar(&o.tickInterval, "tick-interval", time.Second, "how often stages emitting records as time passes (plugins exporting tick, --multiline and --dedupe) are ticked")
+	fs.StringVar(&o.outputTemplate, "template", "", "Go template applied to parsed records when using the template output format")
+	fs.StringVar(&o.transformPosition, "transforms", "before", "whether built-in transforms (fields, exclude-fields, query) run before or after plugins")
+	fs.IntVar(&o.workers, "workers", 1, "number of workers processing records concurrently, each with its own instances of the plugins and transforms")
+}
+
+// validate checks the flags for errors that don't require loading anything
+func (o *processingOptions) validate() error {
+	if _, err := newRecordWriter(io.Discard, o.outputFormat, o.outputTemplate); err != nil {
+		return err
+	}
+	if o.tickInterval <= 0 {
+		return fmt.Errorf("invalid tick interval %s (must be positive)", o.tickInterval)
+	}
+	if o.workers < 1 {
+		return fmt.Errorf("invalid number of workers %d (must be at least 1)", o.workers)
+	}
+	if o.maxOpenFiles < 1 {
+		return fmt.Errorf("invalid maximum number of open files %d (must be at least 1)", o.maxOpenFiles)
+	}
+	ordering, err := internal.ParsePipelineOrdering(o.ordering)
+	if err != nil {
+		return err
+	}
+	// continuation lines have to reach the worker that got the line they continue
+	if o.multiline != "" && o.workers > 1 && ordering != internal.POPod {
+		return fmt.Errorf("--multiline requires --ordering %s with several workers", internal.POPod)
+	}
+	// each worker would collapse only the repeated messages it happens to get
+	if o.dedupe && o.workers > 1 {
+		return errors.New("--dedupe can't be used with several workers")
+	}
+	switch o.transformPosition {
+	case "before", "after":
+	default:
+		return fmt.Errorf("invalid transforms position %q (must be before or after)", o.transformPosition)
+	}
+	if o.rotateSize != "" {
+		if _, err := resource.ParseQuantity(o.rotateSize); err != nil {
+			return fmt.Errorf("invalid rotation size %q: %w", o.rotateSize, err)
+		}
+	}
+	if o.query != "" {
+		if _, err := internal.NewQueryStage(o.query); err != nil {
+			return fmt.Errorf("invalid query %q: %w", o.query, err)
+		}
+	}
+	if o.multiline != "" {
+		if _, err := internal.NewMultilineStage(o.multilineRules(), o.multilineTimeout); err != nil {
+			return fmt.Errorf("invalid multiline pattern %q: %w", o.multiline, err)
+		}
+	}
+	for _, route := range o.routes {
+		if _, _, err := parseRoute(route); err != nil {
+			return err
+		}
+	}
+	return o.pluginOpts.validate(o.plugins)
+}
+
+// pluginOptions holds the flags controlling how plugins are loaded
+type pluginOptions struct {
+	cacheDir            string
+	configFile          string
+	dirs                []string
+	maxMemory           string
+	onViolation         []string
+	plainHTTPRegistries []string
+	publicKeys          []string
+	timeout             time.Duration
+}
+
+func (o *pluginOptions) addFlags(fs *pflag.FlagSet) {
+	o.addCacheFlags(fs)
+	fs.StringVar(&o.configFile, "plugin-config", "", "YAML file mapping plugins (as referenced with --plugin) to their configuration, which is overridden by the query of plugin references (e.g. --plugin grep.wasm?pattern=error)")
+	fs.StringArrayVar(&o.dirs, "plugin-dir", nil, "directory plugins can read at the relative path NAME, as NAME=DIR or DIR to use its base name (plugins get a copy, so they can't modify it)")
+	fs.StringVar(&o.maxMemory, "plugin-max-memory", "256Mi", "maximum size of the memory of each plugin, e.g. 64Mi (empty for unlimited); checked after each call unless the plugin imports its memory")
+	fs.StringSliceVar(&o.onViolation, "plugin-on-violation", []string{string(internal.VPDrop)}, fmt.Sprintf("what happens to records once a plugin exceeds its limits: one of %v, or PLUGIN=POLICY for a single plugin", internal.ViolationPolicies))
+	fs.DurationVar(&o.timeout, "plugin-timeout", time.Second, "maximum duration of processing a record by a plugin, after which it's disabled (0 for unlimited); calls can't be interrupted, so a plugin that doesn't return keeps using a CPU")
+}
+
+// addCacheFlags adds the flags controlling how plugins are fetched and cached
+func (o *pluginOptions) addCacheFlags(fs *pflag.FlagSet) {
+	// without a cache directory (e.g. without a home directory) caching is disabled by default
+	dir, _ := internal.DefaultModuleCacheDir()
+	fs.StringVar(&o.cacheDir, "plugin-cache-dir", dir, "directory compiled plugins are cached and remote plugins are downloaded to (empty disables caching)")
+	fs.StringArrayVar(&o.plainHTTPRegistries, "plugin-plain-http-registry", nil, "OCI registry (HOST[:PORT]) plugins are pulled from over plain HTTP instead of HTTPS (can be repeated)")
+	fs.StringArrayVar(&o.publicKeys, "plugin-public-key", nil, "PEM file of a public key (ECDSA, Ed25519 or RSA) remote plugins have to be signed with, by cosign for OCI artifacts and in a .sig file next to HTTPS URLs (can be repeated)")
+}
+
+// cache returns the cache of compiled plugins, nil if caching is disabled
+func (o *pluginOptions) cache(logs log.Sink) *internal.ModuleCache {
+	if o.cacheDir == "" {
+		return nil
+	}
+	return internal.NewModuleCache(o.cacheDir, logs)
+}
+
+// validate checks the flags and the plugin references for errors that don't require loading the plugins
+func (o *pluginOptions) validate(refs []string) error {
+	if _, err := o.stageOptions(); err != nil {
+		return err
+	}
+	if _, _, err := o.policies(); err != nil {
+		return err
+	}
+	if _, err := o.configs(); err != nil {
+		return err
+	}
+	return o.validateRefs(refs)
+}
+
+// validateRefs checks the plugin references and the flags needed to fetch remote plugins
+func (o *pluginOptions) validateRefs(refs []string) error {
+	if _, err := internal.LoadPluginPublicKeys(o.publicKeys); err != nil {
+		return err
+	}
+	for _, ref := range refs {
+		path, _, err := internal.ParsePluginReference(ref)
+		if err != nil {
+			return err
+		}
+		if !internal.IsRemotePluginReference(path) {
+			continue
+		}
+		if _, err := internal.ParseRemotePluginReference(path); err != nil {
+			return err
+		}
+		if o.cacheDir == "" {
+			return fmt.Errorf("remote plugin %s can't be fetched without a directory to download it to (--plugin-cache-dir)", path)
+		}
+	}
+	return nil
+}
+
+// fetcher returns the fetcher of remote plugins, which keeps the plugins it downloads in the cache directory
+func (o *pluginOptions) fetcher(logs log.Sink) (*internal.PluginFetcher, error) {
+	keys, err := internal.LoadPluginPublicKeys(o.publicKeys)
+	if err != nil {
+		return nil, err
+	}
+	fetcher := internal.NewPluginFetcher(filepath.Join(o.cacheDir, "downloads"), logs)
+	fetcher.PlainHTTPRegistries = o.plainHTTPRegistries
+	fetcher.PublicKeys = keys
+	return fetcher, nil
+}
+
+// read returns the code of a plugin, fetching remote plugins with the fetcher
+func (o *pluginOptions) read(ctx context.Context, fetcher *internal.PluginFetcher, path string) ([]byte, error) {
+	if !internal.IsRemotePluginReference(path) {
+		return os.ReadFile(path)
+	}
+	ref, err := internal.ParseRemotePluginReference(path)
+	if err != nil {
+		return nil, err
+	}
+	return fetcher.Fetch(ctx, ref)
+}
+
+// stageOptions returns the options shared by all plugins
+func (o *pluginOptions) stageOptions() (res internal.PluginOptions, err error) {
+	for _, dir := range o.dirs {
+		name, host, err := internal.ParsePluginDir(dir)
+		if err != nil {
+			return res, err
+		}
+		if res.Dirs == nil {
+			res.Dirs = make(map[string]string)
+		}
+		res.Dirs[name] = host
+	}
+	if o.maxMemory != "" {
+		q, err := resource.ParseQuantity(o.maxMemory)
+		if err != nil || q.Sign() <= 0 {
+			return res, fmt.Errorf("invalid plugin memory limit %q", o.maxMemory)
+		}
+		res.Limits.MaxMemory = uint64(q.Value())
+	}
+	res.Limits.Timeout = o.timeout
+	return res, nil
+}
+
+// policies returns the default violation policy and the ones of specific plugins
+func (o *pluginOptions) policies() (def internal.ViolationPolicy, perPlugin map[string]internal.ViolationPolicy, err error) {
+	def = internal.VPDrop
+	for _, s := range o.onViolation {
+		plugin, policy, ok := strings.Cut(s, "=")
+		if !ok {
+			policy = plugin
+		}
+		p, err := internal.ParseViolationPolicy(policy)
+		if err != nil {
+			return def, nil, err
+		}
+		if !ok {
+			def = p
+			continue
+		}
+		if perPlugin == nil {
+			perPlugin = make(map[string]internal.ViolationPolicy)
+		}
+		perPlugin[plugin] = p
+	}
+	return def, perPlugin, nil
+}
+
+func (o *pluginOptions) configs() (internal.PluginConfigs, error) {
+	if o.configFile == "" {
+		return nil, nil
+	}
+	return internal.LoadPluginConfigs(o.configFile)
+}
+
+// load loads the referenced plugins into a pipeline
+func (o *pluginOptions) load(logs log.Sink, refs []string) (internal.Pipeline, error) {
+	pipelines, err := o.loadInstances(logs, refs, 1)
+	if err != nil {
+		return nil, err
+	}
+	return pipelines[0], nil
+}
+
+// loadInstances loads n pipelines of the referenced plugins, each with its own instances.
+// Plugins are read and compiled once, the other instances are loaded from the compiled modules.
+func (o *pluginOptions) loadInstances(logs log.Sink, refs []string, n int) (pipelines []internal.Pipeline, err error) {
+	opts, err := o.stageOptions()
+	if err != nil {
+		return nil, err
+	}
+	defaultPolicy, policies, err := o.policies()
+	if err != nil {
+		return nil, err
+	}
+	configs, err := o.configs()
+	if err != nil {
+		return nil, err
+	}
+	opts.Cache = o.cache(logs)
+	fetcher, err := o.fetcher(logs)
+	if err != nil {
+		return nil, err
+	}
+	closePipelines := func() {
+		for _, p := range pipelines {
+			_ = p.Close()
+		}
+	}
+	pipelines = make([]internal.Pipeline, n)
+	stores := make([]*wasmer.Store, n)
+	for i := range stores {
+		// stores aren't shared, so that the instances can be used concurrently
+		stores[i] = wasmer.NewStore(wasmer.NewEngine())
+	}
+	for _, ref := range refs {
+		path, overrides, err := internal.ParsePluginReference(ref)
+		if err != nil {
+			closePipelines()
+			return nil, err
+		}
+		opts.Limits.OnViolation = defaultPolicy
+		if p, ok := policies[path]; ok {
+			opts.Limits.OnViolation = p
+		}
+		if opts.Config, err = configs.Config(path, overrides); err != nil {
+			closePipelines()
+			return nil, fmt.Errorf("invalid configuration of plugin %q: %w", path, err)
+		}
+		code, err := o.read(context.Background(), fetcher, path)
+		if err != nil {
+			closePipelines()
+			return nil, fmt.Errorf("failed to read plugin %q: %w", path, err)
+		}
+		stage, err := internal.LoadStageFromCode(stores[0], logs, path, code, opts)
+		if err != nil {
+			closePipelines()
+			return nil, fmt.Errorf("failed to load plugin %q: %w", path, err)
+		}
+		pipelines[0] = append(pipelines[0], stage)
+		if n == 1 {
+			continue
+		}
+		compiled, err := stage.Module.Serialize()
+		if err != nil {
+			closePipelines()
+			return nil, fmt.Errorf("failed to load plugin %q: %w", path, err)
+		}
+		for i := 1; i < n; i++ {
+			stage, err := loadCompiledStage(stores[i], logs, path, compiled, opts)
+			if err != nil {
+				closePipelines()
+				return nil, fmt.Errorf("failed to load plugin %q: %w", path, err)
+			}
+			pipelines[i] = append(pipelines[i], stage)
+		}
+	}
+	return pipelines, nil
+}
+
+// loadCompiledStage instantiates a plugin from its serialized compiled module
+func loadCompiledStage(store *wasmer.Store, logs log.Sink, path string, compiled []byte, opts internal.PluginOptions) (*internal.WASMStage, error) {
+	module, err := wasmer.DeserializeModule(store, compiled)
+	if err != nil {
+		return nil, err
+	}
+	return internal.LoadStage(store, logs, path, module, opts)
+}
+
+// multilineRules returns the preset named by the multiline flag, or uses the flag as the start pattern
+func (o *processingOptions) multilineRules() internal.MultilineRules {
+	if rules, ok := internal.MultilinePresets[o.multiline]; ok {
+		return rules
+	}
+	return internal.MultilineRules{Start: o.multiline}
+}
+
+func multilinePresetNames() (res []string) {
+	for name := range internal.MultilinePresets {
+		res = append(res, name)
+	}
+	sort.Strings(res)
+	return
+}
+
+// pipelines assembles the built-in transforms and the plugins into a pipeline for each worker
+func (o *processingOptions) pipelines(logs log.Sink) ([]internal.Pipeline, error) {
+	var plugins []internal.Pipeline
+	if len(o.plugins) > 0 {
+		var err error
+		if plugins, err = o.pluginOpts.loadInstances(logs, o.plugins, o.workers); err != nil {
+			return nil, err
+		}
+	}
+	pipelines := make([]internal.Pipeline, o.workers)
+	for i := range pipelines {
+		var worker internal.Pipeline
+		if plugins != nil {
+			worker = plugins[i]
+		}
+		pipeline, err := o.pipeline(worker)
+		if err != nil {
+			for _, p := range plugins {
+				_ = p.Close()
+			}
+			return nil, err
+		}
+		pipelines[i] = pipeline
+	}
+	if len(pipelines[0]) > 0 {
+		log.Event(logs, "pipeline loaded", log.V(1), log.Fields{"pipeline": pipelines[0], "workers": o.workers})
+	}
+	return pipelines, nil
+}
+
+// pipeline assembles the built-in transforms around the plugins
+func (o *processingOptions) pipeline(plugins internal.Pipeline) (pipeline internal.Pipeline, err error) {
+	var transforms internal.Pipeline
+	if len(o.fields) > 0 {
+		transforms = append(transforms, internal.NewProjectionStage(o.fields))
+	}
+	if len(o.excludeFields) > 0 {
+		transforms = append(transforms, internal.NewExclusionStage(o.excludeFields))
+	}
+	if o.query != "" {
+		stage, err := internal.NewQueryStage(o.query)
+		if err != nil {
+			return nil, err
+		}
+		transforms = append(transforms, stage)
+	}
+
+	// lines have to be joined before anything else looks at them
+	if o.multiline != "" {
+		stage, err := internal.NewMultilineStage(o.multilineRules(), o.multilineTimeout)
+		if err != nil {
+			return nil, err
+		}
+		stage.MaxAge = o.multilineMaxAge
+		stage.MaxLines = o.multilineMaxLines
+		pipeline = append(pipeline, stage)
+	}
+	if o.transformPosition == "before" {
+		pipeline = append(pipeline, transforms...)
+	}
+	pipeline = append(pipeline, plugins...)
+	if o.transformPosition == "after" {
+		pipeline = append(pipeline, transforms...)
+	}
+	if o.dedupe {
+		pipeline = append(pipeline, internal.NewDedupeStage(internal.DedupeOptions{SummaryInterval: o.dedupeInterval}))
+	}
+	return
+}
+
+// output returns the record writer specified by the flags, which writes the records routed to named outputs to their routes, and a function that has to be called once it's no longer used
+func (o *processingOptions) output(logs log.Sink) (*routedWriter, func(), error) {
+	def, closeDef, err := o.defaultOutput(logs)
+	if err != nil {
+		return nil, nil, err
+	}
+	routes, closeRoutes, err := o.routeWriters()
+	if err != nil {
+		closeDef()
+		return nil, nil, err
+	}
+	return &routedWriter{def: def, routes: routes}, func() {
+		if err := closeRoutes(); err != nil {
+			log.Event(logs, "failed to close route files", log.Error(err))
+		}
+		closeDef()
+	}, nil
+}
+
+// defaultOutput returns the writer of the records that aren't routed to named outputs and a function that has to be called once it's no longer used
+func (o *processingOptions) defaultOutput(logs log.Sink) (recordWriter, func(), error) {
+	if o.outDir == "" {
+		output, err := newRecordWriter(os.Stdout, o.outputFormat, o.outputTemplate)
+		return output, func() {}, err
+	}
+
+	var maxSize int64
+	if o.rotateSize != "" {
+		q, err := resource.ParseQuantity(o.rotateSize)
+		if err != nil {
+			return nil, nil, err
+		}
+		maxSize = q.Value()
+	}
+	output, err := newDirWriter(o.outDir, o.splitBy, maxSize, o.rotateInterval, o.maxOpenFiles, o.compressRotated, func(w io.Writer) (recordWriter, error) {
+		return newRecordWriter(w, o.outputFormat, o.outputTemplate)
+	}, logs)
+	if err != nil {
+		return nil, nil, err
+	}
+	return output, func() {
+		if err := output.Close(); err != nil {
+			log.Event(logs, "failed to close output files", log.Error(err), log.Fields{"dir": o.outDir})
+		}
+	}, nil
+}
+
+// setup loads the pipeline and the output, exiting on failure.
+// The returned function flushes the pipeline and closes the output; it has to be called once the processor is no longer used.
+func (o *processingOptions) setup(logs log.Sink) (*recordProcessor, func()) {
+	pipelines, err := o.pipelines(logs)
+	if err != nil {
+		log.Event(logs, "failed to load pipeline", log.Error(err))
+		os.Exit(2)
+	}
+	output, closeOutput, err := o.output(logs)
+	if err != nil {
+		log.Event(logs, "failed to set up output", log.Error(err))
+		// removes the copies of the directories plugins could read
+		for _, p := range pipelines {
+			_ = p.Close()
+		}
+		os.Exit(2)
+	}
+	// validated by validate
+	ordering, _ := internal.ParsePipelineOrdering(o.ordering)
+	processor := newRecordProcessor(pipelines, ordering, output, o.tickInterval, logs)
+	var once sync.Once
+	return processor, func() {
+		once.Do(func() {
+			processor.close()
+			closeOutput()
+		})
+	}
+}
+
+// newRecordProcessor returns a processor feeding records through the pipelines to the output.
+// Records are processed by a pool of workers if there are several pipelines (instances of the same stages), and by the first pipeline otherwise.
+// If any of the stages have to be ticked, the pipelines are ticked every tickInterval until the processor is closed.
+func newRecordProcessor(pipelines []internal.Pipeline, ordering internal.PipelineOrdering, output *routedWriter, tickInterval time.Duration, logs log.Sink) *recordProcessor {
+	p := &recordProcessor{
+		logs:    logs,
+		output:  output,
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	if len(pipelines) > 1 && len(pipelines[0]) > 0 {
+		p.pool = internal.NewPipelinePool(pipelines, ordering)
+	} else {
+		p.pipeline = pipelines[0]
+	}
+	if pipelines[0].Ticking() {
+		go p.tickLoop(tickInterval)
+	} else {
+		close(p.stopped)
+	}
+	return p
+}
+
+type recordProcessor struct {
+	logs           log.Sink
+	mutex          sync.Mutex // serializes using the pipeline (or submitting to the pool) and, without a pool, the output
+	output         *routedWriter
+	pipeline       internal.Pipeline
+	pool           *internal.PipelinePool // processes records instead of pipeline if there are several workers, it writes the output on its own goroutine
+	stop           chan struct{}
+	stopped        chan struct{}
+	violation      error // set if a plugin exceeded its limits while being ticked (or while processing a record in the pool), which aborts processing the next record
+	violationMutex sync.Mutex
+}
+
+// process feeds a record received from a flow through the pipeline to the output.
+// It returns an error if processing has to be aborted because a plugin exceeded its limits.
+func (p *recordProcessor) process(data []byte, flow internal.FlowReference, received time.Time) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if err := p.aborted(); err != nil {
+		return err
+	}
+
+	if p.pool != nil {
+		p.pool.ProcessRecord(data, internal.NewRecordMeta(flow, received, data), func(res []internal.RoutedRecord, err error) {
+			// the records queued after a record aborting processing are dropped
+			if p.aborted() == nil {
+				_ = p.processed(data, res, err)
+			}
+		})
+		return nil
+	}
+	var meta *internal.RecordMeta
+	if len(p.pipeline) > 0 {
+		meta = internal.NewRecordMeta(flow, received, data)
+	}
+	res, err := p.pipeline.ProcessRecord(data, meta)
+	return p.processed(data, res, err)
+}
+
+// processed writes the records resulting from processing a record, it returns an error if processing has to be aborted because a plugin exceeded its limits
+func (p *recordProcessor) processed(data []byte, res []internal.RoutedRecord, err error) error {
+	var violation *internal.SandboxViolationError
+	if errors.As(err, &violation) {
+		p.abort(err)
+		return err
+	}
+	if err != nil {
+		log.Event(p.logs, "failed to process record", log.Fields{"record": string(data), "result": res}, log.Error(err))
+	}
+	p.write(res)
+	return nil
+}
+
+func (p *recordProcessor) tickLoop(interval time.Duration) {
+	defer close(p.stopped)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case now := <-ticker.C:
+			if !p.tick(now) {
+				return
+			}
+		}
+	}
+}
+
+// tick writes the records emitted by ticking the pipeline, it returns false if ticking has to stop because a plugin exceeded its limits
+func (p *recordProcessor) tick(now time.Time) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.pool != nil {
+		p.pool.Tick(now, p.ticked)
+	} else {
+		p.ticked(p.pipeline.Tick(now))
+	}
+	return p.aborted() == nil
+}
+
+func (p *recordProcessor) ticked(res []internal.RoutedRecord, err error) {
+	var violation *internal.SandboxViolationError
+	if errors.As(err, &violation) {
+		p.abort(err)
+		return
+	}
+	if err != nil {
+		log.Event(p.logs, "failed to tick pipeline", log.Error(err))
+	}
+	p.write(res)
+}
+
+// close stops ticking, writes the records flushed from the pipeline and closes the pipeline
+func (p *recordProcessor) close() {
+	close(p.stop)
+	<-p.stopped
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	var err error
+	if p.pool != nil {
+		err = p.pool.Close(p.flushed)
+	} else {
+		p.flushed(p.pipeline.Flush())
+		err = p.pipeline.Close()
+	}
+	if err != nil {
+		log.Event(p.logs, "failed to close pipeline", log.Error(err))
+	}
+}
+
+func (p *recordProcessor) flushed(res []internal.RoutedRecord, err error) {
+	if err != nil {
+		log.Event(p.logs, "failed to flush pipeline", log.Error(err))
+	}
+	p.write(res)
+}
+
+// aborted returns the error aborting processing if a plugin exceeded its limits
+func (p *recordProcessor) aborted() error {
+	p.violationMutex.Lock()
+	defer p.violationMutex.Unlock()
+	return p.violation
+}
+
+func (p *recordProcessor) abort(err error) {
+	p.violationMutex.Lock()
+	defer p.violationMutex.Unlock()
+	if p.violation == nil {
+		p.violation = err
+	}
+}
+
+func (p *recordProcessor) write(records []internal.RoutedRecord) {
+	for _, rec := range records {
+		if err := p.output.WriteRouted(rec); err != nil {
+			log.Event(p.logs, "failed to write record to output", log.Error(err))
+		}
+	}
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/banzaicloud/log-socket/log"
+)
+
+const (
+	splitByContainer = "container"
+	splitByPod       = "pod"
+
+	// defaultMaxOpenFiles is the default maximum number of files kept open at the same time, so that tailing many pods doesn't run out of file descriptors
+	defaultMaxOpenFiles = 256
+	indexFileName       = "index.jsonl"
+	// maxRotationCheckInterval is how often files are checked for rotation by time, so that the files of idle streams are rotated too
+	maxRotationCheckInterval = time.Second
+	rotatedTimeFormat        = "20060102T150405Z"
+	unknownStreamName        = "_unknown"
+)
+
+// newDirWriter returns a record writer that writes records to files under dir, split by pod or container.
+// Files are rotated when they reach maxSize bytes or when they have been open for maxAge (if these are non-zero).
+// Every closed file is listed in an index file in dir.
+// At most maxOpen files are kept open: the least recently written file is closed to open another one, and a new file is opened if its stream is written again.
+// Closed files are compressed in the background if compress is set.
+func newDirWriter(dir string, splitBy string, maxSize int64, maxAge time.Duration, maxOpen int, compress bool, format func(io.Writer) (recordWriter, error), logs log.Sink) (*dirWriter, error) {
+	switch splitBy {
+	case splitByContainer, splitByPod:
+	default:
+		return nil, fmt.Errorf("invalid split mode %q (must be %s or %s)", splitBy, splitByPod, splitByContainer)
+	}
+	if maxOpen < 1 {
+		return nil, fmt.Errorf("invalid maximum number of open files %d (must be at least 1)", maxOpen)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	index, err := os.OpenFile(filepath.Join(dir, indexFileName), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	w := &dirWriter{
+		compress: compress,
+		dir:      dir,
+		files:    make(map[string]*splitFile),
+		format:   format,
+		index:    index,
+		logs:     logs,
+		maxAge:   maxAge,
+		maxOpen:  maxOpen,
+		maxSize:  maxSize,
+		now:      time.Now,
+		splitBy:  splitBy,
+		stop:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	if maxAge > 0 {
+		interval := maxRotationCheckInterval
+		if maxAge < interval {
+			interval = maxAge
+		}
+		go w.rotateLoop(interval)
+	} else {
+		close(w.stopped)
+	}
+	return w, nil
+}
+
+type dirWriter struct {
+	compress     bool
+	compressions sync.WaitGroup // compressions of closed files running in the background
+	dir          string
+	files        map[string]*splitFile
+	format       func(io.Writer) (recordWriter, error)
+	index        *os.File
+	indexMutex   sync.Mutex // serializes writing the index, which background compressions do as well
+	logs         log.Sink
+	maxAge       time.Duration
+	maxOpen      int
+	maxSize      int64
+	mutex        sync.Mutex
+	now          func() time.Time
+	splitBy      string
+	stop         chan struct{}
+	stopOnce     sync.Once
+	stopped      chan struct{}
+}
+
+func (w *dirWriter) WriteRecord(data []byte) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.index == nil {
+		return errors.New("writer is closed")
+	}
+
+	var rec struct {
+		Kubernetes streamInfo `json:"kubernetes"`
+	}
+	_ = json.Unmarshal(data, &rec) // records that cannot be parsed end up in the unknown stream
+	stream := rec.Kubernetes
+	if w.splitBy == splitByPod {
+		stream.ContainerName = ""
+	}
+
+	key := stream.key()
+	now := w.now()
+	f := w.files[key]
+	if f != nil && w.needsRotation(f, now) {
+		if err := w.closeFile(f, now); err != nil {
+			log.Event(w.logs, "failed to rotate output file", log.Error(err), log.Fields{"file": f.path})
+		}
+		delete(w.files, key)
+		f = nil
+	}
+	if f == nil {
+		if len(w.files) >= w.maxOpen {
+			w.closeLeastRecentlyWritten(now)
+		}
+		var err error
+		if f, err = w.openFile(key, stream, now); err != nil {
+			return err
+		}
+		w.files[key] = f
+	}
+
+	if err := f.output.WriteRecord(data); err != nil {
+		return err
+	}
+	f.records++
+	f.lastWrite = now
+	return nil
+}
+
+// Close closes all open files, waits for their compression and closes the index file
+func (w *dirWriter) Close() (err error) {
+	w.stopOnce.Do(func() { close(w.stop) })
+	<-w.stopped
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.index == nil {
+		return nil
+	}
+	now := w.now()
+	for key, f := range w.files {
+		if e := w.closeFile(f, now); e != nil && err == nil {
+			err = e
+		}
+		delete(w.files, key)
+	}
+	w.compressions.Wait()
+	if e := w.index.Close(); e != nil && err == nil {
+		err = e
+	}
+	w.index = nil
+	return
+}
+
+// closeLeastRecentlyWritten closes the open file that was written least recently
+func (w *dirWriter) closeLeastRecentlyWritten(now time.Time) {
+	var lru string
+	for key, f := range w.files {
+		if lru == "" || f.lastWrite.Before(w.files[lru].lastWrite) {
+			lru = key
+		}
+	}
+	f := w.files[lru]
+	if err := w.closeFile(f, now); err != nil {
+		log.Event(w.logs, "failed to close output file", log.Error(err), log.Fields{"file": f.path})
+	}
+	delete(w.files, lru)
+}
+
+// rotateLoop rotates the files that have been open for too long even if nothing is written to them
+func (w *dirWriter) rotateLoop(interval time.Duration) {
+	defer close(w.stopped)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+			w.rotateExpired()
+		}
+	}
+}
+
+func (w *dirWriter) rotateExpired() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	now := w.now()
+	for key, f := range w.files {
+		if !w.needsRotation(f, now) {
+			continue
+		}
+		if err := w.closeFile(f, now); err != nil {
+			log.Event(w.logs, "failed to rotate output file", log.Error(err), log.Fields{"file": f.path})
+		}
+		delete(w.files, key)
+	}
+}
+
+func (w *dirWriter) needsRotation(f *splitFile, now time.Time) bool {
+	return (w.maxSize > 0 && f.size.n >= w.maxSize) || (w.maxAge > 0 && now.Sub(f.opened) >= w.maxAge)
+}
+
+func (w *dirWriter) openFile(key string, stream streamInfo, now time.Time) (*splitFile, error) {
+	base := filepath.Join(w.dir, key) + "-" + now.UTC().Format(rotatedTimeFormat)
+	if err := os.MkdirAll(filepath.Dir(base), 0o755); err != nil {
+		return nil, err
+	}
+	var file *os.File
+	var path string
+	for i := 0; file == nil; i++ {
+		path = base + ".log"
+		if i > 0 {
+			path = fmt.Sprintf("%s-%d.log", base, i)
+		}
+		if _, err := os.Stat(path + ".gz"); err == nil {
+			continue // a compressed file with the same name already exists
+		}
+		var err error
+		file, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+		if err != nil && !os.IsExist(err) {
+			return nil, err
+		}
+	}
+	f := &splitFile{
+		file:   file,
+		opened: now,
+		path:   path,
+		stream: stream,
+	}
+	f.size.w = file
+	output, err := w.format(&f.size)
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	f.output = output
+	log.Event(w.logs, "opened output file", log.V(1), log.Fields{"file": path})
+	return f, nil
+}
+
+// closeFile closes a file and lists it in the index, after compressing it in the background if compression is enabled
+func (w *dirWriter) closeFile(f *splitFile, now time.Time) error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	entry := indexEntry{
+		Namespace: f.stream.NamespaceName,
+		Pod:       f.stream.PodName,
+		Container: f.stream.ContainerName,
+		Opened:    f.opened.UTC(),
+		Closed:    now.UTC(),
+		LastWrite: f.lastWrite.UTC(),
+		Records:   f.records,
+		Bytes:     f.size.n,
+	}
+	if !w.compress {
+		return w.writeIndex(f.path, entry)
+	}
+	w.compressions.Add(1)
+	go func() {
+		defer w.compressions.Done()
+		path, err := gzipFile(f.path)
+		if err != nil {
+			// the uncompressed file is kept
+			log.Event(w.logs, "failed to compress output file", log.Error(err), log.Fields{"file": f.path})
+			path = f.path
+		}
+		if err := w.writeIndex(path, entry); err != nil {
+			log.Event(w.logs, "failed to write index", log.Error(err), log.Fields{"file": path})
+		}
+	}()
+	return nil
+}
+
+// writeIndex lists a closed file in the index
+func (w *dirWriter) writeIndex(path string, entry indexEntry) error {
+	rel, err := filepath.Rel(w.dir, path)
+	if err != nil {
+		rel = path
+	}
+	entry.File = filepath.ToSlash(rel)
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	w.indexMutex.Lock()
+	defer w.indexMutex.Unlock()
+	_, err = w.index.Write(append(data, '\n'))
+	log.Event(w.logs, "closed output file", log.V(1), log.Fields{"file": path})
+	return err
+}
+
+type splitFile struct {
+	file      *os.File
+	lastWrite time.Time
+	opened    time.Time
+	output    recordWriter
+	path      string
+	records   int
+	size      countingWriter
+	stream    streamInfo
+}
+
+type streamInfo struct {
+	ContainerName string `json:"container_name"`
+	NamespaceName string `json:"namespace_name"`
+	PodName       string `json:"pod_name"`
+}
+
+func (s streamInfo) key() string {
+	if s.PodName == "" {
+		return unknownStreamName
+	}
+	elts := []string{safePathElement(s.NamespaceName), safePathElement(s.PodName)}
+	if s.ContainerName != "" {
+		elts = append(elts, safePathElement(s.ContainerName))
+	}
+	return filepath.Join(elts...)
+}
+
+func safePathElement(s string) string {
+	if s == "" || s == "." || s == ".." {
+		return unknownStreamName
+	}
+	return strings.NewReplacer("/", "_", "\\", "_").Replace(s)
+}
+
+type indexEntry struct {
+	File      string    `json:"file"`
+	Namespace string    `json:"namespace,omitempty"`
+	Pod       string    `json:"pod,omitempty"`
+	Container string    `json:"container,omitempty"`
+	Opened    time.Time `json:"opened"`
+	Closed    time.Time `json:"closed"`
+	LastWrite time.Time `json:"lastWrite"`
+	Records   int       `json:"records"`
+	Bytes     int64     `json:"bytes"`
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (n int, err error) {
+	n, err = c.w.Write(p)
+	c.n += int64(n)
+	return
+}
+
+// gzipFile compresses the file at path and removes the original, returning the path of the compressed file
+func gzipFile(path string) (res string, err error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer src.Close()
+
+	res = path + ".gz"
+	dst, err := os.OpenFile(res, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			_ = os.Remove(res)
+		}
+	}()
+	zw := gzip.NewWriter(dst)
+	zw.Name = filepath.Base(path)
+	if _, err = io.Copy(zw, src); err != nil {
+		_ = dst.Close()
+		return
+	}
+	if err = zw.Close(); err != nil {
+		_ = dst.Close()
+		return
+	}
+	if err = dst.Close(); err != nil {
+		return
+	}
+	err = os.Remove(path)
+	return
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/banzaicloud/log-socket/log"
+)
+
+// testClock is the time of a dirWriter, which its rotation loop reads concurrently
+type testClock struct {
+	mutex sync.Mutex
+	now   time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+func (c *testClock) Add(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = c.now.Add(d)
+}
+
+type dirWriterOptions struct {
+	splitBy  string
+	maxSize  int64
+	maxAge   time.Duration
+	maxOpen  int
+	compress bool
+}
+
+func newTestDirWriter(t *testing.T, opts dirWriterOptions) (*dirWriter, *testClock, string) {
+	dir := t.TempDir()
+	if opts.splitBy == "" {
+		opts.splitBy = splitByPod
+	}
+	if opts.maxOpen == 0 {
+		opts.maxOpen = defaultMaxOpenFiles
+	}
+	w, err := newDirWriter(dir, opts.splitBy, opts.maxSize, opts.maxAge, opts.maxOpen, opts.compress, func(w io.Writer) (recordWriter, error) {
+		return newRecordWriter(w, outputRaw, "")
+	}, log.NewWriterSink(io.Discard))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := &testClock{now: time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)}
+	w.mutex.Lock()
+	w.now = clock.Now
+	w.mutex.Unlock()
+	t.Cleanup(func() { _ = w.Close() })
+	return w, clock, dir
+}
+
+func podRecord(namespace, pod, container, msg string) []byte {
+	data, _ := json.Marshal(map[string]interface{}{
+		"message":    msg,
+		"kubernetes": map[string]string{"namespace_name": namespace, "pod_name": pod, "container_name": container},
+	})
+	return data
+}
+
+func writeRecords(t *testing.T, w *dirWriter, records ...[]byte) {
+	t.Helper()
+	for _, r := range records {
+		if err := w.WriteRecord(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// readIndex returns the entries of the index, sorted by file
+func readIndex(t *testing.T, dir string) []indexEntry {
+	t.Helper()
+	file, err := os.Open(filepath.Join(dir, indexFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var entries []indexEntry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var e indexEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].File < entries[j].File })
+	return entries
+}
+
+// readOutputFiles returns the content of the files in the directory (except the index) by path, decompressing gzipped files
+func readOutputFiles(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	res := map[string]string{}
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || d.Name() == indexFileName {
+			return err
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		var r io.Reader = file
+		if strings.HasSuffix(path, ".gz") {
+			if r, err = gzip.NewReader(file); err != nil {
+				return err
+			}
+		}
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, path)
+		res[filepath.ToSlash(rel)] = string(data)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+// messages returns the messages of the raw records of a file
+func messages(t *testing.T, content string) []string {
+	t.Helper()
+	var res []string
+	for _, line := range strings.Split(strings.TrimSuffix(content, "\n"), "\n") {
+		var rec struct {
+			Message string `json:"message"`
+		}
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			res = append(res, line)
+			continue
+		}
+		res = append(res, rec.Message)
+	}
+	return res
+}
+
+func TestDirWriterSplit(t *testing.T) {
+	tests := map[string]struct {
+		splitBy  string
+		expected map[string][]string
+	}{
+		"pod": {
+			splitBy: splitByPod,
+			expected: map[string][]string{
+				"default/app-20230101T000000Z.log":     {"1", "2", "3"},
+				"default/other-20230101T000000Z.log":   {"4"},
+				"kube-system/app-20230101T000000Z.log": {"5"},
+				"_unknown-20230101T000000Z.log":        {"not json", "6"},
+				"default/a_b-20230101T000000Z.log":     {"7"},
+			},
+		},
+		"container": {
+			splitBy: splitByContainer,
+			expected: map[string][]string{
+				"default/app/main-20230101T000000Z.log":     {"1", "3"},
+				"default/app/sidecar-20230101T000000Z.log":  {"2"},
+				"default/other/main-20230101T000000Z.log":   {"4"},
+				"kube-system/app/main-20230101T000000Z.log": {"5"},
+				"_unknown-20230101T000000Z.log":             {"not json", "6"},
+				"default/a_b/_unknown-20230101T000000Z.log": {"7"},
+			},
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			w, _, dir := newTestDirWriter(t, dirWriterOptions{splitBy: test.splitBy})
+			writeRecords(t, w,
+				podRecord("default", "app", "main", "1"),
+				podRecord("default", "app", "sidecar", "2"),
+				podRecord("default", "app", "main", "3"),
+				podRecord("default", "other", "main", "4"),
+				podRecord("kube-system", "app", "main", "5"),
+				[]byte("not json"),
+				podRecord("default", "", "main", "6"),
+				// path elements are sanitized
+				podRecord("default", "a/b", "..", "7"),
+			)
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			files := readOutputFiles(t, dir)
+			if len(files) != len(test.expected) {
+				t.Errorf("expected files %v, got %v", test.expected, files)
+			}
+			for path, expected := range test.expected {
+				if actual := messages(t, files[path]); fmt.Sprint(actual) != fmt.Sprint(expected) {
+					t.Errorf("expected %s to hold %q, got %q", path, expected, actual)
+				}
+			}
+			index := readIndex(t, dir)
+			if len(index) != len(test.expected) {
+				t.Fatalf("expected an index entry for each file, got %+v", index)
+			}
+			for _, e := range index {
+				if e.Records != len(test.expected[e.File]) || e.Bytes != int64(len(files[e.File])) {
+					t.Errorf("expected %s to be listed with %d records and %d bytes, got %+v", e.File, len(test.expected[e.File]), len(files[e.File]), e)
+				}
+			}
+		})
+	}
+}
+
+func TestDirWriterIndex(t *testing.T) {
+	w, clock, dir := newTestDirWriter(t, dirWriterOptions{splitBy: splitByContainer})
+	opened := clock.Now()
+	writeRecords(t, w, podRecord("default", "app", "main", "1"))
+	clock.Add(time.Minute)
+	writeRecords(t, w, podRecord("default", "app", "main", "2"))
+	clock.Add(time.Minute)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	index := readIndex(t, dir)
+	if len(index) != 1 {
+		t.Fatalf("expected an index entry, got %+v", index)
+	}
+	expected := indexEntry{
+		File:      "default/app/main-20230101T000000Z.log",
+		Namespace: "default",
+		Pod:       "app",
+		Container: "main",
+		Opened:    opened,
+		Closed:    opened.Add(2 * time.Minute),
+		LastWrite: opened.Add(time.Minute),
+		Records:   2,
+		Bytes:     int64(len(podRecord("default", "app", "main", "1"))+1) * 2,
+	}
+	if index[0] != expected {
+		t.Errorf("expected %+v, got %+v", expected, index[0])
+	}
+	if err := w.WriteRecord(podRecord("default", "app", "main", "3")); err == nil {
+		t.Error("expected writing to a closed writer to fail")
+	}
+}
+
+func TestDirWriterRotation(t *testing.T) {
+	record := podRecord("default", "app", "main", "1")
+	size := int64(len(record) + 1)
+
+	t.Run("size", func(t *testing.T) {
+		// the file reaching the maximum size is rotated before the next write
+		w, _, dir := newTestDirWriter(t, dirWriterOptions{maxSize: 2 * size})
+		writeRecords(t, w, record, record, record, record, record)
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		var records []int
+		for _, e := range readIndex(t, dir) {
+			records = append(records, e.Records)
+		}
+		sort.Ints(records)
+		if expected := []int{1, 2, 2}; fmt.Sprint(records) != fmt.Sprint(expected) {
+			t.Errorf("expected files of %v records, got %v", expected, records)
+		}
+		if files := readOutputFiles(t, dir); len(files) != 3 {
+			t.Errorf("expected 3 files, got %v", files)
+		}
+	})
+
+	t.Run("age", func(t *testing.T) {
+		w, clock, dir := newTestDirWriter(t, dirWriterOptions{maxAge: time.Hour})
+		writeRecords(t, w, record, podRecord("default", "other", "main", "1"))
+		clock.Add(30 * time.Minute)
+		writeRecords(t, w, record)
+		clock.Add(30 * time.Minute)
+		// the file written to is rotated when it's written again
+		writeRecords(t, w, record)
+		// the file of the idle stream is rotated by the rotation loop
+		w.rotateExpired()
+		index := readIndex(t, dir)
+		if len(index) != 2 || index[0].File != "default/app-20230101T000000Z.log" || index[0].Records != 2 ||
+			index[1].File != "default/other-20230101T000000Z.log" || index[1].Records != 1 {
+			t.Errorf("unexpected index %+v", index)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		files := readOutputFiles(t, dir)
+		if content := files["default/app-20230101T010000Z.log"]; content != string(record)+"\n" {
+			t.Errorf("expected the record written after the rotation in a new file, got %v", files)
+		}
+	})
+}
+
+func TestDirWriterCompress(t *testing.T) {
+	w, clock, dir := newTestDirWriter(t, dirWriterOptions{maxAge: time.Hour, compress: true})
+	writeRecords(t, w, podRecord("default", "app", "main", "1"))
+	clock.Add(time.Hour)
+	writeRecords(t, w, podRecord("default", "app", "main", "2"))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	files := readOutputFiles(t, dir)
+	expected := map[string][]string{
+		"default/app-20230101T000000Z.log.gz": {"1"},
+		"default/app-20230101T010000Z.log.gz": {"2"},
+	}
+	if len(files) != len(expected) {
+		t.Errorf("expected only compressed files, got %v", files)
+	}
+	for path, msgs := range expected {
+		if actual := messages(t, files[path]); fmt.Sprint(actual) != fmt.Sprint(msgs) {
+			t.Errorf("expected %s to hold %q, got %q", path, msgs, actual)
+		}
+	}
+	index := readIndex(t, dir)
+	if len(index) != 2 || index[0].File != "default/app-20230101T000000Z.log.gz" || index[1].File != "default/app-20230101T010000Z.log.gz" {
+		t.Errorf("expected the compressed files to be listed, got %+v", index)
+	}
+	// the index lists the size of the uncompressed file
+	if index[0].Bytes != int64(len(files["default/app-20230101T000000Z.log.gz"])) {
+		t.Errorf("expected %d bytes, got %d", len(files["default/app-20230101T000000Z.log.gz"]), index[0].Bytes)
+	}
+}
+
+func TestDirWriterMaxOpenFiles(t *testing.T) {
+	w, clock, dir := newTestDirWriter(t, dirWriterOptions{maxOpen: 2})
+	write := func(pod, msg string) {
+		clock.Add(time.Second)
+		writeRecords(t, w, podRecord("default", pod, "main", msg))
+		if len(w.files) > 2 {
+			t.Fatalf("expected at most 2 open files, got %d", len(w.files))
+		}
+	}
+	write("a", "1")
+	write("b", "2")
+	write("a", "3")
+	write("c", "4") // closes b, which was written least recently
+	write("a", "5")
+	write("b", "6") // closes c
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	files := readOutputFiles(t, dir)
+	expected := map[string][]string{
+		"default/a-20230101T000001Z.log": {"1", "3", "5"},
+		"default/b-20230101T000002Z.log": {"2"},
+		"default/c-20230101T000004Z.log": {"4"},
+		"default/b-20230101T000006Z.log": {"6"},
+	}
+	if len(files) != len(expected) {
+		t.Errorf("expected files %v, got %v", expected, files)
+	}
+	for path, msgs := range expected {
+		if actual := messages(t, files[path]); fmt.Sprint(actual) != fmt.Sprint(msgs) {
+			t.Errorf("expected %s to hold %q, got %q", path, msgs, actual)
+		}
+	}
+	if index := readIndex(t, dir); len(index) != len(expected) {
+		t.Errorf("expected an index entry for each file, got %+v", index)
+	}
+
+	if _, err := newDirWriter(t.TempDir(), splitByPod, 0, 0, 0, false, nil, log.NewWriterSink(io.Discard)); err == nil {
+		t.Error("expected a maximum of 0 open files to be rejected")
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/mattn/go-isatty"
+)
+
+const (
+	outputAuto     = ""
+	outputJSON     = "json"
+	outputLogfmt   = "logfmt"
+	outputPretty   = "pretty"
+	outputRaw      = "raw"
+	outputTemplate = "template"
+)
+
+var outputFormats = []string{outputRaw, outputJSON, outputLogfmt, outputTemplate, outputPretty}
+
+type recordWriter interface {
+	WriteRecord(data []byte) error
+}
+
+// newRecordWriter returns a record writer for the specified output format.
+// If no format is specified, pretty output is used for terminals and raw output otherwise.
+func newRecordWriter(out io.Writer, format string, tmpl string) (recordWriter, error) {
+	tty := isTerminal(out)
+	if format == outputAuto {
+		format = outputRaw
+		if tty {
+			format = outputPretty
+		}
+	}
+	switch format {
+	case outputRaw:
+		return rawWriter{out}, nil
+	case outputJSON:
+		return jsonWriter{out}, nil
+	case outputLogfmt:
+		return logfmtWriter{out}, nil
+	case outputTemplate:
+		if tmpl == "" {
+			return nil, fmt.Errorf("output format %q requires a template", format)
+		}
+		t, err := template.New("record").Option("missingkey=zero").Parse(tmpl)
+		if err != nil {
+			return nil, err
+		}
+		return templateWriter{out, t}, nil
+	case outputPretty:
+		return &prettyWriter{writer: out, color: tty}, nil
+	default:
+		return nil, fmt.Errorf("unknown output format %q (must be one of %s)", format, strings.Join(outputFormats, ", "))
+	}
+}
+
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	return ok && (isatty.IsTerminal(f.Fd()) || isatty.IsCygwinTerminal(f.Fd()))
+}
+
+type rawWriter struct {
+	writer io.Writer
+}
+
+func (w rawWriter) WriteRecord(data []byte) error {
+	if _, err := w.writer.Write(data); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintln(w.writer)
+	return err
+}
+
+type jsonWriter struct {
+	writer io.Writer
+}
+
+func (w jsonWriter) WriteRecord(data []byte) error {
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, data, "", "  "); err != nil {
+		// not JSON, output as is
+		return rawWriter{w.writer}.WriteRecord(data)
+	}
+	_ = buf.WriteByte('\n')
+	_, err := buf.WriteTo(w.writer)
+	return err
+}
+
+type logfmtWriter struct {
+	writer io.Writer
+}
+
+func (w logfmtWriter) WriteRecord(data []byte) error {
+	rec, err := parseRecord(data)
+	if err != nil {
+		return rawWriter{w.writer}.WriteRecord(data)
+	}
+	var b strings.Builder
+	flattenRecord(rec, "", func(key string, value interface{}) {
+		if b.Len() > 0 {
+			_ = b.WriteByte(' ')
+		}
+		_, _ = b.WriteString(key)
+		_ = b.WriteByte('=')
+		_, _ = b.WriteString(logfmtValue(value))
+	})
+	_ = b.WriteByte('\n')
+	_, err = io.WriteString(w.writer, b.String())
+	return err
+}
+
+type templateWriter struct {
+	writer   io.Writer
+	template *template.Template
+}
+
+func (w templateWriter) WriteRecord(data []byte) error {
+	rec, err := parseRecord(data)
+	if err != nil {
+		return rawWriter{w.writer}.WriteRecord(data)
+	}
+	var buf bytes.Buffer
+	if err := w.template.Execute(&buf, rec); err != nil {
+		return err
+	}
+	if !bytes.HasSuffix(buf.Bytes(), []byte{'\n'}) {
+		_ = buf.WriteByte('\n')
+	}
+	_, err = buf.WriteTo(w.writer)
+	return err
+}
+
+type prettyWriter struct {
+	writer io.Writer
+	color  bool
+}
+
+func (w *prettyWriter) WriteRecord(data []byte) error {
+	rec, err := parseRecord(data)
+	if err != nil {
+		return rawWriter{w.writer}.WriteRecord(data)
+	}
+
+	var b strings.Builder
+
+	ts := lookupString(rec, "time", "@timestamp", "timestamp", "ts")
+	if ts == "" {
+		ts = time.Now().Format(time.RFC3339)
+	}
+	_, _ = b.WriteString(w.colored(ansiGray, ts))
+	_ = b.WriteByte(' ')
+
+	if k8s, ok := rec["kubernetes"].(map[string]interface{}); ok {
+		pod := lookupString(k8s, "pod_name")
+		prefix := strings.Join(nonEmpty(lookupString(k8s, "namespace_name"), pod, lookupString(k8s, "container_name")), "/")
+		if prefix != "" {
+			_, _ = b.WriteString(w.colored(podColor(pod), prefix))
+			_ = b.WriteByte(' ')
+		}
+	}
+
+	if level := lookupString(rec, "level", "severity", "lvl"); level != "" {
+		_, _ = b.WriteString(w.colored(levelColor(level), strings.ToUpper(level)))
+		_ = b.WriteByte(' ')
+	}
+
+	msg := lookupString(rec, "message", "msg", "log")
+	if msg == "" {
+		msg = string(data)
+	}
+	_, _ = b.WriteString(strings.TrimRight(msg, "\n"))
+	_ = b.WriteByte('\n')
+
+	_, err = io.WriteString(w.writer, b.String())
+	return err
+}
+
+func (w *prettyWriter) colored(color string, s string) string {
+	if !w.color {
+		return s
+	}
+	return color + s + ansiReset
+}
+
+const (
+	ansiReset  = "\x1b[0m"
+	ansiGray   = "\x1b[90m"
+	ansiRed    = "\x1b[31m"
+	ansiGreen  = "\x1b[32m"
+	ansiYellow = "\x1b[33m"
+	ansiBlue   = "\x1b[34m"
+)
+
+var podColors = []string{
+	"\x1b[31m", "\x1b[32m", "\x1b[33m", "\x1b[34m", "\x1b[35m", "\x1b[36m",
+	"\x1b[91m", "\x1b[92m", "\x1b[93m", "\x1b[94m", "\x1b[95m", "\x1b[96m",
+}
+
+func podColor(pod string) string {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(pod))
+	return podColors[h.Sum32()%uint32(len(podColors))]
+}
+
+func levelColor(level string) string {
+	switch strings.ToLower(level) {
+	case "fatal", "panic", "crit", "critical", "err", "error":
+		return ansiRed
+	case "warn", "warning":
+		return ansiYellow
+	case "info", "notice":
+		return ansiGreen
+	default:
+		return ansiBlue
+	}
+}
+
+func parseRecord(data []byte) (rec map[string]interface{}, err error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	err = dec.Decode(&rec)
+	return
+}
+
+func lookupString(m map[string]interface{}, keys ...string) string {
+	for _, key := range keys {
+		switch v := m[key].(type) {
+		case nil:
+		case string:
+			return v
+		default:
+			return fmt.Sprint(v)
+		}
+	}
+	return ""
+}
+
+func nonEmpty(strs ...string) (res []string) {
+	for _, s := range strs {
+		if s != "" {
+			res = append(res, s)
+		}
+	}
+	return
+}
+
+// flattenRecord calls fn for each leaf value of the record in lexical key order, joining nested keys with dots
+func flattenRecord(rec map[string]interface{}, prefix string, fn func(key string, value interface{})) {
+	keys := make([]string, 0, len(rec))
+	for k := range rec {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		key := prefix + k
+		if m, ok := rec[k].(map[string]interface{}); ok {
+			flattenRecord(m, key+".", fn)
+			continue
+		}
+		fn(key, rec[k])
+	}
+}
+
+func logfmtValue(value interface{}) string {
+	var s string
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		s = v
+	case json.Number:
+		return v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	default:
+		data, err := json.Marshal(v)
+		if err != nil {
+			s = fmt.Sprint(v)
+		} else {
+			s = string(data)
+		}
+	}
+	if s == "" || strings.ContainsAny(s, " =\"\t\r\n") {
+		return strconv.Quote(s)
+	}
+	return s
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRecordWriters(t *testing.T) {
+	const record = `{"time":"2023-01-01T00:00:00Z","level":"warn","message":"disk almost full","kubernetes":{"namespace_name":"default","pod_name":"app","container_name":"main"},"free":0.05,"id":9007199254740993,"ok":false,"tags":["a","b"],"empty":"","nothing":null}`
+	tests := map[string]struct {
+		format   string
+		template string
+		record   string
+		expected string
+	}{
+		"raw": {format: outputRaw, record: record, expected: record + "\n"},
+		"json": {
+			format:   outputJSON,
+			record:   `{"a":1,"b":{"c":"<d>"}}`,
+			expected: "{\n  \"a\": 1,\n  \"b\": {\n    \"c\": \"<d>\"\n  }\n}\n",
+		},
+		"json of a record that isn't JSON": {format: outputJSON, record: "plain text", expected: "plain text\n"},
+		"logfmt": {
+			format:   outputLogfmt,
+			record:   record,
+			expected: `empty="" free=0.05 id=9007199254740993 kubernetes.container_name=main kubernetes.namespace_name=default kubernetes.pod_name=app level=warn message="disk almost full" nothing= ok=false tags="[\"a\",\"b\"]" time=2023-01-01T00:00:00Z` + "\n",
+		},
+		"logfmt quoting": {
+			format:   outputLogfmt,
+			record:   `{"eq":"a=b","quote":"say \"hi\"","tab":"a\tb","newline":"a\nb","plain":"a-b"}`,
+			expected: `eq="a=b" newline="a\nb" plain=a-b quote="say \"hi\"" tab="a\tb"` + "\n",
+		},
+		"logfmt of a record that isn't JSON": {format: outputLogfmt, record: "plain text", expected: "plain text\n"},
+		"pretty": {
+			format:   outputPretty,
+			record:   record,
+			expected: "2023-01-01T00:00:00Z default/app/main WARN disk almost full\n",
+		},
+		"pretty with other fields": {
+			format:   outputPretty,
+			record:   `{"@timestamp":"2023-01-01T00:00:00Z","severity":"error","log":"failed\n","kubernetes":{"pod_name":"app"}}`,
+			expected: "2023-01-01T00:00:00Z app ERROR failed\n",
+		},
+		"pretty without a message": {
+			format:   outputPretty,
+			record:   `{"ts":1672531200,"status":200}`,
+			expected: `1672531200 {"ts":1672531200,"status":200}` + "\n",
+		},
+		"pretty of a record that isn't JSON": {format: outputPretty, record: "plain text", expected: "plain text\n"},
+		"template": {
+			format:   outputTemplate,
+			template: `{{.kubernetes.pod_name}}: {{.message}} ({{.missing}})`,
+			record:   record,
+			expected: "app: disk almost full (<no value>)\n",
+		},
+		"template ending with a line break": {format: outputTemplate, template: "{{.level}}\n", record: record, expected: "warn\n"},
+		// a buffer isn't a terminal
+		"auto": {format: outputAuto, record: record, expected: record + "\n"},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			var buf bytes.Buffer
+			w, err := newRecordWriter(&buf, test.format, test.template)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := w.WriteRecord([]byte(test.record)); err != nil {
+				t.Fatal(err)
+			}
+			if buf.String() != test.expected {
+				t.Errorf("expected %q, got %q", test.expected, buf.String())
+			}
+		})
+	}
+}
+
+func TestPrettyWriterColors(t *testing.T) {
+	var buf bytes.Buffer
+	w := &prettyWriter{writer: &buf, color: true}
+	for _, level := range []string{"error", "warning", "info", "debug"} {
+		if err := w.WriteRecord([]byte(`{"time":"t","level":"` + level + `","message":"m","kubernetes":{"pod_name":"app"}}`)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pod := podColor("app") + "app" + ansiReset
+	expected := []string{
+		ansiGray + "t" + ansiReset + " " + pod + " " + ansiRed + "ERROR" + ansiReset + " m",
+		ansiGray + "t" + ansiReset + " " + pod + " " + ansiYellow + "WARNING" + ansiReset + " m",
+		ansiGray + "t" + ansiReset + " " + pod + " " + ansiGreen + "INFO" + ansiReset + " m",
+		ansiGray + "t" + ansiReset + " " + pod + " " + ansiBlue + "DEBUG" + ansiReset + " m",
+	}
+	if actual := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n"); strings.Join(actual, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected %q, got %q", expected, actual)
+	}
+}
+
+func TestNewRecordWriterErrors(t *testing.T) {
+	if _, err := newRecordWriter(&bytes.Buffer{}, "yaml", ""); err == nil {
+		t.Error("expected an unknown format to be rejected")
+	}
+	if _, err := newRecordWriter(&bytes.Buffer{}, outputTemplate, ""); err == nil {
+		t.Error("expected the template format to require a template")
+	}
+	if _, err := newRecordWriter(&bytes.Buffer{}, outputTemplate, "{{.a"); err == nil {
+		t.Error("expected an invalid template to be rejected")
+	}
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/wasmerio/wasmer-go/wasmer"
+
+	"github.com/banzaicloud/log-socket/internal"
+	"github.com/banzaicloud/log-socket/log"
+)
+
+func newPluginsCommand(global *globalOptions) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "plugins",
+		Short: "Work with WASM plugins",
+	}
+	cmd.AddCommand(
+		newPluginsBenchCommand(global),
+		newPluginsInspectCommand(global),
+		newPluginsPrecompileCommand(global),
+		newPluginsTestCommand(global),
+	)
+	return cmd
+}
+
+func newPluginsBenchCommand(global *globalOptions) *cobra.Command {
+	var input, ordering string
+	var pluginOpts pluginOptions
+	var repeat int
+	var workers []int
+
+	cmd := &cobra.Command{
+		Use:   "bench PLUGIN... --input FILE",
+		Short: "Measure the throughput of a pipeline of plugins with different numbers of workers",
+		Long: `Measure the throughput of a pipeline of plugins processing the records of a file (one per line) with each of the numbers of workers given with --workers, as k8stail --workers does.
+Each run loads the plugins, then processes the records --repeat times and flushes the pipelines; only processing and flushing is measured.
+The speedup is relative to the first run.`,
+		Args: cobra.MinimumNArgs(1),
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			if _, err := internal.ParsePipelineOrdering(ordering); err != nil {
+				return err
+			}
+			if repeat < 1 {
+				return fmt.Errorf("invalid repeat count %d (must be at least 1)", repeat)
+			}
+			if len(workers) == 0 {
+				return errors.New("at least one number of workers has to be specified")
+			}
+			for _, n := range workers {
+				if n < 1 {
+					return fmt.Errorf("invalid number of workers %d (must be at least 1)", n)
+				}
+			}
+			return pluginOpts.validate(args)
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			logs := global.logs()
+
+			records, err := readLines(input)
+			if err != nil {
+				log.Event(logs, "failed to read input", log.Error(err), log.Fields{"file": input})
+				os.Exit(2)
+			}
+			metas := make([]*internal.RecordMeta, len(records))
+			for i, rec := range records {
+				metas[i] = internal.NewRecordMeta(internal.FlowReference{}, time.Time{}, rec)
+			}
+			order, _ := internal.ParsePipelineOrdering(ordering)
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "WORKERS\tORDERING\tRECORDS\tDURATION\tRECORDS/S\tSPEEDUP")
+			var baseline float64
+			for _, n := range workers {
+				pipelines, err := pluginOpts.loadInstances(logs, args, n)
+				if err != nil {
+					log.Event(logs, "failed to load plugins", log.Error(err))
+					os.Exit(2)
+				}
+				var failed int
+				result := func(_ []internal.RoutedRecord, err error) {
+					if err != nil {
+						failed++
+					}
+				}
+				pool := internal.NewPipelinePool(pipelines, order)
+				start := time.Now()
+				for i := 0; i < repeat; i++ {
+					for j, rec := range records {
+						pool.ProcessRecord(rec, metas[j], result)
+					}
+				}
+				if err := pool.Close(result); err != nil {
+					log.Event(logs, "failed to close pipeline", log.Error(err))
+				}
+				elapsed := time.Since(start)
+				if failed > 0 {
+					log.Event(logs, "records failed processing", log.Fields{"workers": n, "failed": failed})
+				}
+
+				throughput := float64(len(records)*repeat) / elapsed.Seconds()
+				if baseline == 0 {
+					baseline = throughput
+				}
+				fmt.Fprintf(w, "%d\t%s\t%d\t%s\t%.0f\t%.2fx\n", n, order, len(records)*repeat, elapsed.Round(time.Millisecond), throughput, throughput/baseline)
+			}
+			if err := w.Flush(); err != nil {
+				log.Event(logs, "failed to write output", log.Error(err))
+				os.Exit(2)
+			}
+		},
+	}
+	cmd.Flags().StringVar(&input, "input", "", "file holding the records to process, one per line")
+	cmd.Flags().StringVar(&ordering, "ordering", string(internal.POStrict), fmt.Sprintf("the order results are delivered in: one of %v", internal.PipelineOrderings))
+	pluginOpts.addFlags(cmd.Flags())
+	cmd.Flags().IntVar(&repeat, "repeat", 100, "how many times the records of the input are processed in each run")
+	cmd.Flags().IntSliceVar(&workers, "workers", []int{1, 2, 4}, "numbers of workers to measure the throughput with")
+	_ = cmd.MarkFlagRequired("input")
+	return cmd
+}
+
+func newPluginsInspectCommand(global *globalOptions) *cobra.Command {
+	return &cobra.Command{
+		Use:   "inspect PLUGIN...",
+		Short: "List the imports and exports of plugins",
+		Args:  cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			logs := global.logs()
+
+			store := wasmer.NewStore(wasmer.NewEngine())
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			for i, path := range args {
+				code, err := os.ReadFile(path)
+				if err != nil {
+					log.Event(logs, "failed to read plugin", log.Error(err), log.Fields{"plugin": path})
+					os.Exit(2)
+				}
+				module, err := wasmer.NewModule(store, code)
+				if err != nil {
+					log.Event(logs, "failed to compile plugin", log.Error(err), log.Fields{"plugin": path})
+					os.Exit(2)
+				}
+				if i > 0 {
+					fmt.Fprintln(w)
+				}
+				fmt.Fprintf(w, "Plugin:\t%s\n", path)
+				fmt.Fprintln(w, "DIRECTION\tMODULE\tNAME\tKIND")
+				for _, desc := range module.Imports() {
+					fmt.Fprintf(w, "import\t%s\t%s\t%s\n", desc.Module(), desc.Name(), desc.Type().Kind())
+				}
+				for _, desc := range module.Exports() {
+					fmt.Fprintf(w, "export\t\t%s\t%s\n", desc.Name(), desc.Type().Kind())
+				}
+			}
+			if err := w.Flush(); err != nil {
+				log.Event(logs, "failed to write output", log.Error(err))
+				os.Exit(2)
+			}
+		},
+	}
+}
+
+func newPluginsPrecompileCommand(global *globalOptions) *cobra.Command {
+	var pluginOpts pluginOptions
+
+	cmd := &cobra.Command{
+		Use:   "precompile PLUGIN...",
+		Short: "Compile plugins into the cache of compiled plugins",
+		Long: `Compile plugins into the cache of compiled plugins, so that loading them doesn't have to compile them.
+Plugins are cached by the digest of their code and the version of the engine compiling them; modules compiled by other engine versions are removed.
+Plugins can be referenced as with --plugin (their configuration is ignored), remote plugins are downloaded as well.`,
+		Args: cobra.MinimumNArgs(1),
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			if pluginOpts.cacheDir == "" {
+				return errors.New("caching compiled plugins is disabled, a directory has to be specified with --plugin-cache-dir")
+			}
+			return pluginOpts.validateRefs(args)
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			logs := global.logs()
+
+			cache := pluginOpts.cache(logs)
+			fetcher, err := pluginOpts.fetcher(logs)
+			if err != nil {
+				log.Event(logs, "failed to set up fetching plugins", log.Error(err))
+				os.Exit(2)
+			}
+			store := wasmer.NewStore(wasmer.NewEngine())
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "PLUGIN	STATUS	FILE")
+			for _, ref := range args {
+				path, _, _ := internal.ParsePluginReference(ref)
+				code, err := pluginOpts.read(context.Background(), fetcher, path)
+				if err != nil {
+					log.Event(logs, "failed to read plugin", log.Error(err), log.Fields{"plugin": path})
+					os.Exit(2)
+				}
+				module, cached, err := cache.Compile(store, code)
+				if err != nil {
+					log.Event(logs, "failed to compile plugin", log.Error(err), log.Fields{"plugin": path})
+					os.Exit(2)
+				}
+				module.Close()
+				// failing to write the cache is only logged by Compile
+				if _, err := os.Stat(cache.Path(code)); err != nil {
+					log.Event(logs, "failed to cache plugin", log.Error(err), log.Fields{"plugin": path})
+					os.Exit(2)
+				}
+				status := "compiled"
+				if cached {
+					status = "cached"
+				}
+				fmt.Fprintf(w, "%s\t%s\t%s\n", path, status, cache.Path(code))
+			}
+			if err := w.Flush(); err != nil {
+				log.Event(logs, "failed to write output", log.Error(err))
+				os.Exit(2)
+			}
+		},
+	}
+	pluginOpts.addCacheFlags(cmd.Flags())
+	return cmd
+}
+
+func newPluginsTestCommand(global *globalOptions) *cobra.Command {
+	var golden, input string
+	var pluginOpts pluginOptions
+	var update bool
+
+	cmd := &cobra.Command{
+		Use:   "test PLUGIN... --input FILE --golden FILE",
+		Short: "Run the records of a file through a pipeline of plugins and compare the results with a golden file",
+		Long: `Run the records of a file (one per line) through a pipeline of plugins and compare the results with a golden file (one record per line).
+Records sent to a named output are prefixed with the name of the output and a tab in the golden file.
+Plugins get the Kubernetes metadata of the records, but no flow reference and receive time.
+Exits with 1 if the results differ from the golden file, which can be rewritten with --update.`,
+		Args: cobra.MinimumNArgs(1),
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			return pluginOpts.validate(args)
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			logs := global.logs()
+
+			records, err := readLines(input)
+			if err != nil {
+				log.Event(logs, "failed to read input", log.Error(err), log.Fields{"file": input})
+				os.Exit(2)
+			}
+			pipeline, err := pluginOpts.load(logs, args)
+			if err != nil {
+				log.Event(logs, "failed to load plugins", log.Error(err))
+				os.Exit(2)
+			}
+			closePipeline := func() {
+				if err := pipeline.Close(); err != nil {
+					log.Event(logs, "failed to close pipeline", log.Error(err))
+				}
+			}
+
+			var results [][]byte
+			for i, rec := range records {
+				res, err := pipeline.ProcessRecord(rec, internal.NewRecordMeta(internal.FlowReference{}, time.Time{}, rec))
+				if err != nil {
+					log.Event(logs, "failed to process record", log.Error(err), log.Fields{"file": input, "line": i + 1})
+					closePipeline()
+					os.Exit(2)
+				}
+				results = append(results, goldenLines(res)...)
+			}
+			res, err := pipeline.Flush()
+			closePipeline()
+			if err != nil {
+				log.Event(logs, "failed to flush pipeline", log.Error(err))
+				os.Exit(2)
+			}
+			results = append(results, goldenLines(res)...)
+
+			if update {
+				var b bytes.Buffer
+				for _, rec := range results {
+					b.Write(bytes.TrimSpace(rec))
+					b.WriteByte('\n')
+				}
+				if err := os.WriteFile(golden, b.Bytes(), 0o644); err != nil {
+					log.Event(logs, "failed to write golden file", log.Error(err), log.Fields{"file": golden})
+					os.Exit(2)
+				}
+				return
+			}
+
+			expected, err := readLines(golden)
+			if err != nil {
+				log.Event(logs, "failed to read golden file", log.Error(err), log.Fields{"file": golden})
+				os.Exit(2)
+			}
+			if diffs := diffRecords(expected, results); len(diffs) > 0 {
+				for _, d := range diffs {
+					fmt.Println(d)
+				}
+				os.Exit(1)
+			}
+			fmt.Printf("ok: %d records in, %d records out\n", len(records), len(results))
+		},
+	}
+	cmd.Flags().StringVar(&golden, "golden", "", "file holding the expected results, one record per line")
+	cmd.Flags().StringVar(&input, "input", "", "file holding the records to process, one per line")
+	pluginOpts.addFlags(cmd.Flags())
+	cmd.Flags().BoolVar(&update, "update", false, "write the results to the golden file instead of comparing them")
+	_ = cmd.MarkFlagRequired("golden")
+	_ = cmd.MarkFlagRequired("input")
+	return cmd
+}
+
+// goldenLines formats records as lines of golden files, prefixing records sent to named outputs with the name of the output and a tab
+func goldenLines(records []internal.RoutedRecord) [][]byte {
+	res := make([][]byte, len(records))
+	for i, rec := range records {
+		res[i] = bytes.TrimSpace(rec.Data)
+		if rec.Output != "" {
+			res[i] = append([]byte(rec.Output+"\t"), res[i]...)
+		}
+	}
+	return res
+}
+
+// readLines returns the non-empty lines of a file
+func readLines(path string) (res [][]byte, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 16<<20)
+	for scanner.Scan() {
+		if line := bytes.TrimSpace(scanner.Bytes()); len(line) > 0 {
+			res = append(res, append([]byte(nil), line...))
+		}
+	}
+	return res, scanner.Err()
+}
+
+// diffRecords describes the differences between the expected and the actual records
+func diffRecords(expected, actual [][]byte) (res []string) {
+	for i := 0; i < len(expected) || i < len(actual); i++ {
+		switch {
+		case i >= len(actual):
+			res = append(res, fmt.Sprintf("record %d: missing, expected %s", i+1, expected[i]))
+		case i >= len(expected):
+			res = append(res, fmt.Sprintf("record %d: unexpected %s", i+1, bytes.TrimSpace(actual[i])))
+		case !bytes.Equal(expected[i], bytes.TrimSpace(actual[i])):
+			res = append(res, fmt.Sprintf("record %d: expected %s, got %s", i+1, expected[i], bytes.TrimSpace(actual[i])))
+		}
+	}
+	return
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/pflag"
+
+	"github.com/banzaicloud/log-socket/internal"
+	"github.com/banzaicloud/log-socket/log"
+)
+
+// TestGoSDKExamples builds the example plugins of the Go SDK and runs them through a pipeline like `k8stail plugins test`, comparing the results with the golden files of sdk/testdata
+func TestGoSDKExamples(t *testing.T) {
+	if testing.Short() {
+		t.Skip("building the examples takes a while")
+	}
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("the go command is needed to build the examples")
+	}
+	sdk := filepath.Join("..", "..", "sdk")
+
+	// configurations of the examples besides the default one, as GOLDEN_SUFFIX:QUERY
+	examples := []struct {
+		name    string
+		configs []string
+	}{
+		{"grep", []string{"panic:pattern=panic"}},
+		{"dropfields", nil},
+		{"levelfilter", []string{"error:min-level=error"}},
+		{"router", nil},
+		{"ratesummary", nil},
+	}
+	input, err := readLines(filepath.Join(sdk, "testdata", "records.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := t.TempDir()
+	// compiled plugins are cached, so that plugins checked with several configurations are compiled once
+	cache := t.TempDir()
+	for _, example := range examples {
+		example := example
+		t.Run(example.name, func(t *testing.T) {
+			plugin := filepath.Join(out, example.name+".wasm")
+			build := exec.Command("go", "build", "-buildmode=c-shared", "-o", plugin, ".")
+			build.Dir = filepath.Join(sdk, "go", "examples", example.name)
+			build.Env = append(os.Environ(), "GOOS=wasip1", "GOARCH=wasm")
+			if output, err := build.CombinedOutput(); err != nil {
+				t.Fatalf("failed to build example: %v\n%s", err, output)
+			}
+
+			checkGolden(t, cache, plugin, input, filepath.Join(sdk, "testdata", example.name+".golden.jsonl"))
+			for _, config := range example.configs {
+				suffix, query, _ := strings.Cut(config, ":")
+				checkGolden(t, cache, plugin+"?"+query, input, filepath.Join(sdk, "testdata", example.name+"-"+suffix+".golden.jsonl"))
+			}
+		})
+	}
+}
+
+func checkGolden(t *testing.T, cacheDir string, ref string, input [][]byte, golden string) {
+	var opts pluginOptions
+	opts.addFlags(pflag.NewFlagSet("test", pflag.ContinueOnError))
+	opts.cacheDir = cacheDir
+	pipeline, err := opts.load(log.NewWriterSink(io.Discard), []string{ref})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pipeline.Close()
+
+	var results [][]byte
+	for _, rec := range input {
+		res, err := pipeline.ProcessRecord(rec, internal.NewRecordMeta(internal.FlowReference{}, time.Time{}, rec))
+		if err != nil {
+			t.Fatal(err)
+		}
+		results = append(results, goldenLines(res)...)
+	}
+	res, err := pipeline.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	results = append(results, goldenLines(res)...)
+
+	expected, err := readLines(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range diffRecords(expected, results) {
+		t.Errorf("%s: %s", filepath.Base(ref), d)
+	}
+}
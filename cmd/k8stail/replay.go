@@ -0,0 +1,85 @@
+package main
+
+import (
+	"io"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/banzaicloud/log-socket/internal"
+	"github.com/banzaicloud/log-socket/log"
+)
+
+func newReplayCommand(global *globalOptions) *cobra.Command {
+	var processing processingOptions
+	var speed float64
+
+	cmd := &cobra.Command{
+		Use:   "replay SESSION",
+		Short: "Feed the frames of a recorded session through the pipeline and output formatters",
+		Args:  cobra.ExactArgs(1),
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			return processing.validate()
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			logs := global.logs()
+
+			processor, closeProcessor := processing.setup(logs)
+			defer closeProcessor()
+
+			if err := replay(args[0], speed, processor, logs); err != nil {
+				log.Event(logs, "failed to replay session", log.Error(err), log.Fields{"session": args[0]})
+				closeProcessor()
+				os.Exit(2)
+			}
+		},
+	}
+	cmd.Flags().Float64Var(&speed, "speed", 0, "speed multiplier relative to the original timing of frames (0 replays as fast as possible)")
+	processing.addFlags(cmd.Flags())
+	return cmd
+}
+
+// replay feeds the frames of a recorded session to the processor.
+// If speed is positive, the original timing of frames is reproduced scaled by speed.
+func replay(path string, speed float64, processor *recordProcessor, logs log.Sink) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	session, err := internal.NewSessionReader(file)
+	if err != nil {
+		return err
+	}
+
+	var first time.Time
+	start := time.Now()
+	for {
+		frame, err := session.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err == io.ErrUnexpectedEOF {
+			log.Event(logs, "session ends with a truncated frame", log.Fields{"session": path})
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if speed > 0 {
+			if first.IsZero() {
+				first = frame.Received
+			}
+			offset := time.Duration(float64(frame.Received.Sub(first)) / speed)
+			time.Sleep(time.Until(start.Add(offset)))
+		}
+
+		log.Event(logs, "replaying frame", log.V(2), log.Fields{"flow": frame.Flow, "received": frame.Received, "data": frame.Data})
+		if err := processor.process(frame.Data, frame.Flow, frame.Received); err != nil {
+			return err
+		}
+	}
+}
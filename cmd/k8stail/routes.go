@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"go.uber.org/multierr"
+
+	"github.com/banzaicloud/log-socket/internal"
+)
+
+const (
+	routeDiscard = "discard"
+	routeStderr  = "stderr"
+	routeStdout  = "stdout"
+)
+
+// parseRoute parses a route of a named output in the format NAME=TARGET
+func parseRoute(s string) (name, target string, err error) {
+	name, target, ok := strings.Cut(s, "=")
+	if !ok || name == "" || target == "" {
+		return "", "", fmt.Errorf("invalid route %q (must be NAME=TARGET, where TARGET is %s, %s, %s or a file)", s, routeStdout, routeStderr, routeDiscard)
+	}
+	return name, target, nil
+}
+
+// routedWriter writes records to the writer of the output they were routed to, or to the default writer if the output has no route
+type routedWriter struct {
+	def    recordWriter
+	routes map[string]recordWriter // nil writers discard records
+}
+
+func (w *routedWriter) WriteRouted(rec internal.RoutedRecord) error {
+	out := w.def
+	if rec.Output != "" {
+		if route, ok := w.routes[rec.Output]; ok {
+			out = route
+		}
+	}
+	if out == nil {
+		return nil
+	}
+	return out.WriteRecord(rec.Data)
+}
+
+// routeWriters opens the targets of the routes, which are written in the output format.
+// The returned function closes the files opened for routes.
+func (o *processingOptions) routeWriters() (res map[string]recordWriter, closeFiles func() error, err error) {
+	res = make(map[string]recordWriter, len(o.routes))
+	files := make(map[string]recordWriter)
+	var closers []io.Closer
+	closeFiles = func() (err error) {
+		for _, c := range closers {
+			err = multierr.Append(err, c.Close())
+		}
+		return
+	}
+	for _, route := range o.routes {
+		name, target, err := parseRoute(route)
+		if err != nil {
+			_ = closeFiles()
+			return nil, nil, err
+		}
+		var out io.Writer
+		switch target {
+		case routeDiscard:
+			res[name] = nil
+			continue
+		case routeStdout:
+			out = os.Stdout
+		case routeStderr:
+			out = os.Stderr
+		default:
+			// routes to the same file share its writer
+			if w, ok := files[target]; ok {
+				res[name] = w
+				continue
+			}
+			file, err := os.OpenFile(target, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+			if err != nil {
+				_ = closeFiles()
+				return nil, nil, err
+			}
+			closers = append(closers, file)
+			out = file
+		}
+		w, err := newRecordWriter(out, o.outputFormat, o.outputTemplate)
+		if err != nil {
+			_ = closeFiles()
+			return nil, nil, err
+		}
+		if out != os.Stdout && out != os.Stderr {
+			files[target] = w
+		}
+		res[name] = w
+	}
+	return res, closeFiles, nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/spf13/pflag"
+
+	"github.com/banzaicloud/log-socket/internal"
+)
+
+// servicePluginOptions holds the flags asking the service to run plugins before sending records
+type servicePluginOptions struct {
+	refs []string
+}
+
+func (o *servicePluginOptions) addFlags(fs *pflag.FlagSet) {
+	fs.StringArrayVar(&o.refs, "service-plugin", nil, "plugin run by the service before sending records: the name of a plugin allowed by the service, or @FILE to upload a local module, optionally followed by ?KEY=VALUE&... configuring it (can be repeated)")
+}
+
+func (o *servicePluginOptions) validate() error {
+	for _, ref := range o.refs {
+		name, _, err := internal.ParsePluginReference(ref)
+		if err != nil {
+			return err
+		}
+		if path := strings.TrimPrefix(name, "@"); path != name {
+			if _, err := os.Stat(path); err != nil {
+				return fmt.Errorf("invalid service plugin %q: %w", ref, err)
+			}
+		}
+	}
+	return nil
+}
+
+// resolve uploads the local modules to the service and returns the references of the plugins for the query
+func (o *servicePluginOptions) resolve(upload func(code []byte) (string, error)) ([]string, error) {
+	res := make([]string, 0, len(o.refs))
+	for _, ref := range o.refs {
+		name, query, hasQuery := strings.Cut(ref, "?")
+		if path := strings.TrimPrefix(name, "@"); path != name {
+			code, err := os.ReadFile(path)
+			if err != nil {
+				return nil, err
+			}
+			if name, err = upload(code); err != nil {
+				return nil, fmt.Errorf("failed to upload plugin %s: %w", path, err)
+			}
+		}
+		if hasQuery {
+			name += "?" + query
+		}
+		res = append(res, name)
+	}
+	return res, nil
+}
+
+// uploadPlugin posts a module to the plugin endpoint of the service and returns the reference the service runs it with
+func uploadPlugin(client *http.Client, endpoint *url.URL, header http.Header, code []byte) (string, error) {
+	req, err := http.NewRequest(http.MethodPost, endpoint.String(), bytes.NewReader(code))
+	if err != nil {
+		return "", err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/wasm")
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	var res internal.PluginUpload
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return "", err
+	}
+	return res.Plugin, nil
+}
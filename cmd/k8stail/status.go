@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/banzaicloud/log-socket/internal"
+	"github.com/banzaicloud/log-socket/log"
+	loggingv1beta1 "github.com/banzaicloud/logging-operator/pkg/sdk/logging/api/v1beta1"
+)
+
+func newStatusCommand(global *globalOptions) *cobra.Command {
+	var svc serviceOptions
+
+	cmd := &cobra.Command{
+		Use:   "status",
+		Short: "Show the state of the log socket service and the flows it currently taps",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			logs := global.logs()
+
+			c, err := global.kube.client()
+			if err != nil {
+				log.Event(logs, "failed to create kubernetes client", log.Error(err))
+				os.Exit(2)
+			}
+			ctx := context.Background()
+			key := types.NamespacedName{Namespace: svc.namespace, Name: svc.name}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+
+			var service corev1.Service
+			if err := c.Get(ctx, key, &service); err != nil {
+				log.Event(logs, "failed to get log socket service", log.Error(err), log.Fields{"service": key})
+				os.Exit(2)
+			}
+			var endpoints corev1.Endpoints
+			ready, notReady := 0, 0
+			if err := c.Get(ctx, key, &endpoints); client.IgnoreNotFound(err) != nil {
+				log.Event(logs, "failed to get log socket service endpoints", log.Error(err), log.Fields{"service": key})
+				os.Exit(2)
+			}
+			for _, subset := range endpoints.Subsets {
+				ready += len(subset.Addresses)
+				notReady += len(subset.NotReadyAddresses)
+			}
+			fmt.Fprintf(w, "Service:\t%s\n", key)
+			fmt.Fprintf(w, "Endpoints:\t%d ready, %d not ready\n", ready, notReady)
+			fmt.Fprintln(w)
+
+			var outputs loggingv1beta1.OutputList
+			if err := c.List(ctx, &outputs, client.MatchingLabels(internal.DefLabel)); err != nil {
+				log.Event(logs, "failed to list outputs", log.Error(err))
+				os.Exit(2)
+			}
+			var clusterOutputs loggingv1beta1.ClusterOutputList
+			if err := c.List(ctx, &clusterOutputs, client.MatchingLabels(internal.DefLabel)); err != nil {
+				log.Event(logs, "failed to list cluster outputs", log.Error(err))
+				os.Exit(2)
+			}
+			fmt.Fprintln(w, "TAPPED KIND\tNAMESPACE\tNAME\tOUTPUT")
+			for _, output := range outputs.Items {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", internal.FKFlow, output.Namespace, output.Annotations[internal.FlowAnnotationKey], output.Name)
+			}
+			for _, output := range clusterOutputs.Items {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", internal.FKClusterFlow, output.Namespace, output.Annotations[internal.FlowAnnotationKey], output.Name)
+			}
+
+			if err := w.Flush(); err != nil {
+				log.Event(logs, "failed to write output", log.Error(err))
+				os.Exit(2)
+			}
+		},
+	}
+	svc.addFlags(cmd.Flags())
+	return cmd
+}
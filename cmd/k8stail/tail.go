@@ -0,0 +1,530 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	pathpkg "path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+
+	"github.com/banzaicloud/log-socket/internal"
+	"github.com/banzaicloud/log-socket/log"
+)
+
+// serviceOptions holds the flags specifying how to reach the log socket service
+type serviceOptions struct {
+	name      string
+	namespace string
+	port      string
+}
+
+func (o *serviceOptions) addFlags(fs *pflag.FlagSet) {
+	fs.StringVarP(&o.name, "service", "s", "log-socket", "name of the service that accepts WebSocket listeners")
+	fs.StringVar(&o.namespace, "service-namespace", "default", "log socket service namespace")
+	fs.StringVarP(&o.port, "port", "p", "10001", "log socket service listening port")
+}
+
+// applyDeprecatedNamespace keeps the meaning -n had before k8stail had subcommands: if it is set without --service-namespace, it is the namespace of the service,
+// and flows referenced without a namespace are in the namespace of the kubeconfig context.
+// Deprecated: -n will be the namespace of flows in the next release.
+func (o *serviceOptions) applyDeprecatedNamespace(fs *pflag.FlagSet, kube *kubeOptions, logs log.Sink) {
+	if !fs.Changed(clientcmd.FlagNamespace) || fs.Changed("service-namespace") {
+		return
+	}
+	o.namespace = kube.overrides.Context.Namespace
+	kube.overrides.Context.Namespace = ""
+	log.Event(logs, "-n sets the namespace of the service for backward compatibility, which is deprecated: use --service-namespace instead, -n will set the namespace of flows in the next release", log.Fields{"namespace": o.namespace})
+}
+
+// authOptions holds the flags specifying how k8stail authenticates to the service
+type authOptions struct {
+	audience       string
+	insecure       bool
+	listenCAFile   string
+	serviceAccount string
+	token          string
+	tokenTTL       time.Duration
+}
+
+func (o *authOptions) addFlags(fs *pflag.FlagSet) {
+	fs.StringVar(&o.audience, "token-audience", internal.TokenAudience, "audience of the tokens minted for --service-account (one of the service's --token-audiences)")
+	fs.BoolVar(&o.insecure, "insecure-send-token", false, "send the token even if the connection isn't encrypted or the server's certificate isn't verified (e.g. to a --no-tls service on a trusted network)")
+	fs.StringVar(&o.listenCAFile, "listen-ca-file", "", "file containing the CA certificates used to verify the service's certificate when connecting to --listen-addr")
+	fs.StringVar(&o.serviceAccount, "service-account", "", "mint a short-lived token for this service account (NAMESPACE/NAME) with the TokenRequest API")
+	fs.StringVarP(&o.token, "token", "t", "", "token used for authentication (instead of minting one for --service-account)")
+	fs.DurationVar(&o.tokenTTL, "token-ttl", 10*time.Minute, "lifetime of tokens minted for --service-account")
+}
+
+// samplingOptions holds the flags asking the service to sample records before sending them
+type samplingOptions struct {
+	firstPerPod string
+	maxRate     string
+	probability float64
+	seed        int64
+}
+
+func (o *samplingOptions) addFlags(fs *pflag.FlagSet) {
+	fs.StringVar(&o.firstPerPod, "first-per-pod", "", "only receive the first N records of each pod per minute (or per N/s, N/m, N/h)")
+	fs.StringVar(&o.maxRate, "max-rate", "", "receive at most this many records (N/s, N/m or N/h)")
+	fs.Float64Var(&o.probability, "sample", 0, "receive each record with this probability (e.g. 0.01)")
+	fs.Int64Var(&o.seed, "sample-seed", 0, "seed for sampling with --sample, to make it reproducible (random if 0)")
+}
+
+// query returns the query parameters requesting sampling
+func (o *samplingOptions) query() url.Values {
+	res := url.Values{}
+	if o.firstPerPod != "" {
+		res.Set(internal.FirstPerPodQueryKey, o.firstPerPod)
+	}
+	if o.maxRate != "" {
+		res.Set(internal.MaxRateQueryKey, o.maxRate)
+	}
+	if o.probability != 0 {
+		res.Set(internal.SampleQueryKey, strconv.FormatFloat(o.probability, 'g', -1, 64))
+	}
+	if o.seed != 0 {
+		res.Set(internal.SeedQueryKey, strconv.FormatInt(o.seed, 10))
+	}
+	return res
+}
+
+// streamOptions holds the flags shaping what the service streams
+type streamOptions struct {
+	aggregation aggregationOptions
+	plugins     servicePluginOptions
+	sampling    samplingOptions
+}
+
+func (o *streamOptions) addFlags(fs *pflag.FlagSet) {
+	o.aggregation.addFlags(fs)
+	o.plugins.addFlags(fs)
+	o.sampling.addFlags(fs)
+}
+
+func (o *streamOptions) query() url.Values {
+	res := o.sampling.query()
+	for k, v := range o.aggregation.query() {
+		res[k] = v
+	}
+	return res
+}
+
+// resolveToken returns the token to authenticate to the service with.
+// The kubeconfig's credentials are never handed over to the service, since it could use them to act as the user on the API server.
+func (o *authOptions) resolveToken(kube *kubeOptions) (string, error) {
+	if o.token != "" {
+		return o.token, nil
+	}
+	if o.serviceAccount != "" {
+		cfg, err := kube.restConfig()
+		if err != nil {
+			return "", err
+		}
+		return requestServiceAccountToken(cfg, o.serviceAccount, o.audience, o.tokenTTL)
+	}
+	return "", errors.New("no token to authenticate to the service with, use --service-account or --token")
+}
+
+func newTailCommand(global *globalOptions) *cobra.Command {
+	var auth authOptions
+	var clusterFlow bool
+	var listenAddr string
+	var recordPath string
+	var processing processingOptions
+	var stream streamOptions
+	var svc serviceOptions
+
+	cmd := &cobra.Command{
+		Use:   "tail [NAMESPACE/]NAME",
+		Short: "Stream the live output of a flow or cluster flow",
+		Args:  cobra.ExactArgs(1),
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			if err := stream.plugins.validate(); err != nil {
+				return err
+			}
+			return processing.validate()
+		},
+		ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+			if len(args) > 0 {
+				return nil, cobra.ShellCompDirectiveNoFileComp
+			}
+			return completeFlows(global.kube, clusterFlow, toComplete)
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			logs := global.logs()
+			svc.applyDeprecatedNamespace(cmd.Flags(), global.kube, logs)
+
+			flowKind := internal.FKFlow
+			if clusterFlow {
+				flowKind = internal.FKClusterFlow
+			}
+			flow, err := parseFlowArg(global.kube, flowKind, args[0])
+			if err != nil {
+				log.Event(logs, "invalid flow reference", log.Error(err), log.Fields{"flow": args[0]})
+				os.Exit(1)
+			}
+
+			// exit after the deferred cleanups (registered later, so run earlier) have finished
+			exitCode := 0
+			defer func() {
+				if exitCode != 0 {
+					os.Exit(exitCode)
+				}
+			}()
+
+			processor, closeProcessor := processing.setup(logs)
+			defer closeProcessor()
+
+			var session *internal.SessionWriter
+			if recordPath != "" {
+				if session, err = internal.OpenSessionFile(recordPath); err != nil {
+					log.Event(logs, "failed to open session file for recording", log.Error(err), log.Fields{"session": recordPath})
+					exitCode = 2
+					return
+				}
+				defer func() {
+					if err := session.Close(); err != nil {
+						log.Event(logs, "failed to close session file", log.Error(err), log.Fields{"session": recordPath})
+					}
+				}()
+			}
+
+			err = tail(global.kube, svc, listenAddr, auth, stream, flow, logs, func(data []byte) error {
+				received := time.Now()
+				if session != nil {
+					if err := session.WriteFrame(internal.SessionFrame{Received: received, Flow: flow, Data: data}); err != nil {
+						log.Event(logs, "failed to record frame", log.Error(err))
+					}
+				}
+				return processor.process(data, flow, received)
+			})
+			var violation *internal.SandboxViolationError
+			switch {
+			case errors.As(err, &violation):
+				log.Event(logs, "processing aborted", log.Error(err))
+				exitCode = 2
+			case err != nil:
+				log.Event(logs, "failed to tail flow", log.Error(err), log.Fields{"flow": flow})
+				exitCode = 2
+			}
+		},
+	}
+	cmd.Flags().BoolVarP(&clusterFlow, "clusterflow", "c", false, "stream logs from a cluster flow instead of a regular flow")
+	cmd.Flags().StringVar(&listenAddr, "listen-addr", "", "address where the service accepts WebSocket listeners (bypasses the K8s API server proxy)")
+	cmd.Flags().StringVar(&recordPath, "record", "", "append every received frame to this session file for replaying later")
+	auth.addFlags(cmd.Flags())
+	svc.addFlags(cmd.Flags())
+	processing.addFlags(cmd.Flags())
+	stream.addFlags(cmd.Flags())
+	return cmd
+}
+
+// parseFlowArg parses a flow reference in the format [NAMESPACE/]NAME, using the namespace from the kubeconfig flags if not specified
+func parseFlowArg(kube *kubeOptions, kind internal.FlowKind, arg string) (flow internal.FlowReference, err error) {
+	flow.Kind = kind
+	if elts := strings.SplitN(arg, "/", 2); len(elts) == 2 {
+		flow.Namespace, flow.Name = elts[0], elts[1]
+	} else {
+		flow.Name = arg
+		if flow.Namespace, err = kube.namespace(); err != nil {
+			return
+		}
+	}
+	if flow.Namespace == "" || flow.Name == "" || strings.Contains(flow.Name, "/") {
+		return flow, fmt.Errorf("invalid flow reference %q", arg)
+	}
+	return
+}
+
+// tail connects to the service and calls handle for each received record until interrupted.
+// It returns an error if connecting fails, if the connection is closed by the service (e.g. because access was revoked) or lost, or if handle fails.
+func tail(kube *kubeOptions, svc serviceOptions, listenAddr string, auth authOptions, stream streamOptions, flow internal.FlowReference, logs log.Sink, handle func(data []byte) error) error {
+	dialer := *websocket.DefaultDialer
+	header := http.Header{}
+
+	path := pathpkg.Join("/", flow.URL())
+
+	var listenURL *url.URL
+	if listenAddr == "" {
+		cfg, err := kube.restConfig()
+		if err != nil {
+			return fmt.Errorf("failed to get kubeconfig: %w", err)
+		}
+		tlsCfg, err := rest.TLSConfigFor(cfg)
+		if err != nil {
+			return fmt.Errorf("failed to get TLS config for kubeconfig: %w", err)
+		}
+
+		dialer.TLSClientConfig = tlsCfg
+
+		// the API server proxy authenticates us with the kubeconfig's credentials
+		kubeHeaders, err := kubeconfigAuthHeaders(cfg)
+		if err != nil {
+			return fmt.Errorf("failed to get credentials from kubeconfig: %w", err)
+		}
+		for k, v := range kubeHeaders {
+			header[k] = v
+		}
+
+		listenURL, err = proxyURL(cfg, svc.namespace, "services", svc.name, true, svc.port, path)
+		if err != nil {
+			return fmt.Errorf("failed to generate K8s API server proxy URL for service %s/%s:%s: %w", svc.namespace, svc.name, svc.port, err)
+		}
+	} else {
+		var err error
+		if !strings.Contains(listenAddr, "://") {
+			listenAddr = "wss://" + listenAddr
+		}
+		listenURL, err = url.Parse(listenAddr)
+		if err != nil {
+			return fmt.Errorf("failed to parse listen address: %w", err)
+		}
+		listenURL.Path = pathpkg.Join(listenURL.Path, path)
+	}
+
+	websocketScheme(listenURL)
+	if listenURL.Scheme == "wss" && listenAddr != "" {
+		// the service generates a self-signed certificate unless it's given one
+		dialer.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+		if auth.listenCAFile != "" {
+			caCerts, err := os.ReadFile(auth.listenCAFile)
+			if err != nil {
+				return fmt.Errorf("failed to read CA file: %w", err)
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(caCerts) {
+				return fmt.Errorf("no certificates found in CA file %s", auth.listenCAFile)
+			}
+			dialer.TLSClientConfig = &tls.Config{RootCAs: pool}
+		}
+	}
+	if !auth.insecure {
+		if err := checkTokenTransport(listenURL, dialer.TLSClientConfig, listenAddr != ""); err != nil {
+			return err
+		}
+	}
+
+	authToken, err := auth.resolveToken(kube)
+	if err != nil {
+		return fmt.Errorf("failed to get token for authentication: %w", err)
+	}
+	header.Set(internal.AuthHeaderKey, authToken)
+
+	query := stream.query()
+	plugins, err := stream.plugins.resolve(func(code []byte) (string, error) {
+		// the plugin endpoint is next to the flow's path
+		endpoint := *listenURL
+		endpoint.Scheme = strings.Replace(endpoint.Scheme, "ws", "http", 1)
+		endpoint.Path = pathpkg.Join(strings.TrimSuffix(listenURL.Path, path), internal.PluginEndpoint)
+		client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: dialer.TLSClientConfig}}
+		return uploadPlugin(client, &endpoint, header, code)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to set up service plugins: %w", err)
+	}
+	if len(plugins) > 0 {
+		query[internal.PluginQueryKey] = plugins
+	}
+	listenURL.RawQuery = query.Encode()
+
+	wsConn, resp, err := dialer.DialContext(context.Background(), listenURL.String(), header)
+	if err != nil {
+		if resp != nil {
+			// the service explains why it rejected the connection (e.g. a connection limit was exceeded) in the body
+			if body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024)); len(body) > 0 {
+				err = fmt.Errorf("%w: %s", err, strings.TrimSpace(string(body)))
+			}
+		}
+		return fmt.Errorf("failed to open websocket connection to %s: %w", listenURL.Redacted(), err)
+	}
+
+	log.Event(logs, "successfully connected to service", log.V(1), log.Fields{"addr": wsConn.UnderlyingConn().RemoteAddr()})
+	if limits := resp.Header.Get(internal.RateLimitHeaderKey); limits != "" {
+		log.Event(logs, "the service limits the rate of records sent to this listener", log.V(1), log.Fields{"limits": limits})
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt)
+
+	var table *aggregateTable
+	if stream.aggregation.enabled() {
+		table = &aggregateTable{
+			fields:  stream.aggregation.fields,
+			out:     os.Stdout,
+			refresh: isTerminal(os.Stdout),
+		}
+	}
+
+	closed := make(chan error, 1)
+	go func() {
+		for {
+			msgTyp, reader, err := wsConn.NextReader()
+			if err != nil {
+				closed <- err
+				return
+			}
+			switch msgTyp {
+			case websocket.BinaryMessage:
+				data, err := io.ReadAll(reader)
+				if err != nil {
+					log.Event(logs, "failed to read record data", log.V(1), log.Error(err))
+					continue
+				}
+				log.Event(logs, "new record", log.V(2), log.Fields{"data": data})
+				if err := handle(data); err != nil {
+					deadline := time.Now().Add(5 * time.Second)
+					if err := wsConn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "processing aborted"), deadline); err != nil {
+						log.Event(logs, "an error occurred while writing close message to websocket", log.Error(err))
+					}
+					closed <- err
+					return
+				}
+			case websocket.TextMessage:
+				var msg internal.ControlMessage
+				if err := json.NewDecoder(reader).Decode(&msg); err != nil {
+					log.Event(logs, "failed to decode control message", log.V(1), log.Error(err))
+					continue
+				}
+				if msg.Type == internal.CMAggregate && table != nil {
+					if err := table.render(msg); err != nil {
+						log.Event(logs, "failed to write aggregated records", log.Error(err))
+					}
+					continue
+				}
+				authToken = handleControlMessage(wsConn, msg, authToken, auth, kube, logs)
+			}
+		}
+	}()
+
+	select {
+	case signal := <-signals:
+		log.Event(logs, "received signal", log.V(1), log.Fields{"signal": signal})
+		deadline := time.Now().Add(5 * time.Second)
+		if err := wsConn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, signal.String()), deadline); err != nil {
+			log.Event(logs, "an error occurred while writing close message to websocket", log.Error(err))
+		}
+		return nil
+	case err := <-closed:
+		var violation *internal.SandboxViolationError
+		if errors.As(err, &violation) {
+			return err
+		}
+		return fmt.Errorf("connection to service closed: %w", err)
+	}
+}
+
+// handleControlMessage handles a control message from the service and returns the token currently used for authentication
+func handleControlMessage(wsConn *websocket.Conn, msg internal.ControlMessage, authToken string, auth authOptions, kube *kubeOptions, logs log.Sink) string {
+	switch msg.Type {
+	case internal.CMExpiring:
+		if auth.token != "" {
+			log.Event(logs, "token expires soon and can't be refreshed since it was specified explicitly", log.Fields{"expires": msg.Expires})
+			return authToken
+		}
+		token, err := auth.resolveToken(kube)
+		if err != nil {
+			log.Event(logs, "failed to get new token for refreshing authentication", log.Error(err), log.Fields{"expires": msg.Expires})
+			return authToken
+		}
+		if token == authToken {
+			log.Event(logs, "token expires soon but the credentials didn't provide a new one", log.Fields{"expires": msg.Expires})
+			return authToken
+		}
+		data, err := json.Marshal(internal.ControlMessage{Type: internal.CMRefresh, Token: token})
+		if err != nil {
+			log.Event(logs, "failed to encode control message", log.Error(err))
+			return authToken
+		}
+		if err := wsConn.WriteMessage(websocket.TextMessage, data); err != nil {
+			log.Event(logs, "failed to send token refresh", log.Error(err))
+			return authToken
+		}
+		log.Event(logs, "sent token refresh", log.V(1))
+		return token
+	case internal.CMRefreshed:
+		log.Event(logs, "service accepted refreshed token", log.V(1), log.Fields{"expires": msg.Expires})
+	case internal.CMRateLimited:
+		log.Event(logs, "service dropped records because of rate limits", log.Fields{"dropped": msg.Dropped})
+	case internal.CMStatus:
+		log.Event(logs, "service skipped records because of sampling", log.V(1), log.Fields{"skipped": msg.Skipped})
+	case internal.CMRefreshFailed:
+		log.Event(logs, "service rejected refreshed token", log.Fields{"error": msg.Error})
+	default:
+		log.Event(logs, "unknown control message", log.V(1), log.Fields{"type": msg.Type})
+	}
+	return authToken
+}
+
+// websocketScheme switches the scheme of an API server URL to the matching WebSocket scheme
+func websocketScheme(u *url.URL) {
+	switch u.Scheme {
+	case "https", "":
+		u.Scheme = "wss"
+	case "http":
+		u.Scheme = "ws"
+	}
+}
+
+// checkTokenTransport returns an error unless a token can be sent to the URL safely: encrypted, to a server whose certificate is verified.
+// direct is whether the URL is the service's own (--listen-addr) rather than the API server proxy.
+func checkTokenTransport(u *url.URL, tlsCfg *tls.Config, direct bool) error {
+	if u.Scheme == "wss" && (tlsCfg == nil || !tlsCfg.InsecureSkipVerify) {
+		return nil
+	}
+	if direct {
+		if u.Scheme != "wss" {
+			return fmt.Errorf("refusing to send a token to %s over an unencrypted connection, use wss or --insecure-send-token", u.Redacted())
+		}
+		return fmt.Errorf("refusing to send a token to %s without verifying its certificate, specify the CA of the service with --listen-ca-file", u.Redacted())
+	}
+	if u.Scheme != "wss" {
+		return fmt.Errorf("refusing to send a token to %s over an unencrypted connection to the API server, use --insecure-send-token to send it anyway", u.Redacted())
+	}
+	return fmt.Errorf("refusing to send a token to %s without verifying the certificate of the API server, use --insecure-send-token to send it anyway", u.Redacted())
+}
+
+func proxyURL(cfg *rest.Config, namespace, resourceType, name string, tls bool, port string, path string) (uri *url.URL, err error) {
+	switch resourceType {
+	case "pods", "services":
+	default:
+		return nil, errors.New("invalid resource type")
+	}
+
+	uri, err = url.Parse(cfg.Host)
+	if err != nil {
+		return
+	}
+
+	apiPath := cfg.APIPath
+	if apiPath == "" {
+		apiPath = "/api/v1"
+	}
+
+	resource := name
+	if tls {
+		resource = "https:" + resource
+	}
+	if port != "" {
+		resource = resource + ":" + port
+	}
+
+	uri.Path = pathpkg.Join(apiPath, "namespaces", namespace, resourceType, resource, "proxy", path)
+
+	return
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/url"
+	"testing"
+
+	"k8s.io/client-go/rest"
+)
+
+func TestCheckTokenTransport(t *testing.T) {
+	tests := map[string]struct {
+		host   string // the API server's, or the listen address if direct
+		direct bool
+		tls    *tls.Config
+		url    string
+		err    bool
+	}{
+		"API server proxy": {
+			host: "https://api.example.com:6443",
+			url:  "wss://api.example.com:6443/api/v1/namespaces/default/services/https:log-socket:10001/proxy/flow/default/flow1",
+		},
+		"API server proxy with CA": {
+			host: "https://api.example.com:6443",
+			tls:  &tls.Config{},
+			url:  "wss://api.example.com:6443/api/v1/namespaces/default/services/https:log-socket:10001/proxy/flow/default/flow1",
+		},
+		"insecure API server": {
+			host: "https://api.example.com:6443",
+			tls:  &tls.Config{InsecureSkipVerify: true},
+			url:  "wss://api.example.com:6443/api/v1/namespaces/default/services/https:log-socket:10001/proxy/flow/default/flow1",
+			err:  true,
+		},
+		"plain HTTP API server": {
+			host: "http://localhost:8080",
+			url:  "ws://localhost:8080/api/v1/namespaces/default/services/https:log-socket:10001/proxy/flow/default/flow1",
+			err:  true,
+		},
+		"service with CA": {
+			host:   "wss://log-socket.example.com",
+			direct: true,
+			tls:    &tls.Config{},
+			url:    "wss://log-socket.example.com",
+		},
+		"service without CA": {
+			host:   "wss://log-socket.example.com",
+			direct: true,
+			tls:    &tls.Config{InsecureSkipVerify: true},
+			url:    "wss://log-socket.example.com",
+			err:    true,
+		},
+		"service without TLS": {
+			host:   "ws://log-socket.example.com",
+			direct: true,
+			url:    "ws://log-socket.example.com",
+			err:    true,
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			var u *url.URL
+			var err error
+			if test.direct {
+				u, err = url.Parse(test.host)
+			} else {
+				u, err = proxyURL(&rest.Config{Host: test.host}, "default", "services", "log-socket", true, "10001", "/flow/default/flow1")
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			websocketScheme(u)
+			if u.String() != test.url {
+				t.Errorf("expected URL %s, got %s", test.url, u)
+			}
+			if err := checkTokenTransport(u, test.tls, test.direct); test.err != (err != nil) {
+				t.Errorf("expected error: %t, got %v", test.err, err)
+			}
+		})
+	}
+}
@@ -3,15 +3,22 @@ package main
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"fmt"
 	"math/big"
 	"net"
+	"net/http"
 	"os"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/spf13/pflag"
 	authv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 
 	"github.com/banzaicloud/log-socket/internal"
@@ -29,14 +36,87 @@ func main() {
 	var serviceAddr string
 	var noTLS bool
 	var verbosity int
+	var authCacheSize int
+	var authCacheTTL time.Duration
+	var authNegativeCacheTTL time.Duration
+	var oidcCAFile string
+	var oidcCfg internal.OIDCConfig
+	var tokenReviewTimeout time.Duration
+	var tokenAudiences []string
+	var acceptAPIServerTokens bool
+	var tlsCertFile string
+	var tlsKeyFile string
+	var listenOpts internal.ListenOptions
+	var auditLogPath string
+	var connLimits internal.ConnectionLimits
+	var auditWebhookURL string
+	var ticketTTL time.Duration
+	var maxTickets int
+	var maxTicketsPerUser int
+	var pluginPolicy string
+	var pluginAllowList string
+	var pluginMaxMemory string
+	var pluginMaxUploadSize string
+	var pluginAllowUnboundedCPU bool
+	var pluginLimits internal.PluginLimits
+	var pluginMaxAbandonedCalls int
+	var pluginMaxAbandonedCallsPerUser int
+	var pluginTickInterval time.Duration
+	var pluginUploadTTL time.Duration
 	pflag.StringVar(&ingestAddr, "ingest-addr", ":10000", "local address where the service ingests logs")
 	pflag.StringVar(&serviceAddr, "service-addr", "log-socket.default.svc:10000", "remote address where the service ingests logs")
 	pflag.StringVar(&listenAddr, "listen-addr", ":10001", "address where the service accepts WebSocket listeners")
 	pflag.BoolVar(&noTLS, "no-tls", false, "listen for WebSocket connections without TLS")
+	pflag.StringVar(&tlsCertFile, "tls-cert-file", "", "file containing the TLS certificate of the listener endpoint (a certificate signed by a generated self-signed CA is used if empty)")
+	pflag.StringVar(&tlsKeyFile, "tls-key-file", "", "file containing the private key of --tls-cert-file")
 	pflag.IntVarP(&verbosity, "verbosity", "v", verbosity, "log verbosity level")
+	pflag.IntVar(&authCacheSize, "auth-cache-size", 1024, "maximum number of cached authentication results (0 disables caching)")
+	pflag.DurationVar(&authCacheTTL, "auth-cache-ttl", 2*time.Minute, "duration successful authentication results are cached for")
+	pflag.DurationVar(&authNegativeCacheTTL, "auth-negative-cache-ttl", 10*time.Second, "duration failed authentication results are cached for (0 disables caching failures)")
+	pflag.StringVar(&oidcCfg.IssuerURL, "oidc-issuer-url", "", "URL of the OpenID provider whose ID tokens are accepted (OIDC authentication is disabled if empty)")
+	pflag.StringVar(&oidcCfg.ClientID, "oidc-client-id", "", "client ID ID tokens have to be issued for (required with --oidc-issuer-url)")
+	pflag.StringVar(&oidcCfg.UsernameClaim, "oidc-username-claim", "sub", "ID token claim used as the user name")
+	pflag.StringVar(&oidcCfg.UsernamePrefix, "oidc-username-prefix", "oidc:", "prefix prepended to user names from ID tokens")
+	pflag.StringVar(&oidcCfg.GroupsClaim, "oidc-groups-claim", "", "ID token claim used as the user's groups")
+	pflag.StringVar(&oidcCfg.GroupsPrefix, "oidc-groups-prefix", "oidc:", "prefix prepended to groups from ID tokens")
+	pflag.StringVar(&oidcCAFile, "oidc-ca-file", "", "file containing the CA certificates used to verify the OpenID provider's certificate (the system's CAs are used if empty)")
+	pflag.DurationVar(&tokenReviewTimeout, "token-review-timeout", 10*time.Second, "timeout for token reviews")
+	pflag.StringSliceVar(&tokenAudiences, "token-audiences", []string{internal.TokenAudience}, "audiences service account tokens have to be issued for")
+	pflag.BoolVar(&acceptAPIServerTokens, "accept-api-server-tokens", true, "also accept tokens issued for the API server (e.g. kubeconfig credentials, which listeners then have to hand over to the service; deprecated, will default to false in the next release)")
+	pflag.StringVar(&auditLogPath, "audit-log-path", "", "file the audit trail of listeners is appended to as JSON lines (\"-\" means stderr)")
+	pflag.StringVar(&auditWebhookURL, "audit-webhook-url", "", "URL batches of audit events are posted to as JSON arrays")
+	pflag.IntVar(&connLimits.MaxListeners, "max-listeners", 0, "maximum number of concurrent listeners (0 means unlimited)")
+	pflag.IntVar(&connLimits.MaxListenersPerUser, "max-listeners-per-user", 0, "maximum number of concurrent listeners of a single user (0 means unlimited)")
+	pflag.IntVar(&connLimits.MaxListenersPerFlow, "max-listeners-per-flow", 0, "maximum number of concurrent listeners of a single flow (0 means unlimited)")
+	pflag.Float64Var(&listenOpts.RateLimits.RecordsPerSecond, "listener-records-per-second", 0, "maximum number of records sent to a listener per second, excess records are dropped (0 means unlimited)")
+	pflag.Float64Var(&listenOpts.RateLimits.BytesPerSecond, "listener-bytes-per-second", 0, "maximum number of bytes sent to a listener per second, excess records are dropped (0 means unlimited)")
+	pflag.BoolVar(&listenOpts.AllowTokenInQuery, "allow-token-in-query", true, "accept auth tokens in the URL query string of WebSocket connections (deprecated, use connection tickets instead; will default to false in the next release)")
+	pflag.DurationVar(&listenOpts.RevalidationInterval, "revalidation-interval", 5*time.Minute, "how often the tokens of connected listeners are authenticated again (0 disables revalidation)")
+	pflag.DurationVar(&ticketTTL, "ticket-ttl", 30*time.Second, "duration connection tickets are valid for (0 disables issuing tickets)")
+	pflag.IntVar(&maxTickets, "max-tickets", 10000, "maximum number of outstanding connection tickets (0 means unlimited)")
+	pflag.IntVar(&maxTicketsPerUser, "max-tickets-per-user", 100, "maximum number of outstanding connection tickets of a single user (0 means unlimited)")
+	pflag.StringSliceVar(&listenOpts.TicketOrigins, "ticket-allowed-origins", nil, "origins of the web pages allowed to request connection tickets from browsers (e.g. https://logs.example.com)")
+	pflag.StringVar(&pluginPolicy, "listener-plugins", string(internal.LPPDisabled), fmt.Sprintf("which WASM plugins listeners can run on the service (one of %v)", internal.ListenerPluginPolicies))
+	pflag.StringVar(&pluginAllowList, "plugin-allow-list", "", "NAMESPACE/NAME of the ConfigMap whose binary data holds the plugins listeners can run, keyed by their names")
+	pflag.BoolVar(&pluginAllowUnboundedCPU, "listener-plugin-allow-unbounded-cpu", false, "let listeners upload plugins with --listener-plugins=any even though the runtime can't bound their CPU use (only for clusters whose users are trusted not to upload plugins that don't return)")
+	pflag.StringVar(&pluginMaxMemory, "listener-plugin-max-memory", "64Mi", "maximum memory of each plugin instance of a listener (0 means unlimited)")
+	pflag.BoolVar(&pluginLimits.RequireBoundedMemory, "listener-plugin-require-bounded-memory", true, "reject plugins whose memory could grow beyond --listener-plugin-max-memory during a call (plugins that neither import their memory nor declare a maximum size within it)")
+	pflag.DurationVar(&pluginLimits.Timeout, "listener-plugin-timeout", 100*time.Millisecond, "maximum duration of a call into a plugin of a listener, after which the listener is disconnected (0 means unlimited); calls can't be interrupted, so a plugin that doesn't return keeps using a CPU")
+	pflag.IntVar(&pluginMaxAbandonedCalls, "listener-plugin-max-abandoned-calls", 4, "maximum number of calls into plugins that exceeded --listener-plugin-timeout and are still running, after which listeners can't run plugins until some return (0 means unlimited)")
+	pflag.IntVar(&pluginMaxAbandonedCallsPerUser, "listener-plugin-max-abandoned-calls-per-user", 1, "maximum number of calls into the plugins of a single user that exceeded --listener-plugin-timeout and are still running (0 means unlimited)")
+	pflag.DurationVar(&pluginTickInterval, "listener-plugin-tick-interval", time.Second, "how often the plugins of listeners exporting tick are ticked (0 disables ticking)")
+	pflag.StringVar(&pluginMaxUploadSize, "max-plugin-upload-size", "16Mi", "maximum size of the plugins listeners upload (0 means unlimited)")
+	pflag.DurationVar(&pluginUploadTTL, "plugin-upload-ttl", 10*time.Minute, "duration uploaded plugins are kept for")
 	pflag.Parse()
 
-	var logs log.Sink = log.WithVerbosityFilter(log.NewWriterSink(os.Stdout), verbosity)
+	var logs log.Sink = log.WithVerbosityFilter(log.WithRedaction(log.NewWriterSink(os.Stdout), log.DefaultRedactor()), verbosity)
+
+	if acceptAPIServerTokens {
+		log.Event(logs, "accepting tokens issued for the API server is deprecated and will be disabled by default in the next release: issue tokens for one of --token-audiences instead (e.g. with k8stail --service-account), or --accept-api-server-tokens=false to disable it now")
+	}
+	if listenOpts.AllowTokenInQuery {
+		log.Event(logs, "accepting tokens in the query string of WebSocket connections is deprecated and will be disabled by default in the next release: use connection tickets instead, or --allow-token-in-query=false to disable it now")
+	}
 
 	metrics := internal.NewMetrics(logs)
 
@@ -46,7 +126,18 @@ func main() {
 
 	var tlsConfig *tls.Config
 
-	if !noTLS {
+	if !noTLS && tlsCertFile != "" {
+		tlsCert, err := tls.LoadX509KeyPair(tlsCertFile, tlsKeyFile)
+		if err != nil {
+			log.Event(logs, "failed to load TLS certificate", log.Error(err), log.Fields{"cert": tlsCertFile, "key": tlsKeyFile})
+			return
+		}
+		tlsConfig = &tls.Config{
+			Certificates: []tls.Certificate{
+				tlsCert,
+			},
+		}
+	} else if !noTLS {
 		caCert, caKey, err := tlstools.GenerateSelfSignedCA()
 		if err != nil {
 			log.Event(logs, "failed to generate self-signed CA", log.Error(err))
@@ -78,6 +169,10 @@ func main() {
 		log.Event(logs, "an error occurred while adding API group to scheme", log.Error(err), log.Fields{"group": authv1.SchemeGroupVersion, "scheme": s})
 		return
 	}
+	if err := corev1.AddToScheme(s); err != nil {
+		log.Event(logs, "an error occurred while adding API group to scheme", log.Error(err), log.Fields{"group": corev1.SchemeGroupVersion, "scheme": s})
+		return
+	}
 	cfg, err := ctrl.GetConfig()
 	if err != nil {
 		log.Event(logs, "an error occurred while loading kubeconfig", log.Error(err))
@@ -93,7 +188,96 @@ func main() {
 		serviceAddr = "http://" + serviceAddr
 	}
 
-	authenticator := internal.TokenReviewAuthenticator{Client: c}
+	var authenticator internal.Authenticator = internal.TokenReviewAuthenticator{Audiences: tokenAudiences, Client: c, Timeout: tokenReviewTimeout}
+	if acceptAPIServerTokens {
+		authenticator = internal.ChainAuthenticator{authenticator, internal.TokenReviewAuthenticator{Client: c, Timeout: tokenReviewTimeout}}
+	}
+	if oidcCfg.IssuerURL != "" {
+		if oidcCfg.ClientID == "" {
+			log.Event(logs, "--oidc-client-id is required with --oidc-issuer-url")
+			return
+		}
+		if oidcCAFile != "" {
+			caCerts, err := os.ReadFile(oidcCAFile)
+			if err != nil {
+				log.Event(logs, "an error occurred while reading OIDC CA file", log.Error(err), log.Fields{"file": oidcCAFile})
+				return
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(caCerts) {
+				log.Event(logs, "no certificates found in OIDC CA file", log.Fields{"file": oidcCAFile})
+				return
+			}
+			oidcCfg.HTTPClient = &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+		}
+		authenticator = internal.ChainAuthenticator{internal.NewOIDCAuthenticator(oidcCfg), authenticator}
+	}
+	if authCacheSize > 0 {
+		authenticator = internal.NewCachingAuthenticator(authenticator, authCacheTTL, authNegativeCacheTTL, authCacheSize)
+	}
+	var auditSinks internal.MultiAuditSink
+	if auditLogPath != "" {
+		sink, err := internal.OpenAuditFile(auditLogPath, logs)
+		if err != nil {
+			log.Event(logs, "an error occurred while opening audit log", log.Error(err), log.Fields{"file": auditLogPath})
+			return
+		}
+		auditSinks = append(auditSinks, sink)
+	}
+	if auditWebhookURL != "" {
+		auditSinks = append(auditSinks, internal.NewWebhookAuditSink(auditWebhookURL, nil, logs))
+	}
+	if len(auditSinks) > 0 {
+		listenOpts.Audit = auditSinks
+	}
+	if connLimits != (internal.ConnectionLimits{}) {
+		listenOpts.Connections = internal.NewConnectionLimiter(connLimits)
+	}
+	if ticketTTL > 0 {
+		listenOpts.Tickets = internal.NewTicketStore(ticketTTL, maxTickets, maxTicketsPerUser)
+	}
+	policy, err := internal.ParseListenerPluginPolicy(pluginPolicy)
+	if err != nil {
+		log.Event(logs, "invalid listener plugin policy", log.Error(err))
+		return
+	}
+	if policy != internal.LPPDisabled {
+		maxMemory, err := resource.ParseQuantity(pluginMaxMemory)
+		if err != nil {
+			log.Event(logs, "invalid listener plugin memory limit", log.Error(err), log.Fields{"limit": pluginMaxMemory})
+			return
+		}
+		pluginLimits.MaxMemory = uint64(maxMemory.Value())
+		if policy == internal.LPPAny && pluginLimits.Timeout <= 0 {
+			log.Event(logs, "running uploaded plugins requires --listener-plugin-timeout")
+			return
+		}
+		// calls that time out can't be interrupted, so a plugin that doesn't return keeps using a CPU until the service restarts
+		if policy == internal.LPPAny && !pluginAllowUnboundedCPU {
+			log.Event(logs, "the CPU use of uploaded plugins can't be bounded, so running them requires --listener-plugin-allow-unbounded-cpu (use --listener-plugins=allow-list to run only reviewed plugins)")
+			return
+		}
+		maxUploadSize, err := resource.ParseQuantity(pluginMaxUploadSize)
+		if err != nil {
+			log.Event(logs, "invalid maximum plugin upload size", log.Error(err), log.Fields{"size": pluginMaxUploadSize})
+			return
+		}
+		var allowList internal.PluginAllowList
+		if pluginAllowList != "" {
+			namespace, name, ok := strings.Cut(pluginAllowList, "/")
+			if !ok || namespace == "" || name == "" {
+				log.Event(logs, "invalid plugin allow-list, it must be NAMESPACE/NAME of a ConfigMap", log.Fields{"allowList": pluginAllowList})
+				return
+			}
+			allowList = internal.NewConfigMapPluginAllowList(c, types.NamespacedName{Namespace: namespace, Name: name})
+		}
+		listenOpts.Plugins = internal.NewListenerPlugins(policy, allowList, pluginLimits)
+		listenOpts.Plugins.MaxAbandonedCalls = pluginMaxAbandonedCalls
+		listenOpts.Plugins.MaxAbandonedCallsPerUser = pluginMaxAbandonedCallsPerUser
+		listenOpts.Plugins.MaxUploadSize = maxUploadSize.Value()
+		listenOpts.Plugins.TickInterval = pluginTickInterval
+		listenOpts.Plugins.UploadTTL = pluginUploadTTL
+	}
 
 	go func() {
 		rec := reconciler.New(serviceAddr, c)
@@ -122,7 +306,7 @@ func main() {
 		defer wg.Done()
 		defer stopLatch.Close()
 
-		internal.Listen(listenAddr, tlsConfig, listenerReg, logs, metrics, stopSignal, nil, authenticator)
+		internal.Listen(listenAddr, tlsConfig, listenerReg, logs, metrics, stopSignal, nil, authenticator, listenOpts)
 	}()
 	wg.Add(1)
 	go func() {
@@ -178,6 +362,10 @@ func main() {
 	reconcileEventChannel <- internal.ReconcileEvent{}
 
 	wg.Wait()
+
+	if err := auditSinks.Close(); err != nil {
+		log.Event(logs, "an error occurred while closing audit sinks", log.Error(err))
+	}
 }
 
 func gatherListenerEvents(ev internal.ListenerEvent, ch <-chan internal.ListenerEvent) (listenersToAdd []internal.Listener, listenersToRemove []internal.Listener) {
@@ -0,0 +1,145 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// query parameters listeners can request aggregation with
+const (
+	AggregateQueryKey = "aggregate"
+	WindowQueryKey    = "window"
+)
+
+const defaultAggregationWindow = 10 * time.Second
+
+// AggregationOptions specifies how records are counted instead of being sent to a listener
+type AggregationOptions struct {
+	// GroupBy are the fields records are grouped by (aggregation is disabled if empty)
+	GroupBy []FieldPath
+	// Window is the length of the tumbling windows records are counted in
+	Window time.Duration
+}
+
+func (o AggregationOptions) Enabled() bool {
+	return len(o.GroupBy) > 0
+}
+
+// ParseAggregationOptions parses aggregation options from the query parameters of a listener's request, e.g.
+//
+//	?aggregate=kubernetes.pod_name,level&window=10s
+func ParseAggregationOptions(query url.Values) (res AggregationOptions, err error) {
+	res.Window = defaultAggregationWindow
+	if s := query.Get(AggregateQueryKey); s != "" {
+		for _, field := range strings.Split(s, ",") {
+			if field = strings.TrimSpace(field); field == "" {
+				return res, fmt.Errorf("invalid %s parameter %q: empty field", AggregateQueryKey, s)
+			}
+			res.GroupBy = append(res.GroupBy, ParseFieldPath(field))
+		}
+	}
+	if s := query.Get(WindowQueryKey); s != "" {
+		if res.Window, err = time.ParseDuration(s); err != nil || res.Window < time.Second {
+			return res, fmt.Errorf("invalid %s parameter %q: must be a duration of at least 1s", WindowQueryKey, s)
+		}
+	}
+	return res, nil
+}
+
+// AggregateRow is the number of records in a window having the same values of the grouping fields
+type AggregateRow struct {
+	Group map[string]string `json:"group"`
+	Count uint64            `json:"count"`
+}
+
+func newAggregator(opts AggregationOptions) *aggregator {
+	return &aggregator{
+		opts: opts,
+		rows: make(map[string]*AggregateRow),
+	}
+}
+
+type aggregator struct {
+	opts  AggregationOptions
+	mutex sync.Mutex
+	rows  map[string]*AggregateRow
+}
+
+// add counts the record in the current window
+func (a *aggregator) add(data []byte) error {
+	obj, err := decodeJSONObject(data)
+	if err != nil {
+		return err
+	}
+	values := make([]string, len(a.opts.GroupBy))
+	for i, field := range a.opts.GroupBy {
+		values[i] = groupValue(field.Get(obj))
+	}
+	key := strings.Join(values, "\x00")
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	row, ok := a.rows[key]
+	if !ok {
+		row = &AggregateRow{Group: make(map[string]string, len(values))}
+		for i, field := range a.opts.GroupBy {
+			row.Group[field.String()] = values[i]
+		}
+		a.rows[key] = row
+	}
+	row.Count++
+	return nil
+}
+
+// window returns the bounds of the window now is in: windows are aligned to multiples of their length since the zero time, so they start at the same times for all listeners
+func (a *aggregator) window(now time.Time) (start, end time.Time) {
+	start = now.Truncate(a.opts.Window)
+	return start, start.Add(a.opts.Window)
+}
+
+// flush returns the rows of the current window, ordered by decreasing count, and starts a new window
+func (a *aggregator) flush() []AggregateRow {
+	a.mutex.Lock()
+	rows := a.rows
+	a.rows = make(map[string]*AggregateRow)
+	a.mutex.Unlock()
+
+	keys := make([]string, 0, len(rows))
+	for k := range rows {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if ci, cj := rows[keys[i]].Count, rows[keys[j]].Count; ci != cj {
+			return ci > cj
+		}
+		return keys[i] < keys[j]
+	})
+	res := make([]AggregateRow, len(keys))
+	for i, k := range keys {
+		res[i] = *rows[k]
+	}
+	return res
+}
+
+func groupValue(v interface{}, ok bool) string {
+	switch v := v.(type) {
+	case nil:
+		if ok {
+			return "null"
+		}
+		return ""
+	case string:
+		return v
+	default:
+		data, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Sprint(v)
+		}
+		return string(data)
+	}
+}
@@ -0,0 +1,121 @@
+package internal
+
+import (
+	"fmt"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestAggregationWindow(t *testing.T) {
+	base := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		window time.Duration
+		now    time.Time
+		start  time.Time
+	}{
+		{window: 10 * time.Second, now: base, start: base},
+		{window: 10 * time.Second, now: base.Add(time.Nanosecond), start: base},
+		{window: 10 * time.Second, now: base.Add(10*time.Second - time.Nanosecond), start: base},
+		// the end of a window is the start of the next one
+		{window: 10 * time.Second, now: base.Add(10 * time.Second), start: base.Add(10 * time.Second)},
+		{window: time.Minute, now: base.Add(90 * time.Second), start: base.Add(time.Minute)},
+		// windows are aligned to multiples of their length since the zero time, not to the minute
+		{window: 7 * time.Second, now: base, start: base.Add(-4 * time.Second)},
+		{window: 7 * time.Second, now: base.Add(3 * time.Second), start: base.Add(3 * time.Second)},
+	}
+	for _, test := range tests {
+		start, end := newAggregator(AggregationOptions{Window: test.window}).window(test.now)
+		if !start.Equal(test.start) || !end.Equal(test.start.Add(test.window)) {
+			t.Errorf("expected the %s window of %s to be %s - %s, got %s - %s", test.window, test.now, test.start, test.start.Add(test.window), start, end)
+		}
+	}
+}
+
+func TestAggregator(t *testing.T) {
+	a := newAggregator(AggregationOptions{GroupBy: []FieldPath{ParseFieldPath("kubernetes.pod_name"), ParseFieldPath("level")}, Window: time.Second})
+	add := func(records ...string) {
+		for _, r := range records {
+			if err := a.add([]byte(r)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	rows := func() string {
+		var res string
+		for _, row := range a.flush() {
+			res += fmt.Sprintf("%s/%s=%d ", row.Group["kubernetes.pod_name"], row.Group["level"], row.Count)
+		}
+		return res
+	}
+
+	add(
+		`{"kubernetes":{"pod_name":"a"},"level":"info"}`,
+		`{"kubernetes":{"pod_name":"b"},"level":"info"}`,
+		`{"kubernetes":{"pod_name":"a"},"level":"info"}`,
+		`{"kubernetes":{"pod_name":"a"},"level":"error"}`,
+		// missing fields are empty, null and other values are JSON encoded
+		`{"kubernetes":{"pod_name":"a"}}`,
+		`{"kubernetes":{"pod_name":"a"},"level":null}`,
+		`{"kubernetes":{"pod_name":"a"},"level":3}`,
+		`{"kubernetes":{"pod_name":"a"},"level":3}`,
+	)
+	if err := a.add([]byte("not json")); err == nil {
+		t.Error("expected a record that isn't a JSON object to be rejected")
+	}
+	// ordered by decreasing count, then by group
+	if expected, actual := "a/3=2 a/info=2 a/=1 a/error=1 a/null=1 b/info=1 ", rows(); actual != expected {
+		t.Errorf("expected rows %q, got %q", expected, actual)
+	}
+
+	// records added after the end of a window are counted in the next one
+	if actual := rows(); actual != "" {
+		t.Errorf("expected no rows in an empty window, got %q", actual)
+	}
+	add(`{"kubernetes":{"pod_name":"b"},"level":"info"}`)
+	if expected, actual := "b/info=1 ", rows(); actual != expected {
+		t.Errorf("expected rows %q, got %q", expected, actual)
+	}
+}
+
+func TestParseAggregationOptions(t *testing.T) {
+	tests := map[string]struct {
+		query   string
+		groupBy string
+		window  time.Duration
+		err     bool
+	}{
+		"disabled":       {query: "", window: defaultAggregationWindow},
+		"fields":         {query: "aggregate=kubernetes.pod_name,+level", groupBy: "[kubernetes.pod_name level]", window: defaultAggregationWindow},
+		"window":         {query: "aggregate=level&window=1m", groupBy: "[level]", window: time.Minute},
+		"shortest":       {query: "aggregate=level&window=1s", groupBy: "[level]", window: time.Second},
+		"too short":      {query: "aggregate=level&window=999ms", err: true},
+		"invalid window": {query: "aggregate=level&window=soon", err: true},
+		"empty field":    {query: "aggregate=level,,pod", err: true},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			query, err := url.ParseQuery(test.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			opts, err := ParseAggregationOptions(query)
+			if test.err {
+				if err == nil {
+					t.Errorf("expected an error, got %+v", opts)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			groupBy := ""
+			if opts.GroupBy != nil {
+				groupBy = fmt.Sprint(opts.GroupBy)
+			}
+			if groupBy != test.groupBy || opts.Window != test.window || opts.Enabled() != (test.groupBy != "") {
+				t.Errorf("expected %s grouped by %s, got %+v", test.window, test.groupBy, opts)
+			}
+		})
+	}
+}
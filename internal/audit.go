@@ -0,0 +1,277 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"go.uber.org/multierr"
+	authv1 "k8s.io/api/authentication/v1"
+
+	"github.com/banzaicloud/log-socket/log"
+)
+
+type AuditEventType string
+
+const (
+	AuditListenerAccepted     AuditEventType = "listener-accepted"
+	AuditListenerRejected     AuditEventType = "listener-rejected"
+	AuditListenerDisconnected AuditEventType = "listener-disconnected"
+	AuditPolicyDecision       AuditEventType = "policy-decision"
+)
+
+// AuditEvent is an entry of the audit trail of who tailed which flow and what they saw
+type AuditEvent struct {
+	Time time.Time      `json:"time"`
+	Type AuditEventType `json:"type"`
+
+	User         string   `json:"user,omitempty"`
+	Groups       []string `json:"groups,omitempty"`
+	SourceIP     string   `json:"sourceIP,omitempty"`
+	ForwardedFor string   `json:"forwardedFor,omitempty"`
+	Flow         string   `json:"flow,omitempty"`
+	// Filter holds the query parameters the listener connected with (without credentials)
+	Filter url.Values `json:"filter,omitempty"`
+	// Reason is why the listener was rejected or disconnected
+	Reason string `json:"reason,omitempty"`
+
+	// Connected is when the listener connected (for disconnects)
+	Connected         *time.Time `json:"connected,omitempty"`
+	RecordsAggregated uint64     `json:"recordsAggregated,omitempty"`
+	RecordsDropped    uint64     `json:"recordsDropped,omitempty"`
+	RecordsSent       uint64     `json:"recordsSent,omitempty"`
+	RecordsRedacted   uint64     `json:"recordsRedacted,omitempty"`
+	RecordsSkipped    uint64     `json:"recordsSkipped,omitempty"`
+
+	// Pod and Decision describe the outcome of evaluating the RBAC policy of a pod's records for the listener
+	Pod      string `json:"pod,omitempty"`
+	Decision policy `json:"decision,omitempty"`
+}
+
+// AuditSink receives audit events; implementations must be safe for concurrent use
+type AuditSink interface {
+	Audit(AuditEvent)
+}
+
+// MultiAuditSink passes audit events to each of its sinks
+type MultiAuditSink []AuditSink
+
+func (m MultiAuditSink) Audit(e AuditEvent) {
+	for _, s := range m {
+		s.Audit(e)
+	}
+}
+
+// Close closes the sinks that can be closed (e.g. to flush pending events)
+func (m MultiAuditSink) Close() (err error) {
+	for _, s := range m {
+		if c, ok := s.(io.Closer); ok {
+			err = multierr.Append(err, c.Close())
+		}
+	}
+	return
+}
+
+type nopAuditSink struct{}
+
+func (nopAuditSink) Audit(AuditEvent) {}
+
+// NewJSONAuditSink returns an audit sink that writes events to w as JSON lines
+func NewJSONAuditSink(w io.Writer, logs log.Sink) *JSONAuditSink {
+	return &JSONAuditSink{
+		logs:    logs,
+		encoder: json.NewEncoder(w),
+	}
+}
+
+type JSONAuditSink struct {
+	closer  io.Closer
+	encoder *json.Encoder
+	logs    log.Sink
+	mutex   sync.Mutex
+}
+
+// Close closes the file the sink was opened with (see OpenAuditFile)
+func (s *JSONAuditSink) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closer == nil {
+		return nil
+	}
+	err := s.closer.Close()
+	s.closer = nil
+	return err
+}
+
+func (s *JSONAuditSink) Audit(e AuditEvent) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := s.encoder.Encode(e); err != nil {
+		log.Event(s.logs, "failed to write audit event", log.Error(err), log.Fields{"event": e})
+	}
+}
+
+// OpenAuditFile returns an audit sink appending events to the specified file ("-" means stderr, keeping them apart from the logs on stdout)
+func OpenAuditFile(path string, logs log.Sink) (*JSONAuditSink, error) {
+	if path == "-" {
+		return NewJSONAuditSink(os.Stderr, logs), nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	s := NewJSONAuditSink(f, logs)
+	s.closer = f
+	return s, nil
+}
+
+const (
+	webhookAuditBatchSize  = 100
+	webhookAuditBufferSize = 10000
+	webhookAuditInterval   = time.Second
+	webhookAuditTimeout    = 10 * time.Second
+)
+
+// NewWebhookAuditSink returns an audit sink that posts batches of events to the specified URL as JSON arrays.
+// Events are sent asynchronously; if the webhook can't keep up, events are dropped (and logged) instead of blocking listeners.
+// If client is nil, a client with a timeout of webhookAuditTimeout is used.
+func NewWebhookAuditSink(url string, client *http.Client, logs log.Sink) *WebhookAuditSink {
+	if client == nil {
+		client = &http.Client{Timeout: webhookAuditTimeout}
+	}
+	s := &WebhookAuditSink{
+		Client: client,
+		URL:    url,
+
+		closing: make(chan struct{}),
+		done:    make(chan struct{}),
+		events:  make(chan AuditEvent, webhookAuditBufferSize),
+		logs:    logs,
+	}
+	go s.run()
+	return s
+}
+
+type WebhookAuditSink struct {
+	Client *http.Client
+	URL    string
+
+	closeOnce sync.Once
+	closing   chan struct{}
+	done      chan struct{}
+	events    chan AuditEvent
+	logs      log.Sink
+}
+
+// Close sends the pending events and stops the sink; events audited afterwards are dropped
+func (s *WebhookAuditSink) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.closing)
+	})
+	<-s.done
+	return nil
+}
+
+func (s *WebhookAuditSink) Audit(e AuditEvent) {
+	select {
+	case s.events <- e:
+	default:
+		log.Event(s.logs, "audit webhook buffer is full, dropping audit event", log.Fields{"event": e})
+	}
+}
+
+func (s *WebhookAuditSink) run() {
+	defer close(s.done)
+	ticker := time.NewTicker(webhookAuditInterval)
+	defer ticker.Stop()
+	var batch []AuditEvent
+	for {
+		select {
+		case e := <-s.events:
+			batch = append(batch, e)
+			if len(batch) < webhookAuditBatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		case <-s.closing:
+			// send the buffered events along with the pending batch
+			for len(s.events) > 0 {
+				batch = append(batch, <-s.events)
+				if len(batch) == webhookAuditBatchSize {
+					s.send(batch)
+					batch = nil
+				}
+			}
+			if len(batch) > 0 {
+				s.send(batch)
+			}
+			return
+		}
+		s.send(batch)
+		batch = nil
+	}
+}
+
+func (s *WebhookAuditSink) send(batch []AuditEvent) {
+	if err := s.post(batch); err != nil {
+		log.Event(s.logs, "failed to send audit events to webhook", log.Error(err), log.Fields{"url": s.URL, "events": batch})
+	}
+}
+
+func (s *WebhookAuditSink) post(batch []AuditEvent) error {
+	data, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+	resp, err := s.Client.Post(s.URL, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// newRequestAuditEvent returns an audit event describing the listener connection request
+func newRequestAuditEvent(typ AuditEventType, r *http.Request, flow FlowReference, usrInfo authv1.UserInfo) AuditEvent {
+	e := AuditEvent{
+		Time:         time.Now(),
+		Type:         typ,
+		User:         usrInfo.Username,
+		Groups:       usrInfo.Groups,
+		ForwardedFor: r.Header.Get("X-Forwarded-For"),
+		Filter:       listenerFilter(r.URL.Query()),
+	}
+	if flow != (FlowReference{}) {
+		e.Flow = flow.URL()
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		e.SourceIP = host
+	} else {
+		e.SourceIP = r.RemoteAddr
+	}
+	return e
+}
+
+// listenerFilter returns the query parameters without credentials
+func listenerFilter(query url.Values) url.Values {
+	delete(query, AuthQueryKey)
+	delete(query, TicketQueryKey)
+	if len(query) == 0 {
+		return nil
+	}
+	return query
+}
@@ -1,28 +1,164 @@
 package internal
 
 import (
+	"container/list"
 	"context"
+	"crypto/sha256"
+	"sync"
+	"time"
 
+	"go.uber.org/multierr"
 	authv1 "k8s.io/api/authentication/v1"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
 type TokenReviewAuthenticator struct {
-	Client client.Client `json:"client" yaml:"client"` //this is a client
+	// Audiences the token has to be issued for (any audience accepted by the API server if empty)
+	Audiences []string      `json:"audiences,omitempty" yaml:"audiences,omitempty"`
+	Client    client.Client `json:"client" yaml:"client"` //this is a client
+	Timeout   time.Duration `json:"timeout" yaml:"timeout"`
 }
 
-func (t TokenReviewAuthenticator) Authenticate(token string) (res authv1.UserInfo, err error) {
-	tr := authv1.TokenReview{Spec: authv1.TokenReviewSpec{Token: token}}
-	if err = t.Client.Create(context.Background(), &tr); err != nil {
+func (t TokenReviewAuthenticator) Authenticate(ctx context.Context, token string) (res authv1.UserInfo, err error) {
+	if t.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.Timeout)
+		defer cancel()
+	}
+	tr := authv1.TokenReview{Spec: authv1.TokenReviewSpec{Token: token, Audiences: t.Audiences}}
+	if err = t.Client.Create(ctx, &tr); err != nil {
 		return res, err
 	}
 	if !tr.Status.Authenticated {
 		return res, unauthenticatedError{}
 	}
+	// authenticators that aren't aware of audiences return none, so the token isn't known to be issued for us
+	if len(t.Audiences) > 0 && !intersects(tr.Status.Audiences, t.Audiences) {
+		return res, unauthenticatedError{}
+	}
 
 	return tr.Status.User, nil
 }
 
+// ChainAuthenticator tries each authenticator in order and returns the result of the first one that authenticates the token.
+// If none of them do, an unauthenticated error is returned, unless an authenticator failed for some other reason.
+type ChainAuthenticator []Authenticator
+
+func (c ChainAuthenticator) Authenticate(ctx context.Context, token string) (res authv1.UserInfo, err error) {
+	var errs error
+	for _, a := range c {
+		res, err := a.Authenticate(ctx, token)
+		if err == nil {
+			return res, nil
+		}
+		if !IsUnauthenticatedError(err) {
+			errs = multierr.Append(errs, err)
+		}
+	}
+	if errs != nil {
+		return res, errs
+	}
+	return res, unauthenticatedError{}
+}
+
+// NewCachingAuthenticator returns an authenticator that caches the results of the specified authenticator, keyed by the hash of the token.
+// Successful authentications are cached for ttl (but not beyond the expiry of JWTs), failed ones for negativeTTL (if positive).
+// At most size entries are kept, evicting the least recently used ones.
+func NewCachingAuthenticator(authenticator Authenticator, ttl time.Duration, negativeTTL time.Duration, size int) *CachingAuthenticator {
+	return &CachingAuthenticator{
+		Authenticator: authenticator,
+		NegativeTTL:   negativeTTL,
+		Size:          size,
+		TTL:           ttl,
+
+		entries: make(map[[sha256.Size]byte]*list.Element),
+		lru:     list.New(),
+		now:     time.Now,
+	}
+}
+
+type CachingAuthenticator struct {
+	Authenticator Authenticator
+	NegativeTTL   time.Duration
+	Size          int
+	TTL           time.Duration
+
+	entries map[[sha256.Size]byte]*list.Element
+	lru     *list.List
+	mutex   sync.Mutex
+	now     func() time.Time
+}
+
+type authCacheEntry struct {
+	expires time.Time
+	key     [sha256.Size]byte
+	usrInfo authv1.UserInfo
+	unauth  bool
+}
+
+func (c *CachingAuthenticator) Authenticate(ctx context.Context, token string) (authv1.UserInfo, error) {
+	key := sha256.Sum256([]byte(token))
+	if entry, ok := c.lookup(key); ok {
+		if entry.unauth {
+			return authv1.UserInfo{}, unauthenticatedError{}
+		}
+		return entry.usrInfo, nil
+	}
+
+	usrInfo, err := c.Authenticator.Authenticate(ctx, token)
+	switch {
+	case err == nil:
+		expires := c.now().Add(c.TTL)
+		// don't keep authenticating the token once it expired
+		if exp, ok := tokenExpiry(token); ok && exp.Before(expires) {
+			expires = exp
+		}
+		c.store(authCacheEntry{expires: expires, key: key, usrInfo: usrInfo})
+	case IsUnauthenticatedError(err) && c.NegativeTTL > 0:
+		c.store(authCacheEntry{expires: c.now().Add(c.NegativeTTL), key: key, unauth: true})
+	}
+	return usrInfo, err
+}
+
+func (c *CachingAuthenticator) lookup(key [sha256.Size]byte) (authCacheEntry, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return authCacheEntry{}, false
+	}
+	entry := elem.Value.(authCacheEntry)
+	if !c.now().Before(entry.expires) {
+		c.lru.Remove(elem)
+		delete(c.entries, key)
+		return authCacheEntry{}, false
+	}
+	c.lru.MoveToFront(elem)
+	return entry, true
+}
+
+func (c *CachingAuthenticator) store(entry authCacheEntry) {
+	if c.Size <= 0 {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if elem, ok := c.entries[entry.key]; ok {
+		elem.Value = entry
+		c.lru.MoveToFront(elem)
+		return
+	}
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.Size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(authCacheEntry).key)
+	}
+}
+
 type unauthenticatedError struct{}
 
 func (unauthenticatedError) Error() string {
@@ -32,3 +168,14 @@ func (unauthenticatedError) Error() string {
 func (unauthenticatedError) IsUnauthenticatedError() bool {
 	return true
 }
+
+func intersects(a, b []string) bool {
+	for _, x := range a {
+		for _, y := range b {
+			if x == y {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,56 @@
+package internal
+
+import (
+	"context"
+	"encoding/base64"
+	"testing"
+	"time"
+
+	authv1 "k8s.io/api/authentication/v1"
+)
+
+type countingAuthenticator int
+
+func (c *countingAuthenticator) Authenticate(context.Context, string) (authv1.UserInfo, error) {
+	*c++
+	return authv1.UserInfo{Username: "alice"}, nil
+}
+
+func TestCachingAuthenticatorTokenExpiry(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	var calls countingAuthenticator
+	c := NewCachingAuthenticator(&calls, time.Hour, 0, 10)
+	c.now = func() time.Time { return now }
+
+	payload := base64.RawURLEncoding.EncodeToString([]byte(`{"exp":1700000060}`))
+	jwt := "e30." + payload + ".sig"
+	for _, token := range []string{jwt, "opaque"} {
+		if _, err := c.Authenticate(context.Background(), token); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if calls != 2 {
+		t.Fatalf("expected 2 calls, got %d", calls)
+	}
+
+	now = now.Add(59 * time.Second)
+	for _, token := range []string{jwt, "opaque"} {
+		if _, err := c.Authenticate(context.Background(), token); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if calls != 2 {
+		t.Fatalf("expected results to be cached, got %d calls", calls)
+	}
+
+	// the JWT expired, the opaque token is cached for the TTL
+	now = now.Add(time.Second)
+	for _, token := range []string{jwt, "opaque"} {
+		if _, err := c.Authenticate(context.Background(), token); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if calls != 3 {
+		t.Fatalf("expected the expired token to be authenticated again, got %d calls", calls)
+	}
+}
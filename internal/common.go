@@ -1,8 +1,13 @@
 package internal
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
 	"path"
+	"strings"
 	"sync"
+	"time"
 
 	authv1 "k8s.io/api/authentication/v1"
 	"k8s.io/apimachinery/pkg/types"
@@ -17,6 +22,13 @@ const (
 
 	AuthHeaderKey = "X-Authorization"
 	AuthQueryKey  = "token"
+	// TokenAudience is the audience of the service account tokens k8stail mints for the service
+	TokenAudience = "log-socket"
+
+	RateLimitHeaderKey = "X-Log-Socket-Rate-Limit"
+
+	TicketEndpoint = "/tickets"
+	TicketQueryKey = "ticket"
 )
 
 var (
@@ -27,12 +39,48 @@ var (
 type Record struct {
 	RawData []byte
 	Data    struct {
-		Kubernetes struct {
-			Labels  map[string]string `json:"labels"`
-			PodName string            `json:"pod_name"`
-		} `json:"kubernetes"`
+		Kubernetes KubernetesMeta `json:"kubernetes"`
 	}
 	Flow FlowReference
+	// Received is when the service ingested the record
+	Received time.Time
+}
+
+// Meta returns the metadata of the record
+func (r Record) Meta() *RecordMeta {
+	return &RecordMeta{
+		Flow:       r.Flow,
+		Kubernetes: r.Data.Kubernetes,
+		Received:   r.Received,
+	}
+}
+
+// KubernetesMeta is the Kubernetes metadata the logging operator adds to records
+type KubernetesMeta struct {
+	ContainerName string            `json:"container_name,omitempty"`
+	Labels        map[string]string `json:"labels,omitempty"`
+	NamespaceName string            `json:"namespace_name,omitempty"`
+	PodName       string            `json:"pod_name,omitempty"`
+}
+
+// RecordMeta is what is known about a record besides its data
+type RecordMeta struct {
+	Flow       FlowReference
+	Kubernetes KubernetesMeta
+	// Received is when the record was received (by the service, or by k8stail from the service)
+	Received time.Time
+}
+
+// NewRecordMeta returns the metadata of a record received from a flow, parsing the Kubernetes metadata of the record (which is left empty if the record is not a JSON object)
+func NewRecordMeta(flow FlowReference, received time.Time, data []byte) *RecordMeta {
+	meta := &RecordMeta{Flow: flow, Received: received}
+	var rec struct {
+		Kubernetes KubernetesMeta `json:"kubernetes"`
+	}
+	if err := json.Unmarshal(data, &rec); err == nil {
+		meta.Kubernetes = rec.Kubernetes
+	}
+	return meta
 }
 
 type RecordSink interface {
@@ -123,6 +171,15 @@ func (f FlowReference) URL() string {
 	return path.Join(string(f.Kind), f.Namespace, f.Name)
 }
 
+// ParseFlowReference parses a flow reference in the format returned by FlowReference.URL
+func ParseFlowReference(s string) (res FlowReference, err error) {
+	if elts := strings.Split(strings.Trim(s, "/"), "/"); len(elts) == 3 {
+		res.Kind, res.Namespace, res.Name = FlowKind(elts[0]), elts[1], elts[2]
+		return
+	}
+	return res, fmt.Errorf("%q is not a valid flow reference", s)
+}
+
 type ReconcileEvent struct {
 	Requests []FlowReference
 }
@@ -151,5 +208,5 @@ func (r ListenerEventChannel) Unregister(l Listener) {
 }
 
 type Authenticator interface {
-	Authenticate(token string) (authv1.UserInfo, error)
+	Authenticate(ctx context.Context, token string) (authv1.UserInfo, error)
 }
@@ -0,0 +1,68 @@
+package internal
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// ControlMessage is exchanged between the service and listeners in WebSocket text messages (records are sent in binary messages)
+type ControlMessage struct {
+	Type ControlMessageType `json:"type"`
+	// Token is the new token of refresh messages
+	Token string `json:"token,omitempty"`
+	// Expires is when the listener's token expires (if it does) in refreshed and expiring messages
+	Expires *time.Time `json:"expires,omitempty"`
+	// Error describes why a refresh failed
+	Error string `json:"error,omitempty"`
+	// Dropped is the number of records dropped since the previous rate limited message
+	Dropped uint64 `json:"dropped,omitempty"`
+	// Skipped is the number of records skipped by sampling since the previous status message
+	Skipped uint64 `json:"skipped,omitempty"`
+	// Start, End and Rows describe a window of aggregated records
+	Start *time.Time     `json:"start,omitempty"`
+	End   *time.Time     `json:"end,omitempty"`
+	Rows  []AggregateRow `json:"rows,omitempty"`
+}
+
+type ControlMessageType string
+
+const (
+	// CMRefresh is sent by listeners to replace their token before it expires
+	CMRefresh ControlMessageType = "refresh"
+	// CMRefreshed is sent by the service after replacing the listener's token
+	CMRefreshed ControlMessageType = "refreshed"
+	// CMRefreshFailed is sent by the service if the listener's new token was rejected (the old one is kept)
+	CMRefreshFailed ControlMessageType = "refresh-failed"
+	// CMExpiring is sent by the service shortly before the listener's token expires
+	CMExpiring ControlMessageType = "expiring"
+	// CMRateLimited is sent by the service (at most once per rateLimitNoticeInterval) if records were dropped because of the listener's rate limits
+	CMRateLimited ControlMessageType = "rate-limited"
+	// CMStatus is sent by the service periodically to listeners that requested sampling if records were skipped
+	CMStatus ControlMessageType = "status"
+	// CMAggregate is sent by the service at the end of each window to listeners that requested aggregation
+	CMAggregate ControlMessageType = "aggregate"
+)
+
+const rateLimitNoticeInterval = time.Second
+
+// tokenExpiry returns the expiry of the token from its exp claim, if it's a JWT.
+// The token is not verified, so this must only be used for tokens that have already been authenticated.
+func tokenExpiry(token string) (time.Time, bool) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}, false
+	}
+	data, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return time.Time{}, false
+	}
+	var claims struct {
+		Exp *float64 `json:"exp"`
+	}
+	if err := json.Unmarshal(data, &claims); err != nil || claims.Exp == nil {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(*claims.Exp), 0), true
+}
@@ -0,0 +1,226 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	dedupeWildcard = "<*>"
+	// dedupePrefixDepth is the number of leading tokens used to narrow down candidate templates (like the depth of Drain's parse tree)
+	dedupePrefixDepth = 1
+	// dedupeMaxClusters bounds the number of templates kept per parse tree leaf
+	dedupeMaxClusters = 100
+	// dedupeMaxTotalClusters bounds the number of templates kept overall
+	dedupeMaxTotalClusters = 10000
+)
+
+// DefaultDedupeFields are the fields messages are looked up in (in order) if none are specified
+var DefaultDedupeFields = []string{"message", "log", "msg"}
+
+// DedupeOptions configures a DedupeStage
+type DedupeOptions struct {
+	// Fields are the fields messages are looked up in, the first one present is used (DefaultDedupeFields if empty)
+	Fields []string
+	// Similarity is the minimum fraction of matching tokens for a message to match a template (0.5 if not positive)
+	Similarity float64
+	// SummaryInterval is how often summaries of repeated templates are emitted (10s if not positive)
+	SummaryInterval time.Duration
+}
+
+// NewDedupeStage returns a stage that clusters messages into templates in the style of the Drain algorithm.
+// The first record matching a template passes through, while further matches are suppressed and reported in periodic summary records.
+func NewDedupeStage(opts DedupeOptions) *DedupeStage {
+	if len(opts.Fields) == 0 {
+		opts.Fields = DefaultDedupeFields
+	}
+	if opts.Similarity <= 0 {
+		opts.Similarity = 0.5
+	}
+	if opts.SummaryInterval <= 0 {
+		opts.SummaryInterval = 10 * time.Second
+	}
+	return &DedupeStage{
+		Options: opts,
+
+		fields: parseFieldPaths(opts.Fields),
+		leaves: make(map[string][]*logCluster),
+		now:    time.Now,
+	}
+}
+
+type DedupeStage struct {
+	Options DedupeOptions
+
+	clusters    []*logCluster
+	fields      []FieldPath
+	lastSummary time.Time
+	leaves      map[string][]*logCluster
+	now         func() time.Time
+}
+
+type logCluster struct {
+	id       int
+	pending  uint64 // matches since the last summary
+	template []string
+	total    uint64
+}
+
+func (s *DedupeStage) Process(record []byte) ([][]byte, error) {
+	now := s.now()
+	if s.lastSummary.IsZero() {
+		s.lastSummary = now
+	}
+	var res [][]byte
+	if now.Sub(s.lastSummary) >= s.Options.SummaryInterval {
+		summaries, err := s.summaries(now)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, summaries...)
+		s.lastSummary = now
+	}
+
+	obj, err := decodeJSONObject(record)
+	if err != nil {
+		return append(res, record), nil // not a JSON object, nothing to dedupe
+	}
+	var msg string
+	for _, field := range s.fields {
+		if v, ok := field.Get(obj); ok {
+			msg, _ = v.(string)
+			break
+		}
+	}
+	if strings.TrimSpace(msg) == "" {
+		return append(res, record), nil
+	}
+
+	if cluster, isNew := s.match(tokenizeMessage(msg)); !isNew {
+		cluster.pending++
+		cluster.total++
+		return res, nil
+	}
+	return append(res, record), nil
+}
+
+// Tick emits the summaries if they are due, so that they don't have to wait for the next record
+func (s *DedupeStage) Tick(now time.Time) ([]RoutedRecord, error) {
+	if s.lastSummary.IsZero() || now.Sub(s.lastSummary) < s.Options.SummaryInterval {
+		return nil, nil
+	}
+	res, err := s.summaries(now)
+	s.lastSummary = now
+	return routed(res, RoutedRecord{}), err
+}
+
+// Flush emits the summaries of the matches suppressed since the last summaries
+func (s *DedupeStage) Flush() ([]RoutedRecord, error) {
+	now := s.now()
+	res, err := s.summaries(now)
+	s.lastSummary = now
+	return routed(res, RoutedRecord{}), err
+}
+
+func (s *DedupeStage) summaries(now time.Time) (res [][]byte, err error) {
+	for _, c := range s.clusters {
+		if c.pending == 0 {
+			continue
+		}
+		template := strings.Join(c.template, " ")
+		recs, err := encodeJSON(map[string]interface{}{
+			"message": fmt.Sprintf("template %d seen %d more times: %s", c.id, c.pending, template),
+			"dedupe": map[string]interface{}{
+				"template_id": c.id,
+				"template":    template,
+				"count":       c.pending,
+				"total":       c.total,
+				"since":       s.lastSummary.UTC().Format(time.RFC3339Nano),
+				"until":       now.UTC().Format(time.RFC3339Nano),
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, recs...)
+		c.pending = 0
+	}
+	return
+}
+
+// match finds the template of the tokens, creating a new one if none is similar enough.
+// If a new template can't be kept because there are too many, nil is returned.
+func (s *DedupeStage) match(tokens []string) (*logCluster, bool) {
+	key := leafKey(tokens)
+	var best *logCluster
+	bestSim := -1.0
+	for _, c := range s.leaves[key] {
+		if sim := similarity(c.template, tokens); sim > bestSim {
+			best, bestSim = c, sim
+		}
+	}
+	if best != nil && bestSim >= s.Options.Similarity {
+		for i, t := range tokens {
+			if best.template[i] != t {
+				best.template[i] = dedupeWildcard
+			}
+		}
+		return best, false
+	}
+
+	// if the leaf or the stage is full, the template is not kept so that memory use is bounded (and matching messages pass through)
+	leaf := s.leaves[key]
+	if len(leaf) >= dedupeMaxClusters || len(s.clusters) >= dedupeMaxTotalClusters {
+		return nil, true
+	}
+	c := &logCluster{
+		id:       len(s.clusters) + 1,
+		template: append([]string(nil), tokens...),
+		total:    1,
+	}
+	s.leaves[key] = append(leaf, c)
+	s.clusters = append(s.clusters, c)
+	return c, true
+}
+
+func (s *DedupeStage) String() string {
+	return fmt.Sprintf("dedupe=%s", strings.Join(s.Options.Fields, ","))
+}
+
+// tokenizeMessage splits the message into tokens, masking the ones containing digits (which are likely variables)
+func tokenizeMessage(msg string) []string {
+	tokens := strings.Fields(msg)
+	for i, t := range tokens {
+		if strings.IndexFunc(t, unicode.IsDigit) >= 0 {
+			tokens[i] = dedupeWildcard
+		}
+	}
+	return tokens
+}
+
+// leafKey returns the key of the parse tree leaf of the tokens: their count and first few tokens
+func leafKey(tokens []string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d", len(tokens))
+	for i := 0; i < len(tokens) && i < dedupePrefixDepth; i++ {
+		b.WriteByte(0)
+		b.WriteString(tokens[i])
+	}
+	return b.String()
+}
+
+// similarity returns the fraction of positions where the template and the tokens match (wildcards in the template match any token)
+func similarity(template []string, tokens []string) float64 {
+	if len(tokens) == 0 {
+		return 1
+	}
+	same := 0
+	for i, t := range tokens {
+		if template[i] == t || template[i] == dedupeWildcard {
+			same++
+		}
+	}
+	return float64(same) / float64(len(tokens))
+}
@@ -0,0 +1,278 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// dedupeRecord returns a record with the message in the field
+func dedupeRecord(field, msg string) []byte {
+	data, _ := json.Marshal(map[string]string{field: msg})
+	return data
+}
+
+// word returns a distinct word without digits for each i, which isn't masked like tokens containing digits
+func word(i int) string {
+	var b strings.Builder
+	for {
+		b.WriteByte(byte('a' + i%26))
+		if i /= 26; i == 0 {
+			return b.String()
+		}
+	}
+}
+
+func TestDedupeTemplates(t *testing.T) {
+	tests := map[string]struct {
+		records   []string // messages, or raw records if they start with { or are "not json"
+		passed    []int    // indexes of the records passing through
+		templates []string
+	}{
+		"repeated message": {
+			records:   []string{"connection reset", "connection reset", "connection reset"},
+			passed:    []int{0},
+			templates: []string{"connection reset"},
+		},
+		"tokens with digits are masked": {
+			records:   []string{"user 1 logged in", "user 22 logged in"},
+			passed:    []int{0},
+			templates: []string{"user <*> logged in"},
+		},
+		"differing tokens are wildcarded": {
+			records:   []string{"connection from alice failed", "connection from bob failed", "connection from carol failed"},
+			passed:    []int{0},
+			templates: []string{"connection from <*> failed"},
+		},
+		"similarity at the threshold matches": {
+			records:   []string{"cache hit for alice", "cache hit by bob"},
+			passed:    []int{0},
+			templates: []string{"cache hit <*> <*>"},
+		},
+		"similarity below the threshold": {
+			records:   []string{"cache hit for alice", "cache miss by bob"},
+			passed:    []int{0, 1},
+			templates: []string{"cache hit for alice", "cache miss by bob"},
+		},
+		"wildcards match any token": {
+			records:   []string{"job alpha started", "job beta started", "job gamma done"},
+			passed:    []int{0},
+			templates: []string{"job <*> <*>"},
+		},
+		"different first tokens": {
+			records:   []string{"alpha job started", "beta job started"},
+			passed:    []int{0, 1},
+			templates: []string{"alpha job started", "beta job started"},
+		},
+		"different lengths": {
+			records:   []string{"job started", "job started again"},
+			passed:    []int{0, 1},
+			templates: []string{"job started", "job started again"},
+		},
+		"other fields": {
+			records:   []string{`{"log":"job started"}`, `{"msg":"job started"}`, `{"message":"job started"}`},
+			passed:    []int{0},
+			templates: []string{"job started"},
+		},
+		"records without messages pass through": {
+			records:   []string{`not json`, `not json`, `{"level":"info"}`, `{"level":"info"}`, `{"message":"  "}`, `{"message":42}`, `{"message":42}`},
+			passed:    []int{0, 1, 2, 3, 4, 5, 6},
+			templates: nil,
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			s := NewDedupeStage(DedupeOptions{})
+			s.now = func() time.Time { return time.Unix(1700000000, 0) }
+			var passed []int
+			for i, r := range test.records {
+				record := []byte(r)
+				if !strings.HasPrefix(r, "{") && r != "not json" {
+					record = dedupeRecord("message", r)
+				}
+				res, err := s.Process(record)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(res) > 0 {
+					if len(res) != 1 || string(res[0]) != string(record) {
+						t.Fatalf("expected record %d to pass through as is, got %q", i, res)
+					}
+					passed = append(passed, i)
+				}
+			}
+			if fmt.Sprint(passed) != fmt.Sprint(test.passed) {
+				t.Errorf("expected records %v to pass through, got %v", test.passed, passed)
+			}
+			var templates []string
+			for _, c := range s.clusters {
+				templates = append(templates, strings.Join(c.template, " "))
+			}
+			if fmt.Sprint(templates) != fmt.Sprint(test.templates) {
+				t.Errorf("expected templates %q, got %q", test.templates, templates)
+			}
+		})
+	}
+}
+
+func TestSimilarity(t *testing.T) {
+	tests := []struct {
+		template, tokens string
+		expected         float64
+	}{
+		{"a b c d", "a b c d", 1},
+		{"a b c d", "a b x y", 0.5},
+		{"a b c d", "a x y z", 0.25},
+		{"a <*> c d", "a b c x", 0.75},
+		{"<*> <*>", "x y", 1},
+		{"", "", 1},
+	}
+	for _, test := range tests {
+		if actual := similarity(strings.Fields(test.template), strings.Fields(test.tokens)); actual != test.expected {
+			t.Errorf("expected similarity %v of %q and %q, got %v", test.expected, test.template, test.tokens, actual)
+		}
+	}
+}
+
+func TestDedupeLimits(t *testing.T) {
+	tests := map[string]struct {
+		message func(i int) string
+		max     int
+	}{
+		// messages of the same length and first token share a leaf, distinct second and third tokens keep them from matching
+		"per leaf": {message: func(i int) string { return "job " + word(i) + " " + word(i) }, max: dedupeMaxClusters},
+		// messages with distinct first tokens have a leaf each
+		"total": {message: word, max: dedupeMaxTotalClusters},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			s := NewDedupeStage(DedupeOptions{})
+			for i := 0; i < test.max; i++ {
+				if res, _ := s.Process(dedupeRecord("message", test.message(i))); len(res) != 1 {
+					t.Fatalf("expected new message %d to pass through", i)
+				}
+			}
+			if len(s.clusters) != test.max {
+				t.Fatalf("expected %d templates, got %d", test.max, len(s.clusters))
+			}
+			// kept templates still suppress repeated messages
+			if res, _ := s.Process(dedupeRecord("message", test.message(0))); len(res) != 0 {
+				t.Errorf("expected a repeated message of a kept template to be suppressed, got %q", res)
+			}
+			// once full, new messages pass through every time and aren't kept
+			for i := 0; i < 3; i++ {
+				if res, _ := s.Process(dedupeRecord("message", test.message(test.max))); len(res) != 1 {
+					t.Errorf("expected a message without a template to pass through, got %q", res)
+				}
+			}
+			if len(s.clusters) != test.max {
+				t.Errorf("expected %d templates, got %d", test.max, len(s.clusters))
+			}
+			if id := s.clusters[len(s.clusters)-1].id; id != test.max {
+				t.Errorf("expected the last template to have ID %d, got %d", test.max, id)
+			}
+		})
+	}
+}
+
+func TestDedupeSummaries(t *testing.T) {
+	start := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := start
+	s := NewDedupeStage(DedupeOptions{SummaryInterval: 10 * time.Second})
+	s.now = func() time.Time { return now }
+
+	type summary struct {
+		Message string `json:"message"`
+		Dedupe  struct {
+			TemplateID int    `json:"template_id"`
+			Template   string `json:"template"`
+			Count      uint64 `json:"count"`
+			Total      uint64 `json:"total"`
+			Since      string `json:"since"`
+			Until      string `json:"until"`
+		} `json:"dedupe"`
+	}
+	parse := func(records [][]byte) (res []summary) {
+		for _, r := range records {
+			var s summary
+			if err := json.Unmarshal(r, &s); err != nil {
+				t.Fatal(err)
+			}
+			res = append(res, s)
+		}
+		return
+	}
+	process := func(msg string) [][]byte {
+		res, err := s.Process(dedupeRecord("message", msg))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	process("request 1 served")
+	process("request 2 served")
+	process("request 3 served")
+	process("cache flushed")
+	if res, _ := s.Tick(now.Add(9 * time.Second)); len(res) != 0 {
+		t.Errorf("expected no summaries before the interval, got %q", recordData(res))
+	}
+
+	res, err := s.Tick(now.Add(10 * time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// templates without suppressed matches aren't summarized
+	summaries := parse(recordData(res))
+	if len(summaries) != 1 {
+		t.Fatalf("expected a summary, got %q", recordData(res))
+	}
+	sum := summaries[0]
+	if sum.Message != "template 1 seen 2 more times: request <*> served" || sum.Dedupe.TemplateID != 1 || sum.Dedupe.Count != 2 || sum.Dedupe.Total != 3 ||
+		sum.Dedupe.Since != "2023-01-01T00:00:00Z" || sum.Dedupe.Until != "2023-01-01T00:00:10Z" {
+		t.Errorf("unexpected summary %+v", sum)
+	}
+	if res, _ := s.Tick(now.Add(15 * time.Second)); len(res) != 0 {
+		t.Errorf("expected no summaries before the next interval, got %q", recordData(res))
+	}
+
+	// a record after the interval emits the due summaries before it
+	now = start.Add(12 * time.Second)
+	process("request 4 served")
+	now = start.Add(20 * time.Second)
+	out := process("cache flushed")
+	if len(out) != 1 {
+		t.Fatalf("expected only the summary (the record is suppressed), got %q", out)
+	}
+	if sum := parse(out)[0]; sum.Dedupe.Count != 1 || sum.Dedupe.Total != 4 || sum.Dedupe.Since != "2023-01-01T00:00:10Z" {
+		t.Errorf("unexpected summary %+v", sum)
+	}
+	out = process("cache flushed")
+	if len(out) != 0 {
+		t.Errorf("expected no summaries right after the last, got %q", out)
+	}
+
+	// flushing emits what was suppressed since the last summaries, regardless of the interval
+	now = start.Add(21 * time.Second)
+	flushed, err := s.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	summaries = parse(recordData(flushed))
+	if len(summaries) != 1 || summaries[0].Dedupe.TemplateID != 2 || summaries[0].Dedupe.Count != 2 || summaries[0].Dedupe.Until != "2023-01-01T00:00:21Z" {
+		t.Errorf("unexpected flushed summaries %+v", summaries)
+	}
+	if flushed, _ := s.Flush(); len(flushed) != 0 {
+		t.Errorf("expected nothing to flush, got %q", recordData(flushed))
+	}
+}
+
+func recordData(records []RoutedRecord) [][]byte {
+	var res [][]byte
+	for _, r := range records {
+		res = append(res, r.Data)
+	}
+	return res
+}
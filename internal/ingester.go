@@ -8,6 +8,7 @@ import (
 	"net/http"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/banzaicloud/log-socket/log"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -65,6 +66,7 @@ func Ingest(addr string, records RecordSink, logs log.Sink, metrics IngestMetric
 				return
 			}
 
+			received := time.Now()
 			dataSet := bytes.Split(data, []byte{'\n'})
 			for _, data := range dataSet {
 
@@ -73,8 +75,9 @@ func Ingest(addr string, records RecordSink, logs log.Sink, metrics IngestMetric
 				}
 
 				rec := Record{
-					RawData: data,
-					Flow:    flow,
+					RawData:  data,
+					Flow:     flow,
+					Received: received,
 				}
 
 				metrics.LogRecordReceived(rec)
@@ -0,0 +1,167 @@
+package internal
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ConnectionLimits bounds the number of concurrent listeners (limits that are not positive are disabled)
+type ConnectionLimits struct {
+	MaxListeners        int `json:"maxListeners" yaml:"maxListeners"`
+	MaxListenersPerUser int `json:"maxListenersPerUser" yaml:"maxListenersPerUser"`
+	MaxListenersPerFlow int `json:"maxListenersPerFlow" yaml:"maxListenersPerFlow"`
+}
+
+func NewConnectionLimiter(limits ConnectionLimits) *ConnectionLimiter {
+	return &ConnectionLimiter{
+		Limits: limits,
+
+		perFlow: make(map[FlowReference]int),
+		perUser: make(map[string]int),
+	}
+}
+
+// ConnectionLimiter keeps track of the number of concurrent listeners to enforce connection limits
+type ConnectionLimiter struct {
+	Limits ConnectionLimits
+
+	mutex   sync.Mutex
+	perFlow map[FlowReference]int
+	perUser map[string]int
+	total   int
+}
+
+// Acquire reserves a connection for the user to the flow, returning a function that releases it.
+// A limit exceeded error is returned if any of the limits would be exceeded.
+func (c *ConnectionLimiter) Acquire(user string, flow FlowReference) (func(), error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	switch {
+	case c.Limits.MaxListeners > 0 && c.total >= c.Limits.MaxListeners:
+		return nil, limitExceededError(fmt.Sprintf("too many listeners (limit %d)", c.Limits.MaxListeners))
+	case c.Limits.MaxListenersPerUser > 0 && c.perUser[user] >= c.Limits.MaxListenersPerUser:
+		return nil, limitExceededError(fmt.Sprintf("too many listeners for user %s (limit %d)", user, c.Limits.MaxListenersPerUser))
+	case c.Limits.MaxListenersPerFlow > 0 && c.perFlow[flow] >= c.Limits.MaxListenersPerFlow:
+		return nil, limitExceededError(fmt.Sprintf("too many listeners for %s (limit %d)", flow.URL(), c.Limits.MaxListenersPerFlow))
+	}
+	c.total++
+	c.perUser[user]++
+	c.perFlow[flow]++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			c.release(user, flow)
+		})
+	}, nil
+}
+
+func (c *ConnectionLimiter) release(user string, flow FlowReference) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.total--
+	if c.perUser[user]--; c.perUser[user] <= 0 {
+		delete(c.perUser, user)
+	}
+	if c.perFlow[flow]--; c.perFlow[flow] <= 0 {
+		delete(c.perFlow, flow)
+	}
+}
+
+type limitExceededError string
+
+func (e limitExceededError) Error() string {
+	return string(e)
+}
+
+// RateLimits bounds the throughput of each listener (limits that are not positive are disabled)
+type RateLimits struct {
+	BytesPerSecond   float64 `json:"bytesPerSecond" yaml:"bytesPerSecond"`
+	RecordsPerSecond float64 `json:"recordsPerSecond" yaml:"recordsPerSecond"`
+}
+
+func (l RateLimits) String() string {
+	var res string
+	if l.RecordsPerSecond > 0 {
+		res = fmt.Sprintf("%g records/s", l.RecordsPerSecond)
+	}
+	if l.BytesPerSecond > 0 {
+		if res != "" {
+			res += ", "
+		}
+		res += fmt.Sprintf("%g bytes/s", l.BytesPerSecond)
+	}
+	return res
+}
+
+func newRateLimiter(limits RateLimits) *rateLimiter {
+	res := &rateLimiter{}
+	if limits.BytesPerSecond > 0 {
+		res.bytes = newTokenBucket(limits.BytesPerSecond)
+	}
+	if limits.RecordsPerSecond > 0 {
+		res.records = newTokenBucket(limits.RecordsPerSecond)
+	}
+	return res
+}
+
+// rateLimiter decides whether records can be sent to a listener without exceeding its rate limits (it is not safe for concurrent use)
+type rateLimiter struct {
+	bytes   *tokenBucket
+	records *tokenBucket
+}
+
+func (l *rateLimiter) allow(now time.Time, size int) bool {
+	if l.records != nil && !l.records.available(now, 1) {
+		return false
+	}
+	if l.bytes != nil && !l.bytes.available(now, float64(size)) {
+		return false
+	}
+	if l.records != nil {
+		l.records.take(1)
+	}
+	if l.bytes != nil {
+		l.bytes.take(float64(size))
+	}
+	return true
+}
+
+// newTokenBucket returns a token bucket refilled at rate tokens per second that holds up to a second's worth of tokens
+func newTokenBucket(rate float64) *tokenBucket {
+	return &tokenBucket{
+		burst:  rate,
+		rate:   rate,
+		tokens: rate,
+	}
+}
+
+type tokenBucket struct {
+	burst  float64
+	last   time.Time
+	rate   float64
+	tokens float64
+}
+
+// available refills the bucket and returns whether n tokens can be taken.
+// Requests larger than the burst are allowed when the bucket is full, going into debt.
+func (b *tokenBucket) available(now time.Time, n float64) bool {
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+	if n > b.burst {
+		n = b.burst
+	}
+	return b.tokens >= n
+}
+
+func (b *tokenBucket) take(n float64) {
+	b.tokens -= n
+}
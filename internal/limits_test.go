@@ -0,0 +1,135 @@
+package internal
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestRateLimiter(t *testing.T) {
+	type step struct {
+		after   time.Duration // since the previous step
+		size    int
+		allowed bool
+	}
+	tests := map[string]struct {
+		limits RateLimits
+		steps  []step
+	}{
+		"records": {
+			limits: RateLimits{RecordsPerSecond: 2},
+			steps: []step{
+				// the bucket starts full
+				{allowed: true}, {allowed: true}, {allowed: false},
+				{after: 499 * time.Millisecond, allowed: false},
+				{after: time.Millisecond, allowed: true}, {allowed: false},
+				// the bucket holds a second's worth of tokens at most
+				{after: time.Hour, allowed: true}, {allowed: true}, {allowed: false},
+			},
+		},
+		"bytes": {
+			limits: RateLimits{BytesPerSecond: 100},
+			steps: []step{
+				{size: 60, allowed: true}, {size: 60, allowed: false}, {size: 40, allowed: true}, {size: 1, allowed: false},
+				{after: 200 * time.Millisecond, size: 21, allowed: false},
+				{size: 20, allowed: true},
+			},
+		},
+		"records larger than the burst": {
+			limits: RateLimits{BytesPerSecond: 100},
+			steps: []step{
+				// allowed when the bucket is full, going into debt
+				{size: 250, allowed: true},
+				{after: 1500 * time.Millisecond, size: 1, allowed: false},
+				{after: 20 * time.Millisecond, size: 1, allowed: true},
+				{after: 10 * time.Millisecond, size: 250, allowed: false},
+				{after: 990 * time.Millisecond, size: 250, allowed: true},
+			},
+		},
+		"records and bytes": {
+			limits: RateLimits{RecordsPerSecond: 2, BytesPerSecond: 100},
+			steps: []step{
+				{size: 90, allowed: true},
+				// denied by the bytes, so no record is taken
+				{size: 20, allowed: false},
+				{size: 10, allowed: true},
+				// denied by the records, so no bytes are taken
+				{size: 0, allowed: false},
+				{after: 500 * time.Millisecond, size: 50, allowed: true},
+			},
+		},
+		"unlimited": {
+			steps: []step{{size: 1 << 30, allowed: true}, {size: 1 << 30, allowed: true}},
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			l := newRateLimiter(test.limits)
+			now := time.Unix(1700000000, 0)
+			for i, step := range test.steps {
+				now = now.Add(step.after)
+				if allowed := l.allow(now, step.size); allowed != step.allowed {
+					t.Errorf("expected step %d (%d bytes) to be allowed: %t, got %t", i, step.size, step.allowed, allowed)
+				}
+			}
+		})
+	}
+}
+
+func TestConnectionLimiter(t *testing.T) {
+	flow := func(name string) FlowReference {
+		return FlowReference{NamespacedName: types.NamespacedName{Namespace: "default", Name: name}, Kind: FKFlow}
+	}
+	c := NewConnectionLimiter(ConnectionLimits{MaxListeners: 3, MaxListenersPerUser: 2, MaxListenersPerFlow: 2})
+	acquire := func(user string, flow FlowReference) (func(), bool) {
+		release, err := c.Acquire(user, flow)
+		if err != nil {
+			var limitErr limitExceededError
+			if !errors.As(err, &limitErr) {
+				t.Fatalf("expected a limitExceededError, got %v", err)
+			}
+			return nil, false
+		}
+		return release, true
+	}
+
+	release, _ := acquire("alice", flow("a"))
+	if _, ok := acquire("alice", flow("b")); !ok {
+		t.Fatal("expected alice to connect twice")
+	}
+	if _, ok := acquire("alice", flow("c")); ok {
+		t.Error("expected the listeners of alice to be limited")
+	}
+	if _, ok := acquire("bob", flow("a")); !ok {
+		t.Fatal("expected bob to connect")
+	}
+	if _, ok := acquire("carol", flow("c")); ok {
+		t.Error("expected the total of the listeners to be limited")
+	}
+
+	// releasing twice releases once
+	release()
+	release()
+	if _, ok := acquire("carol", flow("a")); !ok {
+		t.Fatal("expected carol to connect after alice disconnected")
+	}
+	if _, ok := acquire("dave", flow("d")); ok {
+		t.Error("expected the total of the listeners to be limited")
+	}
+	if c.total != 3 || c.perUser["alice"] != 1 || c.perFlow[flow("a")] != 2 {
+		t.Errorf("unexpected counts: %d in total, %v by user, %v by flow", c.total, c.perUser, c.perFlow)
+	}
+
+	c = NewConnectionLimiter(ConnectionLimits{MaxListenersPerFlow: 1})
+	if _, ok := acquire("alice", flow("a")); !ok {
+		t.Fatal("expected alice to connect")
+	}
+	if _, ok := acquire("bob", flow("a")); ok {
+		t.Error("expected the listeners of the flow to be limited")
+	}
+	if _, ok := acquire("bob", flow("b")); !ok {
+		t.Error("expected bob to connect to another flow")
+	}
+}
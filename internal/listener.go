@@ -1,11 +1,16 @@
 package internal
 
 import (
+	"context"
 	"crypto/tls"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"go.uber.org/multierr"
@@ -14,40 +19,123 @@ import (
 	"github.com/banzaicloud/log-socket/log"
 )
 
+// ListenOptions holds the optional settings of the listener server
+type ListenOptions struct {
+	// Audit receives the audit trail of listeners if not nil
+	Audit AuditSink
+	// Connections enforces connection limits if not nil
+	Connections *ConnectionLimiter
+	// RateLimits bounds the throughput of each listener
+	RateLimits RateLimits
+	// AllowTokenInQuery enables falling back to the auth token in the URL query string, where it might end up in access logs and browser histories
+	AllowTokenInQuery bool
+	// RevalidationInterval is how often listeners' tokens are authenticated again (revalidation is disabled if not positive)
+	RevalidationInterval time.Duration
+	// Tickets enables issuing connection tickets and connecting with them if not nil
+	Tickets *TicketStore
+	// TicketOrigins are the origins of the web pages allowed to request tickets from browsers
+	TicketOrigins []string
+	// Plugins lets listeners run plugins on the service if not nil
+	Plugins *ListenerPlugins
+}
+
 func Listen(addr string, tlsConfig *tls.Config, reg ListenerRegistry, logs log.Sink, metrics ListenMetrics,
-	stopSignal Handleable, terminationSignal Handleable, authenticator Authenticator) {
+	stopSignal Handleable, terminationSignal Handleable, authenticator Authenticator, opts ListenOptions) {
+	audit := opts.Audit
+	if audit == nil {
+		audit = nopAuditSink{}
+	}
 	upgrader := websocket.Upgrader{
 		CheckOrigin: func(r *http.Request) bool { return true }, // allow connections from any origin
 	}
 	server := &http.Server{
 		Addr: addr,
 		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == TicketEndpoint && opts.Tickets != nil {
+				handleTicketRequest(w, r, logs, authenticator, opts.Tickets, opts.TicketOrigins)
+				return
+			}
+			if r.URL.Path == PluginEndpoint && opts.Plugins != nil {
+				handlePluginUpload(w, r, logs, authenticator, opts.Plugins)
+				return
+			}
+
 			log.Event(logs, "new listener connection request", log.V(2), log.Fields{"request": r})
 
+			reject := func(flow FlowReference, usrInfo authv1.UserInfo, reason string) {
+				metrics.ListenerRejected(flow, usrInfo)
+				e := newRequestAuditEvent(AuditListenerRejected, r, flow, usrInfo)
+				e.Reason = reason
+				audit.Audit(e)
+			}
+
 			flow, err := ExtractFlow(r)
 			if err != nil {
 				log.Event(logs, "failed to extract flow from request", log.V(1), log.Error(err), log.Fields{"request": r})
-				metrics.ListenerRejected(flow, authv1.UserInfo{})
+				reject(flow, authv1.UserInfo{}, err.Error())
 				http.Error(w, err.Error(), http.StatusBadRequest)
 				return
 			}
 
-			authToken := r.Header.Get(AuthHeaderKey)
-			if authToken == "" {
-				// browsers don't support specifying headers for WebSocket connections so we fall back to getting the auth token from the URL query string
-				authToken = r.URL.Query().Get(AuthQueryKey)
+			sampling, err := ParseSamplingOptions(r.URL.Query())
+			if err != nil {
+				log.Event(logs, "invalid sampling options", log.V(1), log.Error(err), log.Fields{"flow": flow})
+				reject(flow, authv1.UserInfo{}, err.Error())
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
 			}
-			if authToken == "" {
-				log.Event(logs, "no authentication token in request", log.V(1), log.Fields{"headers": r.Header, "query": r.URL.RawQuery})
-				metrics.ListenerRejected(flow, authv1.UserInfo{})
-				http.Error(w, "missing authentication token", http.StatusForbidden)
+
+			aggregation, err := ParseAggregationOptions(r.URL.Query())
+			if err != nil {
+				log.Event(logs, "invalid aggregation options", log.V(1), log.Error(err), log.Fields{"flow": flow})
+				reject(flow, authv1.UserInfo{}, err.Error())
+				http.Error(w, err.Error(), http.StatusBadRequest)
 				return
 			}
 
-			usrInfo, err := authenticator.Authenticate(authToken)
+			pluginRefs := r.URL.Query()[PluginQueryKey]
+			if len(pluginRefs) > 0 {
+				var err error
+				statusCode := http.StatusBadRequest
+				switch {
+				case opts.Plugins == nil:
+					err = errors.New("plugins are disabled on this service")
+					statusCode = http.StatusForbidden
+				case aggregation.Enabled():
+					err = errors.New("plugins can't be combined with aggregation")
+				}
+				if err != nil {
+					log.Event(logs, "invalid plugin options", log.V(1), log.Error(err), log.Fields{"flow": flow})
+					reject(flow, authv1.UserInfo{}, err.Error())
+					http.Error(w, err.Error(), statusCode)
+					return
+				}
+			}
+
+			var usrInfo authv1.UserInfo
+			var authToken string
+			if ticket := r.URL.Query().Get(TicketQueryKey); ticket != "" && opts.Tickets != nil {
+				usrInfo, authToken, err = opts.Tickets.Redeem(ticket, flow)
+			} else {
+				authToken = r.Header.Get(AuthHeaderKey)
+				if authToken == "" && opts.AllowTokenInQuery {
+					// browsers don't support specifying headers for WebSocket connections so we fall back to getting the auth token from the URL query string
+					authToken = r.URL.Query().Get(AuthQueryKey)
+					if authToken != "" {
+						log.Event(logs, "listener passed its token in the query string, which is deprecated: use connection tickets instead", log.V(1), log.Fields{"flow": flow})
+					}
+				}
+				if authToken == "" {
+					log.Event(logs, "no authentication token in request", log.V(1), log.Fields{"headers": r.Header, "url": r.URL})
+					reject(flow, authv1.UserInfo{}, "missing authentication token")
+					http.Error(w, "missing authentication token", http.StatusForbidden)
+					return
+				}
+				usrInfo, err = authenticator.Authenticate(r.Context(), authToken)
+			}
 			if err != nil {
-				log.Event(logs, "authentication failed", log.V(1), log.Error(err), log.Fields{"token": authToken})
-				metrics.ListenerRejected(flow, usrInfo)
+				log.Event(logs, "authentication failed", log.V(1), log.Error(err), log.Fields{"flow": flow})
+				reject(flow, usrInfo, err.Error())
 				statusCode := http.StatusInternalServerError
 				if IsUnauthenticatedError(err) {
 					statusCode = http.StatusForbidden
@@ -56,10 +144,37 @@ func Listen(addr string, tlsConfig *tls.Config, reg ListenerRegistry, logs log.S
 				return
 			}
 
-			wsConn, err := upgrader.Upgrade(w, r, nil)
+			release := func() {}
+			if opts.Connections != nil {
+				if release, err = opts.Connections.Acquire(usrInfo.Username, flow); err != nil {
+					log.Event(logs, "connection limit exceeded", log.V(1), log.Error(err), log.Fields{"flow": flow, "user": usrInfo.Username})
+					reject(flow, usrInfo, err.Error())
+					http.Error(w, err.Error(), http.StatusTooManyRequests)
+					return
+				}
+			}
+
+			var plugins Pipeline
+			if len(pluginRefs) > 0 {
+				if plugins, err = opts.Plugins.Load(r.Context(), logs, usrInfo.Username, pluginRefs); err != nil {
+					log.Event(logs, "failed to load listener plugins", log.V(1), log.Error(err), log.Fields{"flow": flow, "user": usrInfo.Username})
+					reject(flow, usrInfo, err.Error())
+					release()
+					http.Error(w, err.Error(), listenerPluginErrorStatus(err))
+					return
+				}
+			}
+
+			var respHeader http.Header
+			if limits := opts.RateLimits.String(); limits != "" {
+				respHeader = http.Header{RateLimitHeaderKey: []string{limits}}
+			}
+			wsConn, err := upgrader.Upgrade(w, r, respHeader)
 			if err != nil {
 				log.Event(logs, "failed to upgrade connection", log.V(1), log.Error(err))
-				metrics.ListenerRejected(flow, usrInfo)
+				reject(flow, usrInfo, err.Error())
+				release()
+				_ = plugins.Close()
 				// cannot reply with an error here since the connection has been "hijacked"
 				return
 			}
@@ -67,17 +182,43 @@ func Listen(addr string, tlsConfig *tls.Config, reg ListenerRegistry, logs log.S
 			log.Event(logs, "successful websocket upgrade", log.V(2), log.Fields{"request": r, "wsConn": wsConn})
 
 			metrics.ListenerAccepted(flow, usrInfo)
+			accepted := newRequestAuditEvent(AuditListenerAccepted, r, flow, usrInfo)
+			audit.Audit(accepted)
 
 			l := &listener{
-				conn:    wsConn,
-				flow:    flow,
-				logs:    logs,
-				metrics: metrics,
-				reg:     reg,
-				usrInfo: usrInfo,
+				audit:         audit,
+				auditInfo:     accepted,
+				authenticator: authenticator,
+				conn:          wsConn,
+				decisions:     make(map[string]policy),
+				done:          make(chan struct{}),
+				flow:          flow,
+				limiter:       newRateLimiter(opts.RateLimits),
+				logs:          logs,
+				metrics:       metrics,
+				refreshed:     make(chan struct{}, 1),
+				reg:           reg,
+				release:       release,
+				token:         authToken,
+				usrInfo:       usrInfo,
+			}
+			l.expires, _ = tokenExpiry(authToken)
+			if sampling.Enabled() {
+				l.sampler = newSampler(sampling)
+				go l.reportSkipped()
+			}
+			if aggregation.Enabled() {
+				l.aggregator = newAggregator(aggregation)
+				go l.sendAggregates()
+			}
+			if plugins != nil {
+				l.plugins = plugins
+				l.pluginQueue = make(chan pluginJob, pluginQueueSize)
+				go l.runPlugins(opts.Plugins.TickInterval)
 			}
 			reg.Register(l)
 			go l.readLoop()
+			go l.watchAccess(opts.RevalidationInterval)
 			wsConn.SetCloseHandler(func(code int, text string) error {
 				log.Event(logs, "websocket connection closed", log.V(1), log.Fields{"code": code, "text": text, "listener": l})
 				reg.Unregister(l)
@@ -100,6 +241,72 @@ func Listen(addr string, tlsConfig *tls.Config, reg ListenerRegistry, logs log.S
 	}
 }
 
+// handleTicketRequest issues a connection ticket to clients authenticated by the auth header.
+// The ticket is restricted to the flow specified by the flow query parameter, if any.
+func handleTicketRequest(w http.ResponseWriter, r *http.Request, logs log.Sink, authenticator Authenticator, tickets *TicketStore, origins []string) {
+	// tickets are meant for browsers, which send a preflight request because of the auth header
+	w.Header().Add("Vary", "Origin")
+	if origin := r.Header.Get("Origin"); origin != "" && intersects(origins, []string{origin}) {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Allow-Headers", AuthHeaderKey)
+		w.Header().Set("Access-Control-Allow-Methods", http.MethodPost)
+	}
+	switch r.Method {
+	case http.MethodOptions:
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case http.MethodPost:
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var flow *FlowReference
+	if s := r.URL.Query().Get("flow"); s != "" {
+		f, err := ParseFlowReference(s)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		flow = &f
+	}
+
+	authToken := r.Header.Get(AuthHeaderKey)
+	if authToken == "" {
+		http.Error(w, "missing authentication token", http.StatusForbidden)
+		return
+	}
+	usrInfo, err := authenticator.Authenticate(r.Context(), authToken)
+	if err != nil {
+		log.Event(logs, "authentication failed", log.V(1), log.Error(err))
+		statusCode := http.StatusInternalServerError
+		if IsUnauthenticatedError(err) {
+			statusCode = http.StatusForbidden
+		}
+		http.Error(w, err.Error(), statusCode)
+		return
+	}
+
+	ticket, expires, err := tickets.Issue(authToken, usrInfo, flow)
+	if err != nil {
+		log.Event(logs, "failed to issue ticket", log.Error(err), log.Fields{"user": usrInfo})
+		if _, ok := err.(limitExceededError); ok {
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+			return
+		}
+		http.Error(w, "failed to issue ticket", http.StatusInternalServerError)
+		return
+	}
+	log.Event(logs, "issued ticket", log.V(1), log.Fields{"user": usrInfo, "flow": flow, "expires": expires})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(w).Encode(struct {
+		Ticket  string    `json:"ticket"`
+		Expires time.Time `json:"expires"`
+	}{ticket, expires})
+}
+
 type UnauthenticatedError interface {
 	IsUnauthenticatedError() bool
 }
@@ -127,28 +334,70 @@ type Listener interface {
 }
 
 type listener struct {
-	conn    *websocket.Conn
-	flow    FlowReference
-	logs    log.Sink
-	metrics listenerMetrics
-	reg     ListenerRegistry
-	usrInfo authv1.UserInfo
+	// accessed atomically, first in the struct to be 64-bit aligned
+	recordsAggregated uint64
+	recordsDropped    uint64
+	recordsRedacted   uint64
+	recordsSent       uint64
+	recordsSkipped    uint64
+	skipped           uint64 // since the last status message
+	pluginsDropped    uint64 // records dropped because the plugins couldn't keep up, since they were last added to dropped
+
+	aggregator    *aggregator
+	audit         AuditSink
+	auditInfo     AuditEvent // the event of accepting the listener
+	authenticator Authenticator
+	conn          *websocket.Conn
+	decisions     map[string]policy // the last policy decision for each pod, at most maxAuditedDecisions (only accessed by Send)
+	done          chan struct{}
+	flow          FlowReference
+	limiter       *rateLimiter
+	logs          log.Sink
+	metrics       listenerMetrics
+	plugins       Pipeline // only accessed by runPlugins
+	pluginQueue   chan pluginJob
+	refreshed     chan struct{}
+	reg           ListenerRegistry
+	release       func()
+	sampler       *sampler // only accessed by Send
+
+	// dropped counts the records dropped because of rate limits since lastNotice (only accessed by deliver)
+	dropped    uint64
+	lastNotice time.Time
+
+	// mutex guards the listener's credentials, which are replaced by revalidation and refreshes, and the close reason
+	mutex       sync.Mutex
+	closeReason string
+	expires     time.Time
+	token       string
+	usrInfo     authv1.UserInfo
+
+	// writeMutex serializes writing messages to the connection
+	writeMutex sync.Mutex
 }
 
+const (
+	// tokenExpiryNotice is how long before the token expires the listener is notified
+	tokenExpiryNotice = time.Minute
+	closeTimeout      = 5 * time.Second
+	// maxAuditedDecisions is the number of pods whose last policy decision a listener remembers for auditing
+	maxAuditedDecisions = 10000
+)
+
 type listenerMetrics interface {
 	LogRecordRedacted(l Listener, r Record)
 	LogRecordTransmitted(l Listener, r Record)
 }
 
-func (l listener) Equals(o listener) bool {
+func (l *listener) Equals(o *listener) bool {
 	return l.conn == o.conn
 }
 
-func (l listener) Flow() FlowReference {
+func (l *listener) Flow() FlowReference {
 	return l.flow
 }
 
-func (l listener) Format(f fmt.State, c rune) {
+func (l *listener) Format(f fmt.State, c rune) {
 	type listener struct {
 		Conn *websocket.Conn
 		Flow FlowReference
@@ -164,77 +413,434 @@ func (l listener) Format(f fmt.State, c rune) {
 	fmt.Fprintf(f, fmt.Sprintf("%%%s%c", flag, c), listener{
 		Conn: l.conn,
 		Flow: l.flow,
-		User: l.usrInfo,
+		User: l.User(),
 	})
 }
 
 func (l *listener) Send(r Record) {
 	log.Event(l.logs, "processing log record", log.V(2), log.Fields{"listener": l, "record": r})
 
+	if l.sampler != nil && !l.sampler.keep(time.Now(), r.Data.Kubernetes.PodName) {
+		log.Event(l.logs, "skipping log record", log.V(2), log.Fields{"listener": l, "record": r})
+		atomic.AddUint64(&l.recordsSkipped, 1)
+		atomic.AddUint64(&l.skipped, 1)
+		return
+	}
+
 	rules, err := loadRBACRules(r)
 	if err != nil {
 		log.Event(l.logs, "an error occurred while loading RBAC rules from record", log.V(1), log.Fields{"record": r})
 	}
 
+	usrInfo := l.User()
 	data := r.RawData
-	if !rules.canView(l.usrInfo) {
+	decision := policyAllow
+	if !rules.canView(usrInfo) {
 		log.Event(l.logs, "listener does not have permission to view log record", log.V(1), log.Fields{"listener": l, "record": r, "rules": rules})
-		l.metrics.LogRecordRedacted(l, r)
+		decision = policyDeny
+
+		data = []byte(fmt.Sprintf(`{"error": "Permission denied to access %s logs for %s"}`, r.Data.Kubernetes.PodName, usrInfo.Username))
+	}
+	// audit decisions when they are first made or change instead of for every record
+	if pod := r.Data.Kubernetes.PodName; l.decisions[pod] != decision {
+		if len(l.decisions) >= maxAuditedDecisions {
+			// forget the decisions instead of growing without bounds, they are audited again when made next
+			l.decisions = make(map[string]policy)
+		}
+		l.decisions[pod] = decision
+		e := l.auditEvent(AuditPolicyDecision)
+		e.User, e.Groups = usrInfo.Username, usrInfo.Groups
+		e.Pod, e.Decision = pod, decision
+		l.audit.Audit(e)
+	}
+
+	if l.aggregator != nil {
+		// only count the records the listener is allowed to see
+		if decision == policyDeny {
+			atomic.AddUint64(&l.recordsRedacted, 1)
+		} else if err := l.aggregator.add(r.RawData); err != nil {
+			log.Event(l.logs, "failed to aggregate log record", log.V(1), log.Error(err), log.Fields{"listener": l, "record": r})
+		} else {
+			atomic.AddUint64(&l.recordsAggregated, 1)
+		}
+		return
+	}
 
-		data = []byte(fmt.Sprintf(`{"error": "Permission denied to access %s logs for %s"}`, r.Data.Kubernetes.PodName, l.usrInfo.Username))
+	if l.plugins != nil {
+		select {
+		case l.pluginQueue <- pluginJob{record: r, data: data, decision: decision}:
+		default:
+			log.Event(l.logs, "plugins can't keep up, dropping log record", log.V(2), log.Fields{"listener": l, "record": r})
+			atomic.AddUint64(&l.recordsDropped, 1)
+			atomic.AddUint64(&l.pluginsDropped, 1)
+		}
+		return
+	}
+	l.deliver(r, data, decision)
+}
+
+// deliver sends data (the record or what the listener's plugins made of it) to the listener, subject to rate limits.
+// It is called by Send, or by runPlugins if the listener runs plugins.
+func (l *listener) deliver(r Record, data []byte, decision policy) {
+	l.dropped += atomic.SwapUint64(&l.pluginsDropped, 0)
+	now := time.Now()
+	if !l.limiter.allow(now, len(data)) {
+		log.Event(l.logs, "rate limit exceeded, dropping log record", log.V(2), log.Fields{"listener": l, "record": r})
+		atomic.AddUint64(&l.recordsDropped, 1)
+		l.dropped++
+		l.notifyDropped(now)
+		return
+	}
+	if decision == policyDeny {
+		l.metrics.LogRecordRedacted(l, r)
+		atomic.AddUint64(&l.recordsRedacted, 1)
 	} else {
 		l.metrics.LogRecordTransmitted(l, r)
+		atomic.AddUint64(&l.recordsSent, 1)
 	}
 
 	log.Event(l.logs, "sending log record to listener", log.V(1), log.Fields{"listener": l, "record": r})
 
-	wc, err := l.conn.NextWriter(websocket.BinaryMessage)
-	if err != nil {
-		log.Event(l.logs, "an error occurred while getting next writer for websocket connection", log.V(1), log.Error(err))
-		goto unregister
+	if err := l.writeMessage(websocket.BinaryMessage, data); err != nil {
+		log.Event(l.logs, "an error occurred while writing record to websocket connection", log.V(1), log.Error(err))
+		go l.reg.Unregister(l)
+		return
 	}
+	l.notifyDropped(now)
+}
 
-	if _, err := wc.Write(data); err != nil {
-		log.Event(l.logs, "an error occurred while writing record data to websocket connection", log.V(1), log.Error(err))
-		goto unregister
+// pluginJob is a record waiting to be processed by the plugins of a listener
+type pluginJob struct {
+	record   Record
+	data     []byte
+	decision policy
+}
+
+// runPlugins runs the records the listener is allowed to see through its plugins until the listener disconnects.
+// Records are processed off the goroutine calling Send, so that slow plugins don't hold up other listeners.
+func (l *listener) runPlugins(tickInterval time.Duration) {
+	defer func() {
+		if err := l.plugins.Close(); err != nil {
+			log.Event(l.logs, "failed to close listener plugins", log.V(1), log.Error(err), log.Fields{"listener": l})
+		}
+	}()
+	var ticks <-chan time.Time
+	if l.plugins.Ticking() && tickInterval > 0 {
+		ticker := time.NewTicker(tickInterval)
+		defer ticker.Stop()
+		ticks = ticker.C
+	}
+	for {
+		var job pluginJob
+		select {
+		case <-l.done:
+			return
+		case now := <-ticks:
+			if !l.tickPlugins(now) {
+				return
+			}
+			continue
+		case job = <-l.pluginQueue:
+		}
+		if job.decision == policyDeny {
+			// plugins only see the records the listener is allowed to see
+			l.deliver(job.record, job.data, job.decision)
+			continue
+		}
+		outputs, err := l.plugins.ProcessRecord(job.data, job.record.Meta())
+		var violation *SandboxViolationError
+		if errors.As(err, &violation) {
+			l.disconnect(websocket.ClosePolicyViolation, violation.Error())
+			return
+		}
+		if err != nil {
+			log.Event(l.logs, "listener plugins failed to process log record", log.V(1), log.Error(err), log.Fields{"listener": l, "record": job.record})
+		}
+		// the listener gets the records routed to named outputs as well, it is up to the listener to route them
+		for _, out := range outputs {
+			l.deliver(job.record, out.Data, job.decision)
+		}
 	}
+}
 
-	if err := wc.Close(); err != nil {
-		log.Event(l.logs, "an error occurred while flushing frame to websocket connection", log.V(1), log.Error(err))
-		goto unregister
+// tickPlugins sends the records emitted by ticking the plugins to the listener, it returns false if the listener was disconnected because a plugin exceeded its limits
+func (l *listener) tickPlugins(now time.Time) bool {
+	outputs, err := l.plugins.Tick(now)
+	var violation *SandboxViolationError
+	if errors.As(err, &violation) {
+		l.disconnect(websocket.ClosePolicyViolation, violation.Error())
+		return false
 	}
+	if err != nil {
+		log.Event(l.logs, "failed to tick listener plugins", log.V(1), log.Error(err), log.Fields{"listener": l})
+	}
+	for _, out := range outputs {
+		l.deliver(Record{}, out.Data, policyAllow)
+	}
+	return true
+}
 
-	return
+// sendAggregates sends the aggregated rows to the listener at the end of each window
+func (l *listener) sendAggregates() {
+	start, end := l.aggregator.window(time.Now())
+	for {
+		timer := time.NewTimer(time.Until(end))
+		select {
+		case <-l.done:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		l.sendControlMessage(ControlMessage{Type: CMAggregate, Start: &start, End: &end, Rows: l.aggregator.flush()})
+		start, end = end, end.Add(l.aggregator.opts.Window)
+	}
+}
 
-unregister:
-	go l.reg.Unregister(l)
+// reportSkipped periodically tells the listener how many records were skipped by sampling
+func (l *listener) reportSkipped() {
+	ticker := time.NewTicker(samplingStatusInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.done:
+			return
+		case <-ticker.C:
+			if skipped := atomic.SwapUint64(&l.skipped, 0); skipped > 0 {
+				l.sendControlMessage(ControlMessage{Type: CMStatus, Skipped: skipped})
+			}
+		}
+	}
+}
+
+// notifyDropped tells the listener how many records were dropped because of rate limits, at most once per rateLimitNoticeInterval
+func (l *listener) notifyDropped(now time.Time) {
+	if l.dropped == 0 || now.Sub(l.lastNotice) < rateLimitNoticeInterval {
+		return
+	}
+	l.sendControlMessage(ControlMessage{Type: CMRateLimited, Dropped: l.dropped})
+	l.dropped = 0
+	l.lastNotice = now
 }
 
 func (l *listener) User() authv1.UserInfo {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
 	return l.usrInfo
 }
 
-// readLoop reads the websocket connection so we handle close messages
+func (l *listener) writeMessage(typ int, data []byte) error {
+	l.writeMutex.Lock()
+	defer l.writeMutex.Unlock()
+
+	wc, err := l.conn.NextWriter(typ)
+	if err != nil {
+		return err
+	}
+	if _, err := wc.Write(data); err != nil {
+		return err
+	}
+	return wc.Close()
+}
+
+func (l *listener) sendControlMessage(msg ControlMessage) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		log.Event(l.logs, "failed to encode control message", log.Error(err))
+		return
+	}
+	if err := l.writeMessage(websocket.TextMessage, data); err != nil {
+		log.Event(l.logs, "an error occurred while writing control message to websocket connection", log.V(1), log.Error(err))
+	}
+}
+
+// auditEvent returns an audit event of the specified type about the listener
+func (l *listener) auditEvent(typ AuditEventType) AuditEvent {
+	e := l.auditInfo
+	e.Time = time.Now()
+	e.Type = typ
+	return e
+}
+
+// disconnect closes the connection with the specified reason and unregisters the listener
+func (l *listener) disconnect(code int, reason string) {
+	log.Event(l.logs, "disconnecting listener", log.Fields{"listener": l, "reason": reason})
+	l.mutex.Lock()
+	l.closeReason = reason
+	l.mutex.Unlock()
+	if len(reason) > 123 { // the maximum length of a close reason
+		reason = reason[:123]
+	}
+	if err := l.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(closeTimeout)); err != nil {
+		log.Event(l.logs, "an error occurred while writing close message to websocket connection", log.V(1), log.Error(err))
+	}
+	_ = l.conn.Close()
+	go l.reg.Unregister(l)
+}
+
+// readLoop reads the websocket connection so we handle close and control messages
 func (l *listener) readLoop() {
+	defer close(l.done)
+	defer l.release()
 	for {
 		typ, dat, err := l.conn.ReadMessage()
-		log.Event(l.logs, "read message from listener", log.V(2), log.Fields{"type": typ, "data": dat, "error": err})
+		log.Event(l.logs, "read message from listener", log.V(2), log.Fields{"type": typ, "error": err})
 		if err != nil {
 			log.Event(l.logs, "an error occurred while reading websocket connection", log.V(1), log.Error(err))
+			l.auditDisconnect(err)
 			return
 		}
-		if typ == websocket.CloseMessage {
+		switch typ {
+		case websocket.CloseMessage:
+			l.auditDisconnect(errors.New("closed by listener"))
 			return
+		case websocket.TextMessage:
+			var msg ControlMessage
+			if err := json.Unmarshal(dat, &msg); err != nil {
+				log.Event(l.logs, "failed to decode control message from listener", log.V(1), log.Error(err))
+				continue
+			}
+			switch msg.Type {
+			case CMRefresh:
+				l.refresh(msg.Token)
+			default:
+				log.Event(l.logs, "unknown control message type", log.V(1), log.Fields{"type": msg.Type})
+			}
 		}
 	}
 }
 
-func ExtractFlow(req *http.Request) (res FlowReference, err error) {
-	if elts := strings.Split(strings.Trim(req.URL.Path, "/"), "/"); len(elts) == 3 {
-		res.Kind, res.Namespace, res.Name = FlowKind(elts[0]), elts[1], elts[2]
+func (l *listener) auditDisconnect(err error) {
+	e := l.auditEvent(AuditListenerDisconnected)
+	connected := l.auditInfo.Time
+	e.Connected = &connected
+	e.RecordsAggregated = atomic.LoadUint64(&l.recordsAggregated)
+	e.RecordsDropped = atomic.LoadUint64(&l.recordsDropped)
+	e.RecordsSent = atomic.LoadUint64(&l.recordsSent)
+	e.RecordsSkipped = atomic.LoadUint64(&l.recordsSkipped)
+	e.RecordsRedacted = atomic.LoadUint64(&l.recordsRedacted)
+	l.mutex.Lock()
+	e.User, e.Groups = l.usrInfo.Username, l.usrInfo.Groups
+	e.Reason = l.closeReason
+	l.mutex.Unlock()
+	if e.Reason == "" {
+		e.Reason = err.Error()
+	}
+	l.audit.Audit(e)
+}
+
+// refresh replaces the listener's token if the new one authenticates the same user
+func (l *listener) refresh(token string) {
+	usrInfo, err := l.authenticator.Authenticate(context.Background(), token)
+	if err == nil && usrInfo.Username != l.User().Username {
+		err = errors.New("token belongs to a different user")
+	}
+	if err != nil {
+		log.Event(l.logs, "failed to refresh listener token", log.V(1), log.Error(err), log.Fields{"listener": l})
+		l.sendControlMessage(ControlMessage{Type: CMRefreshFailed, Error: err.Error()})
 		return
 	}
-	return res, errors.New("URL path is not a valid flow reference")
+
+	expires, ok := tokenExpiry(token)
+	l.mutex.Lock()
+	l.expires = expires
+	l.token = token
+	l.usrInfo = usrInfo
+	l.mutex.Unlock()
+
+	log.Event(l.logs, "refreshed listener token", log.V(1), log.Fields{"listener": l, "expires": expires})
+	msg := ControlMessage{Type: CMRefreshed}
+	if ok {
+		msg.Expires = &expires
+	}
+	l.sendControlMessage(msg)
+	select {
+	case l.refreshed <- struct{}{}:
+	default:
+	}
+}
+
+// watchAccess periodically revalidates the listener's token and disconnects the listener if access is revoked or the token expires
+func (l *listener) watchAccess(interval time.Duration) {
+	var ticks <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		ticks = ticker.C
+	}
+	var notified time.Time // expiry the listener has been notified about
+	for {
+		l.mutex.Lock()
+		expires := l.expires
+		l.mutex.Unlock()
+
+		var expiring, expired <-chan time.Time
+		var timers []*time.Timer
+		if !expires.IsZero() {
+			expiredTimer := time.NewTimer(time.Until(expires))
+			expired = expiredTimer.C
+			timers = append(timers, expiredTimer)
+			if !notified.Equal(expires) {
+				expiringTimer := time.NewTimer(time.Until(expires.Add(-tokenExpiryNotice)))
+				expiring = expiringTimer.C
+				timers = append(timers, expiringTimer)
+			}
+		}
+
+		stop := false
+		select {
+		case <-l.done:
+			stop = true
+		case <-l.refreshed:
+		case <-ticks:
+			stop = !l.revalidate()
+		case <-expiring:
+			notified = expires
+			l.sendControlMessage(ControlMessage{Type: CMExpiring, Expires: &expires})
+		case <-expired:
+			l.disconnect(websocket.ClosePolicyViolation, "token expired")
+			stop = true
+		}
+		for _, t := range timers {
+			t.Stop()
+		}
+		if stop {
+			return
+		}
+	}
+}
+
+// revalidate authenticates the listener's token again and returns whether the listener is still connected
+func (l *listener) revalidate() bool {
+	l.mutex.Lock()
+	token, username := l.token, l.usrInfo.Username
+	l.mutex.Unlock()
+
+	usrInfo, err := l.authenticator.Authenticate(context.Background(), token)
+	switch {
+	case IsUnauthenticatedError(err):
+		l.disconnect(websocket.ClosePolicyViolation, "access revoked: "+err.Error())
+		return false
+	case err != nil:
+		// keep the listener connected, the authentication backend is probably unavailable
+		log.Event(l.logs, "failed to revalidate listener token", log.Error(err), log.Fields{"listener": l})
+		return true
+	case usrInfo.Username != username:
+		l.disconnect(websocket.ClosePolicyViolation, "access revoked: token belongs to a different user")
+		return false
+	}
+
+	l.mutex.Lock()
+	l.usrInfo = usrInfo // e.g. groups might have changed
+	l.mutex.Unlock()
+	log.Event(l.logs, "revalidated listener token", log.V(2), log.Fields{"listener": l})
+	return true
+}
+
+func ExtractFlow(req *http.Request) (res FlowReference, err error) {
+	if res, err = ParseFlowReference(req.URL.Path); err != nil {
+		return res, errors.New("URL path is not a valid flow reference")
+	}
+	return
 }
 
 func loadRBACRules(r Record) (res rbacRules, err error) {
@@ -259,12 +865,7 @@ loop:
 type rbacRules map[string]policy
 
 func (rs rbacRules) canView(userInfo authv1.UserInfo) bool {
-	key := userInfo.Username
-	// skip first 2 segments
-	key = key[strings.IndexRune(key, ':')+1:]
-	key = key[strings.IndexRune(key, ':')+1:]
-	key = strings.ReplaceAll(key, ":", "_")
-	if p, ok := rs[key]; ok { // user has custom policy
+	if p, ok := rs[rbacKey(userInfo.Username)]; ok { // user has custom policy
 		return p == policyAllow
 	}
 	if p, ok := rs["policy"]; ok { // user has no custom policy, try using default policy
@@ -273,6 +874,29 @@ func (rs rbacRules) canView(userInfo authv1.UserInfo) bool {
 	return false // default policy is deny
 }
 
+// rbacKey returns the key of the RBAC label of a user: NAMESPACE_NAME for service accounts and user.ESCAPED_USERNAME for other users (e.g. OIDC users).
+// Namespaces can't contain dots, so the keys of other users can't collide with the ones of service accounts (or with policy).
+// In the user names, bytes not allowed in label names are escaped as _XX (hexadecimal), e.g. oidc:alice@example.com becomes user.oidc_3aalice_40example.com.
+func rbacKey(username string) string {
+	const saPrefix = "system:serviceaccount:"
+	if strings.HasPrefix(username, saPrefix) {
+		if elts := strings.Split(username[len(saPrefix):], ":"); len(elts) == 2 {
+			return elts[0] + "_" + elts[1]
+		}
+	}
+	var sb strings.Builder
+	sb.WriteString("user.")
+	for i := 0; i < len(username); i++ {
+		c := username[i]
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '.' {
+			sb.WriteByte(c)
+		} else {
+			fmt.Fprintf(&sb, "_%02x", c)
+		}
+	}
+	return sb.String()
+}
+
 type policy string
 
 const policyAllow policy = "allow"
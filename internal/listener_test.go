@@ -0,0 +1,18 @@
+package internal
+
+import "testing"
+
+func TestRBACKey(t *testing.T) {
+	tests := map[string]string{
+		"system:serviceaccount:default:alice": "default_alice",
+		"oidc:alice@example.com":              "user.oidc_3aalice_40example.com",
+		"oidc:default:alice":                  "user.oidc_3adefault_3aalice",
+		"policy":                              "user.policy",
+		"a_b":                                 "user.a_5fb",
+	}
+	for username, key := range tests {
+		if res := rbacKey(username); res != key {
+			t.Errorf("expected key %q for user %q, got %q", key, username, res)
+		}
+	}
+}
@@ -0,0 +1,431 @@
+package internal
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/banzaicloud/log-socket/log"
+	"github.com/wasmerio/wasmer-go/wasmer"
+)
+
+const (
+	PluginEndpoint = "/plugins"
+	PluginQueryKey = "plugin"
+
+	// UploadedPluginPrefix starts the references of uploaded plugins, which are followed by the hex encoded SHA-256 digest of the module
+	UploadedPluginPrefix = "sha256:"
+
+	// maxPluginUploads is the maximum number of uploaded plugins kept by the service at the same time
+	maxPluginUploads = 64
+	// pluginAllowListTTL is how long the plugins of an allow-list are cached
+	pluginAllowListTTL = 30 * time.Second
+	// pluginQueueSize is the number of records buffered for the plugins of a listener, further records are dropped
+	pluginQueueSize = 1024
+)
+
+// ListenerPluginPolicy decides which plugins listeners can run on the service
+type ListenerPluginPolicy string
+
+const (
+	// LPPDisabled doesn't let listeners run plugins
+	LPPDisabled ListenerPluginPolicy = "disabled"
+	// LPPAllowList lets listeners run the plugins of the allow-list
+	LPPAllowList ListenerPluginPolicy = "allow-list"
+	// LPPAny lets listeners also run the plugins they upload
+	LPPAny ListenerPluginPolicy = "any"
+)
+
+var ListenerPluginPolicies = []ListenerPluginPolicy{LPPDisabled, LPPAllowList, LPPAny}
+
+func ParseListenerPluginPolicy(s string) (ListenerPluginPolicy, error) {
+	for _, p := range ListenerPluginPolicies {
+		if s == string(p) {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("invalid listener plugin policy %q (must be one of %v)", s, ListenerPluginPolicies)
+}
+
+// PluginAllowList provides the plugins listeners can reference by name
+type PluginAllowList interface {
+	// Plugin returns the code of the named plugin, or an error for which IsUnknownPluginError is true if there is no such plugin
+	Plugin(ctx context.Context, name string) ([]byte, error)
+}
+
+// NewConfigMapPluginAllowList returns the allow-list of the plugins in the ConfigMap
+func NewConfigMapPluginAllowList(c client.Reader, configMap types.NamespacedName) *ConfigMapPluginAllowList {
+	return &ConfigMapPluginAllowList{Client: c, ConfigMap: configMap, now: time.Now}
+}
+
+// ConfigMapPluginAllowList reads the plugins from the binary data of a ConfigMap, keyed by their names.
+// The ConfigMap is cached for pluginAllowListTTL, so changes take effect within that long.
+type ConfigMapPluginAllowList struct {
+	Client    client.Reader
+	ConfigMap types.NamespacedName
+
+	mutex   sync.Mutex
+	fetched time.Time
+	plugins map[string][]byte
+	now     func() time.Time
+}
+
+func (a *ConfigMapPluginAllowList) Plugin(ctx context.Context, name string) ([]byte, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if now := a.now(); a.plugins == nil || now.Sub(a.fetched) >= pluginAllowListTTL {
+		var cm corev1.ConfigMap
+		if err := a.Client.Get(ctx, a.ConfigMap, &cm); err != nil {
+			return nil, fmt.Errorf("failed to get plugin allow-list: %w", err)
+		}
+		a.plugins = cm.BinaryData
+		if a.plugins == nil {
+			a.plugins = map[string][]byte{}
+		}
+		a.fetched = now
+	}
+	code, ok := a.plugins[name]
+	if !ok {
+		return nil, unknownPluginError(name)
+	}
+	return code, nil
+}
+
+type unknownPluginError string
+
+func (e unknownPluginError) Error() string {
+	return fmt.Sprintf("unknown plugin %q", string(e))
+}
+
+func IsUnknownPluginError(err error) bool {
+	var e unknownPluginError
+	return errors.As(err, &e)
+}
+
+// listenerPluginError is an error caused by the plugins requested by a listener, which is reported to the listener with the status code
+type listenerPluginError struct {
+	status int
+	err    error
+}
+
+func (e listenerPluginError) Error() string {
+	return e.err.Error()
+}
+
+func (e listenerPluginError) Unwrap() error {
+	return e.err
+}
+
+// NewListenerPlugins returns the plugins listeners can run on the service according to the policy
+func NewListenerPlugins(policy ListenerPluginPolicy, allowList PluginAllowList, limits PluginLimits) *ListenerPlugins {
+	return &ListenerPlugins{
+		AllowList: allowList,
+		Limits:    limits,
+		Policy:    policy,
+
+		abandoned: make(map[string]int),
+		allowed:   make(map[string]compiledPlugin),
+		engine:    wasmer.NewEngine(),
+		now:       time.Now,
+		uploads:   make(map[string]compiledPlugin),
+	}
+}
+
+// ListenerPlugins compiles the plugins listeners run on the service and instantiates them for each listener separately
+type ListenerPlugins struct {
+	// AllowList holds the plugins listeners can reference by name (none if nil)
+	AllowList PluginAllowList
+	// Limits bounds the resources of each instance of a plugin; the listener is disconnected if a plugin exceeds them
+	Limits PluginLimits
+	// MaxAbandonedCalls is the maximum number of calls into plugins that timed out and are still running, after which listeners can't load plugins (unlimited if 0).
+	// Such calls can't be interrupted, so they keep using a CPU each.
+	MaxAbandonedCalls int
+	// MaxAbandonedCallsPerUser is MaxAbandonedCalls for the plugins loaded by each user (unlimited if 0)
+	MaxAbandonedCallsPerUser int
+	// MaxUploadSize is the maximum size of uploaded modules in bytes (unlimited if 0)
+	MaxUploadSize int64
+	Policy        ListenerPluginPolicy
+	// TickInterval is how often the plugins exporting tick are ticked (never if 0).
+	// Plugins aren't flushed, since the listener is gone by the time its plugins are closed.
+	TickInterval time.Duration
+	// UploadTTL is how long uploaded plugins are kept after they were last uploaded
+	UploadTTL time.Duration
+
+	mutex          sync.Mutex
+	abandoned      map[string]int // the number of abandoned calls by user
+	abandonedTotal int
+	allowed        map[string]compiledPlugin // compiled allow-listed plugins by name
+	engine         *wasmer.Engine
+	now            func() time.Time
+	uploads        map[string]compiledPlugin // compiled uploaded plugins by digest
+}
+
+type compiledPlugin struct {
+	digest  string
+	expires time.Time // only set for uploaded plugins
+	module  []byte    // the serialized compiled module
+}
+
+// Upload compiles an uploaded module and keeps it for UploadTTL, returning the reference listeners can run it with
+func (p *ListenerPlugins) Upload(code []byte) (ref string, expires time.Time, err error) {
+	if p.Policy != LPPAny {
+		return "", time.Time{}, listenerPluginError{http.StatusForbidden, errors.New("uploading plugins is not permitted")}
+	}
+	digest := pluginDigest(code)
+	if ref, expires, err = p.keepUpload(digest, nil); ref != "" || err != nil {
+		return
+	}
+	// compiling takes a while, so it's done without holding the mutex
+	module, err := p.compile(code)
+	if err != nil {
+		return "", time.Time{}, listenerPluginError{http.StatusBadRequest, fmt.Errorf("invalid plugin: %w", err)}
+	}
+	return p.keepUpload(digest, module)
+}
+
+// keepUpload extends the expiry of the uploaded plugin with the digest, or keeps the compiled module (if not nil) as the plugin if there is room for it.
+// The limit and the plugins kept are checked again after compiling, as other uploads may have been kept meanwhile; if the same plugin was, the module is dropped.
+// It returns an empty reference if the plugin isn't kept yet and the module is nil.
+func (p *ListenerPlugins) keepUpload(digest string, module []byte) (ref string, expires time.Time, err error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.expireUploads()
+	plugin, ok := p.uploads[digest]
+	if !ok {
+		if len(p.uploads) >= maxPluginUploads {
+			return "", time.Time{}, listenerPluginError{http.StatusServiceUnavailable, errors.New("too many uploaded plugins, try again later")}
+		}
+		if module == nil {
+			return "", time.Time{}, nil
+		}
+		plugin = compiledPlugin{digest: digest, module: module}
+	}
+	plugin.expires = p.now().Add(p.UploadTTL)
+	p.uploads[digest] = plugin
+	return UploadedPluginPrefix + digest, plugin.expires, nil
+}
+
+// expireUploads removes the uploaded plugins that expired, the mutex must be held
+func (p *ListenerPlugins) expireUploads() {
+	now := p.now()
+	for k, v := range p.uploads {
+		if !now.Before(v.expires) {
+			delete(p.uploads, k)
+		}
+	}
+}
+
+// Load instantiates the plugins referenced by a listener of the user as a pipeline, which has to be closed when it's no longer used.
+// References are in the format NAME[?KEY=VALUE&...], where NAME is the name of an allow-listed plugin or the reference of an uploaded one, and the query is the configuration of the plugin.
+func (p *ListenerPlugins) Load(ctx context.Context, logs log.Sink, user string, refs []string) (res Pipeline, err error) {
+	if p.Policy == LPPDisabled {
+		return nil, listenerPluginError{http.StatusForbidden, errors.New("plugins are disabled on this service")}
+	}
+	if err := p.checkAbandonedCalls(user); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			_ = res.Close()
+			res = nil
+		}
+	}()
+	// instances of the same listener share a store, but nothing else
+	store := wasmer.NewStore(p.engine)
+	limits := p.Limits
+	limits.OnViolation = VPAbort
+	for _, ref := range refs {
+		name, config, err := ParsePluginReference(ref)
+		if err != nil {
+			return res, listenerPluginError{http.StatusBadRequest, err}
+		}
+		plugin, err := p.resolve(ctx, name)
+		if err != nil {
+			return res, err
+		}
+		module, err := wasmer.DeserializeModule(store, plugin.module)
+		if err != nil {
+			return res, fmt.Errorf("failed to load compiled plugin %s: %w", name, err)
+		}
+		opts := PluginOptions{Limits: limits, OnAbandon: p.abandon(logs, user, name)}
+		if config != nil {
+			if opts.Config, err = json.Marshal(config); err != nil {
+				return res, err
+			}
+		}
+		stage, err := LoadStage(store, logs, name, module, opts)
+		if err != nil {
+			return res, listenerPluginError{http.StatusBadRequest, fmt.Errorf("failed to load plugin %s: %w", name, err)}
+		}
+		res = append(res, stage)
+	}
+	return res, nil
+}
+
+// checkAbandonedCalls returns an error if the user or all users together have too many abandoned calls
+func (p *ListenerPlugins) checkAbandonedCalls(user string) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.MaxAbandonedCallsPerUser > 0 && p.abandoned[user] >= p.MaxAbandonedCallsPerUser {
+		return listenerPluginError{http.StatusTooManyRequests, errors.New("too many calls into your plugins did not return, try again later")}
+	}
+	if p.MaxAbandonedCalls > 0 && p.abandonedTotal >= p.MaxAbandonedCalls {
+		return listenerPluginError{http.StatusServiceUnavailable, errors.New("too many calls into plugins did not return, try again later")}
+	}
+	return nil
+}
+
+// abandon returns the function counting the abandoned calls into a plugin of the user until they return
+func (p *ListenerPlugins) abandon(logs log.Sink, user, plugin string) func() func() {
+	return func() func() {
+		p.mutex.Lock()
+		p.abandoned[user]++
+		p.abandonedTotal++
+		p.mutex.Unlock()
+		log.Event(logs, "abandoned plugin call", log.V(1), log.Fields{"user": user, "plugin": plugin})
+		return func() {
+			p.mutex.Lock()
+			if p.abandoned[user]--; p.abandoned[user] == 0 {
+				delete(p.abandoned, user)
+			}
+			p.abandonedTotal--
+			p.mutex.Unlock()
+			log.Event(logs, "abandoned plugin call returned", log.V(1), log.Fields{"user": user, "plugin": plugin})
+		}
+	}
+}
+
+// resolve returns the compiled plugin a listener referenced by name
+func (p *ListenerPlugins) resolve(ctx context.Context, name string) (compiledPlugin, error) {
+	if strings.HasPrefix(name, UploadedPluginPrefix) {
+		if p.Policy != LPPAny {
+			return compiledPlugin{}, listenerPluginError{http.StatusForbidden, errors.New("running uploaded plugins is not permitted")}
+		}
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+		p.expireUploads()
+		plugin, ok := p.uploads[strings.TrimPrefix(name, UploadedPluginPrefix)]
+		if !ok {
+			return compiledPlugin{}, listenerPluginError{http.StatusBadRequest, fmt.Errorf("plugin %s was not uploaded or it expired", name)}
+		}
+		return plugin, nil
+	}
+
+	if p.AllowList == nil {
+		return compiledPlugin{}, listenerPluginError{http.StatusBadRequest, unknownPluginError(name)}
+	}
+	code, err := p.AllowList.Plugin(ctx, name)
+	if IsUnknownPluginError(err) {
+		return compiledPlugin{}, listenerPluginError{http.StatusBadRequest, err}
+	}
+	if err != nil {
+		return compiledPlugin{}, err
+	}
+	digest := pluginDigest(code)
+	p.mutex.Lock()
+	plugin, ok := p.allowed[name]
+	p.mutex.Unlock()
+	if ok && plugin.digest == digest {
+		return plugin, nil
+	}
+	// the plugin is new or it was replaced in the allow-list
+	module, err := p.compile(code)
+	if err != nil {
+		return compiledPlugin{}, fmt.Errorf("failed to compile allow-listed plugin %s: %w", name, err)
+	}
+	plugin = compiledPlugin{digest: digest, module: module}
+	p.mutex.Lock()
+	p.allowed[name] = plugin
+	p.mutex.Unlock()
+	return plugin, nil
+}
+
+// compile compiles a module and returns it serialized, so that it can be instantiated without compiling it again
+func (p *ListenerPlugins) compile(code []byte) ([]byte, error) {
+	module, err := wasmer.NewModule(wasmer.NewStore(p.engine), code)
+	if err != nil {
+		return nil, err
+	}
+	res, err := module.Serialize()
+	// closing the module also keeps it from being finalized while it is serialized
+	module.Close()
+	return res, err
+}
+
+func pluginDigest(code []byte) string {
+	sum := sha256.Sum256(code)
+	return hex.EncodeToString(sum[:])
+}
+
+// handlePluginUpload compiles the module in the body of requests authenticated by the auth header, and replies with the reference listeners can run it with
+func handlePluginUpload(w http.ResponseWriter, r *http.Request, logs log.Sink, authenticator Authenticator, plugins *ListenerPlugins) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	authToken := r.Header.Get(AuthHeaderKey)
+	if authToken == "" {
+		http.Error(w, "missing authentication token", http.StatusForbidden)
+		return
+	}
+	usrInfo, err := authenticator.Authenticate(r.Context(), authToken)
+	if err != nil {
+		log.Event(logs, "authentication failed", log.V(1), log.Error(err))
+		statusCode := http.StatusInternalServerError
+		if IsUnauthenticatedError(err) {
+			statusCode = http.StatusForbidden
+		}
+		http.Error(w, err.Error(), statusCode)
+		return
+	}
+
+	body := r.Body
+	if plugins.MaxUploadSize > 0 {
+		body = http.MaxBytesReader(w, body, plugins.MaxUploadSize)
+	}
+	code, err := io.ReadAll(body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to read plugin: %s", err), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	ref, expires, err := plugins.Upload(code)
+	if err != nil {
+		log.Event(logs, "failed to upload plugin", log.V(1), log.Error(err), log.Fields{"user": usrInfo.Username})
+		http.Error(w, err.Error(), listenerPluginErrorStatus(err))
+		return
+	}
+	log.Event(logs, "plugin uploaded", log.V(1), log.Fields{"user": usrInfo.Username, "plugin": ref, "size": len(code), "expires": expires})
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(PluginUpload{Plugin: ref, Expires: expires})
+}
+
+// PluginUpload is the response to uploading a plugin
+type PluginUpload struct {
+	// Plugin is the reference listeners can run the plugin with
+	Plugin  string    `json:"plugin"`
+	Expires time.Time `json:"expires"`
+}
+
+// listenerPluginErrorStatus returns the status code the error is reported with
+func listenerPluginErrorStatus(err error) int {
+	var e listenerPluginError
+	if errors.As(err, &e) {
+		return e.status
+	}
+	return http.StatusInternalServerError
+}
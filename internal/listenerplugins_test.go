@@ -0,0 +1,220 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/banzaicloud/log-socket/log"
+	"github.com/wasmerio/wasmer-go/wasmer"
+)
+
+// slowPlugin returns a plugin whose receive spins for about as many iterations as the first byte of the record times 2^22
+func slowPlugin(t *testing.T) []byte {
+	code, err := wasmer.Wat2Wasm(`(module
+  (import "env" "get_data" (func $get_data (param i32)))
+  (memory (export "memory") 1 1)
+  (func (export "abi_version") (result i32) i32.const 1)
+  (func (export "receive") (param $len i32) (local $n i32)
+    (call $get_data (i32.const 0))
+    (local.set $n (i32.shl (i32.load8_u (i32.const 0)) (i32.const 22)))
+    (loop $spin
+      (local.set $n (i32.sub (local.get $n) (i32.const 1)))
+      (br_if $spin (i32.gt_s (local.get $n) (i32.const 0))))))`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code
+}
+
+func TestAbandonedPluginCalls(t *testing.T) {
+	p := NewListenerPlugins(LPPAny, nil, PluginLimits{Timeout: 50 * time.Millisecond})
+	p.MaxAbandonedCalls = 2
+	p.MaxAbandonedCallsPerUser = 1
+	p.UploadTTL = time.Hour
+	ref, _, err := p.Upload(slowPlugin(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	logs := log.NewWriterSink(io.Discard)
+
+	load := func(user string) (Pipeline, int) {
+		pipeline, err := p.Load(context.Background(), logs, user, []string{ref})
+		if err != nil {
+			return nil, listenerPluginErrorStatus(err)
+		}
+		return pipeline, http.StatusOK
+	}
+	abandon := func(user string) {
+		pipeline, status := load(user)
+		if status != http.StatusOK {
+			t.Fatalf("expected %s to load the plugin, got status %d", user, status)
+		}
+		defer pipeline.Close()
+		_, err := pipeline.ProcessRecord([]byte{0x7f}, nil)
+		var violation *SandboxViolationError
+		if !errors.As(err, &violation) {
+			t.Fatalf("expected the call to time out, got %v", err)
+		}
+	}
+
+	abandon("alice")
+	if _, status := load("alice"); status != http.StatusTooManyRequests {
+		t.Errorf("expected alice to be rejected with status %d, got %d", http.StatusTooManyRequests, status)
+	}
+	abandon("bob")
+	if _, status := load("carol"); status != http.StatusServiceUnavailable {
+		t.Errorf("expected carol to be rejected with status %d, got %d", http.StatusServiceUnavailable, status)
+	}
+
+	// the calls return eventually
+	deadline := time.Now().Add(time.Minute)
+	for {
+		pipeline, status := load("alice")
+		if status == http.StatusOK {
+			_ = pipeline.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected alice to be able to load plugins once the abandoned calls returned, got status %d", status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestConcurrentPluginUploads(t *testing.T) {
+	plugin := func(i int) []byte {
+		code, err := wasmer.Wat2Wasm(fmt.Sprintf(`(module (func (export "abi_version") (result i32) i32.const 1) (func (export "id") (result i32) i32.const %d))`, i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return code
+	}
+	p := NewListenerPlugins(LPPAny, nil, PluginLimits{})
+	p.UploadTTL = time.Hour
+	// the uploads only overlap if they run in parallel
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(8))
+
+	// the same plugin uploaded concurrently is kept once
+	same := plugin(-1)
+	var wg sync.WaitGroup
+	refs := make([]string, 8)
+	for i := range refs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ref, _, err := p.Upload(same)
+			if err != nil {
+				t.Error(err)
+			}
+			refs[i] = ref
+		}(i)
+	}
+	wg.Wait()
+	for _, ref := range refs {
+		if ref != refs[0] {
+			t.Fatalf("expected the same reference for the same plugin, got %q", refs)
+		}
+	}
+	module := p.uploads[refs[0][len(UploadedPluginPrefix):]].module
+	if _, _, err := p.Upload(same); err != nil {
+		t.Fatal(err)
+	}
+	if len(p.uploads) != 1 || &p.uploads[refs[0][len(UploadedPluginPrefix):]].module[0] != &module[0] {
+		t.Errorf("expected the module of the plugin to be kept, got %d plugins", len(p.uploads))
+	}
+
+	// concurrent uploads don't exceed the limit
+	var mutex sync.Mutex
+	var kept, rejected int
+	codes := make([][]byte, 2*maxPluginUploads)
+	for i := range codes {
+		codes[i] = plugin(i)
+	}
+	for _, code := range codes {
+		wg.Add(1)
+		go func(code []byte) {
+			defer wg.Done()
+			_, _, err := p.Upload(code)
+			mutex.Lock()
+			defer mutex.Unlock()
+			if err == nil {
+				kept++
+			} else if status := listenerPluginErrorStatus(err); status == http.StatusServiceUnavailable {
+				rejected++
+			} else {
+				t.Errorf("expected the upload to be rejected with status %d, got %v", http.StatusServiceUnavailable, err)
+			}
+		}(code)
+	}
+	wg.Wait()
+	if len(p.uploads) != maxPluginUploads || kept != maxPluginUploads-1 || rejected != maxPluginUploads+1 {
+		t.Errorf("expected %d plugins to be kept, got %d plugins (%d uploads kept, %d rejected)", maxPluginUploads, len(p.uploads), kept, rejected)
+	}
+}
+
+// countingReader returns a ConfigMap holding the plugins and counts how often it was read
+type countingReader struct {
+	client.Reader
+	plugins map[string][]byte
+	gets    int
+}
+
+func (r *countingReader) Get(_ context.Context, _ client.ObjectKey, obj client.Object) error {
+	r.gets++
+	obj.(*corev1.ConfigMap).BinaryData = r.plugins
+	return nil
+}
+
+func TestConfigMapPluginAllowListCache(t *testing.T) {
+	reader := &countingReader{plugins: map[string][]byte{"grep": []byte("v1")}}
+	a := NewConfigMapPluginAllowList(reader, types.NamespacedName{Namespace: "default", Name: "plugins"})
+	now := time.Unix(1700000000, 0)
+	a.now = func() time.Time { return now }
+
+	plugin := func(name string) string {
+		code, err := a.Plugin(context.Background(), name)
+		if err != nil {
+			if IsUnknownPluginError(err) {
+				return ""
+			}
+			t.Fatal(err)
+		}
+		return string(code)
+	}
+
+	if code := plugin("grep"); code != "v1" {
+		t.Errorf("expected v1, got %q", code)
+	}
+	reader.plugins = map[string][]byte{"grep": []byte("v2"), "jq": []byte("v1")}
+	if code := plugin("grep"); code != "v1" {
+		t.Errorf("expected the cached v1, got %q", code)
+	}
+	if code := plugin("jq"); code != "" {
+		t.Errorf("expected jq to be unknown until the cache expires, got %q", code)
+	}
+	if reader.gets != 1 {
+		t.Errorf("expected the ConfigMap to be read once, got %d", reader.gets)
+	}
+
+	now = now.Add(pluginAllowListTTL)
+	if code := plugin("grep"); code != "v2" {
+		t.Errorf("expected v2 after the cache expired, got %q", code)
+	}
+	if code := plugin("jq"); code != "v1" {
+		t.Errorf("expected v1, got %q", code)
+	}
+	if reader.gets != 2 {
+		t.Errorf("expected the ConfigMap to be read twice, got %d", reader.gets)
+	}
+}
@@ -0,0 +1,158 @@
+package internal
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strings"
+
+	"github.com/wasmerio/wasmer-go/wasmer"
+
+	"github.com/banzaicloud/log-socket/log"
+)
+
+const (
+	wasmerModulePath     = "github.com/wasmerio/wasmer-go"
+	compiledModuleSuffix = ".wasmu"
+)
+
+// DefaultModuleCacheDir returns the directory compiled plugins are cached in by default, under the user's cache directory
+func DefaultModuleCacheDir() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "log-socket", "plugins"), nil
+}
+
+// ModuleEngineVersion identifies the engine compiling plugins; modules compiled by a different version of the engine can't be loaded
+func ModuleEngineVersion() string {
+	version := "unknown"
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, dep := range info.Deps {
+			if dep.Path != wasmerModulePath {
+				continue
+			}
+			if dep.Replace != nil {
+				dep = dep.Replace
+			}
+			version = dep.Version
+		}
+	}
+	// the version is used as the name of a directory
+	version = strings.ReplaceAll(version, "/", "_")
+	return "wasmer-" + version + "-" + runtime.GOOS + "-" + runtime.GOARCH
+}
+
+// NewModuleCache returns a cache of compiled plugins in dir
+func NewModuleCache(dir string, logs log.Sink) *ModuleCache {
+	return &ModuleCache{
+		Dir:     dir,
+		Version: ModuleEngineVersion(),
+
+		logs: logs,
+	}
+}
+
+// ModuleCache keeps compiled plugins on disk, so that they don't have to be compiled every time they are loaded.
+// Modules are keyed by the SHA-256 digest of their code in a directory per engine version;
+// the directories of other versions are removed when the one of the current version is created.
+type ModuleCache struct {
+	// Dir is the directory holding the directories of engine versions
+	Dir string
+	// Version is the version of the engine (see ModuleEngineVersion)
+	Version string
+
+	logs log.Sink
+}
+
+// Compile returns the compiled module of the code, and whether it was loaded from the cache.
+// Failing to use the cache is logged, and only means that the code is compiled.
+func (c *ModuleCache) Compile(store *wasmer.Store, code []byte) (module *wasmer.Module, cached bool, err error) {
+	path := c.Path(code)
+	data, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		if module, err = wasmer.DeserializeModule(store, data); err == nil {
+			return module, true, nil
+		}
+		log.Event(c.logs, "failed to load compiled plugin from cache, compiling it", log.Error(err), log.Fields{"file": path})
+	case !errors.Is(err, fs.ErrNotExist):
+		log.Event(c.logs, "failed to read compiled plugin from cache", log.Error(err), log.Fields{"file": path})
+	}
+
+	if module, err = wasmer.NewModule(store, code); err != nil {
+		return nil, false, err
+	}
+	if err := c.store(path, module); err != nil {
+		log.Event(c.logs, "failed to cache compiled plugin", log.Error(err), log.Fields{"file": path})
+	}
+	return module, false, nil
+}
+
+// Path returns the file the compiled module of the code is cached in
+func (c *ModuleCache) Path(code []byte) string {
+	return filepath.Join(c.Dir, c.Version, pluginDigest(code)+compiledModuleSuffix)
+}
+
+// store writes a compiled module to the cache
+func (c *ModuleCache) store(path string, module *wasmer.Module) error {
+	data, err := module.Serialize()
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(path)
+	if _, err := os.Stat(dir); errors.Is(err, fs.ErrNotExist) {
+		if err := c.prune(); err != nil {
+			log.Event(c.logs, "failed to remove compiled plugins of other engine versions from cache", log.Error(err), log.Fields{"dir": c.Dir})
+		}
+	}
+	return writeFileAtomically(path, data)
+}
+
+// writeFileAtomically writes data to a temporary file in the directory of path (which is created if needed) and renames it to path,
+// so that concurrent readers never see partial files
+func writeFileAtomically(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(dir, "tmp-*")
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), path)
+	}
+	if err != nil {
+		_ = os.Remove(file.Name())
+	}
+	return err
+}
+
+// prune removes the directories of other engine versions
+func (c *ModuleCache) prune() error {
+	entries, err := os.ReadDir(c.Dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() && entry.Name() != c.Version && strings.HasPrefix(entry.Name(), "wasmer-") {
+			if err := os.RemoveAll(filepath.Join(c.Dir, entry.Name())); err != nil {
+				return err
+			}
+			log.Event(c.logs, "removed compiled plugins of another engine version from cache", log.V(1), log.Fields{"version": entry.Name()})
+		}
+	}
+	return nil
+}
@@ -0,0 +1,247 @@
+package internal
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// MultilineRules decide which lines start a new record; other lines continue the previous record
+type MultilineRules struct {
+	// Start matches lines that start a new record
+	Start string `json:"start" yaml:"start"`
+	// Continue matches lines that continue the previous record even though they match Start (optional)
+	Continue string `json:"continue,omitempty" yaml:"continue,omitempty"`
+}
+
+// MultilinePresets are rules for common multiline records
+var MultilinePresets = map[string]MultilineRules{
+	// stack traces with indented frames, causes and omitted frame counts
+	"java": {
+		Start:    `^\S`,
+		Continue: `^(Caused by: |Suppressed: |\.\.\. \d+ (more|common frames omitted))`,
+	},
+	// tracebacks with indented frames, the final exception line and chained exceptions
+	"python": {
+		Start:    `^\S`,
+		Continue: `^([\w.]+(Error|Exception|Warning|Exit|Interrupt|Iteration)\b.*|During handling of the above exception, another exception occurred:|The above exception was the direct cause of the following exception:|\s*)$`,
+	},
+	// panics followed by goroutine dumps
+	"go": {
+		Start:    `^\S`,
+		Continue: `^(\s*$|goroutine \d+ \[|[\w./*()\-]+\(.*\)$|created by |exit status \d+|\[signal )`,
+	},
+}
+
+const (
+	// DefaultMultilineFlushTimeout is how long a record is buffered waiting for continuation lines by default
+	DefaultMultilineFlushTimeout = time.Second
+	// DefaultMultilineMaxAge is how long a record is buffered at most by default, even if continuation lines keep coming
+	DefaultMultilineMaxAge = 10 * time.Second
+	// DefaultMultilineMaxLines is the number of lines records are flushed at by default
+	DefaultMultilineMaxLines = 1000
+	// DefaultMultilineMaxBytes is the size of the lines records are flushed at by default
+	DefaultMultilineMaxBytes = 1 << 20
+)
+
+// NewMultilineStage returns a stage that joins continuation lines into the record they continue, separately for each (pod, container) stream.
+// Records are buffered until the next record of the stream starts or until timeout passes without continuation lines.
+// Records are also flushed once they reach MaxLines or MaxBytes, or have been buffered for MaxAge (further continuation lines start a new record).
+func NewMultilineStage(rules MultilineRules, timeout time.Duration) (*MultilineStage, error) {
+	start, err := regexp.Compile(rules.Start)
+	if err != nil {
+		return nil, fmt.Errorf("invalid start pattern: %w", err)
+	}
+	var cont *regexp.Regexp
+	if rules.Continue != "" {
+		if cont, err = regexp.Compile(rules.Continue); err != nil {
+			return nil, fmt.Errorf("invalid continue pattern: %w", err)
+		}
+	}
+	if timeout <= 0 {
+		timeout = DefaultMultilineFlushTimeout
+	}
+	return &MultilineStage{
+		Fields:   parseFieldPaths(DefaultDedupeFields),
+		MaxAge:   DefaultMultilineMaxAge,
+		MaxBytes: DefaultMultilineMaxBytes,
+		MaxLines: DefaultMultilineMaxLines,
+		Rules:    rules,
+		Timeout:  timeout,
+
+		buffers: make(map[multilineStream]*multilineBuffer),
+		cont:    cont,
+		now:     time.Now,
+		start:   start,
+	}, nil
+}
+
+type MultilineStage struct {
+	// Fields are the fields messages are looked up in, the first one present is used
+	Fields []FieldPath
+	// MaxAge, MaxBytes and MaxLines bound how long records are buffered and how large they grow (limits that are not positive are disabled)
+	MaxAge   time.Duration
+	MaxBytes int
+	MaxLines int
+	Rules    MultilineRules
+	Timeout  time.Duration
+
+	buffers map[multilineStream]*multilineBuffer
+	cont    *regexp.Regexp
+	now     func() time.Time
+	seq     uint64
+	start   *regexp.Regexp
+}
+
+type multilineStream struct {
+	namespace string
+	pod       string
+	container string
+}
+
+type multilineBuffer struct {
+	eol     string
+	field   FieldPath
+	lines   []string
+	obj     map[string]interface{}
+	raw     []byte
+	seq     uint64 // order of buffering, so that flushing is deterministic
+	size    int    // the size of the lines
+	started time.Time
+	updated time.Time
+}
+
+func (s *MultilineStage) Process(record []byte) ([][]byte, error) {
+	obj, err := decodeJSONObject(record)
+	if err != nil {
+		return [][]byte{record}, nil // not a JSON object, nothing to join
+	}
+	var field FieldPath
+	var line string
+	for _, f := range s.Fields {
+		if v, ok := f.Get(obj); ok {
+			field = f
+			line, _ = v.(string)
+			break
+		}
+	}
+	if field == nil {
+		return [][]byte{record}, nil
+	}
+	// the log field of container runtimes usually includes the line break, which is kept at the end of joined records
+	trimmed := strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+	eol := line[len(trimmed):]
+	line = trimmed
+
+	stream := multilineStream{
+		namespace: stringField(obj, "kubernetes", "namespace_name"),
+		pod:       stringField(obj, "kubernetes", "pod_name"),
+		container: stringField(obj, "kubernetes", "container_name"),
+	}
+	now := s.now()
+	buf := s.buffers[stream]
+	if buf != nil && !s.startsRecord(line) && !s.expired(buf, now) {
+		buf.lines = append(buf.lines, line)
+		buf.size += len(line) + 1
+		buf.updated = now
+		if s.full(buf) {
+			delete(s.buffers, stream)
+			return buf.encode()
+		}
+		return nil, nil
+	}
+
+	var res [][]byte
+	if buf != nil {
+		if res, err = buf.encode(); err != nil {
+			return nil, err
+		}
+	}
+	s.seq++
+	buf = &multilineBuffer{
+		eol:     eol,
+		field:   field,
+		lines:   []string{line},
+		obj:     obj,
+		raw:     record,
+		seq:     s.seq,
+		size:    len(line),
+		started: now,
+		updated: now,
+	}
+	if s.full(buf) {
+		delete(s.buffers, stream)
+		return append(res, record), nil
+	}
+	s.buffers[stream] = buf
+	return res, nil
+}
+
+// full returns whether the record reached MaxLines or MaxBytes
+func (s *MultilineStage) full(buf *multilineBuffer) bool {
+	return s.MaxLines > 0 && len(buf.lines) >= s.MaxLines || s.MaxBytes > 0 && buf.size >= s.MaxBytes
+}
+
+// expired returns whether the record has been buffered for MaxAge
+func (s *MultilineStage) expired(buf *multilineBuffer, now time.Time) bool {
+	return s.MaxAge > 0 && now.Sub(buf.started) >= s.MaxAge
+}
+
+func (s *MultilineStage) startsRecord(line string) bool {
+	return s.start.MatchString(line) && (s.cont == nil || !s.cont.MatchString(line))
+}
+
+// Tick emits the records that haven't been continued for the timeout or have been buffered for MaxAge
+func (s *MultilineStage) Tick(now time.Time) ([]RoutedRecord, error) {
+	res, err := s.flush(func(buf *multilineBuffer) bool {
+		return now.Sub(buf.updated) >= s.Timeout || s.expired(buf, now)
+	})
+	return routed(res, RoutedRecord{}), err
+}
+
+// Flush emits all buffered records
+func (s *MultilineStage) Flush() ([]RoutedRecord, error) {
+	res, err := s.flush(func(*multilineBuffer) bool { return true })
+	return routed(res, RoutedRecord{}), err
+}
+
+func (s *MultilineStage) flush(pred func(*multilineBuffer) bool) (res [][]byte, err error) {
+	var streams []multilineStream
+	for stream, buf := range s.buffers {
+		if pred(buf) {
+			streams = append(streams, stream)
+		}
+	}
+	sort.Slice(streams, func(i, j int) bool {
+		return s.buffers[streams[i]].seq < s.buffers[streams[j]].seq
+	})
+	for _, stream := range streams {
+		recs, err := s.buffers[stream].encode()
+		if err != nil {
+			return res, err
+		}
+		res = append(res, recs...)
+		delete(s.buffers, stream)
+	}
+	return
+}
+
+func (s *MultilineStage) String() string {
+	return fmt.Sprintf("multiline=%s", s.Rules.Start)
+}
+
+func (b *multilineBuffer) encode() ([][]byte, error) {
+	if len(b.lines) == 1 {
+		return [][]byte{b.raw}, nil // nothing was joined, keep the record as is
+	}
+	b.field.Set(b.obj, strings.Join(b.lines, "\n")+b.eol)
+	return encodeJSON(b.obj)
+}
+
+func stringField(obj map[string]interface{}, path ...string) string {
+	v, _ := FieldPath(path).Get(obj)
+	s, _ := v.(string)
+	return s
+}
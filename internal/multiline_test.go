@@ -0,0 +1,241 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var updateGolden = flag.Bool("update", false, "update the golden files of the tests")
+
+// containerRecord returns a record of a container runtime log line (which keeps its line break) of the container of the pod
+func containerRecord(namespace, pod, container, line string) []byte {
+	data, _ := json.Marshal(map[string]interface{}{
+		"log":        line + "\n",
+		"kubernetes": map[string]string{"namespace_name": namespace, "pod_name": pod, "container_name": container},
+	})
+	return data
+}
+
+// TestMultilinePresets runs the lines of testdata/multiline/PRESET.txt through the preset and compares the joined records with PRESET.golden.jsonl
+func TestMultilinePresets(t *testing.T) {
+	for name, rules := range MultilinePresets {
+		t.Run(name, func(t *testing.T) {
+			input, err := os.ReadFile(filepath.Join("testdata", "multiline", name+".txt"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			s, err := NewMultilineStage(rules, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var out bytes.Buffer
+			scanner := bufio.NewScanner(bytes.NewReader(input))
+			for scanner.Scan() {
+				res, err := s.Process(containerRecord("default", "app", "main", scanner.Text()))
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, r := range res {
+					out.Write(r)
+					out.WriteByte('\n')
+				}
+			}
+			res, err := s.Flush()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, r := range res {
+				out.Write(r.Data)
+				out.WriteByte('\n')
+			}
+
+			golden := filepath.Join("testdata", "multiline", name+".golden.jsonl")
+			if *updateGolden {
+				if err := os.WriteFile(golden, out.Bytes(), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			expected, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(out.Bytes(), expected) {
+				t.Errorf("the records differ from %s (run the tests with -update to update it):\n%s", golden, out.Bytes())
+			}
+		})
+	}
+}
+
+// multilineLog returns the log fields of the records, with line breaks shown as |
+func multilineLog(t *testing.T, records [][]byte) []string {
+	var res []string
+	for _, r := range records {
+		var obj struct {
+			Log string `json:"log"`
+		}
+		if err := json.Unmarshal(r, &obj); err != nil {
+			t.Fatal(err)
+		}
+		res = append(res, strings.ReplaceAll(obj.Log, "\n", "|"))
+	}
+	return res
+}
+
+func TestMultilineStage(t *testing.T) {
+	type step struct {
+		after time.Duration // since the previous step
+		pod   string        // "tick" ticks the stage instead, "flush" flushes it
+		line  string
+	}
+	lines := func(pod string, lines ...string) (res []step) {
+		for _, l := range lines {
+			res = append(res, step{pod: pod, line: l})
+		}
+		return
+	}
+	tests := map[string]struct {
+		configure func(s *MultilineStage)
+		steps     []step
+		expected  []string
+	}{
+		"new start line": {
+			steps:    lines("a", "first", " continued", " again", "second", " continued"),
+			expected: []string{"first| continued| again|", "second| continued|"},
+		},
+		"single lines are kept as is": {
+			steps:    lines("a", "first", "second"),
+			expected: []string{"first|", "second|"},
+		},
+		"streams are separate": {
+			steps: []step{
+				{pod: "a", line: "a first"}, {pod: "b", line: "b first"},
+				{pod: "a", line: " a continued"}, {pod: "b", line: " b continued"},
+				{pod: "b", line: "b second"}, {pod: "a", line: "a second"},
+			},
+			expected: []string{"b first| b continued|", "a first| a continued|", "b second|", "a second|"},
+		},
+		"max lines": {
+			configure: func(s *MultilineStage) { s.MaxLines = 3 },
+			steps:     lines("a", "first", " 2", " 3", " 4", " 5", "second"),
+			expected:  []string{"first| 2| 3|", " 4| 5|", "second|"},
+		},
+		"max bytes": {
+			configure: func(s *MultilineStage) { s.MaxBytes = 11 },
+			// the lines are joined with line breaks, which count towards the size: "first\n 2345" is 11 bytes
+			steps:    lines("a", "first", " 2345", " 7", "second"),
+			expected: []string{"first| 2345|", " 7|", "second|"},
+		},
+		"long first line": {
+			configure: func(s *MultilineStage) { s.MaxBytes = 4 },
+			steps:     lines("a", "first", " continued"),
+			expected:  []string{"first|", " continued|"},
+		},
+		"timeout": {
+			steps: []step{
+				{pod: "a", line: "first"}, {pod: "b", line: "other"},
+				{after: 600 * time.Millisecond, pod: "a", line: " continued"},
+				{after: 500 * time.Millisecond, pod: "tick"}, // b timed out
+				{after: 400 * time.Millisecond, pod: "tick"},
+				{after: 100 * time.Millisecond, pod: "tick"}, // a timed out
+				{pod: "a", line: " late"},
+			},
+			expected: []string{"other|", "first| continued|", " late|"},
+		},
+		"max age": {
+			configure: func(s *MultilineStage) { s.MaxAge = 2 * time.Second },
+			steps: []step{
+				{pod: "a", line: "first"},
+				{after: 900 * time.Millisecond, pod: "a", line: " 2"},
+				{after: 900 * time.Millisecond, pod: "a", line: " 3"},
+				{after: 200 * time.Millisecond, pod: "a", line: " 4"}, // starts a new record
+				{after: 900 * time.Millisecond, pod: "a", line: " 5"},
+				{after: 900 * time.Millisecond, pod: "a", line: " 6"},
+				{after: 200 * time.Millisecond, pod: "tick"},
+			},
+			expected: []string{"first| 2| 3|", " 4| 5| 6|"},
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			s, err := NewMultilineStage(MultilineRules{Start: `^\S`}, time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.configure != nil {
+				test.configure(s)
+			}
+			now := time.Unix(1700000000, 0)
+			s.now = func() time.Time { return now }
+			var out [][]byte
+			for _, step := range append(test.steps, step{pod: "flush"}) {
+				now = now.Add(step.after)
+				switch step.pod {
+				case "tick", "flush":
+					var res []RoutedRecord
+					if step.pod == "tick" {
+						res, err = s.Tick(now)
+					} else {
+						res, err = s.Flush()
+					}
+					if err != nil {
+						t.Fatal(err)
+					}
+					out = append(out, recordData(res)...)
+				default:
+					res, err := s.Process(containerRecord("default", step.pod, "main", step.line))
+					if err != nil {
+						t.Fatal(err)
+					}
+					out = append(out, res...)
+				}
+			}
+			if actual := multilineLog(t, out); fmt.Sprint(actual) != fmt.Sprint(test.expected) {
+				t.Errorf("expected %q, got %q", test.expected, actual)
+			}
+		})
+	}
+}
+
+func TestMultilineStreams(t *testing.T) {
+	s, err := NewMultilineStage(MultilineRules{Start: `^\S`}, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the continuation lines only continue the records of their own namespace, pod and container
+	records := [][]byte{
+		containerRecord("ns1", "pod", "main", "first"),
+		containerRecord("ns2", "pod", "main", " other namespace"),
+		containerRecord("ns1", "other", "main", " other pod"),
+		containerRecord("ns1", "pod", "sidecar", " other container"),
+		containerRecord("ns1", "pod", "main", " continued"),
+		[]byte(`not json`),
+		[]byte(`{"level":"info"}`),
+	}
+	var out [][]byte
+	for _, r := range records {
+		res, err := s.Process(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, res...)
+	}
+	if len(out) != 2 || string(out[0]) != "not json" || string(out[1]) != `{"level":"info"}` {
+		t.Errorf("expected records without a log field to pass through, got %q", out)
+	}
+	res, err := s.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"first| continued|", " other namespace|", " other pod|", " other container|"}
+	if actual := multilineLog(t, recordData(res)); fmt.Sprint(actual) != fmt.Sprint(expected) {
+		t.Errorf("expected %q, got %q", expected, actual)
+	}
+}
@@ -0,0 +1,336 @@
+package internal
+
+import (
+	"context"
+	"crypto"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const (
+	ociManifestMediaType    = "application/vnd.oci.image.manifest.v1+json"
+	dockerManifestMediaType = "application/vnd.docker.distribution.manifest.v2+json"
+	ociIndexMediaType       = "application/vnd.oci.image.index.v1+json"
+	dockerListMediaType     = "application/vnd.docker.distribution.manifest.list.v2+json"
+
+	// cosignSignatureAnnotation holds the signature of the payload in the layers of cosign signatures
+	cosignSignatureAnnotation = "dev.cosignproject.cosign/signature"
+
+	dockerHubRegistry  = "docker.io"
+	dockerHubAPIHost   = "registry-1.docker.io"
+	dockerHubConfigKey = "https://index.docker.io/v1/"
+
+	maxManifestSize = 4 << 20
+)
+
+// wasmLayerMediaTypes are the media types of the layers of OCI artifacts holding WASM modules
+var wasmLayerMediaTypes = []string{
+	"application/vnd.wasm.content.layer.v1+wasm",
+	"application/vnd.module.wasm.content.layer.v1+wasm",
+	"application/wasm",
+}
+
+var challengeParamPattern = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type ociManifest struct {
+	MediaType string          `json:"mediaType"`
+	Layers    []ociDescriptor `json:"layers"`
+}
+
+// pluginLayer returns the layer of a manifest holding the WASM module of a plugin: the one with a WASM media type, or the only layer
+func pluginLayer(data []byte) (ociDescriptor, error) {
+	var manifest ociManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return ociDescriptor{}, fmt.Errorf("invalid manifest: %w", err)
+	}
+	switch manifest.MediaType {
+	case ociIndexMediaType, dockerListMediaType:
+		return ociDescriptor{}, errors.New("the reference is an index of manifests, it has to reference a single manifest")
+	}
+	for _, layer := range manifest.Layers {
+		for _, typ := range wasmLayerMediaTypes {
+			if layer.MediaType == typ {
+				return layer, nil
+			}
+		}
+	}
+	if len(manifest.Layers) == 1 {
+		return manifest.Layers[0], nil
+	}
+	return ociDescriptor{}, fmt.Errorf("the manifest has %d layers and none of them has a WASM media type (%s)", len(manifest.Layers), strings.Join(wasmLayerMediaTypes, ", "))
+}
+
+// ociRepository pulls content from a repository of an OCI registry through the distribution API
+type ociRepository struct {
+	base      string // the URL of the registry's API
+	fetcher   *PluginFetcher
+	name      string
+	plainHTTP bool // the registry is accessed over plain HTTP
+	registry  string
+
+	basic bool   // the registry asked for basic authentication
+	token string // the bearer token the registry issued
+}
+
+func (f *PluginFetcher) repository(ref RemotePluginReference) *ociRepository {
+	host, name := ref.Registry, ref.Repository
+	if host == dockerHubRegistry {
+		host = dockerHubAPIHost
+		if !strings.Contains(name, "/") {
+			name = "library/" + name
+		}
+	}
+	repo := &ociRepository{
+		fetcher:  f,
+		name:     name,
+		registry: ref.Registry,
+	}
+	scheme := "https"
+	for _, r := range f.PlainHTTPRegistries {
+		if r == ref.Registry {
+			scheme = "http"
+			repo.plainHTTP = true
+		}
+	}
+	repo.base = scheme + "://" + host + "/v2/"
+	return repo
+}
+
+// manifest gets a manifest by its tag or digest, returning it with its digest
+func (r *ociRepository) manifest(ctx context.Context, tagOrDigest string) (data []byte, digest string, err error) {
+	data, err = r.get(ctx, "manifests/"+tagOrDigest, strings.Join([]string{ociManifestMediaType, dockerManifestMediaType, ociIndexMediaType, dockerListMediaType}, ", "), maxManifestSize)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to get manifest %s: %w", tagOrDigest, err)
+	}
+	return data, sha256Digest(data), nil
+}
+
+// blob gets a blob, checking its digest
+func (r *ociRepository) blob(ctx context.Context, digest string, size int64) ([]byte, error) {
+	limit := int64(maxPluginDownloadSize)
+	if size > 0 && size < limit {
+		limit = size
+	}
+	data, err := r.get(ctx, "blobs/"+digest, "", limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get blob %s: %w", digest, err)
+	}
+	if actual := sha256Digest(data); actual != digest {
+		return nil, fmt.Errorf("the digest of blob %s is %s", digest, actual)
+	}
+	return data, nil
+}
+
+// verifySignature checks that the manifest with the digest has a cosign signature valid for one of the keys
+func (r *ociRepository) verifySignature(ctx context.Context, digest string, keys []crypto.PublicKey) error {
+	data, _, err := r.manifest(ctx, strings.Replace(digest, ":", "-", 1)+signatureSuffix)
+	var statusErr httpStatusError
+	if errors.As(err, &statusErr) && statusErr.status == http.StatusNotFound {
+		return errors.New("the plugin is not signed")
+	}
+	if err != nil {
+		return err
+	}
+	var manifest ociManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return fmt.Errorf("invalid signature manifest: %w", err)
+	}
+	for _, layer := range manifest.Layers {
+		encoded, ok := layer.Annotations[cosignSignatureAnnotation]
+		if !ok {
+			continue
+		}
+		sig, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			continue
+		}
+		payload, err := r.blob(ctx, layer.Digest, layer.Size)
+		if err != nil {
+			return err
+		}
+		// the payload is signed, and it names the manifest it is the signature of
+		var simpleSigning struct {
+			Critical struct {
+				Image struct {
+					DockerManifestDigest string `json:"docker-manifest-digest"`
+				} `json:"image"`
+			} `json:"critical"`
+		}
+		if err := json.Unmarshal(payload, &simpleSigning); err != nil || simpleSigning.Critical.Image.DockerManifestDigest != digest {
+			continue
+		}
+		if verifySignature(keys, payload, sig) == nil {
+			return nil
+		}
+	}
+	return errors.New("the plugin has no signature valid for any of the public keys")
+}
+
+// get gets a resource of the repository, authenticating if the registry asks for it
+func (r *ociRepository) get(ctx context.Context, path, accept string, limit int64) ([]byte, error) {
+	for authenticated := false; ; authenticated = true {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.base+r.name+"/"+path, nil)
+		if err != nil {
+			return nil, err
+		}
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		switch {
+		case r.token != "":
+			req.Header.Set("Authorization", "Bearer "+r.token)
+		case r.basic:
+			if username, password, ok := r.credentials(); ok {
+				req.SetBasicAuth(username, password)
+			}
+		}
+		resp, err := r.fetcher.Client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusUnauthorized || authenticated {
+			return readResponse(resp, limit)
+		}
+		challenge := resp.Header.Get("WWW-Authenticate")
+		resp.Body.Close()
+		if err := r.authenticate(ctx, challenge); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// authenticate answers the authentication challenge of the registry
+func (r *ociRepository) authenticate(ctx context.Context, challenge string) error {
+	scheme, params, _ := strings.Cut(challenge, " ")
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if _, _, ok := r.credentials(); !ok {
+			return fmt.Errorf("registry %s requires credentials", r.registry)
+		}
+		r.basic = true
+		return nil
+	case "bearer":
+	default:
+		return fmt.Errorf("registry %s asked for unsupported authentication %q", r.registry, challenge)
+	}
+
+	values := make(map[string]string)
+	for _, m := range challengeParamPattern.FindAllStringSubmatch(params, -1) {
+		values[m[1]] = m[2]
+	}
+	realm, err := url.Parse(values["realm"])
+	if err != nil || realm.Host == "" || (realm.Scheme != "https" && realm.Scheme != "http") {
+		return fmt.Errorf("registry %s asked for bearer authentication without a valid realm", r.registry)
+	}
+	// credentials are only sent over plain HTTP to registries accessed over plain HTTP anyway
+	if realm.Scheme == "http" && !r.plainHTTP {
+		return fmt.Errorf("registry %s asked for bearer authentication with a realm that doesn't use HTTPS (%s)", r.registry, realm.Redacted())
+	}
+	query := realm.Query()
+	if service := values["service"]; service != "" {
+		query.Set("service", service)
+	}
+	scope := values["scope"]
+	if scope == "" {
+		scope = "repository:" + r.name + ":pull"
+	}
+	query.Set("scope", scope)
+	realm.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return err
+	}
+	if username, password, ok := r.credentials(); ok {
+		req.SetBasicAuth(username, password)
+	}
+	resp, err := r.fetcher.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	data, err := readResponse(resp, maxManifestSize)
+	if err != nil {
+		return fmt.Errorf("failed to get token for registry %s: %w", r.registry, err)
+	}
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.Unmarshal(data, &token); err != nil {
+		return fmt.Errorf("invalid token response from registry %s: %w", r.registry, err)
+	}
+	if r.token = token.Token; r.token == "" {
+		r.token = token.AccessToken
+	}
+	if r.token == "" {
+		return fmt.Errorf("registry %s issued no token", r.registry)
+	}
+	return nil
+}
+
+func (r *ociRepository) credentials() (username, password string, ok bool) {
+	if r.fetcher.Credentials == nil {
+		return "", "", false
+	}
+	return r.fetcher.Credentials(r.registry)
+}
+
+// DockerConfigCredentials returns the credentials stored for a registry in the Docker configuration file ($DOCKER_CONFIG/config.json or ~/.docker/config.json).
+// Credential helpers are not supported.
+func DockerConfigCredentials(registry string) (username, password string, ok bool) {
+	dir := os.Getenv("DOCKER_CONFIG")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", "", false
+		}
+		dir = filepath.Join(home, ".docker")
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "config.json"))
+	if err != nil {
+		return "", "", false
+	}
+	var config struct {
+		Auths map[string]struct {
+			Auth     string `json:"auth"`
+			Username string `json:"username"`
+			Password string `json:"password"`
+		} `json:"auths"`
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return "", "", false
+	}
+	if registry == dockerHubRegistry {
+		registry = dockerHubConfigKey
+	}
+	auth, found := config.Auths[registry]
+	if !found {
+		auth, found = config.Auths["https://"+registry]
+	}
+	if !found {
+		return "", "", false
+	}
+	if auth.Username != "" {
+		return auth.Username, auth.Password, true
+	}
+	decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+	if err != nil {
+		return "", "", false
+	}
+	return strings.Cut(string(decoded), ":")
+}
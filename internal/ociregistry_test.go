@@ -0,0 +1,252 @@
+package internal
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/banzaicloud/log-socket/log"
+)
+
+// testRegistry is an in-process OCI registry serving a plugin from a single repository, which requires bearer tokens issued for basic credentials
+type testRegistry struct {
+	*httptest.Server
+	// realm is the URL of the token endpoint in the challenges of the registry (its own /token if empty)
+	realm     string
+	manifests map[string][]byte // by tag and digest
+	blobs     map[string][]byte // by digest
+}
+
+const (
+	testRegistryToken    = "test-token"
+	testRegistryUsername = "user"
+	testRegistryPassword = "password"
+	testRegistryRepo     = "plugins/grep"
+)
+
+func newTestRegistry(t *testing.T, plainHTTP bool) *testRegistry {
+	reg := &testRegistry{manifests: map[string][]byte{}, blobs: map[string][]byte{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if username, password, ok := r.BasicAuth(); !ok || username != testRegistryUsername || password != testRegistryPassword {
+			http.Error(w, "invalid credentials", http.StatusUnauthorized)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]string{"token": testRegistryToken})
+	})
+	mux.HandleFunc("/v2/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+testRegistryToken {
+			realm := reg.realm
+			if realm == "" {
+				realm = reg.URL + "/token"
+			}
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s",service="test"`, realm))
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		path := strings.TrimPrefix(r.URL.Path, "/v2/"+testRegistryRepo+"/")
+		var data []byte
+		var ok bool
+		if ref := strings.TrimPrefix(path, "manifests/"); ref != path {
+			data, ok = reg.manifests[ref]
+		} else if digest := strings.TrimPrefix(path, "blobs/"); digest != path {
+			data, ok = reg.blobs[digest]
+		}
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write(data)
+	})
+	if plainHTTP {
+		reg.Server = httptest.NewServer(mux)
+	} else {
+		reg.Server = httptest.NewTLSServer(mux)
+	}
+	t.Cleanup(reg.Close)
+	return reg
+}
+
+// push adds a manifest with a single layer holding the content, returning the digest of the manifest
+func (reg *testRegistry) push(tag string, layerMediaType string, content []byte, annotations map[string]string) string {
+	layer := ociDescriptor{MediaType: layerMediaType, Digest: sha256Digest(content), Size: int64(len(content)), Annotations: annotations}
+	manifest, _ := json.Marshal(ociManifest{MediaType: ociManifestMediaType, Layers: []ociDescriptor{layer}})
+	digest := sha256Digest(manifest)
+	reg.blobs[layer.Digest] = content
+	reg.manifests[tag] = manifest
+	reg.manifests[digest] = manifest
+	return digest
+}
+
+// sign adds a cosign signature of the manifest with the digest
+func (reg *testRegistry) sign(t *testing.T, key *ecdsa.PrivateKey, digest string) {
+	payload, _ := json.Marshal(map[string]interface{}{"critical": map[string]interface{}{"image": map[string]string{"docker-manifest-digest": digest}}})
+	sum := sha256.Sum256(payload)
+	sig, err := ecdsa.SignASN1(rand.Reader, key, sum[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg.push(strings.Replace(digest, ":", "-", 1)+signatureSuffix, "application/vnd.dev.cosign.simplesigning.v1+json", payload, map[string]string{cosignSignatureAnnotation: base64.StdEncoding.EncodeToString(sig)})
+}
+
+func (reg *testRegistry) fetcher(t *testing.T) *PluginFetcher {
+	f := NewPluginFetcher(t.TempDir(), log.NewWriterSink(io.Discard))
+	f.Client = reg.Client()
+	f.Credentials = func(registry string) (string, string, bool) {
+		return testRegistryUsername, testRegistryPassword, true
+	}
+	return f
+}
+
+func (reg *testRegistry) ref(suffix string) RemotePluginReference {
+	ref, err := ParseRemotePluginReference(OCIPluginScheme + reg.Listener.Addr().String() + "/" + testRegistryRepo + suffix)
+	if err != nil {
+		panic(err)
+	}
+	return ref
+}
+
+func TestFetchOCIPlugin(t *testing.T) {
+	reg := newTestRegistry(t, false)
+	code := []byte("\x00asm\x01\x00\x00\x00")
+	digest := reg.push("v1", wasmLayerMediaTypes[0], code, nil)
+	// the registry serves a manifest that doesn't match the digest it was requested with
+	tampered := sha256Digest([]byte("tampered"))
+	reg.manifests[tampered] = reg.manifests["v1"]
+
+	tests := map[string]struct {
+		ref string
+		err bool
+	}{
+		"tag":            {ref: ":v1"},
+		"digest":         {ref: "@" + digest},
+		"tag and digest": {ref: ":v1@" + digest},
+		"tampered":       {ref: "@" + tampered, err: true},
+		"unknown tag":    {ref: ":v3", err: true},
+		"unknown digest": {ref: "@" + sha256Digest([]byte("unknown")), err: true},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			res, err := reg.fetcher(t).Fetch(context.Background(), reg.ref(test.ref))
+			if test.err {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(res) != string(code) {
+				t.Errorf("expected %q, got %q", code, res)
+			}
+		})
+	}
+}
+
+func TestFetchOCIPluginPinnedOnce(t *testing.T) {
+	reg := newTestRegistry(t, false)
+	code := []byte("\x00asm\x01\x00\x00\x00")
+	digest := reg.push("v1", wasmLayerMediaTypes[0], code, nil)
+	f := reg.fetcher(t)
+	if _, err := f.Fetch(context.Background(), reg.ref("@"+digest)); err != nil {
+		t.Fatal(err)
+	}
+	// the pinned plugin is kept, so the registry isn't needed anymore
+	reg.Close()
+	res, err := f.Fetch(context.Background(), reg.ref("@"+digest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(res) != string(code) {
+		t.Errorf("expected %q, got %q", code, res)
+	}
+}
+
+func TestFetchOCIPluginSignature(t *testing.T) {
+	reg := newTestRegistry(t, false)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := reg.push("signed", wasmLayerMediaTypes[0], []byte("signed"), nil)
+	reg.sign(t, key, signed)
+	reg.push("unsigned", wasmLayerMediaTypes[0], []byte("unsigned"), nil)
+	// the signature of another manifest doesn't sign this one
+	copied := reg.push("copied", wasmLayerMediaTypes[0], []byte("copied"), nil)
+	reg.manifests[strings.Replace(copied, ":", "-", 1)+signatureSuffix] = reg.manifests[strings.Replace(signed, ":", "-", 1)+signatureSuffix]
+
+	tests := map[string]struct {
+		tag  string
+		keys []crypto.PublicKey
+		err  bool
+	}{
+		"valid":              {tag: "signed", keys: []crypto.PublicKey{key.Public()}},
+		"one of the keys":    {tag: "signed", keys: []crypto.PublicKey{otherKey.Public(), key.Public()}},
+		"other key":          {tag: "signed", keys: []crypto.PublicKey{otherKey.Public()}, err: true},
+		"unsigned":           {tag: "unsigned", keys: []crypto.PublicKey{key.Public()}, err: true},
+		"signature of other": {tag: "copied", keys: []crypto.PublicKey{key.Public()}, err: true},
+		"no keys":            {tag: "unsigned"},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			f := reg.fetcher(t)
+			f.PublicKeys = test.keys
+			_, err := f.Fetch(context.Background(), reg.ref(":"+test.tag))
+			if test.err != (err != nil) {
+				t.Errorf("expected error: %t, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestFetchOCIPluginRealm(t *testing.T) {
+	var credentialsSent bool
+	realm := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _, credentialsSent = r.BasicAuth()
+		_ = json.NewEncoder(w).Encode(map[string]string{"token": testRegistryToken})
+	}))
+	defer realm.Close()
+
+	t.Run("plain HTTP realm of an HTTPS registry", func(t *testing.T) {
+		credentialsSent = false
+		reg := newTestRegistry(t, false)
+		reg.realm = realm.URL + "/token"
+		reg.push("v1", wasmLayerMediaTypes[0], []byte("code"), nil)
+		if _, err := reg.fetcher(t).Fetch(context.Background(), reg.ref(":v1")); err == nil || !strings.Contains(err.Error(), "doesn't use HTTPS") {
+			t.Errorf("expected the realm to be rejected, got %v", err)
+		}
+		if credentialsSent {
+			t.Error("expected the credentials not to be sent over plain HTTP")
+		}
+	})
+	t.Run("plain HTTP realm of a plain HTTP registry", func(t *testing.T) {
+		credentialsSent = false
+		reg := newTestRegistry(t, true)
+		reg.realm = realm.URL + "/token"
+		reg.push("v1", wasmLayerMediaTypes[0], []byte("code"), nil)
+		f := reg.fetcher(t)
+		f.PlainHTTPRegistries = []string{reg.Listener.Addr().String()}
+		if _, err := f.Fetch(context.Background(), reg.ref(":v1")); err != nil {
+			t.Fatal(err)
+		}
+		if !credentialsSent {
+			t.Error("expected the credentials to be sent")
+		}
+	})
+}
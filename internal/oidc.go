@@ -0,0 +1,372 @@
+package internal
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	authv1 "k8s.io/api/authentication/v1"
+)
+
+const (
+	oidcClockSkew       = time.Minute
+	oidcKeysMinInterval = time.Minute
+)
+
+type OIDCConfig struct {
+	// IssuerURL is the URL of the OpenID provider, which has to match the iss claim of tokens
+	IssuerURL string `json:"issuerURL" yaml:"issuerURL"`
+	// ClientID is the audience tokens have to be issued for
+	ClientID string `json:"clientID" yaml:"clientID"`
+	// UsernameClaim is the claim used as the user name (defaults to sub)
+	UsernameClaim  string `json:"usernameClaim" yaml:"usernameClaim"`
+	UsernamePrefix string `json:"usernamePrefix" yaml:"usernamePrefix"`
+	// GroupsClaim is the claim used as the user's groups (groups are not set if empty)
+	GroupsClaim  string `json:"groupsClaim" yaml:"groupsClaim"`
+	GroupsPrefix string `json:"groupsPrefix" yaml:"groupsPrefix"`
+	// HTTPClient is used for fetching the provider's metadata and keys (defaults to http.DefaultClient)
+	HTTPClient *http.Client `json:"-" yaml:"-"`
+}
+
+// NewOIDCAuthenticator returns an authenticator that validates OIDC ID tokens locally, using the keys published by the issuer
+func NewOIDCAuthenticator(cfg OIDCConfig) *OIDCAuthenticator {
+	if cfg.UsernameClaim == "" {
+		cfg.UsernameClaim = "sub"
+	}
+	if cfg.HTTPClient == nil {
+		cfg.HTTPClient = http.DefaultClient
+	}
+	return &OIDCAuthenticator{
+		Config: cfg,
+
+		now: time.Now,
+	}
+}
+
+type OIDCAuthenticator struct {
+	Config OIDCConfig
+
+	jwksURI     string
+	keys        []jsonWebKey
+	keysFetched time.Time
+	mutex       sync.Mutex
+	now         func() time.Time
+}
+
+func (a *OIDCAuthenticator) Authenticate(ctx context.Context, token string) (res authv1.UserInfo, err error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return res, invalidTokenError("not a JWT")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return res, invalidTokenError("malformed header")
+	}
+	var claims map[string]interface{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return res, invalidTokenError("malformed payload")
+	}
+	// check the issuer before anything else so that tokens of other issuers don't trigger fetching keys
+	if iss, _ := claims["iss"].(string); iss != a.Config.IssuerURL {
+		return res, invalidTokenError("issuer mismatch")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return res, invalidTokenError("malformed signature")
+	}
+
+	keys, err := a.keysFor(ctx, header.Kid)
+	if err != nil {
+		return res, err
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	verified := false
+	for _, key := range keys {
+		if verifyJWTSignature(header.Alg, key.publicKey, signed, sig) == nil {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return res, invalidTokenError("invalid signature")
+	}
+
+	if err := a.validateClaims(claims); err != nil {
+		return res, err
+	}
+
+	username, _ := claims[a.Config.UsernameClaim].(string)
+	if username == "" {
+		return res, invalidTokenError(fmt.Sprintf("missing %s claim", a.Config.UsernameClaim))
+	}
+	if a.Config.UsernameClaim == "email" {
+		if verified, ok := claims["email_verified"].(bool); ok && !verified {
+			return res, invalidTokenError("email not verified")
+		}
+	}
+	res.Username = a.Config.UsernamePrefix + username
+	res.UID, _ = claims["sub"].(string)
+	if a.Config.GroupsClaim != "" {
+		switch groups := claims[a.Config.GroupsClaim].(type) {
+		case string:
+			res.Groups = []string{a.Config.GroupsPrefix + groups}
+		case []interface{}:
+			for _, g := range groups {
+				if g, ok := g.(string); ok {
+					res.Groups = append(res.Groups, a.Config.GroupsPrefix+g)
+				}
+			}
+		}
+	}
+	return res, nil
+}
+
+func (a *OIDCAuthenticator) validateClaims(claims map[string]interface{}) error {
+	now := a.now()
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return invalidTokenError("missing exp claim")
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(oidcClockSkew)) {
+		return invalidTokenError("token expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(oidcClockSkew).Before(time.Unix(int64(nbf), 0)) {
+		return invalidTokenError("token not yet valid")
+	}
+	switch aud := claims["aud"].(type) {
+	case string:
+		if aud == a.Config.ClientID {
+			return nil
+		}
+	case []interface{}:
+		for _, v := range aud {
+			if v == a.Config.ClientID {
+				return nil
+			}
+		}
+	}
+	return invalidTokenError("audience mismatch")
+}
+
+// keysFor returns the keys matching kid (or all keys if kid is empty), refreshing the issuer's keys if there are none
+func (a *OIDCAuthenticator) keysFor(ctx context.Context, kid string) ([]jsonWebKey, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if keys := matchingKeys(a.keys, kid); len(keys) > 0 {
+		return keys, nil
+	}
+	if !a.keysFetched.IsZero() && a.now().Sub(a.keysFetched) < oidcKeysMinInterval {
+		return nil, invalidTokenError("unknown signing key")
+	}
+	if err := a.fetchKeys(ctx); err != nil {
+		return nil, fmt.Errorf("failed to fetch OIDC provider keys: %w", err)
+	}
+	if keys := matchingKeys(a.keys, kid); len(keys) > 0 {
+		return keys, nil
+	}
+	return nil, invalidTokenError("unknown signing key")
+}
+
+func (a *OIDCAuthenticator) fetchKeys(ctx context.Context) error {
+	if a.jwksURI == "" {
+		var metadata struct {
+			Issuer  string `json:"issuer"`
+			JWKSURI string `json:"jwks_uri"`
+		}
+		if err := a.getJSON(ctx, strings.TrimSuffix(a.Config.IssuerURL, "/")+"/.well-known/openid-configuration", &metadata); err != nil {
+			return err
+		}
+		if metadata.Issuer != a.Config.IssuerURL {
+			return fmt.Errorf("issuer in provider metadata (%q) does not match configured issuer (%q)", metadata.Issuer, a.Config.IssuerURL)
+		}
+		if metadata.JWKSURI == "" {
+			return errors.New("provider metadata does not specify a JWKS URI")
+		}
+		a.jwksURI = metadata.JWKSURI
+	}
+
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := a.getJSON(ctx, a.jwksURI, &jwks); err != nil {
+		return err
+	}
+	keys := jwks.Keys[:0]
+	for _, key := range jwks.Keys {
+		if key.Use != "" && key.Use != "sig" {
+			continue
+		}
+		if err := key.parse(); err != nil {
+			continue // skip keys we can't use
+		}
+		keys = append(keys, key)
+	}
+	a.keys = keys
+	a.keysFetched = a.now()
+	return nil
+}
+
+func (a *OIDCAuthenticator) getJSON(ctx context.Context, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := a.Config.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: unexpected status %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+type jsonWebKey struct {
+	Crv string `json:"crv"`
+	E   string `json:"e"`
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	N   string `json:"n"`
+	Use string `json:"use"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+
+	publicKey crypto.PublicKey
+}
+
+func (k *jsonWebKey) parse() error {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return errors.New("invalid RSA exponent")
+		}
+		k.publicKey = &rsa.PublicKey{N: n, E: int(e.Int64())}
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return errors.New("invalid EC key")
+		}
+		k.publicKey = &ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+	default:
+		return fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+	return nil
+}
+
+func matchingKeys(keys []jsonWebKey, kid string) (res []jsonWebKey) {
+	for _, key := range keys {
+		if kid == "" || key.Kid == kid {
+			res = append(res, key)
+		}
+	}
+	return
+}
+
+func verifyJWTSignature(alg string, key crypto.PublicKey, signed []byte, sig []byte) error {
+	var hash crypto.Hash
+	switch alg {
+	case "RS256", "PS256", "ES256":
+		hash = crypto.SHA256
+	case "RS384", "PS384", "ES384":
+		hash = crypto.SHA384
+	case "RS512", "PS512", "ES512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported signing algorithm %q", alg)
+	}
+	h := hash.New()
+	_, _ = h.Write(signed)
+	digest := h.Sum(nil)
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		switch alg[:2] {
+		case "RS":
+			return rsa.VerifyPKCS1v15(key, hash, digest, sig)
+		case "PS":
+			return rsa.VerifyPSS(key, hash, digest, sig, nil)
+		}
+	case *ecdsa.PublicKey:
+		if alg[:2] != "ES" {
+			break
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return errors.New("invalid signature length")
+		}
+		r, s := new(big.Int).SetBytes(sig[:size]), new(big.Int).SetBytes(sig[size:])
+		if ecdsa.Verify(key, digest, r, s) {
+			return nil
+		}
+		return errors.New("invalid signature")
+	}
+	return fmt.Errorf("key type does not match signing algorithm %q", alg)
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(data), nil
+}
+
+type invalidTokenError string
+
+func (e invalidTokenError) Error() string {
+	return "invalid token: " + string(e)
+}
+
+func (invalidTokenError) IsUnauthenticatedError() bool {
+	return true
+}
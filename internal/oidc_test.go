@@ -0,0 +1,239 @@
+package internal
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	authv1 "k8s.io/api/authentication/v1"
+)
+
+// testIssuer is an in-process OpenID provider publishing the public keys of its signing keys
+type testIssuer struct {
+	*httptest.Server
+	keys map[string]crypto.Signer
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	iss := &testIssuer{keys: map[string]crypto.Signer{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]string{"issuer": iss.URL, "jwks_uri": iss.URL + "/keys"})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		var keys []map[string]string
+		for kid, key := range iss.keys {
+			switch pub := key.Public().(type) {
+			case *rsa.PublicKey:
+				keys = append(keys, map[string]string{"kty": "RSA", "kid": kid, "use": "sig", "n": encodeBigInt(pub.N), "e": encodeBigInt(big.NewInt(int64(pub.E)))})
+			case *ecdsa.PublicKey:
+				keys = append(keys, map[string]string{"kty": "EC", "kid": kid, "crv": "P-256", "x": encodeBigInt(pub.X), "y": encodeBigInt(pub.Y)})
+			}
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+	})
+	iss.Server = httptest.NewServer(mux)
+	t.Cleanup(iss.Close)
+	return iss
+}
+
+func (iss *testIssuer) addRSAKey(t *testing.T, kid string) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	iss.keys[kid] = key
+}
+
+func (iss *testIssuer) addECKey(t *testing.T, kid string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	iss.keys[kid] = key
+}
+
+// sign returns a JWT with the specified claims signed with the key of kid (which doesn't have to be published)
+func sign(t *testing.T, key crypto.Signer, kid string, claims map[string]interface{}) string {
+	alg := "RS256"
+	if _, ok := key.(*ecdsa.PrivateKey); ok {
+		alg = "ES256"
+	}
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	var sig []byte
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		var err error
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:]); err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func encodeBigInt(i *big.Int) string {
+	return base64.RawURLEncoding.EncodeToString(i.Bytes())
+}
+
+func TestOIDCAuthenticator(t *testing.T) {
+	iss := newTestIssuer(t)
+	iss.addRSAKey(t, "rsa")
+	iss.addECKey(t, "ec")
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Unix(1700000000, 0)
+	claims := func(overrides map[string]interface{}) map[string]interface{} {
+		res := map[string]interface{}{
+			"iss":    iss.URL,
+			"aud":    "log-socket",
+			"sub":    "alice",
+			"exp":    now.Add(time.Hour).Unix(),
+			"groups": []string{"dev", "ops"},
+		}
+		for k, v := range overrides {
+			if v == nil {
+				delete(res, k)
+			} else {
+				res[k] = v
+			}
+		}
+		return res
+	}
+	alice := authv1.UserInfo{Username: "oidc:alice", UID: "alice", Groups: []string{"oidc:dev", "oidc:ops"}}
+
+	tests := map[string]struct {
+		token string
+		user  authv1.UserInfo
+		err   bool
+	}{
+		"RSA key": {
+			token: sign(t, iss.keys["rsa"], "rsa", claims(nil)),
+			user:  alice,
+		},
+		"EC key": {
+			token: sign(t, iss.keys["ec"], "ec", claims(nil)),
+			user:  alice,
+		},
+		"audience in list": {
+			token: sign(t, iss.keys["rsa"], "rsa", claims(map[string]interface{}{"aud": []string{"other", "log-socket"}})),
+			user:  alice,
+		},
+		"expiry within clock skew": {
+			token: sign(t, iss.keys["rsa"], "rsa", claims(map[string]interface{}{"exp": now.Add(-oidcClockSkew / 2).Unix()})),
+			user:  alice,
+		},
+		"expired": {
+			token: sign(t, iss.keys["rsa"], "rsa", claims(map[string]interface{}{"exp": now.Add(-time.Hour).Unix()})),
+			err:   true,
+		},
+		"no expiry": {
+			token: sign(t, iss.keys["rsa"], "rsa", claims(map[string]interface{}{"exp": nil})),
+			err:   true,
+		},
+		"not yet valid": {
+			token: sign(t, iss.keys["rsa"], "rsa", claims(map[string]interface{}{"nbf": now.Add(time.Hour).Unix()})),
+			err:   true,
+		},
+		"other audience": {
+			token: sign(t, iss.keys["rsa"], "rsa", claims(map[string]interface{}{"aud": "other"})),
+			err:   true,
+		},
+		"other issuer": {
+			token: sign(t, iss.keys["rsa"], "rsa", claims(map[string]interface{}{"iss": "https://example.com"})),
+			err:   true,
+		},
+		"unpublished key": {
+			token: sign(t, other, "rsa", claims(nil)),
+			err:   true,
+		},
+		"unknown key ID": {
+			token: sign(t, iss.keys["rsa"], "unknown", claims(nil)),
+			err:   true,
+		},
+		"missing username claim": {
+			token: sign(t, iss.keys["rsa"], "rsa", claims(map[string]interface{}{"sub": nil})),
+			err:   true,
+		},
+		"not a JWT": {
+			token: "not-a-jwt",
+			err:   true,
+		},
+	}
+
+	a := NewOIDCAuthenticator(OIDCConfig{
+		IssuerURL:      iss.URL,
+		ClientID:       "log-socket",
+		UsernamePrefix: "oidc:",
+		GroupsClaim:    "groups",
+		GroupsPrefix:   "oidc:",
+	})
+	a.now = func() time.Time { return now }
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			user, err := a.Authenticate(context.Background(), test.token)
+			if test.err {
+				if !IsUnauthenticatedError(err) {
+					t.Fatalf("expected unauthenticated error, got user %v and error %v", user, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(user, test.user) {
+				t.Errorf("expected user %v, got %v", test.user, user)
+			}
+		})
+	}
+}
+
+func TestOIDCAuthenticatorKeyRotation(t *testing.T) {
+	iss := newTestIssuer(t)
+	iss.addRSAKey(t, "old")
+
+	now := time.Unix(1700000000, 0)
+	a := NewOIDCAuthenticator(OIDCConfig{IssuerURL: iss.URL, ClientID: "log-socket"})
+	a.now = func() time.Time { return now }
+	claims := map[string]interface{}{"iss": iss.URL, "aud": "log-socket", "sub": "alice", "exp": now.Add(time.Hour).Unix()}
+
+	if _, err := a.Authenticate(context.Background(), sign(t, iss.keys["old"], "old", claims)); err != nil {
+		t.Fatal(err)
+	}
+
+	iss.addRSAKey(t, "new")
+	token := sign(t, iss.keys["new"], "new", claims)
+	// the keys were just fetched, so they aren't fetched again yet
+	if _, err := a.Authenticate(context.Background(), token); !IsUnauthenticatedError(err) {
+		t.Fatalf("expected unauthenticated error before the keys can be refreshed, got %v", err)
+	}
+	now = now.Add(oidcKeysMinInterval)
+	if _, err := a.Authenticate(context.Background(), token); err != nil {
+		t.Fatalf("expected the new key to be fetched, got %v", err)
+	}
+}
@@ -1,12 +1,14 @@
 package internal
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"math"
 	"os"
+	"path/filepath"
 	"strings"
+	"time"
 	"unicode/utf8"
 
 	"github.com/banzaicloud/log-socket/log"
@@ -14,24 +16,110 @@ import (
 	"go.uber.org/multierr"
 )
 
-type Pipeline []*Stage
+type Pipeline []Stage
 
-func (p Pipeline) ProcessRecord(record []byte) (res [][]byte, err error) {
-	res = [][]byte{record}
+// ProcessRecord runs a record through the pipeline, meta (if not nil) is passed to the stages implementing RoutingStage
+func (p Pipeline) ProcessRecord(record []byte, meta *RecordMeta) (res []RoutedRecord, err error) {
+	return p.process([]RoutedRecord{{Data: record, Meta: meta}})
+}
+
+// Tick lets the stages implementing Ticker emit records, which are processed by the stages after them
+func (p Pipeline) Tick(now time.Time) ([]RoutedRecord, error) {
+	return p.collect(func(stage Stage) ([]RoutedRecord, error) {
+		if t, ok := stage.(Ticker); ok {
+			return t.Tick(now)
+		}
+		return nil, nil
+	})
+}
+
+// Flush lets the stages implementing Flusher emit the records they buffer, which are processed by the stages after them.
+// Stages are flushed in order, so records flushed by a stage reach later stages before those are flushed.
+func (p Pipeline) Flush() ([]RoutedRecord, error) {
+	return p.collect(func(stage Stage) ([]RoutedRecord, error) {
+		if f, ok := stage.(Flusher); ok {
+			return f.Flush()
+		}
+		return nil, nil
+	})
+}
+
+// Ticking reports whether any of the stages has to be ticked (plugins only have to if they export tick)
+func (p Pipeline) Ticking() bool {
+	for _, stage := range p {
+		if s, ok := stage.(*WASMStage); ok {
+			if s.ticks {
+				return true
+			}
+			continue
+		}
+		if _, ok := stage.(Ticker); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Close closes the stages implementing io.Closer (e.g. to release the resources of plugins)
+func (p Pipeline) Close() (err error) {
+	for _, stage := range p {
+		if c, ok := stage.(io.Closer); ok {
+			err = multierr.Append(err, c.Close())
+		}
+	}
+	return
+}
+
+func (p Pipeline) collect(emit func(Stage) ([]RoutedRecord, error)) (res []RoutedRecord, err error) {
+	for i, stage := range p {
+		emitted, err := emit(stage)
+		if err != nil {
+			return res, err
+		}
+		if len(emitted) == 0 {
+			continue
+		}
+		outputs, err := p[i+1:].process(emitted)
+		res = append(res, outputs...)
+		if err != nil {
+			return res, err
+		}
+	}
+	return
+}
+
+func (p Pipeline) process(records []RoutedRecord) (res []RoutedRecord, err error) {
+	res = records
 	for _, stage := range p {
 		inputs := res
 		res = nil
 		for _, input := range inputs {
-			stage.data = input
-			if err = stage.Receive(); err != nil {
+			var outputs []RoutedRecord
+			if rs, ok := stage.(RoutingStage); ok {
+				outputs, err = rs.ProcessRouted(input)
+			} else {
+				var data [][]byte
+				data, err = stage.Process(input.Data)
+				outputs = routed(data, input)
+			}
+			if err != nil {
 				return
 			}
-			res = append(res, stage.sent...)
+			res = append(res, outputs...)
 		}
 	}
 	return
 }
 
+// routed returns the records with the metadata and output of the record they were made of
+func routed(data [][]byte, from RoutedRecord) []RoutedRecord {
+	res := make([]RoutedRecord, len(data))
+	for i, d := range data {
+		res[i] = RoutedRecord{Data: d, Meta: from.Meta, Output: from.Output}
+	}
+	return res
+}
+
 func (p Pipeline) String() string {
 	var b strings.Builder
 	_, _ = b.WriteString("[")
@@ -39,29 +127,159 @@ func (p Pipeline) String() string {
 		if i > 0 {
 			_, _ = b.WriteString(" > ")
 		}
-		_, _ = fmt.Fprintf(&b, "%q", s.Origin)
+		_, _ = fmt.Fprintf(&b, "%q", s)
 	}
 	_, _ = b.WriteString("]")
 	return b.String()
 }
 
-type Stage struct {
+// Stage is a single step of a Pipeline that turns a record into zero or more records
+type Stage interface {
+	Process(record []byte) ([][]byte, error)
+	fmt.Stringer
+}
+
+// RoutedRecord is a record passing through a pipeline
+type RoutedRecord struct {
+	Data []byte
+	// Meta describes where the record comes from (nil if unknown, e.g. for records emitted by Ticker and Flusher stages)
+	Meta *RecordMeta
+	// Output is the named output a stage routed the record to ("" for the default output)
+	Output string
+}
+
+// RoutingStage is implemented by stages that use the metadata of records or route them to named outputs.
+// Pipelines call ProcessRouted instead of Process for them; the records emitted by other stages keep the metadata and output of the record they were made of.
+type RoutingStage interface {
+	ProcessRouted(record RoutedRecord) ([]RoutedRecord, error)
+}
+
+// Ticker is implemented by stages that emit records as time passes (e.g. buffered records after a timeout).
+// Pipelines are never ticked while processing a record, so stages don't have to synchronize Tick with Process.
+type Ticker interface {
+	Tick(now time.Time) ([]RoutedRecord, error)
+}
+
+// Flusher is implemented by stages that buffer records, which they emit when flushed at the end of the stream.
+// Pipelines are flushed once, after the last record was processed and the last tick.
+type Flusher interface {
+	Flush() ([]RoutedRecord, error)
+}
+
+// PluginABIVersion is the version of the plugin ABI (see docs/plugin-abi.md) implemented by the host.
+// Plugins declare the version they were built against by exporting an abi_version function, which is checked when they are loaded.
+const PluginABIVersion = 1
+
+// PluginABIModule is the module the host functions of the plugin ABI are imported from
+const PluginABIModule = "env"
+
+type WASMStage struct {
 	Instance *wasmer.Instance
 	Memory   *wasmer.Memory
 	Module   *wasmer.Module
 	Origin   string
+	// WASI is the WASI environment of the plugin (nil if it doesn't import WASI functions)
+	WASI   *wasmer.WasiEnvironment
+	Limits PluginLimits
 
-	data []byte
-	err  error
-	sent [][]byte
+	abandoned bool // a call into the plugin timed out and is still running
+	config    []byte
+	data      []byte
+	err       error
+	flushes   bool  // the plugin exports flush
+	hostErr   error // the error of a host function during the current call (see loggedFn)
+	logs      log.Sink
+	onAbandon func() (returned func())
+	received  RoutedRecord // the record being processed, whose metadata and output the records sent by the plugin get
+	sent      []RoutedRecord
+	snapshots []string
+	stderr    pluginOutput
+	stdout    pluginOutput
+	ticks     bool // the plugin exports tick
+	violation *SandboxViolationError
 }
 
-func (s *Stage) Receive() error {
-	fn, err := s.Instance.Exports.GetFunction("receive")
-	if err != nil {
-		return err
+func (s *WASMStage) Process(record []byte) ([][]byte, error) {
+	routed, err := s.ProcessRouted(RoutedRecord{Data: record})
+	res := make([][]byte, len(routed))
+	for i, r := range routed {
+		res[i] = r.Data
+	}
+	return res, err
+}
+
+func (s *WASMStage) ProcessRouted(record RoutedRecord) (res []RoutedRecord, err error) {
+	if s.violation == nil {
+		s.data = record.Data
+		s.received = record
+		s.sent = nil
+		err = s.Receive()
+		s.received = RoutedRecord{}
+		if s.violation == nil {
+			if err != nil {
+				return nil, err
+			}
+			return s.sent, nil
+		}
 	}
-	if _, err := fn(len(s.data)); err != nil {
+	switch s.Limits.OnViolation {
+	case VPPass:
+		return []RoutedRecord{record}, nil
+	case VPAbort:
+		return nil, s.violation
+	default:
+		return nil, nil
+	}
+}
+
+// Tick calls the tick export of the plugin (if any) with the time in milliseconds since the Unix epoch, returning the records it sent
+func (s *WASMStage) Tick(now time.Time) ([]RoutedRecord, error) {
+	if !s.ticks {
+		return nil, nil
+	}
+	return s.emit("tick", now.UnixMilli())
+}
+
+// Flush calls the flush export of the plugin (if any), returning the records it sent
+func (s *WASMStage) Flush() ([]RoutedRecord, error) {
+	if !s.flushes {
+		return nil, nil
+	}
+	return s.emit("flush")
+}
+
+// emit calls a function of the plugin that doesn't receive a record, so the records the plugin sends have no metadata
+func (s *WASMStage) emit(name string, args ...interface{}) ([]RoutedRecord, error) {
+	if s.violation == nil {
+		s.sent = nil
+		_, err := s.call(name, args...)
+		s.readOutput()
+		sent := s.sent
+		s.sent = nil
+		if err == nil {
+			err = s.err
+		}
+		s.err = nil
+		if s.violation == nil {
+			if err != nil {
+				return nil, err
+			}
+			return sent, nil
+		}
+	}
+	if s.Limits.OnViolation == VPAbort {
+		return nil, s.violation
+	}
+	return nil, nil
+}
+
+func (s *WASMStage) Receive() error {
+	if s.violation != nil {
+		return s.violation
+	}
+	_, err := s.call("receive", len(s.data))
+	s.readOutput()
+	if err != nil {
 		return err
 	}
 	if err := s.err; err != nil {
@@ -71,51 +289,132 @@ func (s *Stage) Receive() error {
 	return nil
 }
 
-func LoadStageFromFile(store *wasmer.Store, logs log.Sink, path string) (stage *Stage, err error) {
-	stage = &Stage{
-		Origin: path,
-	}
-	file, err := os.Open(path)
-	if err != nil {
+// readOutput logs what the plugin wrote to stdout and stderr
+func (s *WASMStage) readOutput() {
+	if s.WASI == nil || s.abandoned {
 		return
 	}
-	code, err := io.ReadAll(file)
+	s.stdout.write(s.WASI.ReadStdout())
+	s.stderr.write(s.WASI.ReadStderr())
+}
+
+// Close logs the remaining output of the plugin and removes the copies of the directories it could read
+func (s *WASMStage) Close() error {
+	s.readOutput()
+	s.stdout.flush()
+	s.stderr.flush()
+	removeAll(s.snapshots)
+	s.snapshots = nil
+	return nil
+}
+
+func (s *WASMStage) String() string {
+	return s.Origin
+}
+
+func LoadStageFromFile(store *wasmer.Store, logs log.Sink, path string, opts PluginOptions) (*WASMStage, error) {
+	code, err := os.ReadFile(path)
 	if err != nil {
-		return
+		return nil, err
 	}
-	stage.Module, err = wasmer.NewModule(store, code)
-	if err != nil {
-		return
+	return LoadStageFromCode(store, logs, path, code, opts)
+}
+
+// LoadStageFromCode compiles a plugin (or loads it from opts.Cache) and instantiates it, origin identifies the plugin in logs and errors
+func LoadStageFromCode(store *wasmer.Store, logs log.Sink, origin string, code []byte, opts PluginOptions) (*WASMStage, error) {
+	var module *wasmer.Module
+	var err error
+	if opts.Cache != nil {
+		var cached bool
+		if module, cached, err = opts.Cache.Compile(store, code); err != nil {
+			return nil, err
+		}
+		log.Event(logs, "plugin compiled", log.V(1), log.Fields{"plugin": origin, "cached": cached})
+	} else if module, err = wasmer.NewModule(store, code); err != nil {
+		return nil, err
+	}
+	return LoadStage(store, logs, origin, module, opts)
+}
+
+// LoadStage instantiates a compiled plugin, origin identifies the plugin in logs and errors
+func LoadStage(store *wasmer.Store, logs log.Sink, origin string, module *wasmer.Module, opts PluginOptions) (stage *WASMStage, err error) {
+	stage = &WASMStage{
+		Limits: opts.Limits,
+		Module: module,
+		Origin: origin,
+
+		logs:      logs,
+		onAbandon: opts.OnAbandon,
 	}
+	stage.stdout = pluginOutput{logs: logs, stage: stage, stream: "stdout"}
+	stage.stderr = pluginOutput{logs: logs, stage: stage, stream: "stderr"}
+	defer func() {
+		if err != nil {
+			_ = stage.Close()
+		}
+	}()
 	imports := wasmer.NewImportObject()
+	wasiModule := ""
+	if version := wasmer.GetWasiVersion(stage.Module); version != wasmer.WASI_VERSION_INVALID {
+		wasiModule = version.String()
+		if stage.WASI, stage.snapshots, err = newWASIEnvironment(filepath.Base(origin), opts.Dirs); err != nil {
+			return
+		}
+		if imports, err = stage.WASI.GenerateImportObject(store, stage.Module); err != nil {
+			return
+		}
+	}
 	for _, desc := range stage.Module.Imports() {
 		desc := desc
+		if desc.Module() == wasiModule {
+			continue
+		}
 		if desc.Type().Kind() == wasmer.MEMORY {
-			limits, err := wasmer.NewLimits(1, math.MaxUint32)
+			limits, err := wasmer.NewLimits(1, opts.Limits.maxPages())
 			if err != nil {
-				panic(err)
+				return stage, err
 			}
 			stage.Memory = wasmer.NewMemory(store, wasmer.NewMemoryType(limits))
 			imports.Register(desc.Module(), map[string]wasmer.IntoExtern{desc.Name(): stage.Memory})
 			continue
 		}
-		if desc.Type().Kind() == wasmer.FUNCTION {
+		if desc.Type().Kind() == wasmer.FUNCTION && desc.Module() == PluginABIModule {
 			switch desc.Name() {
 			case "error":
 				errorFnType := wasmer.NewFunctionType(wasmer.NewValueTypes(wasmer.I32, wasmer.I32), wasmer.NewValueTypes())
 				imports.Register(desc.Module(), map[string]wasmer.IntoExtern{
 					desc.Name(): wasmer.NewFunction(store, errorFnType, loggedFn(logs, desc, stage, func(v []wasmer.Value) ([]wasmer.Value, error) {
-						a, l := v[0].I32(), v[1].I32()
-						msg := stage.Memory.Data()[a : a+l]
+						msg, err := stage.memory(v[0].I32(), v[1].I32())
+						if err != nil {
+							return nil, err
+						}
 						if !utf8.Valid(msg) {
 							return nil, errors.New("message is not valid UTF-8")
 						}
-						err := errors.New(string(msg))
+						err = errors.New(string(msg))
 						stage.err = multierr.Append(stage.err, err)
 						log.Event(logs, "stage produced an error", log.Fields{"stage": stage}, log.Error(err))
 						return nil, nil
 					})),
 				})
+			case "get_config":
+				getConfigFnTyp := wasmer.NewFunctionType(wasmer.NewValueTypes(wasmer.I32), wasmer.NewValueTypes())
+				imports.Register(desc.Module(), map[string]wasmer.IntoExtern{
+					desc.Name(): wasmer.NewFunction(store, getConfigFnTyp, loggedFn(logs, desc, stage, func(v []wasmer.Value) ([]wasmer.Value, error) {
+						a := v[0].I32()
+						config := stage.config
+						stage.config = nil
+						if config == nil {
+							return nil, errors.New("stage tried to get its configuration outside of init")
+						}
+						buf, err := stage.memory(a, int32(len(config)))
+						if err != nil {
+							return nil, fmt.Errorf("could not copy configuration to memory: %w", err)
+						}
+						copy(buf, config)
+						return nil, nil
+					})),
+				})
 			case "get_data":
 				getDataFnTyp := wasmer.NewFunctionType(wasmer.NewValueTypes(wasmer.I32), wasmer.NewValueTypes())
 				imports.Register(desc.Module(), map[string]wasmer.IntoExtern{
@@ -126,9 +425,11 @@ func LoadStageFromFile(store *wasmer.Store, logs log.Sink, path string) (stage *
 						if data == nil {
 							return nil, errors.New("stage tried to get data when there was no data set")
 						}
-						if l := copy(stage.Memory.Data()[a:], data); l < len(data) {
-							return nil, fmt.Errorf("could not copy whole data to memory at %x: %d < %d", a, l, len(data))
+						buf, err := stage.memory(a, int32(len(data)))
+						if err != nil {
+							return nil, fmt.Errorf("could not copy data to memory: %w", err)
 						}
+						copy(buf, data)
 						return nil, nil
 					})),
 				})
@@ -136,56 +437,82 @@ func LoadStageFromFile(store *wasmer.Store, logs log.Sink, path string) (stage *
 				sendFnTyp := wasmer.NewFunctionType(wasmer.NewValueTypes(wasmer.I32, wasmer.I32), wasmer.NewValueTypes(wasmer.I32))
 				imports.Register(desc.Module(), map[string]wasmer.IntoExtern{
 					desc.Name(): wasmer.NewFunction(store, sendFnTyp, loggedFn(logs, desc, stage, func(v []wasmer.Value) ([]wasmer.Value, error) {
-						a, l := v[0].I32(), v[1].I32()
-						data := make([]byte, l)
-						_ = copy(data, stage.Memory.Data()[a:a+l])
-						stage.sent = append(stage.sent, data)
+						record, err := stage.memory(v[0].I32(), v[1].I32())
+						if err != nil {
+							return nil, err
+						}
+						data := make([]byte, len(record))
+						copy(data, record)
+						stage.sent = append(stage.sent, RoutedRecord{Data: data, Meta: stage.received.Meta, Output: stage.received.Output})
 						return []wasmer.Value{wasmer.NewI32(1)}, nil
 					})),
 				})
-			/*
-				case "fd_write":
-					imports.Register(desc.Module(), map[string]wasmer.IntoExtern{
-						desc.Name(): wasmer.NewFunction(store, desc.Type().IntoFunctionType(), func(v []wasmer.Value) ([]wasmer.Value, error) {
-							fd, iovs_ptr, iovs_len, nwritten_ptr := v[0].I32(), v[1].I32(), v[2].I32(), v[3].I32()
-							mem := stage.Memory.Data()
-							ios := make([]string, iovs_len)
-							nwritten := uint32(0)
-							for i := range ios {
-								iov_ptr := int(iovs_ptr) + i*8
-								p, l := binary.LittleEndian.Uint32(mem[iov_ptr:]), binary.LittleEndian.Uint32(mem[iov_ptr+4:])
-								blck := mem[p : p+l]
-								data := make([]byte, l)
-								copy(data, blck)
-								ios[i] = string(data)
-								nwritten += l
+			case "send_to":
+				sendToFnTyp := wasmer.NewFunctionType(wasmer.NewValueTypes(wasmer.I32, wasmer.I32, wasmer.I32, wasmer.I32), wasmer.NewValueTypes(wasmer.I32))
+				imports.Register(desc.Module(), map[string]wasmer.IntoExtern{
+					desc.Name(): wasmer.NewFunction(store, sendToFnTyp, loggedFn(logs, desc, stage, func(v []wasmer.Value) ([]wasmer.Value, error) {
+						name, err := stage.memory(v[0].I32(), v[1].I32())
+						if err != nil {
+							return nil, err
+						}
+						if !utf8.Valid(name) {
+							return nil, errors.New("output name is not valid UTF-8")
+						}
+						record, err := stage.memory(v[2].I32(), v[3].I32())
+						if err != nil {
+							return nil, err
+						}
+						data := make([]byte, len(record))
+						_ = copy(data, record)
+						stage.sent = append(stage.sent, RoutedRecord{Data: data, Meta: stage.received.Meta, Output: string(name)})
+						return []wasmer.Value{wasmer.NewI32(1)}, nil
+					})),
+				})
+			case "get_meta":
+				getMetaFnTyp := wasmer.NewFunctionType(wasmer.NewValueTypes(wasmer.I32, wasmer.I32, wasmer.I32, wasmer.I32), wasmer.NewValueTypes(wasmer.I32))
+				imports.Register(desc.Module(), map[string]wasmer.IntoExtern{
+					desc.Name(): wasmer.NewFunction(store, getMetaFnTyp, loggedFn(logs, desc, stage, func(v []wasmer.Value) ([]wasmer.Value, error) {
+						key, err := stage.memory(v[0].I32(), v[1].I32())
+						if err != nil {
+							return nil, err
+						}
+						value, ok := metaValue(stage.received.Meta, string(key))
+						if !ok {
+							return []wasmer.Value{wasmer.NewI32(-1)}, nil
+						}
+						if len(value) <= int(v[3].I32()) {
+							buf, err := stage.memory(v[2].I32(), int32(len(value)))
+							if err != nil {
+								return nil, err
 							}
-							binary.LittleEndian.PutUint32(mem[nwritten_ptr:], nwritten)
-							log.Event(logs, "fd_write", log.Fields{
-								"stage":     stage,
-								"fd":        fd,
-								"&iovs":     iovs_ptr,
-								"iovs_len":  iovs_len,
-								"&nwritten": nwritten_ptr,
-								"ios":       ios,
-								"nwritten":  nwritten,
-							})
-							return []wasmer.Value{wasmer.NewI32(0)}, nil
-						}),
-					})
-			*/
-			default:
+							_ = copy(buf, value)
+						}
+						return []wasmer.Value{wasmer.NewI32(int32(len(value)))}, nil
+					})),
+				})
+			case "get_received":
+				getReceivedFnTyp := wasmer.NewFunctionType(wasmer.NewValueTypes(), wasmer.NewValueTypes(wasmer.I64))
 				imports.Register(desc.Module(), map[string]wasmer.IntoExtern{
-					desc.Name(): wasmer.NewFunction(store, desc.Type().IntoFunctionType(), loggedFn(logs, desc, stage, func(v []wasmer.Value) ([]wasmer.Value, error) {
-						return nil, nil
+					desc.Name(): wasmer.NewFunction(store, getReceivedFnTyp, loggedFn(logs, desc, stage, func(v []wasmer.Value) ([]wasmer.Value, error) {
+						var ms int64
+						if meta := stage.received.Meta; meta != nil && !meta.Received.IsZero() {
+							ms = meta.Received.UnixMilli()
+						}
+						return []wasmer.Value{wasmer.NewI64(ms)}, nil
 					})),
 				})
-				log.Event(logs, "stubbed import", log.V(1), log.Fields{"stage": stage, "import": fmt.Sprintf("(%q %q %s)", desc.Module(), desc.Name(), desc.Type().Kind())})
+			default:
+				return stage, fmt.Errorf("unknown host function (%q %q), the plugin may have been built against a different ABI version", desc.Module(), desc.Name())
 			}
 			continue
 		}
 		return stage, fmt.Errorf("unsupported import (%q %q %s)", desc.Module(), desc.Name(), desc.Type().Kind())
 	}
+	if stage.Memory == nil && opts.Limits.RequireBoundedMemory && opts.Limits.MaxMemory > 0 {
+		if err = opts.Limits.checkExportedMemory(stage.Module); err != nil {
+			return
+		}
+	}
 	stage.Instance, err = wasmer.NewInstance(stage.Module, imports)
 	if err != nil {
 		return
@@ -196,17 +523,167 @@ func LoadStageFromFile(store *wasmer.Store, logs log.Sink, path string) (stage *
 			return
 		}
 	}
+	if size := uint64(stage.Memory.DataSize()); opts.Limits.MaxMemory > 0 && size > opts.Limits.MaxMemory {
+		return stage, fmt.Errorf("the initial memory of the plugin is %d bytes, more than the maximum of %d", size, opts.Limits.MaxMemory)
+	}
+	if err = stage.checkABI(); err != nil {
+		return
+	}
+	err = stage.init(opts.Config)
+	stage.readOutput()
 	return
 }
 
-func loggedFn(logs log.Sink, desc *wasmer.ImportType, stage *Stage, fn func([]wasmer.Value) ([]wasmer.Value, error)) func([]wasmer.Value) ([]wasmer.Value, error) {
-	return func(args []wasmer.Value) ([]wasmer.Value, error) {
+// init passes the configuration (an empty object if nil) to the plugin if it exports init
+func (s *WASMStage) init(config []byte) error {
+	if _, err := s.Instance.Exports.GetFunction("init"); err != nil {
+		if config != nil {
+			return errors.New("plugin is configured but doesn't export init")
+		}
+		return nil
+	}
+	if config == nil {
+		config = []byte("{}")
+	}
+	s.config = config
+	_, err := s.call("init", len(config))
+	s.config = nil
+	if err == nil {
+		err = s.err
+	}
+	s.err = nil
+	if err != nil {
+		return fmt.Errorf("plugin init failed: %w", err)
+	}
+	return nil
+}
+
+// checkABI initializes the plugin if it is a WASI reactor, then checks that it was built against the ABI version of the host and exports the functions the host calls
+func (s *WASMStage) checkABI() error {
+	if _, err := s.Instance.Exports.GetFunction("_initialize"); err == nil {
+		if _, err := s.call("_initialize"); err != nil {
+			return fmt.Errorf("failed to initialize plugin: %w", err)
+		}
+	}
+	if _, err := s.Instance.Exports.GetFunction("abi_version"); err != nil {
+		return fmt.Errorf("plugin does not export abi_version, it has to be built against ABI version %d (see docs/plugin-abi.md): %w", PluginABIVersion, err)
+	}
+	res, err := s.call("abi_version")
+	if err != nil {
+		return fmt.Errorf("failed to get plugin ABI version: %w", err)
+	}
+	if version, ok := res.(int32); !ok || version != PluginABIVersion {
+		return fmt.Errorf("plugin was built against ABI version %v, which is not supported (the supported version is %d)", res, PluginABIVersion)
+	}
+	if _, err := s.Instance.Exports.GetFunction("receive"); err != nil {
+		return fmt.Errorf("plugin does not export receive: %w", err)
+	}
+	if s.ticks, err = s.optionalExport("tick", wasmer.I64); err != nil {
+		return err
+	}
+	s.flushes, err = s.optionalExport("flush")
+	return err
+}
+
+// optionalExport reports whether the plugin exports a function, which has to take the given parameters and return nothing
+func (s *WASMStage) optionalExport(name string, params ...wasmer.ValueKind) (bool, error) {
+	fn, err := s.Instance.Exports.GetRawFunction(name)
+	if err != nil {
+		return false, nil
+	}
+	typ := fn.Type()
+	ok := len(typ.Params()) == len(params) && len(typ.Results()) == 0
+	for i := 0; ok && i < len(params); i++ {
+		ok = typ.Params()[i].Kind() == params[i]
+	}
+	if !ok {
+		return false, fmt.Errorf("the %s export of the plugin has the wrong type, it has to take %v and return nothing", name, params)
+	}
+	return true, nil
+}
+
+// memory returns the l bytes of the memory of the plugin at a
+func (s *WASMStage) memory(a, l int32) ([]byte, error) {
+	if s.Memory == nil {
+		return nil, errors.New("the plugin has no memory")
+	}
+	data := s.Memory.Data()
+	if a < 0 || l < 0 || int(a)+int(l) > len(data) {
+		return nil, fmt.Errorf("%d bytes at %x are out of the bounds of the memory of the plugin", l, a)
+	}
+	return data[a : a+l], nil
+}
+
+// metaValue returns the value of a metadata key of the plugin ABI (see docs/plugin-abi.md)
+func metaValue(meta *RecordMeta, key string) ([]byte, bool) {
+	if meta == nil {
+		return nil, false
+	}
+	var value string
+	switch key {
+	case "flow":
+		if meta.Flow.Name == "" {
+			return nil, false
+		}
+		value = meta.Flow.URL()
+	case "namespace":
+		value = meta.Kubernetes.NamespaceName
+	case "pod":
+		value = meta.Kubernetes.PodName
+	case "container":
+		value = meta.Kubernetes.ContainerName
+	case "labels":
+		labels := meta.Kubernetes.Labels
+		if labels == nil {
+			labels = map[string]string{}
+		}
+		data, err := json.Marshal(labels)
+		return data, err == nil
+	default:
+		name := strings.TrimPrefix(key, "label:")
+		if name == key {
+			return nil, false
+		}
+		var ok bool
+		if value, ok = meta.Kubernetes.Labels[name]; !ok {
+			return nil, false
+		}
+	}
+	if value == "" {
+		return nil, false
+	}
+	return []byte(value), true
+}
+
+// loggedFn wraps a host function, logging its calls.
+// The error of a host function (or a panic, which can't unwind through the runtime) fails the call into the plugin once it returns:
+// the runtime frees the trap of an error returned to it a second time when it's garbage collected, so host functions don't trap,
+// but return zero values and ignore the later host calls of the call instead.
+func loggedFn(logs log.Sink, desc *wasmer.ImportType, stage *WASMStage, fn func([]wasmer.Value) ([]wasmer.Value, error)) func([]wasmer.Value) ([]wasmer.Value, error) {
+	var zero []wasmer.Value
+	for _, typ := range desc.Type().IntoFunctionType().Results() {
+		zero = append(zero, wasmer.NewValue(0, typ.Kind()))
+	}
+	return func(args []wasmer.Value) (res []wasmer.Value, _ error) {
+		if stage.hostErr != nil {
+			return zero, nil
+		}
+		defer func() {
+			if r := recover(); r != nil {
+				stage.hostErr = fmt.Errorf("%s.%s failed: %v", desc.Module(), desc.Name(), r)
+			}
+			if stage.hostErr != nil {
+				res = zero
+			}
+		}()
 		log.Event(logs, "imported function invoked", log.V(2), log.Fields{
 			"stage": stage,
 			"func":  fmt.Sprintf("%s.%s", desc.Module(), desc.Name()),
 			"args":  loggableArgs(args),
 		})
-		return fn(args)
+		res, err := fn(args)
+		stage.hostErr = err
+		return res, nil
 	}
 }
 
@@ -0,0 +1,164 @@
+package internal
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"go.uber.org/multierr"
+)
+
+// PipelineOrdering decides in which order a PipelinePool delivers the results of records processed concurrently
+type PipelineOrdering string
+
+const (
+	// POStrict delivers results in the order records were submitted, records are spread across workers round-robin
+	POStrict PipelineOrdering = "strict"
+	// POPod delivers results as soon as they are ready, but keeps the order of the records of each pod,
+	// which are all processed by the same worker (records without a pod are processed by the first worker)
+	POPod PipelineOrdering = "pod"
+)
+
+var PipelineOrderings = []PipelineOrdering{POStrict, POPod}
+
+func ParsePipelineOrdering(s string) (PipelineOrdering, error) {
+	for _, o := range PipelineOrderings {
+		if s == string(o) {
+			return o, nil
+		}
+	}
+	return "", fmt.Errorf("invalid ordering %q (must be one of %v)", s, PipelineOrderings)
+}
+
+// pipelinePoolQueueSize is the number of jobs queued per worker before submitting blocks
+const pipelinePoolQueueSize = 64
+
+// PipelineResultFunc receives the records resulting from a job of a PipelinePool
+type PipelineResultFunc func(res []RoutedRecord, err error)
+
+// NewPipelinePool starts a worker for each pipeline; the pipelines have to be instances of the same stages, none of them shared.
+func NewPipelinePool(pipelines []Pipeline, ordering PipelineOrdering) *PipelinePool {
+	p := &PipelinePool{
+		ordering: ordering,
+		results:  make(chan *pipelineJob, pipelinePoolQueueSize*len(pipelines)),
+		done:     make(chan struct{}),
+	}
+	for _, pipeline := range pipelines {
+		w := &pipelineWorker{
+			jobs:     make(chan *pipelineJob, pipelinePoolQueueSize),
+			pipeline: pipeline,
+		}
+		p.workers = append(p.workers, w)
+		p.wg.Add(1)
+		go p.work(w)
+	}
+	go p.deliver()
+	return p
+}
+
+// PipelinePool processes records concurrently, each worker running its own instance of the pipeline.
+// Stateful stages (e.g. plugins aggregating records) only see the records of their worker.
+// The result functions of jobs are called one at a time, in the order decided by the ordering.
+// Submitting jobs (ProcessRecord, Tick and Close) is not safe for concurrent use.
+type PipelinePool struct {
+	done     chan struct{}
+	next     int // the worker the next record goes to with POStrict
+	ordering PipelineOrdering
+	results  chan *pipelineJob
+	wg       sync.WaitGroup
+	workers  []*pipelineWorker
+}
+
+type pipelineWorker struct {
+	jobs     chan *pipelineJob
+	pipeline Pipeline
+}
+
+type pipelineJob struct {
+	run    func(Pipeline) ([]RoutedRecord, error)
+	result PipelineResultFunc
+	ready  chan struct{} // closed once res and err are set
+	res    []RoutedRecord
+	err    error
+}
+
+// Workers returns the number of workers
+func (p *PipelinePool) Workers() int {
+	return len(p.workers)
+}
+
+// ProcessRecord queues a record to be run through a pipeline (see Pipeline.ProcessRecord), blocking while the queue of its worker is full
+func (p *PipelinePool) ProcessRecord(record []byte, meta *RecordMeta, result PipelineResultFunc) {
+	worker := p.next
+	if p.ordering == POPod {
+		worker = p.podWorker(meta)
+	} else {
+		p.next = (p.next + 1) % len(p.workers)
+	}
+	p.submit(p.workers[worker], result, func(pipeline Pipeline) ([]RoutedRecord, error) {
+		return pipeline.ProcessRecord(record, meta)
+	})
+}
+
+// Tick queues ticking the pipeline of every worker (see Pipeline.Tick), result is called once per worker
+func (p *PipelinePool) Tick(now time.Time, result PipelineResultFunc) {
+	for _, w := range p.workers {
+		p.submit(w, result, func(pipeline Pipeline) ([]RoutedRecord, error) {
+			return pipeline.Tick(now)
+		})
+	}
+}
+
+// Close flushes the pipeline of every worker once the queued jobs are done (see Pipeline.Flush, result is called once per worker),
+// waits until the results are delivered and closes the pipelines. The pool can't be used afterwards.
+func (p *PipelinePool) Close(result PipelineResultFunc) (err error) {
+	for _, w := range p.workers {
+		p.submit(w, result, Pipeline.Flush)
+		close(w.jobs)
+	}
+	p.wg.Wait()
+	close(p.results)
+	<-p.done
+	for _, w := range p.workers {
+		err = multierr.Append(err, w.pipeline.Close())
+	}
+	return
+}
+
+func (p *PipelinePool) submit(w *pipelineWorker, result PipelineResultFunc, run func(Pipeline) ([]RoutedRecord, error)) {
+	job := &pipelineJob{run: run, result: result, ready: make(chan struct{})}
+	w.jobs <- job
+	// with POStrict results are delivered in the order jobs are submitted, otherwise once they are ready
+	if p.ordering != POPod {
+		p.results <- job
+	}
+}
+
+func (p *PipelinePool) podWorker(meta *RecordMeta) int {
+	if meta == nil || meta.Kubernetes.PodName == "" {
+		return 0
+	}
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(meta.Kubernetes.NamespaceName + "/" + meta.Kubernetes.PodName))
+	return int(h.Sum32() % uint32(len(p.workers)))
+}
+
+func (p *PipelinePool) work(w *pipelineWorker) {
+	defer p.wg.Done()
+	for job := range w.jobs {
+		job.res, job.err = job.run(w.pipeline)
+		close(job.ready)
+		if p.ordering == POPod {
+			p.results <- job
+		}
+	}
+}
+
+func (p *PipelinePool) deliver() {
+	defer close(p.done)
+	for job := range p.results {
+		<-job.ready
+		job.result(job.res, job.err)
+	}
+}
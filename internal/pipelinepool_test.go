@@ -0,0 +1,222 @@
+package internal
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+)
+
+// delayStage passes records through after a random delay, tagged with its worker, and emits a record naming its worker when ticked and flushed
+type delayStage struct {
+	worker int
+	rnd    *rand.Rand
+}
+
+func (s *delayStage) Process(record []byte) ([][]byte, error) {
+	time.Sleep(time.Duration(s.rnd.Intn(200)) * time.Microsecond)
+	return [][]byte{[]byte(fmt.Sprintf("%s@%d", record, s.worker))}, nil
+}
+
+func (s *delayStage) Tick(time.Time) ([]RoutedRecord, error) {
+	time.Sleep(time.Duration(s.rnd.Intn(200)) * time.Microsecond)
+	return []RoutedRecord{{Data: []byte(fmt.Sprintf("tick@%d", s.worker))}}, nil
+}
+
+func (s *delayStage) Flush() ([]RoutedRecord, error) {
+	return []RoutedRecord{{Data: []byte(fmt.Sprintf("flush@%d", s.worker))}}, nil
+}
+
+func (s *delayStage) String() string {
+	return fmt.Sprintf("delay@%d", s.worker)
+}
+
+// runDelayPool submits records of 8 pods to a pool of delay stages, ticking it after every 100 records,
+// and returns the records in the order they were delivered in (each result on its own) and the submitted records
+func runDelayPool(t *testing.T, ordering PipelineOrdering, workers int) (delivered, submitted []string) {
+	var pipelines []Pipeline
+	for i := 0; i < workers; i++ {
+		pipelines = append(pipelines, Pipeline{&delayStage{worker: i, rnd: rand.New(rand.NewSource(int64(i)))}})
+	}
+	pool := NewPipelinePool(pipelines, ordering)
+	result := func(res []RoutedRecord, err error) {
+		if err != nil {
+			t.Error(err)
+		}
+		if len(res) != 1 {
+			t.Errorf("expected a single record per result, got %d", len(res))
+		}
+		for _, r := range res {
+			delivered = append(delivered, string(r.Data))
+		}
+	}
+	for i := 0; i < 400; i++ {
+		record := fmt.Sprintf("pod-%d/%d", i%8, i)
+		meta := &RecordMeta{Kubernetes: KubernetesMeta{NamespaceName: "default", PodName: fmt.Sprintf("pod-%d", i%8)}}
+		submitted = append(submitted, record)
+		pool.ProcessRecord([]byte(record), meta, result)
+		if i%100 == 99 {
+			submitted = append(submitted, "tick")
+			pool.Tick(time.Now(), result)
+		}
+	}
+	if err := pool.Close(result); err != nil {
+		t.Fatal(err)
+	}
+	return delivered, submitted
+}
+
+// untag splits a delivered record into the submitted record and the worker that processed it
+func untag(record string) (string, string) {
+	i := strings.LastIndex(record, "@")
+	return record[:i], record[i+1:]
+}
+
+func TestPipelinePoolStrictOrdering(t *testing.T) {
+	const workers = 4
+	delivered, submitted := runDelayPool(t, POStrict, workers)
+
+	var expected []string
+	for _, record := range submitted {
+		if record == "tick" {
+			// every worker is ticked, in the order of the workers
+			for w := 0; w < workers; w++ {
+				expected = append(expected, fmt.Sprintf("tick@%d", w))
+			}
+			continue
+		}
+		expected = append(expected, record)
+	}
+	for w := 0; w < workers; w++ {
+		expected = append(expected, fmt.Sprintf("flush@%d", w))
+	}
+	var actual []string
+	records := 0
+	for _, record := range delivered {
+		if r, w := untag(record); r != "tick" && r != "flush" {
+			// records are spread across workers round-robin
+			if expectedWorker := fmt.Sprint(records % workers); w != expectedWorker {
+				t.Errorf("expected record %s to be processed by worker %s, got %s", r, expectedWorker, w)
+			}
+			records++
+			actual = append(actual, r)
+			continue
+		}
+		actual = append(actual, record)
+	}
+	if strings.Join(actual, " ") != strings.Join(expected, " ") {
+		t.Errorf("expected the results in submission order:\n%v\ngot:\n%v", expected, actual)
+	}
+}
+
+func TestPipelinePoolPodOrdering(t *testing.T) {
+	const workers = 4
+	delivered, submitted := runDelayPool(t, POPod, workers)
+
+	expected := map[string][]string{} // records by pod
+	for _, record := range submitted {
+		if record != "tick" {
+			pod, _, _ := strings.Cut(record, "/")
+			expected[pod] = append(expected[pod], record)
+		}
+	}
+	actual := map[string][]string{}
+	podWorkers := map[string]string{}
+	ticks, flushes := map[string]int{}, map[string]int{}
+	flushed := map[string]bool{}
+	for _, record := range delivered {
+		r, w := untag(record)
+		switch r {
+		case "tick":
+			ticks[w]++
+			continue
+		case "flush":
+			flushes[w]++
+			flushed[w] = true
+			continue
+		}
+		if flushed[w] {
+			t.Errorf("record %s delivered after its worker %s was flushed", r, w)
+		}
+		pod, _, _ := strings.Cut(r, "/")
+		if prev, ok := podWorkers[pod]; ok && prev != w {
+			t.Errorf("records of %s processed by workers %s and %s", pod, prev, w)
+		}
+		podWorkers[pod] = w
+		actual[pod] = append(actual[pod], r)
+	}
+	for pod, records := range expected {
+		if strings.Join(actual[pod], " ") != strings.Join(records, " ") {
+			t.Errorf("expected the records of %s in submission order:\n%v\ngot:\n%v", pod, records, actual[pod])
+		}
+	}
+	for w := 0; w < workers; w++ {
+		if worker := fmt.Sprint(w); ticks[worker] != 4 || flushes[worker] != 1 {
+			t.Errorf("expected worker %d to be ticked 4 times and flushed once, got %d ticks and %d flushes", w, ticks[worker], flushes[worker])
+		}
+	}
+}
+
+// benchmarkRecords returns records of 16 pods with their metadata
+func benchmarkRecords() ([][]byte, []*RecordMeta) {
+	var records [][]byte
+	var metas []*RecordMeta
+	for i := 0; i < 1024; i++ {
+		record := []byte(fmt.Sprintf(`{"kubernetes":{"namespace_name":"default","pod_name":"pod-%d","container_name":"app"},"level":"info","message":"request %d served in %dms"}`, i%16, i, i%100))
+		records = append(records, record)
+		metas = append(metas, NewRecordMeta(FlowReference{}, time.Now(), record))
+	}
+	return records, metas
+}
+
+// benchmarkPipelines returns n instances of a pipeline transforming each record with a query
+func benchmarkPipelines(b *testing.B, n int) []Pipeline {
+	var res []Pipeline
+	for i := 0; i < n; i++ {
+		stage, err := NewQueryStage(`{level, message: (.message | ascii_upcase), pod: .kubernetes.pod_name}`)
+		if err != nil {
+			b.Fatal(err)
+		}
+		res = append(res, Pipeline{stage})
+	}
+	return res
+}
+
+func BenchmarkPipeline(b *testing.B) {
+	records, metas := benchmarkRecords()
+	pipeline := benchmarkPipelines(b, 1)[0]
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := pipeline.ProcessRecord(records[i%len(records)], metas[i%len(metas)]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkPipelinePool(b *testing.B) {
+	records, metas := benchmarkRecords()
+	for _, ordering := range PipelineOrderings {
+		for _, workers := range []int{1, 2, 4, 8} {
+			b.Run(fmt.Sprintf("%s/workers=%d", ordering, workers), func(b *testing.B) {
+				pool := NewPipelinePool(benchmarkPipelines(b, workers), ordering)
+				var failed int
+				result := func(res []RoutedRecord, err error) {
+					if err != nil {
+						failed++
+					}
+				}
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					pool.ProcessRecord(records[i%len(records)], metas[i%len(metas)], result)
+				}
+				if err := pool.Close(result); err != nil {
+					b.Fatal(err)
+				}
+				if failed > 0 {
+					b.Fatalf("%d records failed processing", failed)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+// PluginOptions configures how plugins are loaded
+type PluginOptions struct {
+	// Cache keeps the plugins compiled by LoadStageFromFile and LoadStageFromCode on disk (plugins are compiled every time they are loaded if nil)
+	Cache *ModuleCache
+	// Dirs maps the relative paths plugins see to host directories they can read (plugins have no filesystem access if empty)
+	Dirs map[string]string
+	// Config is the configuration of the plugin, a JSON object passed to its init function (nil if the plugin is not configured)
+	Config []byte
+	Limits PluginLimits
+	// OnAbandon is called when a call into the plugin times out, and the function it returns when the abandoned call returns (if it ever does)
+	OnAbandon func() (returned func())
+}
+
+// ParsePluginReference splits a plugin reference in the format PATH[?KEY=VALUE&...] into the path of the plugin and the configuration given in the query
+func ParsePluginReference(ref string) (path string, config map[string]interface{}, err error) {
+	path, query, ok := strings.Cut(ref, "?")
+	if path == "" {
+		return "", nil, fmt.Errorf("invalid plugin reference %q: empty path", ref)
+	}
+	if !ok {
+		return path, nil, nil
+	}
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid plugin reference %q: %w", ref, err)
+	}
+	config = make(map[string]interface{}, len(values))
+	for key, vs := range values {
+		if len(vs) > 1 {
+			return "", nil, fmt.Errorf("invalid plugin reference %q: %s is specified more than once", ref, key)
+		}
+		config[key] = vs[0]
+	}
+	return path, config, nil
+}
+
+// PluginConfigs holds the configurations of plugins, keyed by the paths plugins are referenced with
+type PluginConfigs map[string]map[string]interface{}
+
+// LoadPluginConfigs reads the configurations of plugins from a YAML (or JSON) file mapping plugin paths to their configuration, e.g.
+//
+//	grep.wasm:
+//	  pattern: error
+func LoadPluginConfigs(path string) (res PluginConfigs, err error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := yaml.Unmarshal(data, &res); err != nil {
+		return nil, fmt.Errorf("invalid plugin configuration file %s: %w", path, err)
+	}
+	return res, nil
+}
+
+// Config returns the configuration of a plugin encoded as a JSON object, with the values in overrides replacing the ones in the file.
+// It returns nil if the plugin has no configuration.
+func (c PluginConfigs) Config(path string, overrides map[string]interface{}) ([]byte, error) {
+	config, ok := c[path]
+	if !ok && overrides == nil {
+		return nil, nil
+	}
+	merged := make(map[string]interface{}, len(config)+len(overrides))
+	for k, v := range config {
+		merged[k] = v
+	}
+	for k, v := range overrides {
+		merged[k] = v
+	}
+	return json.Marshal(merged)
+}
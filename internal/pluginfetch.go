@@ -0,0 +1,349 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/banzaicloud/log-socket/log"
+)
+
+const (
+	// OCIPluginScheme prefixes references to plugins in OCI registries: oci://REGISTRY/REPOSITORY[:TAG][@sha256:DIGEST]
+	OCIPluginScheme = "oci://"
+	// HTTPSPluginScheme prefixes references to plugins at HTTPS URLs: https://HOST/PATH[@sha256:DIGEST]
+	HTTPSPluginScheme = "https://"
+
+	// pinSeparator separates the digest a remote plugin is pinned to from the rest of its reference
+	pinSeparator = "@"
+	// signatureSuffix is appended to the URL of a plugin to get its signature
+	signatureSuffix = ".sig"
+
+	maxPluginDownloadSize = 256 << 20
+	maxSignatureSize      = 64 << 10
+)
+
+var (
+	digestPattern     = regexp.MustCompile(`^sha256:[a-f0-9]{64}$`)
+	repositoryPattern = regexp.MustCompile(`^[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*(?:/[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*)*$`)
+	tagPattern        = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9._-]{0,127}$`)
+)
+
+// IsRemotePluginReference reports whether the path of a plugin reference is a plugin to fetch rather than a local file
+func IsRemotePluginReference(path string) bool {
+	return strings.HasPrefix(path, OCIPluginScheme) || strings.HasPrefix(path, HTTPSPluginScheme) || strings.HasPrefix(path, "http://")
+}
+
+// RemotePluginReference is a plugin in an OCI registry or at an HTTPS URL
+type RemotePluginReference struct {
+	// URL is the HTTPS URL of the plugin (empty for plugins in OCI registries)
+	URL string
+	// Registry, Repository and Tag locate the plugin in an OCI registry (empty for plugins at HTTPS URLs)
+	Registry   string
+	Repository string
+	Tag        string
+	// Digest pins the plugin (empty if it isn't pinned): it is the digest of the manifest for plugins in OCI registries, and of the module for plugins at HTTPS URLs
+	Digest string
+}
+
+// ParseRemotePluginReference parses the path of a reference to a plugin in an OCI registry or at an HTTPS URL
+func ParseRemotePluginReference(path string) (res RemotePluginReference, err error) {
+	rest := path
+	if i := strings.LastIndex(rest, pinSeparator+"sha256:"); i >= 0 {
+		res.Digest = rest[i+len(pinSeparator):]
+		rest = rest[:i]
+		if !digestPattern.MatchString(res.Digest) {
+			return res, fmt.Errorf("invalid plugin reference %q: invalid digest %q", path, res.Digest)
+		}
+	}
+	switch {
+	case strings.HasPrefix(rest, HTTPSPluginScheme):
+		u, err := url.Parse(rest)
+		if err != nil {
+			return res, fmt.Errorf("invalid plugin reference %q: %w", path, err)
+		}
+		if u.Host == "" {
+			return res, fmt.Errorf("invalid plugin reference %q: missing host", path)
+		}
+		res.URL = rest
+	case strings.HasPrefix(rest, OCIPluginScheme):
+		registry, repository, ok := strings.Cut(strings.TrimPrefix(rest, OCIPluginScheme), "/")
+		if !ok || registry == "" {
+			return res, fmt.Errorf("invalid plugin reference %q: it must be %sREGISTRY/REPOSITORY[:TAG][@sha256:DIGEST]", path, OCIPluginScheme)
+		}
+		if i := strings.LastIndex(repository, ":"); i >= 0 {
+			res.Tag = repository[i+1:]
+			repository = repository[:i]
+			if !tagPattern.MatchString(res.Tag) {
+				return res, fmt.Errorf("invalid plugin reference %q: invalid tag %q", path, res.Tag)
+			}
+		}
+		if !repositoryPattern.MatchString(repository) {
+			return res, fmt.Errorf("invalid plugin reference %q: invalid repository %q", path, repository)
+		}
+		if res.Tag == "" && res.Digest == "" {
+			res.Tag = "latest"
+		}
+		res.Registry, res.Repository = registry, repository
+	default:
+		return res, fmt.Errorf("invalid plugin reference %q: plugins can only be fetched from OCI registries (%s) and HTTPS URLs (%s)", path, OCIPluginScheme, HTTPSPluginScheme)
+	}
+	return res, nil
+}
+
+func (r RemotePluginReference) String() string {
+	var res string
+	if r.URL != "" {
+		res = r.URL
+	} else {
+		res = OCIPluginScheme + r.Registry + "/" + r.Repository
+		if r.Tag != "" {
+			res += ":" + r.Tag
+		}
+	}
+	if r.Digest != "" {
+		res += pinSeparator + r.Digest
+	}
+	return res
+}
+
+// LoadPluginPublicKeys reads PEM encoded public keys (ECDSA, Ed25519 or RSA) that plugins can be signed with
+func LoadPluginPublicKeys(paths []string) (res []crypto.PublicKey, err error) {
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("no PEM encoded public key in %s", path)
+		}
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("invalid public key in %s: %w", path, err)
+		}
+		switch key.(type) {
+		case *ecdsa.PublicKey, ed25519.PublicKey, *rsa.PublicKey:
+		default:
+			return nil, fmt.Errorf("unsupported public key type %T in %s", key, path)
+		}
+		res = append(res, key)
+	}
+	return res, nil
+}
+
+// NewPluginFetcher returns a fetcher keeping the plugins it downloads in dir
+func NewPluginFetcher(dir string, logs log.Sink) *PluginFetcher {
+	return &PluginFetcher{
+		Client:      &http.Client{Timeout: time.Minute},
+		Credentials: DockerConfigCredentials,
+		Dir:         dir,
+
+		logs: logs,
+	}
+}
+
+// PluginFetcher downloads plugins from OCI registries and HTTPS URLs, verifying them before they are loaded.
+// Downloaded plugins (and the manifests of OCI artifacts) are kept in a directory by their digest, so that pinned plugins are only downloaded once.
+type PluginFetcher struct {
+	// Client is the HTTP client plugins are downloaded with
+	Client *http.Client
+	// Credentials returns the username and password for a registry (HOST[:PORT]), ok is false for anonymous access
+	Credentials func(registry string) (username, password string, ok bool)
+	// Dir is the directory downloaded plugins are kept in
+	Dir string
+	// PlainHTTPRegistries are the registries (HOST[:PORT]) accessed over plain HTTP instead of HTTPS
+	PlainHTTPRegistries []string
+	// PublicKeys verify the signatures of plugins; if any are set, plugins without a valid signature by one of them are rejected.
+	// Plugins in OCI registries are signed like container images by cosign, and plugins at HTTPS URLs have their signature (as created by cosign sign-blob) at the URL with a .sig suffix.
+	PublicKeys []crypto.PublicKey
+
+	logs log.Sink
+}
+
+// Fetch returns the code of a remote plugin, which is downloaded unless it is pinned to a digest that was downloaded before.
+// Signatures are always downloaded if public keys are set.
+func (f *PluginFetcher) Fetch(ctx context.Context, ref RemotePluginReference) ([]byte, error) {
+	if ref.URL != "" {
+		return f.fetchURL(ctx, ref)
+	}
+	return f.fetchOCI(ctx, ref)
+}
+
+func (f *PluginFetcher) fetchURL(ctx context.Context, ref RemotePluginReference) ([]byte, error) {
+	if ref.Digest != "" && len(f.PublicKeys) == 0 {
+		if code, ok := f.kept(ref.Digest); ok {
+			return code, nil
+		}
+	}
+	code, err := f.get(ctx, ref.URL, maxPluginDownloadSize)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256Digest(code)
+	if ref.Digest != "" && digest != ref.Digest {
+		return nil, fmt.Errorf("the digest of the plugin is %s instead of %s", digest, ref.Digest)
+	}
+	if len(f.PublicKeys) > 0 {
+		sig, err := f.get(ctx, ref.URL+signatureSuffix, maxSignatureSize)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get signature: %w", err)
+		}
+		if sig, err = base64.StdEncoding.DecodeString(string(bytes.TrimSpace(sig))); err != nil {
+			return nil, fmt.Errorf("invalid signature: %w", err)
+		}
+		if err := verifySignature(f.PublicKeys, code, sig); err != nil {
+			return nil, err
+		}
+	}
+	f.keep(digest, code)
+	return code, nil
+}
+
+func (f *PluginFetcher) fetchOCI(ctx context.Context, ref RemotePluginReference) ([]byte, error) {
+	repo := f.repository(ref)
+	var manifest []byte
+	digest := ref.Digest
+	if digest != "" {
+		manifest, _ = f.kept(digest)
+	}
+	if manifest == nil {
+		tagOrDigest := ref.Tag
+		if ref.Digest != "" {
+			tagOrDigest = ref.Digest
+		}
+		var err error
+		if manifest, digest, err = repo.manifest(ctx, tagOrDigest); err != nil {
+			return nil, err
+		}
+		if ref.Digest != "" && digest != ref.Digest {
+			return nil, fmt.Errorf("the digest of the manifest is %s instead of %s", digest, ref.Digest)
+		}
+	}
+	layer, err := pluginLayer(manifest)
+	if err != nil {
+		return nil, err
+	}
+	if len(f.PublicKeys) > 0 {
+		if err := repo.verifySignature(ctx, digest, f.PublicKeys); err != nil {
+			return nil, err
+		}
+	}
+	code, ok := f.kept(layer.Digest)
+	if !ok {
+		if code, err = repo.blob(ctx, layer.Digest, layer.Size); err != nil {
+			return nil, err
+		}
+		f.keep(layer.Digest, code)
+	}
+	f.keep(digest, manifest)
+	log.Event(f.logs, "plugin fetched", log.V(1), log.Fields{"plugin": ref, "digest": digest, "layer": layer.Digest})
+	return code, nil
+}
+
+// get downloads a file over HTTPS
+func (f *PluginFetcher) get(ctx context.Context, url string, limit int64) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := f.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	return readResponse(resp, limit)
+}
+
+// path returns the file content with a digest is kept in
+func (f *PluginFetcher) path(digest string) string {
+	return filepath.Join(f.Dir, "sha256", strings.TrimPrefix(digest, "sha256:"))
+}
+
+// kept returns the content with a digest if it was kept before (and wasn't corrupted since)
+func (f *PluginFetcher) kept(digest string) ([]byte, bool) {
+	data, err := os.ReadFile(f.path(digest))
+	if err != nil || sha256Digest(data) != digest {
+		return nil, false
+	}
+	return data, true
+}
+
+// keep writes content to the directory, failing to do so is only logged
+func (f *PluginFetcher) keep(digest string, data []byte) {
+	if err := writeFileAtomically(f.path(digest), data); err != nil {
+		log.Event(f.logs, "failed to keep downloaded plugin", log.Error(err), log.Fields{"digest": digest})
+	}
+}
+
+// verifySignature checks that the signature of data is valid for one of the keys.
+// ECDSA and RSA (PKCS #1 v1.5) signatures are of the SHA-256 digest of data, Ed25519 signatures are of data.
+func verifySignature(keys []crypto.PublicKey, data, sig []byte) error {
+	digest := sha256.Sum256(data)
+	for _, key := range keys {
+		switch key := key.(type) {
+		case *ecdsa.PublicKey:
+			if ecdsa.VerifyASN1(key, digest[:], sig) {
+				return nil
+			}
+		case ed25519.PublicKey:
+			if ed25519.Verify(key, data, sig) {
+				return nil
+			}
+		case *rsa.PublicKey:
+			if rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig) == nil {
+				return nil
+			}
+		}
+	}
+	return errors.New("the signature of the plugin is not valid for any of the public keys")
+}
+
+func sha256Digest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// httpStatusError is returned for unsuccessful responses
+type httpStatusError struct {
+	status  int
+	message string
+}
+
+func (e httpStatusError) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.status, http.StatusText(e.status), e.message)
+}
+
+// readResponse returns the body of a successful response, which must not be longer than limit
+func readResponse(resp *http.Response, limit int64) ([]byte, error) {
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, httpStatusError{status: resp.StatusCode, message: strings.TrimSpace(string(body))}
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("the response from %s is larger than %d bytes", resp.Request.URL, limit)
+	}
+	return data, nil
+}
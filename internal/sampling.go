@@ -0,0 +1,142 @@
+package internal
+
+import (
+	"fmt"
+	"math/rand"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// query parameters listeners can request sampling with
+const (
+	SampleQueryKey      = "sample"
+	MaxRateQueryKey     = "max-rate"
+	FirstPerPodQueryKey = "first-per-pod"
+	SeedQueryKey        = "seed"
+)
+
+// samplingStatusInterval is how often listeners are told how many records were skipped
+const samplingStatusInterval = 5 * time.Second
+
+// SamplingOptions specifies how records are thinned out before being sent to a listener
+type SamplingOptions struct {
+	// Probability is the probability of keeping each record (sampling by probability is disabled if 0)
+	Probability float64
+	// MaxRate is the maximum number of records per second (disabled if 0)
+	MaxRate float64
+	// FirstPerPod is the number of records kept per pod in each FirstPerPodWindow (disabled if 0)
+	FirstPerPod       int
+	FirstPerPodWindow time.Duration
+	// Seed makes sampling by probability deterministic
+	Seed int64
+}
+
+func (o SamplingOptions) Enabled() bool {
+	return o.Probability > 0 || o.MaxRate > 0 || o.FirstPerPod > 0
+}
+
+// ParseSamplingOptions parses sampling options from the query parameters of a listener's request, e.g.
+//
+//	?sample=0.01&seed=42
+//	?max-rate=200/s
+//	?first-per-pod=10/m
+func ParseSamplingOptions(query url.Values) (res SamplingOptions, err error) {
+	if s := query.Get(SampleQueryKey); s != "" {
+		if res.Probability, err = strconv.ParseFloat(s, 64); err != nil || res.Probability <= 0 || res.Probability > 1 {
+			return res, fmt.Errorf("invalid %s parameter %q: must be a probability in (0, 1]", SampleQueryKey, s)
+		}
+	}
+	if s := query.Get(MaxRateQueryKey); s != "" {
+		n, per, err := parseRate(s)
+		if err != nil {
+			return res, fmt.Errorf("invalid %s parameter %q: %w", MaxRateQueryKey, s, err)
+		}
+		res.MaxRate = n / per.Seconds()
+	}
+	if s := query.Get(FirstPerPodQueryKey); s != "" {
+		n, per, err := parseRate(s)
+		if err != nil || n != float64(int(n)) {
+			return res, fmt.Errorf("invalid %s parameter %q: must be a whole number of records optionally followed by /s, /m or /h (per minute by default)", FirstPerPodQueryKey, s)
+		}
+		res.FirstPerPod, res.FirstPerPodWindow = int(n), per
+	}
+	if s := query.Get(SeedQueryKey); s != "" {
+		if res.Seed, err = strconv.ParseInt(s, 10, 64); err != nil {
+			return res, fmt.Errorf("invalid %s parameter %q: must be an integer", SeedQueryKey, s)
+		}
+	} else {
+		res.Seed = time.Now().UnixNano()
+	}
+	return res, nil
+}
+
+// parseRate parses a rate in the format N[/s|/m|/h] (per minute if the unit is omitted)
+func parseRate(s string) (float64, time.Duration, error) {
+	num, unit, _ := strings.Cut(s, "/")
+	n, err := strconv.ParseFloat(num, 64)
+	if err != nil || n <= 0 {
+		return 0, 0, fmt.Errorf("%q is not a positive number", num)
+	}
+	switch unit {
+	case "s":
+		return n, time.Second, nil
+	case "", "m":
+		return n, time.Minute, nil
+	case "h":
+		return n, time.Hour, nil
+	default:
+		return 0, 0, fmt.Errorf("unknown unit %q (must be s, m or h)", unit)
+	}
+}
+
+func newSampler(opts SamplingOptions) *sampler {
+	res := &sampler{
+		opts: opts,
+		rand: rand.New(rand.NewSource(opts.Seed)),
+	}
+	if opts.MaxRate > 0 {
+		res.rate = newTokenBucket(opts.MaxRate)
+	}
+	if opts.FirstPerPod > 0 {
+		res.perPod = make(map[string]int)
+	}
+	return res
+}
+
+// sampler decides which records to keep; given the same options and records, it makes the same decisions (it is not safe for concurrent use)
+type sampler struct {
+	opts   SamplingOptions
+	perPod map[string]int
+	rand   *rand.Rand
+	rate   *tokenBucket
+	window time.Time
+}
+
+func (s *sampler) keep(now time.Time, pod string) bool {
+	if s.perPod != nil {
+		// tumbling windows, counts are reset at the start of each
+		if window := now.Truncate(s.opts.FirstPerPodWindow); !window.Equal(s.window) {
+			s.window = window
+			s.perPod = make(map[string]int)
+		}
+		if s.perPod[pod] >= s.opts.FirstPerPod {
+			return false
+		}
+	}
+	if s.opts.Probability > 0 && s.rand.Float64() >= s.opts.Probability {
+		return false
+	}
+	if s.rate != nil {
+		if !s.rate.available(now, 1) {
+			return false
+		}
+		s.rate.take(1)
+	}
+	// only records that are kept count towards the first records of their pod
+	if s.perPod != nil {
+		s.perPod[pod]++
+	}
+	return true
+}
@@ -0,0 +1,114 @@
+package internal
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func sample(opts SamplingOptions, start time.Time, interval time.Duration, pods []string) (res []bool) {
+	s := newSampler(opts)
+	now := start
+	for _, pod := range pods {
+		res = append(res, s.keep(now, pod))
+		now = now.Add(interval)
+	}
+	return
+}
+
+func repeat(pods []string, n int) (res []string) {
+	for i := 0; i < n; i++ {
+		res = append(res, pods...)
+	}
+	return
+}
+
+func count(kept []bool) (n int) {
+	for _, k := range kept {
+		if k {
+			n++
+		}
+	}
+	return
+}
+
+func TestSamplerSeed(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	pods := repeat([]string{"a", "b"}, 500)
+
+	first := sample(SamplingOptions{Probability: 0.3, Seed: 42}, start, time.Millisecond, pods)
+	if n := count(first); n < 200 || n > 400 {
+		t.Errorf("expected about 300 records to be kept, got %d", n)
+	}
+	if again := sample(SamplingOptions{Probability: 0.3, Seed: 42}, start, time.Millisecond, pods); !reflect.DeepEqual(first, again) {
+		t.Error("expected the same decisions with the same seed")
+	}
+	if other := sample(SamplingOptions{Probability: 0.3, Seed: 43}, start, time.Millisecond, pods); reflect.DeepEqual(first, other) {
+		t.Error("expected different decisions with another seed")
+	}
+}
+
+func TestSamplerFirstPerPodCountsKeptRecords(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	pods := repeat([]string{"a", "b"}, 100)
+
+	// records dropped by probability don't use up the pods' slots
+	kept := sample(SamplingOptions{FirstPerPod: 5, FirstPerPodWindow: time.Minute, Probability: 0.5, Seed: 42}, start, time.Millisecond, pods)
+	perPod := map[string]int{}
+	for i, k := range kept {
+		if k {
+			perPod[pods[i]]++
+		}
+	}
+	if !reflect.DeepEqual(perPod, map[string]int{"a": 5, "b": 5}) {
+		t.Errorf("expected 5 records of each pod, got %v", perPod)
+	}
+
+	// neither do records dropped by the rate limit: with a rate of 1/s, one record is kept per second until each pod had 2
+	kept = sample(SamplingOptions{FirstPerPod: 2, FirstPerPodWindow: time.Hour, MaxRate: 1}, start, 250*time.Millisecond, repeat([]string{"a", "b"}, 20))
+	var keptAt []int
+	for i, k := range kept {
+		if k {
+			keptAt = append(keptAt, i)
+		}
+	}
+	if expected := []int{0, 4, 9, 13}; !reflect.DeepEqual(keptAt, expected) {
+		t.Errorf("expected records %v to be kept, got %v", expected, keptAt)
+	}
+}
+
+func TestSamplerFirstPerPodWindow(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	s := newSampler(SamplingOptions{FirstPerPod: 2, FirstPerPodWindow: time.Minute})
+	for i, expected := range []bool{true, true, false} {
+		if kept := s.keep(start.Add(time.Duration(i)*time.Second), "a"); kept != expected {
+			t.Errorf("record %d: expected kept to be %v", i, expected)
+		}
+	}
+	if !s.keep(start.Add(time.Minute), "a") {
+		t.Error("expected the count to be reset in the next window")
+	}
+}
+
+func TestParseSamplingOptions(t *testing.T) {
+	opts, err := ParseSamplingOptions(url.Values{"sample": {"0.01"}, "seed": {"42"}, "max-rate": {"120/m"}, "first-per-pod": {"10/s"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := SamplingOptions{Probability: 0.01, MaxRate: 2, FirstPerPod: 10, FirstPerPodWindow: time.Second, Seed: 42}
+	if opts != expected {
+		t.Errorf("expected %+v, got %+v", expected, opts)
+	}
+	for _, query := range []url.Values{
+		{"sample": {"0"}},
+		{"sample": {"1.5"}},
+		{"max-rate": {"10/d"}},
+		{"first-per-pod": {"1.5"}},
+		{"seed": {"x"}},
+	} {
+		if _, err := ParseSamplingOptions(query); err == nil {
+			t.Errorf("expected an error for %v", query)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/banzaicloud/log-socket/log"
+	"github.com/wasmerio/wasmer-go/wasmer"
+)
+
+// ViolationPolicy decides what happens to records when a plugin exceeds its resource limits.
+// A plugin that exceeded its limits is disabled, the policy applies to the record being processed and all later records.
+type ViolationPolicy string
+
+const (
+	// VPDrop drops the records
+	VPDrop ViolationPolicy = "drop"
+	// VPPass passes the records through unchanged, as if the plugin wasn't part of the pipeline
+	VPPass ViolationPolicy = "pass"
+	// VPAbort fails processing the records with a SandboxViolationError
+	VPAbort ViolationPolicy = "abort"
+)
+
+var ViolationPolicies = []ViolationPolicy{VPDrop, VPPass, VPAbort}
+
+func ParseViolationPolicy(s string) (ViolationPolicy, error) {
+	for _, p := range ViolationPolicies {
+		if s == string(p) {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("invalid violation policy %q (must be one of %v)", s, ViolationPolicies)
+}
+
+// PluginLimits bounds the resources plugins can use
+type PluginLimits struct {
+	// MaxMemory is the maximum size of the memory of a plugin in bytes (unlimited if 0).
+	// It is checked after each call into the plugin, except for imported memories, which can't grow beyond it.
+	MaxMemory uint64
+	// RequireBoundedMemory rejects plugins whose memory could grow beyond MaxMemory during a call,
+	// i.e. plugins that neither import their memory nor declare a maximum size of their memory within MaxMemory.
+	RequireBoundedMemory bool
+	// Timeout is the maximum duration of a call into a plugin (unlimited if 0), after which the plugin is disabled.
+	// It doesn't limit CPU use: the runtime can't interrupt calls, so a plugin that doesn't return keeps using a CPU until the process exits.
+	Timeout time.Duration
+	// OnViolation is what happens to records when the plugin exceeds its limits (VPDrop if empty)
+	OnViolation ViolationPolicy
+}
+
+// maxPages returns the maximum number of memory pages allowed by the limits
+func (l PluginLimits) maxPages() uint32 {
+	pages := l.MaxMemory / uint64(wasmer.WasmPageSize)
+	switch {
+	case l.MaxMemory == 0 || pages > 1<<16:
+		return 1 << 16 // the maximum of 32-bit memories
+	case pages == 0:
+		return 1
+	default:
+		return uint32(pages)
+	}
+}
+
+// checkExportedMemory returns an error unless the memory exported by the module declares a maximum size within the limits.
+// It's meant for modules that don't import their memory, whose size can only be checked after calls otherwise.
+func (l PluginLimits) checkExportedMemory(module *wasmer.Module) error {
+	for _, export := range module.Exports() {
+		if export.Name() != "memory" || export.Type().Kind() != wasmer.MEMORY {
+			continue
+		}
+		if max := export.Type().IntoMemoryType().Limits().Maximum(); max == wasmer.LimitMaxUnbound() || max > l.maxPages() {
+			return fmt.Errorf("the plugin has to import its memory or declare a maximum size of its memory of at most %d bytes", l.MaxMemory)
+		}
+		return nil
+	}
+	return errors.New("the plugin doesn't export its memory")
+}
+
+// SandboxViolationError is returned by stages whose plugin exceeded its resource limits if their policy is VPAbort
+type SandboxViolationError struct {
+	Stage  string
+	Reason string
+}
+
+func (e *SandboxViolationError) Error() string {
+	return fmt.Sprintf("plugin %s exceeded its limits: %s", e.Stage, e.Reason)
+}
+
+// call calls a function of the plugin, enforcing the limits of the stage
+func (s *WASMStage) call(name string, args ...interface{}) (interface{}, error) {
+	fn, err := s.Instance.Exports.GetFunction(name)
+	if err != nil {
+		return nil, err
+	}
+	var res interface{}
+	s.hostErr = nil
+	if s.Limits.Timeout <= 0 {
+		res, err = fn(args...)
+	} else {
+		type result struct {
+			res interface{}
+			err error
+		}
+		done := make(chan result, 1)
+		go func() {
+			res, err := fn(args...)
+			done <- result{res, err}
+		}()
+		timer := time.NewTimer(s.Limits.Timeout)
+		defer timer.Stop()
+		select {
+		case r := <-done:
+			res, err = r.res, r.err
+		case <-timer.C:
+			// the call keeps running, so the plugin must not be touched anymore
+			s.abandoned = true
+			if s.onAbandon != nil {
+				returned := s.onAbandon()
+				go func() {
+					<-done
+					returned()
+				}()
+			}
+			return nil, s.violate(fmt.Sprintf("%s did not return within %s", name, s.Limits.Timeout))
+		}
+	}
+	if size := uint64(s.Memory.DataSize()); s.Limits.MaxMemory > 0 && size > s.Limits.MaxMemory {
+		return nil, s.violate(fmt.Sprintf("memory grew to %d bytes (the maximum is %d)", size, s.Limits.MaxMemory))
+	}
+	if err == nil && s.hostErr != nil {
+		res, err = nil, s.hostErr
+	}
+	s.hostErr = nil
+	return res, err
+}
+
+// violate disables the plugin
+func (s *WASMStage) violate(reason string) error {
+	s.violation = &SandboxViolationError{Stage: s.Origin, Reason: reason}
+	log.Event(s.logs, "plugin disabled", log.Error(s.violation), log.Fields{"stage": s, "policy": s.Limits.OnViolation})
+	return s.violation
+}
@@ -0,0 +1,179 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/wasmerio/wasmer-go/wasmer"
+
+	"github.com/banzaicloud/log-socket/log"
+)
+
+// testPlugin returns a plugin passing records through that defines its memory as specified, growing it by 100 pages when a record is "grow"
+func testPlugin(t *testing.T, memory string) []byte {
+	code, err := wasmer.Wat2Wasm(`(module
+  (import "env" "get_data" (func $get_data (param i32)))
+  (import "env" "send" (func $send (param i32 i32) (result i32)))
+  ` + memory + `
+  (func (export "abi_version") (result i32) i32.const 1)
+  (func (export "receive") (param $len i32)
+    (call $get_data (i32.const 0))
+    (if (i32.eq (i32.load8_u (i32.const 0)) (i32.const 103)) (then (drop (memory.grow (i32.const 100)))))
+    (drop (call $send (i32.const 0) (local.get $len)))))`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code
+}
+
+func TestRequireBoundedMemory(t *testing.T) {
+	limits := PluginLimits{MaxMemory: 4 * uint64(wasmer.WasmPageSize), OnViolation: VPAbort, RequireBoundedMemory: true}
+	tests := map[string]struct {
+		memory string
+		err    bool
+	}{
+		"imported":            {memory: `(import "env" "memory" (memory 1))`},
+		"maximum within":      {memory: `(memory (export "memory") 1 4)`},
+		"maximum beyond":      {memory: `(memory (export "memory") 1 5)`, err: true},
+		"no maximum":          {memory: `(memory (export "memory") 1)`, err: true},
+		"not exported memory": {memory: `(memory 1 1)`, err: true},
+	}
+	logs := log.NewWriterSink(io.Discard)
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			stage, err := LoadStageFromCode(wasmer.NewStore(wasmer.NewEngine()), logs, name, testPlugin(t, test.memory), PluginOptions{Limits: limits})
+			if test.err {
+				if err == nil {
+					_ = stage.Close()
+					t.Fatal("expected the plugin to be rejected")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer stage.Close()
+
+			// growing the memory beyond the limit fails inside the plugin, so it keeps working
+			for _, record := range []string{"grow", "next"} {
+				res, err := stage.Process([]byte(record))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(res) != 1 || string(res[0]) != record {
+					t.Errorf("expected %q to pass through, got %q", record, res)
+				}
+			}
+		})
+	}
+}
+
+func TestMemoryCheckedAfterCalls(t *testing.T) {
+	limits := PluginLimits{MaxMemory: 4 * uint64(wasmer.WasmPageSize), OnViolation: VPAbort}
+	stage, err := LoadStageFromCode(wasmer.NewStore(wasmer.NewEngine()), log.NewWriterSink(io.Discard), "unbounded", testPlugin(t, `(memory (export "memory") 1)`), PluginOptions{Limits: limits})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stage.Close()
+	_, err = stage.Process([]byte("grow"))
+	var violation *SandboxViolationError
+	if !errors.As(err, &violation) {
+		t.Fatalf("expected a sandbox violation, got %v", err)
+	}
+}
+
+func TestHostFunctionBounds(t *testing.T) {
+	plugin := func(init, receive string) []byte {
+		code, err := wasmer.Wat2Wasm(`(module
+  (import "env" "get_config" (func $get_config (param i32)))
+  (import "env" "get_data" (func $get_data (param i32)))
+  (import "env" "send" (func $send (param i32 i32) (result i32)))
+  (import "env" "error" (func $error (param i32 i32)))
+  (memory (export "memory") 1 1)
+  (func (export "abi_version") (result i32) i32.const 1)
+  (func (export "init") (param $len i32) ` + init + `)
+  (func (export "receive") (param $len i32) ` + receive + `))`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return code
+	}
+	valid := `(call $get_data (i32.const 0)) (drop (call $send (i32.const 0) (local.get $len)))`
+	tests := map[string]struct {
+		init, receive string
+		loadErr       bool
+	}{
+		"valid":                      {init: `(call $get_config (i32.const 0))`, receive: valid},
+		"config beyond memory":       {init: `(call $get_config (i32.const 0xffff))`, loadErr: true},
+		"config at negative":         {init: `(call $get_config (i32.const -1))`, loadErr: true},
+		"data beyond memory":         {receive: `(call $get_data (i32.const 0xfffe))`},
+		"data at negative":           {receive: `(call $get_data (i32.const -1))`},
+		"send at negative":           {receive: `(drop (call $send (i32.const -1) (i32.const 5)))`},
+		"send negative length":       {receive: `(drop (call $send (i32.const 0) (i32.const -1)))`},
+		"send beyond memory":         {receive: `(drop (call $send (i32.const 0xfff0) (i32.const 0x20)))`},
+		"send overflowing":           {receive: `(drop (call $send (i32.const 0x7fffffff) (i32.const 0x7fffffff)))`},
+		"error beyond memory":        {receive: `(call $error (i32.const 0x7fffffff) (i32.const 8))`},
+		"error at negative":          {receive: `(call $error (i32.const -8) (i32.const 8))`},
+		"error with negative length": {receive: `(call $error (i32.const 0) (i32.const -8))`},
+		// host calls after a failed one are ignored, so the record isn't sent
+		"send after failure": {receive: `(call $get_data (i32.const -1)) (drop (call $send (i32.const 0) (i32.const 1)))`},
+	}
+	logs := log.NewWriterSink(io.Discard)
+	for name, test := range tests {
+		// calls with a timeout run on another goroutine, where a panic would crash the process
+		for _, timeout := range []time.Duration{0, time.Second} {
+			t.Run(fmt.Sprintf("%s/timeout=%s", name, timeout), func(t *testing.T) {
+				limits := PluginLimits{Timeout: timeout, OnViolation: VPAbort}
+				stage, err := LoadStageFromCode(wasmer.NewStore(wasmer.NewEngine()), logs, name, plugin(test.init, test.receive), PluginOptions{Limits: limits})
+				if test.loadErr {
+					if err == nil {
+						_ = stage.Close()
+						t.Fatal("expected loading the plugin to fail")
+					}
+					return
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer stage.Close()
+				res, err := stage.Process([]byte("record"))
+				if name == "valid" {
+					if err != nil || len(res) != 1 || string(res[0]) != "record" {
+						t.Errorf("expected the record to pass through, got %q and error %v", res, err)
+					}
+					return
+				}
+				if err == nil || len(res) > 0 {
+					t.Errorf("expected an error, got %q and error %v", res, err)
+				}
+			})
+		}
+	}
+	// the runtime must not free anything twice
+	runtime.GC()
+	runtime.GC()
+}
+
+func TestLoggedFnRecovers(t *testing.T) {
+	module, err := wasmer.NewModule(wasmer.NewStore(wasmer.NewEngine()), testPlugin(t, `(memory (export "memory") 1)`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stage := &WASMStage{}
+	calls := 0
+	fn := loggedFn(log.NewWriterSink(io.Discard), module.Imports()[0], stage, func([]wasmer.Value) ([]wasmer.Value, error) {
+		calls++
+		var data []byte
+		return nil, fmt.Errorf("unreachable %d", data[1])
+	})
+	if _, err := fn(nil); err != nil || stage.hostErr == nil {
+		t.Errorf("expected the panic to fail the call, got %v and %v", err, stage.hostErr)
+	}
+	if _, _ = fn(nil); calls != 1 {
+		t.Errorf("expected the host function not to be called after it failed, got %d calls", calls)
+	}
+}
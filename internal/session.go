@@ -0,0 +1,227 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// session files start with this magic followed by the format version
+var sessionMagic = []byte("LSR")
+
+const sessionVersion = 1
+
+// maxSessionFieldSize bounds the size of the fields of frames read from session files, so that corrupt files can't exhaust the memory
+const maxSessionFieldSize = 64 << 20
+
+// SessionFrame is a single frame received from the service, as stored in a session file
+type SessionFrame struct {
+	Received time.Time
+	Flow     FlowReference
+	Data     []byte
+}
+
+// OpenSessionFile opens a session file for appending frames, creating it if it does not exist.
+// A truncated frame at the end of the file (e.g. if the process writing it was killed) is removed, so that appended frames can be read.
+func OpenSessionFile(path string) (*SessionWriter, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	if info.Size() > 0 {
+		end, err := completeFramesEnd(file)
+		if err != nil {
+			_ = file.Close()
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		if end < info.Size() {
+			if err := file.Truncate(end); err != nil {
+				_ = file.Close()
+				return nil, err
+			}
+		}
+		if _, err := file.Seek(end, io.SeekStart); err != nil {
+			_ = file.Close()
+			return nil, err
+		}
+	} else if _, err := file.Write(append(sessionMagic, sessionVersion)); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	return &SessionWriter{
+		file:   file,
+		writer: bufio.NewWriter(file),
+	}, nil
+}
+
+// SessionWriter appends frames to a session file.
+// Each frame is stored as the receive time (Unix nanoseconds), the flow reference and the data, each prefixed with its varint encoded length.
+type SessionWriter struct {
+	file   *os.File
+	mutex  sync.Mutex
+	writer *bufio.Writer
+}
+
+func (w *SessionWriter) WriteFrame(frame SessionFrame) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	buf := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+len(frame.Data)+64)
+	buf = buf[:binary.PutVarint(buf, frame.Received.UnixNano())]
+	buf = appendBytes(buf, []byte(frame.Flow.URL()))
+	buf = appendBytes(buf, frame.Data)
+	if _, err := w.writer.Write(buf); err != nil {
+		return err
+	}
+	// flush every frame so that the session file is usable even if the process is killed
+	return w.writer.Flush()
+}
+
+func (w *SessionWriter) Close() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if err := w.writer.Flush(); err != nil {
+		_ = w.file.Close()
+		return err
+	}
+	return w.file.Close()
+}
+
+// completeFramesEnd returns the offset of the end of the last complete frame of a session file
+func completeFramesEnd(file *os.File) (int64, error) {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	r, err := NewSessionReader(file)
+	if err != nil {
+		return 0, err
+	}
+	for {
+		end := r.reader.n
+		_, err := r.Next()
+		switch err {
+		case nil:
+		case io.EOF, io.ErrUnexpectedEOF:
+			return end, nil
+		default:
+			return 0, err
+		}
+	}
+}
+
+// NewSessionReader returns a reader of the frames of a session; if r is a file, fields longer than the rest of the file are detected as truncated frames without reading them
+func NewSessionReader(r io.Reader) (*SessionReader, error) {
+	size := int64(-1)
+	if f, ok := r.(interface{ Stat() (os.FileInfo, error) }); ok {
+		if info, err := f.Stat(); err == nil && info.Mode().IsRegular() {
+			size = info.Size()
+		}
+	}
+	br := &countingByteReader{r: bufio.NewReader(r)}
+	if err := readSessionHeader(br); err != nil {
+		return nil, err
+	}
+	return &SessionReader{
+		reader: br,
+		size:   size,
+	}, nil
+}
+
+type SessionReader struct {
+	reader *countingByteReader
+	size   int64 // the size of the session (-1 if unknown)
+}
+
+// Next returns the next frame from the session, or io.EOF if there are no more frames.
+// A truncated frame at the end of the session results in io.ErrUnexpectedEOF.
+func (r *SessionReader) Next() (frame SessionFrame, err error) {
+	ts, err := binary.ReadVarint(r.reader)
+	if err != nil {
+		return
+	}
+	frame.Received = time.Unix(0, ts)
+	flow, err := r.readBytes()
+	if err != nil {
+		return frame, unexpectedEOF(err)
+	}
+	if frame.Flow, err = ParseFlowReference(string(flow)); err != nil {
+		return
+	}
+	frame.Data, err = r.readBytes()
+	return frame, unexpectedEOF(err)
+}
+
+func (r *SessionReader) readBytes() ([]byte, error) {
+	l, err := binary.ReadUvarint(r.reader)
+	if err != nil {
+		return nil, err
+	}
+	if l > maxSessionFieldSize {
+		return nil, fmt.Errorf("invalid session: frame field of %d bytes exceeds the maximum of %d bytes", l, maxSessionFieldSize)
+	}
+	if r.size >= 0 && int64(l) > r.size-r.reader.n {
+		return nil, io.ErrUnexpectedEOF
+	}
+	data := make([]byte, l)
+	_, err = io.ReadFull(r.reader, data)
+	return data, err
+}
+
+func readSessionHeader(r io.Reader) error {
+	header := make([]byte, len(sessionMagic)+1)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return errors.New("not a session file")
+	}
+	if !bytes.Equal(header[:len(sessionMagic)], sessionMagic) {
+		return errors.New("not a session file")
+	}
+	if v := header[len(sessionMagic)]; v != sessionVersion {
+		return fmt.Errorf("unsupported session file version %d", v)
+	}
+	return nil
+}
+
+func appendBytes(buf []byte, data []byte) []byte {
+	var l [binary.MaxVarintLen64]byte
+	buf = append(buf, l[:binary.PutUvarint(l[:], uint64(len(data)))]...)
+	return append(buf, data...)
+}
+
+// countingByteReader counts the bytes read from a buffered reader
+type countingByteReader struct {
+	r *bufio.Reader
+	n int64
+}
+
+func (c *countingByteReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countingByteReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.n++
+	}
+	return b, err
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,254 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func testSessionFrames() []SessionFrame {
+	flow := FlowReference{NamespacedName: types.NamespacedName{Namespace: "default", Name: "all"}, Kind: FKFlow}
+	clusterFlow := FlowReference{NamespacedName: types.NamespacedName{Namespace: "logging", Name: "audit"}, Kind: FKClusterFlow}
+	return []SessionFrame{
+		{Received: time.Unix(1700000000, 1), Flow: flow, Data: []byte(`{"log":"first"}`)},
+		{Received: time.Unix(1700000001, 2), Flow: clusterFlow, Data: []byte{}},
+		// the length of the data takes more than a byte as a varint
+		{Received: time.Unix(1700000002, 3), Flow: flow, Data: bytes.Repeat([]byte("x"), 300)},
+	}
+}
+
+func writeSession(t *testing.T, path string, frames []SessionFrame) {
+	w, err := OpenSessionFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range frames {
+		if err := w.WriteFrame(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readSession returns the frames of the session and the error that ended reading it (nil at the end of the session)
+func readSession(t *testing.T, r io.Reader) ([]SessionFrame, error) {
+	sr, err := NewSessionReader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var frames []SessionFrame
+	for {
+		f, err := sr.Next()
+		if err == io.EOF {
+			return frames, nil
+		}
+		if err != nil {
+			return frames, err
+		}
+		frames = append(frames, f)
+	}
+}
+
+func checkSessionFrames(t *testing.T, expected, actual []SessionFrame) {
+	t.Helper()
+	if len(actual) != len(expected) {
+		t.Fatalf("expected %d frames, got %d", len(expected), len(actual))
+	}
+	for i := range expected {
+		if e, a := expected[i], actual[i]; !a.Received.Equal(e.Received) || a.Flow != e.Flow || !bytes.Equal(a.Data, e.Data) {
+			t.Errorf("expected frame %d to be %+v, got %+v", i, e, a)
+		}
+	}
+}
+
+func TestSessionRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "session")
+	frames := testSessionFrames()
+	writeSession(t, path, frames[:2])
+	// reopening the session appends to it
+	writeSession(t, path, frames[2:])
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	actual, err := readSession(t, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSessionFrames(t, frames, actual)
+
+	// the same session read from a stream of unknown size
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	actual, err = readSession(t, bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSessionFrames(t, frames, actual)
+}
+
+func TestTruncatedSession(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "session")
+	frames := testSessionFrames()
+	writeSession(t, path, frames)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the ends of the header and the frames
+	ends := []int{len(sessionMagic) + 1}
+	for _, f := range frames {
+		var ts [binary.MaxVarintLen64]byte
+		l := binary.PutVarint(ts[:], f.Received.UnixNano())
+		l += len(appendBytes(nil, []byte(f.Flow.URL())))
+		l += len(appendBytes(nil, f.Data))
+		ends = append(ends, ends[len(ends)-1]+l)
+	}
+	if ends[len(ends)-1] != len(data) {
+		t.Fatalf("expected a session of %d bytes, got %d", ends[len(ends)-1], len(data))
+	}
+
+	// cut the session at every offset after the header, which includes offsets in the middle of the varints and the payloads
+	for cut := ends[0]; cut < len(data); cut++ {
+		complete := 0
+		for complete+1 < len(ends) && ends[complete+1] <= cut {
+			complete++
+		}
+
+		truncated := filepath.Join(dir, "truncated")
+		if err := os.WriteFile(truncated, data[:cut], 0o644); err != nil {
+			t.Fatal(err)
+		}
+		for _, open := range []struct {
+			name string
+			r    func() (io.Reader, func())
+		}{
+			{"file", func() (io.Reader, func()) {
+				f, err := os.Open(truncated)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return f, func() { f.Close() }
+			}},
+			{"stream", func() (io.Reader, func()) { return bytes.NewReader(data[:cut]), func() {} }},
+		} {
+			r, done := open.r()
+			actual, err := readSession(t, r)
+			done()
+			expectedErr := error(nil)
+			if cut != ends[complete] {
+				expectedErr = io.ErrUnexpectedEOF
+			}
+			if err != expectedErr {
+				t.Errorf("cut at %d of the %s: expected %v, got %v", cut, open.name, expectedErr, err)
+			}
+			checkSessionFrames(t, frames[:complete], actual)
+		}
+
+		// opening the session removes the truncated frame, so that the appended frames can be read
+		writeSession(t, truncated, frames[:1])
+		info, err := os.Stat(truncated)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := int64(ends[complete] + ends[1] - ends[0]); info.Size() != expected {
+			t.Errorf("cut at %d: expected the session to have %d bytes after appending a frame, got %d", cut, expected, info.Size())
+		}
+		file, err := os.Open(truncated)
+		if err != nil {
+			t.Fatal(err)
+		}
+		actual, err := readSession(t, file)
+		file.Close()
+		if err != nil {
+			t.Errorf("cut at %d: %v", cut, err)
+		}
+		checkSessionFrames(t, append(frames[:complete:complete], frames[0]), actual)
+	}
+}
+
+func TestInvalidSession(t *testing.T) {
+	// concat returns a new slice, so that the test cases don't share their data
+	concat := func(parts ...[]byte) []byte { return bytes.Join(parts, nil) }
+	header := concat(sessionMagic, []byte{sessionVersion})
+	frame := func(fieldSize uint64) []byte {
+		buf := make([]byte, 2*binary.MaxVarintLen64)
+		n := binary.PutVarint(buf, time.Unix(1700000000, 0).UnixNano())
+		return buf[:n+binary.PutUvarint(buf[n:], fieldSize)]
+	}
+	tests := map[string]struct {
+		data []byte
+		err  string
+	}{
+		"not a session":      {data: []byte("{}\n"), err: "not a session file"},
+		"empty":              {data: nil, err: "not a session file"},
+		"unknown version":    {data: concat(sessionMagic, []byte{sessionVersion + 1}), err: "unsupported session file version"},
+		"field over max":     {data: concat(header, frame(maxSessionFieldSize+1)), err: "exceeds the maximum"},
+		"huge field":         {data: concat(header, frame(1<<62)), err: "exceeds the maximum"},
+		"field at max":       {data: concat(header, frame(maxSessionFieldSize)), err: io.ErrUnexpectedEOF.Error()},
+		"invalid flow":       {data: concat(header, frame(3), []byte("a/b")), err: "not a valid flow reference"},
+		"overflowing varint": {data: concat(header, bytes.Repeat([]byte{0xff}, binary.MaxVarintLen64+1)), err: "overflow"},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "session")
+			if err := os.WriteFile(path, test.data, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			file, err := os.Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer file.Close()
+			r, err := NewSessionReader(file)
+			if err == nil {
+				_, err = r.Next()
+			}
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("expected an error containing %q reading the session, got %v", test.err, err)
+			}
+
+			// only truncated frames are repaired, other sessions aren't appended to
+			w, err := OpenSessionFile(path)
+			repaired := header
+			switch {
+			case len(test.data) == 0:
+			case test.err == io.ErrUnexpectedEOF.Error():
+				if err != nil {
+					t.Fatalf("expected the session to be repaired, got %v", err)
+				}
+			default:
+				if err == nil {
+					t.Fatal("expected an error opening the session")
+				}
+				repaired = test.data
+			}
+			if w != nil {
+				if err := w.Close(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(data, repaired) {
+				t.Errorf("expected the session to be %q, got %q", repaired, data)
+			}
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package internal
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"sync"
+	"time"
+
+	authv1 "k8s.io/api/authentication/v1"
+)
+
+// NewTicketStore returns a store of connection tickets that are valid for ttl.
+// At most max tickets (maxPerUser for a single user) can be outstanding, limits that are not positive are disabled.
+func NewTicketStore(ttl time.Duration, max int, maxPerUser int) *TicketStore {
+	return &TicketStore{
+		Max:        max,
+		MaxPerUser: maxPerUser,
+		TTL:        ttl,
+
+		now:     time.Now,
+		tickets: make(map[[sha256.Size]byte]ticket),
+	}
+}
+
+// TicketStore issues short-lived, single-use connection tickets to authenticated users.
+// Tickets let clients that can't set headers for WebSocket connections (e.g. browsers) connect without putting long-lived tokens in URLs.
+type TicketStore struct {
+	Max        int
+	MaxPerUser int
+	TTL        time.Duration
+
+	mutex   sync.Mutex
+	now     func() time.Time
+	tickets map[[sha256.Size]byte]ticket
+}
+
+type ticket struct {
+	expires time.Time
+	flow    *FlowReference
+	token   string
+	usrInfo authv1.UserInfo
+}
+
+// Issue returns a new ticket for the user authenticated by token, optionally restricted to the specified flow.
+// A limitExceededError is returned if there are too many outstanding tickets.
+// The token is kept so that listeners connecting with the ticket can be revalidated.
+func (s *TicketStore) Issue(token string, usrInfo authv1.UserInfo, flow *FlowReference) (string, time.Time, error) {
+	var buf [32]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return "", time.Time{}, err
+	}
+	t := base64.RawURLEncoding.EncodeToString(buf[:])
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := s.now()
+	perUser := 0
+	for k, v := range s.tickets {
+		if !now.Before(v.expires) {
+			delete(s.tickets, k)
+		} else if v.usrInfo.Username == usrInfo.Username {
+			perUser++
+		}
+	}
+	if s.Max > 0 && len(s.tickets) >= s.Max {
+		return "", time.Time{}, limitExceededError(fmt.Sprintf("too many outstanding tickets (limit %d)", s.Max))
+	}
+	if s.MaxPerUser > 0 && perUser >= s.MaxPerUser {
+		return "", time.Time{}, limitExceededError(fmt.Sprintf("too many outstanding tickets for user %s (limit %d)", usrInfo.Username, s.MaxPerUser))
+	}
+	expires := now.Add(s.TTL)
+	s.tickets[sha256.Sum256([]byte(t))] = ticket{
+		expires: expires,
+		flow:    flow,
+		token:   token,
+		usrInfo: usrInfo,
+	}
+	return t, expires, nil
+}
+
+// Redeem consumes the ticket and returns the user it was issued to along with the user's token.
+// An unauthenticated error is returned if the ticket is unknown, expired, already redeemed or restricted to another flow.
+func (s *TicketStore) Redeem(t string, flow FlowReference) (authv1.UserInfo, string, error) {
+	key := sha256.Sum256([]byte(t))
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	entry, ok := s.tickets[key]
+	if !ok {
+		return authv1.UserInfo{}, "", invalidTicketError("unknown ticket")
+	}
+	delete(s.tickets, key)
+	if !s.now().Before(entry.expires) {
+		return authv1.UserInfo{}, "", invalidTicketError("ticket expired")
+	}
+	if entry.flow != nil && *entry.flow != flow {
+		return authv1.UserInfo{}, "", invalidTicketError("ticket was issued for another flow")
+	}
+	return entry.usrInfo, entry.token, nil
+}
+
+type invalidTicketError string
+
+func (e invalidTicketError) Error() string {
+	return "invalid ticket: " + string(e)
+}
+
+func (invalidTicketError) IsUnauthenticatedError() bool {
+	return true
+}
@@ -0,0 +1,134 @@
+package internal
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	authv1 "k8s.io/api/authentication/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func TestTickets(t *testing.T) {
+	flow := FlowReference{NamespacedName: types.NamespacedName{Namespace: "default", Name: "all"}, Kind: FKFlow}
+	otherFlow := FlowReference{NamespacedName: types.NamespacedName{Namespace: "default", Name: "other"}, Kind: FKFlow}
+	alice := authv1.UserInfo{Username: "alice"}
+
+	now := time.Unix(1700000000, 0)
+	s := NewTicketStore(time.Minute, 0, 0)
+	s.now = func() time.Time { return now }
+	issue := func(flow *FlowReference) string {
+		ticket, expires, err := s.Issue("alice-token", alice, flow)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !expires.Equal(now.Add(time.Minute)) {
+			t.Errorf("expected the ticket to expire at %s, got %s", now.Add(time.Minute), expires)
+		}
+		return ticket
+	}
+	redeem := func(ticket string, flow FlowReference) error {
+		usrInfo, token, err := s.Redeem(ticket, flow)
+		if err != nil {
+			if !IsUnauthenticatedError(err) {
+				t.Errorf("expected an unauthenticated error, got %v", err)
+			}
+			return err
+		}
+		if usrInfo.Username != "alice" || token != "alice-token" {
+			t.Errorf("expected the user and token the ticket was issued to, got %q and %q", usrInfo.Username, token)
+		}
+		return nil
+	}
+
+	t.Run("single use", func(t *testing.T) {
+		ticket := issue(nil)
+		if err := redeem(ticket, flow); err != nil {
+			t.Fatal(err)
+		}
+		if err := redeem(ticket, flow); err == nil {
+			t.Error("expected a redeemed ticket to be rejected")
+		}
+		if err := redeem("unknown", flow); err == nil {
+			t.Error("expected an unknown ticket to be rejected")
+		}
+	})
+	t.Run("expiry", func(t *testing.T) {
+		valid, expired := issue(nil), issue(nil)
+		now = now.Add(time.Minute - time.Nanosecond)
+		if err := redeem(valid, flow); err != nil {
+			t.Errorf("expected the ticket to be valid until it expires, got %v", err)
+		}
+		now = now.Add(time.Nanosecond)
+		if err := redeem(expired, flow); err == nil {
+			t.Error("expected an expired ticket to be rejected")
+		}
+	})
+	t.Run("flow", func(t *testing.T) {
+		ticket := issue(&flow)
+		if err := redeem(ticket, otherFlow); err == nil {
+			t.Error("expected a ticket to be rejected for another flow")
+		}
+		// the ticket is consumed anyway, so it can't be tried against other flows
+		if err := redeem(ticket, flow); err == nil {
+			t.Error("expected a ticket rejected for another flow to be consumed")
+		}
+		if err := redeem(issue(&flow), flow); err != nil {
+			t.Errorf("expected the ticket to be valid for its flow, got %v", err)
+		}
+		if err := redeem(issue(nil), otherFlow); err != nil {
+			t.Errorf("expected a ticket without a flow to be valid for any flow, got %v", err)
+		}
+	})
+}
+
+func TestTicketLimits(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	s := NewTicketStore(time.Minute, 3, 2)
+	s.now = func() time.Time { return now }
+	issue := func(user string) (string, error) {
+		ticket, _, err := s.Issue(user+"-token", authv1.UserInfo{Username: user}, nil)
+		return ticket, err
+	}
+	limited := func(user string) bool {
+		_, err := issue(user)
+		var limitErr limitExceededError
+		if err != nil && !errors.As(err, &limitErr) {
+			t.Fatalf("expected a limitExceededError, got %v", err)
+		}
+		return err != nil
+	}
+
+	first, _ := issue("alice")
+	if _, err := issue("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if !limited("alice") {
+		t.Error("expected the tickets of alice to be limited")
+	}
+	if limited("bob") {
+		t.Error("expected the tickets of bob not to be limited by the ones of alice")
+	}
+	if !limited("carol") {
+		t.Error("expected the total of the tickets to be limited")
+	}
+
+	// redeemed tickets aren't outstanding anymore
+	if _, _, err := s.Redeem(first, FlowReference{}); err != nil {
+		t.Fatal(err)
+	}
+	if limited("alice") {
+		t.Error("expected alice to get a ticket after redeeming one")
+	}
+	if !limited("carol") {
+		t.Error("expected the total of the tickets to be limited")
+	}
+
+	// neither are expired ones
+	now = now.Add(time.Minute)
+	for _, user := range []string{"alice", "alice", "carol"} {
+		if limited(user) {
+			t.Errorf("expected %s to get a ticket after the others expired", user)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/itchyny/gojq"
+)
+
+// NewProjectionStage returns a stage that keeps only the specified fields of records.
+// Nested fields are referenced by joining their keys with dots, e.g. "kubernetes.pod_name".
+func NewProjectionStage(fields []string) *ProjectionStage {
+	return &ProjectionStage{
+		Fields: parseFieldPaths(fields),
+	}
+}
+
+type ProjectionStage struct {
+	Fields []FieldPath
+}
+
+func (s *ProjectionStage) Process(record []byte) ([][]byte, error) {
+	src, err := decodeJSONObject(record)
+	if err != nil {
+		return nil, err
+	}
+	dst := make(map[string]interface{})
+	for _, path := range s.Fields {
+		if v, ok := path.Get(src); ok {
+			path.Set(dst, v)
+		}
+	}
+	return encodeJSON(dst)
+}
+
+func (s *ProjectionStage) String() string {
+	return fmt.Sprintf("fields=%s", joinFieldPaths(s.Fields))
+}
+
+// NewExclusionStage returns a stage that removes the specified fields from records.
+// Nested fields are referenced by joining their keys with dots, e.g. "kubernetes.labels".
+func NewExclusionStage(fields []string) *ExclusionStage {
+	return &ExclusionStage{
+		Fields: parseFieldPaths(fields),
+	}
+}
+
+type ExclusionStage struct {
+	Fields []FieldPath
+}
+
+func (s *ExclusionStage) Process(record []byte) ([][]byte, error) {
+	rec, err := decodeJSONObject(record)
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range s.Fields {
+		path.Delete(rec)
+	}
+	return encodeJSON(rec)
+}
+
+func (s *ExclusionStage) String() string {
+	return fmt.Sprintf("exclude-fields=%s", joinFieldPaths(s.Fields))
+}
+
+// NewQueryStage returns a stage that evaluates a jq expression on records, emitting a record for each result
+func NewQueryStage(query string) (*QueryStage, error) {
+	q, err := gojq.Parse(query)
+	if err != nil {
+		return nil, err
+	}
+	code, err := gojq.Compile(q)
+	if err != nil {
+		return nil, err
+	}
+	return &QueryStage{
+		Code:  code,
+		Query: query,
+	}, nil
+}
+
+type QueryStage struct {
+	Code  *gojq.Code
+	Query string
+}
+
+func (s *QueryStage) Process(record []byte) (res [][]byte, err error) {
+	var input interface{}
+	dec := json.NewDecoder(bytes.NewReader(record))
+	dec.UseNumber()
+	if err = dec.Decode(&input); err != nil {
+		return
+	}
+	// gojq turns the json.Number values into ints, float64s or, if they don't fit, big.Ints, so that large integers (e.g. 64-bit IDs) keep their precision
+	iter := s.Code.Run(input)
+	for {
+		v, ok := iter.Next()
+		if !ok {
+			return
+		}
+		if err, ok := v.(error); ok {
+			return res, err
+		}
+		data, err := json.Marshal(v)
+		if err != nil {
+			return res, err
+		}
+		res = append(res, data)
+	}
+}
+
+func (s *QueryStage) String() string {
+	return fmt.Sprintf("query=%s", s.Query)
+}
+
+// FieldPath is a sequence of keys referencing a (possibly nested) field of a JSON object
+type FieldPath []string
+
+func ParseFieldPath(s string) FieldPath {
+	return strings.Split(s, ".")
+}
+
+func (p FieldPath) Get(obj map[string]interface{}) (interface{}, bool) {
+	for i, key := range p {
+		v, ok := obj[key]
+		if !ok {
+			return nil, false
+		}
+		if i == len(p)-1 {
+			return v, true
+		}
+		if obj, ok = v.(map[string]interface{}); !ok {
+			return nil, false
+		}
+	}
+	return nil, false
+}
+
+func (p FieldPath) Set(obj map[string]interface{}, value interface{}) {
+	for _, key := range p[:len(p)-1] {
+		child, ok := obj[key].(map[string]interface{})
+		if !ok {
+			child = make(map[string]interface{})
+			obj[key] = child
+		}
+		obj = child
+	}
+	obj[p[len(p)-1]] = value
+}
+
+func (p FieldPath) Delete(obj map[string]interface{}) {
+	for _, key := range p[:len(p)-1] {
+		child, ok := obj[key].(map[string]interface{})
+		if !ok {
+			return
+		}
+		obj = child
+	}
+	delete(obj, p[len(p)-1])
+}
+
+func (p FieldPath) String() string {
+	return strings.Join(p, ".")
+}
+
+func parseFieldPaths(fields []string) (res []FieldPath) {
+	for _, field := range fields {
+		if field == "" {
+			continue
+		}
+		res = append(res, ParseFieldPath(field))
+	}
+	return
+}
+
+func joinFieldPaths(paths []FieldPath) string {
+	strs := make([]string, len(paths))
+	for i, p := range paths {
+		strs[i] = p.String()
+	}
+	return strings.Join(strs, ",")
+}
+
+func decodeJSONObject(data []byte) (obj map[string]interface{}, err error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	err = dec.Decode(&obj)
+	return
+}
+
+func encodeJSON(v interface{}) ([][]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false) // keep messages (and dedupe templates) readable
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return [][]byte{bytes.TrimSuffix(buf.Bytes(), []byte{'\n'})}, nil
+}
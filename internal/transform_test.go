@@ -0,0 +1,133 @@
+package internal
+
+import (
+	"fmt"
+	"testing"
+)
+
+// processRecord runs the record through the stage, returning the records it emitted as strings
+func processRecord(t *testing.T, s Stage, record string) ([]string, error) {
+	t.Helper()
+	res, err := s.Process([]byte(record))
+	var out []string
+	for _, r := range res {
+		out = append(out, string(r))
+	}
+	return out, err
+}
+
+func TestProjectionStage(t *testing.T) {
+	const record = `{"log":"<b>hi</b>","id":9007199254740993,"level":"info","kubernetes":{"pod_name":"app","labels":{"app":"web"}},"tags":["a"]}`
+	tests := map[string]struct {
+		fields   []string
+		record   string
+		expected string
+		err      bool
+	}{
+		"top-level fields":  {fields: []string{"level", "log"}, expected: `{"level":"info","log":"<b>hi</b>"}`},
+		"nested fields":     {fields: []string{"kubernetes.pod_name", "kubernetes.labels.app"}, expected: `{"kubernetes":{"labels":{"app":"web"},"pod_name":"app"}}`},
+		"whole object":      {fields: []string{"kubernetes.labels"}, expected: `{"kubernetes":{"labels":{"app":"web"}}}`},
+		"large integers":    {fields: []string{"id"}, expected: `{"id":9007199254740993}`},
+		"missing fields":    {fields: []string{"msg", "kubernetes.namespace_name", "level.x", "tags.0"}, expected: `{}`},
+		"empty field names": {fields: []string{"", "level"}, expected: `{"level":"info"}`},
+		"not an object":     {fields: []string{"level"}, record: `["level"]`, err: true},
+		"not JSON":          {fields: []string{"level"}, record: `level=info`, err: true},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			if test.record == "" {
+				test.record = record
+			}
+			res, err := processRecord(t, NewProjectionStage(test.fields), test.record)
+			if test.err {
+				if err == nil {
+					t.Errorf("expected an error, got %q", res)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(res) != 1 || res[0] != test.expected {
+				t.Errorf("expected %s, got %q", test.expected, res)
+			}
+		})
+	}
+}
+
+func TestExclusionStage(t *testing.T) {
+	const record = `{"log":"<b>hi</b>","id":9007199254740993,"level":"info","kubernetes":{"pod_name":"app","labels":{"app":"web"}}}`
+	tests := map[string]struct {
+		fields   []string
+		expected string
+	}{
+		"top-level fields": {fields: []string{"level", "log"}, expected: `{"id":9007199254740993,"kubernetes":{"labels":{"app":"web"},"pod_name":"app"}}`},
+		"nested fields":    {fields: []string{"kubernetes.labels"}, expected: `{"id":9007199254740993,"kubernetes":{"pod_name":"app"},"level":"info","log":"<b>hi</b>"}`},
+		"missing fields":   {fields: []string{"msg", "kubernetes.namespace_name", "level.x"}, expected: `{"id":9007199254740993,"kubernetes":{"labels":{"app":"web"},"pod_name":"app"},"level":"info","log":"<b>hi</b>"}`},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			res, err := processRecord(t, NewExclusionStage(test.fields), record)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(res) != 1 || res[0] != test.expected {
+				t.Errorf("expected %s, got %q", test.expected, res)
+			}
+		})
+	}
+	if _, err := processRecord(t, NewExclusionStage([]string{"level"}), `"level"`); err == nil {
+		t.Error("expected a record that isn't an object to be rejected")
+	}
+}
+
+func TestQueryStage(t *testing.T) {
+	tests := map[string]struct {
+		query    string
+		record   string
+		expected []string
+		err      bool
+	}{
+		"field":           {query: `.level`, record: `{"level":"info"}`, expected: []string{`"info"`}},
+		"object":          {query: `{pod: .kubernetes.pod_name}`, record: `{"kubernetes":{"pod_name":"app"}}`, expected: []string{`{"pod":"app"}`}},
+		"several results": {query: `.items[]`, record: `{"items":[1,"a",null]}`, expected: []string{`1`, `"a"`, `null`}},
+		"no results":      {query: `select(.level == "error")`, record: `{"level":"info"}`},
+		// json.Number values are turned into numbers gojq can compute with, without losing the precision of large integers
+		"large integers":              {query: `.id`, record: `{"id":9007199254740993}`, expected: []string{`9007199254740993`}},
+		"large negative":              {query: `.id`, record: `{"id":-9223372036854775808}`, expected: []string{`-9223372036854775808`}},
+		"beyond 64 bits":              {query: `.id`, record: `{"id":123456789012345678901234567890}`, expected: []string{`123456789012345678901234567890`}},
+		"arithmetic":                  {query: `.a + .b`, record: `{"a":1,"b":2.5}`, expected: []string{`3.5`}},
+		"large arithmetic":            {query: `.id + 1`, record: `{"id":9007199254740993}`, expected: []string{`9007199254740994`}},
+		"comparison":                  {query: `.n > 10`, record: `{"n":11}`, expected: []string{`true`}},
+		"floats":                      {query: `.f`, record: `{"f":1.5e300}`, expected: []string{`1.5e+300`}},
+		"numbers in arrays":           {query: `.ids | add`, record: `{"ids":[1,2,3]}`, expected: []string{`6`}},
+		"type of numbers":             {query: `.n | type`, record: `{"n":1}`, expected: []string{`"number"`}},
+		"records that aren't objects": {query: `.`, record: `[1,2]`, expected: []string{`[1,2]`}},
+		"error":                       {query: `.a.b`, record: `{"a":"x"}`, err: true},
+		"not JSON":                    {query: `.`, record: `level=info`, err: true},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			s, err := NewQueryStage(test.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res, err := processRecord(t, s, test.record)
+			if test.err {
+				if err == nil {
+					t.Errorf("expected an error, got %q", res)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fmt.Sprint(res) != fmt.Sprint(test.expected) {
+				t.Errorf("expected %q, got %q", test.expected, res)
+			}
+		})
+	}
+	if _, err := NewQueryStage(`.a |`); err == nil {
+		t.Error("expected an invalid query to be rejected")
+	}
+}
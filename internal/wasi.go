@@ -0,0 +1,146 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/banzaicloud/log-socket/log"
+	"github.com/wasmerio/wasmer-go/wasmer"
+)
+
+// ParsePluginDir parses a host directory made readable for plugins, in the format DIR or NAME=DIR.
+// Plugins see the directory at the relative path NAME, which is the base name of the directory if omitted.
+func ParsePluginDir(s string) (name string, dir string, err error) {
+	name, dir, ok := strings.Cut(s, "=")
+	if !ok {
+		dir, name = s, filepath.Base(s)
+	}
+	if name == "" || dir == "" || filepath.IsAbs(name) || strings.HasPrefix(filepath.Clean(name), "..") {
+		return "", "", fmt.Errorf("invalid plugin directory %q (must be DIR or NAME=DIR, where NAME is a relative path)", s)
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		return "", "", err
+	}
+	if !info.IsDir() {
+		return "", "", fmt.Errorf("%s is not a directory", dir)
+	}
+	return name, dir, nil
+}
+
+// newWASIEnvironment returns a WASI environment capturing stdout and stderr, with access to snapshots of the directories, which have to be removed when the environment is no longer used
+func newWASIEnvironment(program string, dirs map[string]string) (env *wasmer.WasiEnvironment, snapshots []string, err error) {
+	builder := wasmer.NewWasiStateBuilder(program).CaptureStdout().CaptureStderr()
+	names := make([]string, 0, len(dirs))
+	for name := range dirs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		// plugins get a copy of the directory, so that they can't modify the files of the host
+		snapshot, err := snapshotDir(dirs[name])
+		if err != nil {
+			removeAll(snapshots)
+			return nil, nil, fmt.Errorf("failed to copy %s for the plugin: %w", dirs[name], err)
+		}
+		snapshots = append(snapshots, snapshot)
+		builder.MapDirectory(name, snapshot)
+	}
+	if env, err = builder.Finalize(); err != nil {
+		removeAll(snapshots)
+		return nil, nil, err
+	}
+	return env, snapshots, nil
+}
+
+// snapshotDir copies the regular files and directories under dir to a temporary directory
+func snapshotDir(dir string) (string, error) {
+	tmp, err := os.MkdirTemp("", "log-socket-plugin-")
+	if err != nil {
+		return "", err
+	}
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		dst := filepath.Join(tmp, rel)
+		switch {
+		case d.IsDir():
+			return os.MkdirAll(dst, 0o700)
+		case d.Type().IsRegular():
+			return copyFile(path, dst)
+		default:
+			return nil // symlinks could point outside of the directory
+		}
+	})
+	if err != nil {
+		_ = os.RemoveAll(tmp)
+		return "", err
+	}
+	return tmp, nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		_ = out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func removeAll(paths []string) {
+	for _, p := range paths {
+		_ = os.RemoveAll(p)
+	}
+}
+
+// pluginOutput logs the lines a plugin writes to stdout or stderr
+type pluginOutput struct {
+	logs    log.Sink
+	pending []byte
+	stage   fmt.Stringer
+	stream  string
+}
+
+func (o *pluginOutput) write(data []byte) {
+	o.pending = append(o.pending, data...)
+	for {
+		i := bytes.IndexByte(o.pending, '\n')
+		if i < 0 {
+			return
+		}
+		o.log(o.pending[:i])
+		o.pending = o.pending[i+1:]
+	}
+}
+
+// flush logs the last line even if it is incomplete
+func (o *pluginOutput) flush() {
+	if len(o.pending) > 0 {
+		o.log(o.pending)
+		o.pending = nil
+	}
+}
+
+func (o *pluginOutput) log(line []byte) {
+	log.Event(o.logs, "plugin output", log.Fields{"stage": o.stage, "stream": o.stream, "line": string(bytes.TrimSuffix(line, []byte("\r")))})
+}
@@ -0,0 +1,157 @@
+package log
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/siliconbrain/gologlite/log"
+)
+
+// Redacted replaces the values of secrets in log records
+const Redacted = "[REDACTED]"
+
+var (
+	DefaultSecretFields      = []string{"authToken", "password", "secret", "ticket", "token"}
+	DefaultSecretHeaders     = []string{"Authorization", "Cookie", "Proxy-Authorization", "Set-Cookie", "X-Authorization"}
+	DefaultSecretQueryParams = []string{"ticket", "token"}
+)
+
+// NewRedactor returns a redactor masking the specified fields, HTTP headers and URL query parameters (all matched case-insensitively)
+func NewRedactor(fields []string, headers []string, queryParams []string) *Redactor {
+	return &Redactor{
+		fields:      lowerSet(fields),
+		headers:     lowerSet(headers),
+		queryParams: lowerSet(queryParams),
+	}
+}
+
+func DefaultRedactor() *Redactor {
+	return NewRedactor(DefaultSecretFields, DefaultSecretHeaders, DefaultSecretQueryParams)
+}
+
+type Redactor struct {
+	fields      map[string]bool
+	headers     map[string]bool
+	queryParams map[string]bool
+}
+
+// Redact returns the value of the named field with secrets masked.
+// Secret fields are masked entirely, while secret headers and query parameters are masked in HTTP requests, headers, URLs and query values.
+func (r *Redactor) Redact(name string, value interface{}) interface{} {
+	if r.fields[strings.ToLower(name)] {
+		return Redacted
+	}
+	switch v := value.(type) {
+	case *http.Request:
+		if v == nil {
+			return v
+		}
+		req := *v
+		req.Header = r.RedactHeader(v.Header)
+		req.URL = r.RedactURL(v.URL)
+		req.RequestURI = r.redactRequestURI(v.RequestURI)
+		req.Form = r.RedactQuery(v.Form)
+		req.PostForm = r.RedactQuery(v.PostForm)
+		return &req
+	case http.Header:
+		return r.RedactHeader(v)
+	case *url.URL:
+		return r.RedactURL(v)
+	case url.URL:
+		return *r.RedactURL(&v)
+	case url.Values:
+		return r.RedactQuery(v)
+	default:
+		return value
+	}
+}
+
+func (r *Redactor) RedactHeader(header http.Header) http.Header {
+	if header == nil {
+		return nil
+	}
+	res := make(http.Header, len(header))
+	for k, v := range header {
+		if r.headers[strings.ToLower(k)] {
+			v = redactedValues(v)
+		}
+		res[k] = v
+	}
+	return res
+}
+
+func (r *Redactor) RedactURL(u *url.URL) *url.URL {
+	if u == nil || u.RawQuery == "" {
+		return u
+	}
+	res := *u
+	if query, err := url.ParseQuery(u.RawQuery); err == nil {
+		res.RawQuery = r.RedactQuery(query).Encode()
+	} else {
+		res.RawQuery = Redacted // can't tell which part is secret
+	}
+	return &res
+}
+
+func (r *Redactor) RedactQuery(query url.Values) url.Values {
+	if query == nil {
+		return nil
+	}
+	res := make(url.Values, len(query))
+	for k, v := range query {
+		if r.queryParams[strings.ToLower(k)] {
+			v = redactedValues(v)
+		}
+		res[k] = v
+	}
+	return res
+}
+
+func (r *Redactor) redactRequestURI(uri string) string {
+	path, query, found := strings.Cut(uri, "?")
+	if !found {
+		return uri
+	}
+	return path + "?" + r.RedactURL(&url.URL{RawQuery: query}).RawQuery
+}
+
+func WithRedaction(logs Sink, redactor *Redactor) Sink {
+	return RedactingSink{
+		Sink:     logs,
+		Redactor: redactor,
+	}
+}
+
+// RedactingSink masks secrets in the fields of records before passing them on
+type RedactingSink struct {
+	Sink
+	Redactor *Redactor
+}
+
+func (s RedactingSink) Record(message string, fields log.FieldSet) {
+	res := make(Fields)
+	if fields != nil {
+		fields.ForEachField(func(name string, value interface{}) bool {
+			res[name] = s.Redactor.Redact(name, value)
+			return false
+		})
+	}
+	s.Sink.Record(message, res)
+}
+
+func redactedValues(values []string) []string {
+	res := make([]string, len(values))
+	for i := range res {
+		res[i] = Redacted
+	}
+	return res
+}
+
+func lowerSet(strs []string) map[string]bool {
+	res := make(map[string]bool, len(strs))
+	for _, s := range strs {
+		res[strings.ToLower(s)] = true
+	}
+	return res
+}
@@ -0,0 +1,135 @@
+package log
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/siliconbrain/gologlite/log"
+)
+
+func TestRedaction(t *testing.T) {
+	const target = "/flow/default/all?follow=true&token=query-token&Ticket=query-ticket"
+	request := func() *http.Request {
+		r := httptest.NewRequest(http.MethodGet, target, nil)
+		r.Header.Set("Authorization", "Bearer header-token")
+		r.Header.Set("X-Authorization", "x-header-token")
+		r.Header.Set("Cookie", "session=cookie")
+		r.Header.Set("User-Agent", "k8stail")
+		return r
+	}
+	secrets := []string{"query-token", "query-ticket", "header-token", "x-header-token", "cookie", "field-secret"}
+
+	tests := map[string]struct {
+		fields Fields
+		kept   []string // parts of the record that aren't secret
+	}{
+		"request": {
+			fields: Fields{"request": request()},
+			kept:   []string{"follow", "k8stail", "/flow/default/all"},
+		},
+		"request with a parsed form": {
+			fields: Fields{"request": func() *http.Request {
+				r := request()
+				_ = r.ParseForm()
+				return r
+			}()},
+			kept: []string{"follow", "k8stail"},
+		},
+		"headers": {
+			fields: Fields{"headers": request().Header},
+			kept:   []string{"User-Agent", "k8stail"},
+		},
+		"URL": {
+			fields: Fields{"url": request().URL},
+			kept:   []string{"follow=true", "/flow/default/all"},
+		},
+		"URL value": {
+			fields: Fields{"url": *request().URL},
+			kept:   []string{"follow=true"},
+		},
+		"query": {
+			fields: Fields{"query": request().URL.Query()},
+			kept:   []string{"follow"},
+		},
+		"unparsable query": {
+			fields: Fields{"url": &url.URL{Path: "/flow", RawQuery: "token=query-token;%zz"}},
+			kept:   []string{"/flow"},
+		},
+		"secret fields": {
+			fields: Fields{"token": "field-secret", "authToken": "field-secret", "Password": "field-secret", "user": "alice"},
+			kept:   []string{"alice"},
+		},
+		"other values": {
+			fields: Fields{"error": errors.New("failed"), "count": 3},
+			kept:   []string{"failed", "3"},
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			var sink capturingSink
+			Event(WithRedaction(&sink, DefaultRedactor()), "listener connected", test.fields)
+			record := sink.String()
+			for _, s := range secrets {
+				if strings.Contains(record, s) {
+					t.Errorf("expected %q to be redacted, got %s", s, record)
+				}
+			}
+			for _, s := range test.kept {
+				if !strings.Contains(record, s) {
+					t.Errorf("expected %q to be kept, got %s", s, record)
+				}
+			}
+		})
+	}
+}
+
+// capturingSink renders the values of the fields of the records it gets, including the parts of requests and URLs sinks could log
+type capturingSink struct {
+	bytes.Buffer
+}
+
+func (s *capturingSink) Record(message string, fields log.FieldSet) {
+	_, _ = fmt.Fprintln(s, message)
+	fields.ForEachField(func(name string, value interface{}) bool {
+		switch v := value.(type) {
+		case *http.Request:
+			_, _ = fmt.Fprintln(s, name, v.Header, v.URL, v.RequestURI, v.Form, v.PostForm)
+		case url.URL:
+			_, _ = fmt.Fprintln(s, name, v.String())
+		default:
+			_, _ = fmt.Fprintf(s, "%s %+v\n", name, v)
+		}
+		return false
+	})
+}
+
+func TestRedactionCopies(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/flow/default/all?token=query-token", nil)
+	r.Header.Set("Authorization", "Bearer header-token")
+	_ = r.ParseForm()
+
+	redacted := DefaultRedactor().Redact("request", r).(*http.Request)
+	if v := redacted.Header.Get("Authorization"); v != Redacted {
+		t.Errorf("expected the header to be redacted, got %q", v)
+	}
+	if v := redacted.URL.Query().Get("token"); v != Redacted {
+		t.Errorf("expected the query parameter to be redacted, got %q", v)
+	}
+	if v := redacted.Form.Get("token"); v != Redacted {
+		t.Errorf("expected the form value to be redacted, got %q", v)
+	}
+	if !strings.HasPrefix(redacted.RequestURI, "/flow/default/all?") || strings.Contains(redacted.RequestURI, "query-token") {
+		t.Errorf("expected the request URI to be redacted, got %q", redacted.RequestURI)
+	}
+	// the request being served keeps its secrets
+	if r.Header.Get("Authorization") != "Bearer header-token" || r.URL.Query().Get("token") != "query-token" ||
+		r.Form.Get("token") != "query-token" || r.RequestURI != "/flow/default/all?token=query-token" {
+		t.Errorf("expected the request not to be modified, got %+v", r)
+	}
+}
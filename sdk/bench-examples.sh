@@ -0,0 +1,16 @@
+#!/usr/bin/env bash
+# Builds the Go example plugins and measures the throughput of k8stail's pipeline running them with different numbers of workers.
+# The arguments are passed to k8stail plugins bench, e.g. --workers 1,4,8 --ordering pod --repeat 1000.
+set -euo pipefail
+
+sdk=$(cd "$(dirname "$0")" && pwd)
+out=$(mktemp -d)
+trap 'rm -rf "$out"' EXIT
+
+(cd "$sdk/.." && go build -o "$out/k8stail" ./cmd/k8stail)
+
+for example in grep dropfields levelfilter router ratesummary; do
+	(cd "$sdk/go/examples/$example" && GOOS=wasip1 GOARCH=wasm go build -buildmode=c-shared -o "$out/$example.wasm" .)
+	echo "$example:"
+	"$out/k8stail" plugins bench "$out/$example.wasm" --input "$sdk/testdata/records.jsonl" --repeat 500 "$@"
+done
@@ -0,0 +1,23 @@
+//go:build !wasm
+
+package logsocket
+
+// Plugins only run when built for WebAssembly (GOOS=wasip1 GOARCH=wasm); these stubs let the package be built, vetted and documented on other platforms.
+
+const notWasm = "logsocket: plugins have to be built with GOOS=wasip1 GOARCH=wasm"
+
+func send(record []byte) {
+	panic(notWasm)
+}
+
+func sendTo(output string, record []byte) {
+	panic(notWasm)
+}
+
+func meta(key string) (string, bool) {
+	panic(notWasm)
+}
+
+func received() int64 {
+	panic(notWasm)
+}
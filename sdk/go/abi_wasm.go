@@ -0,0 +1,98 @@
+//go:build wasm
+
+package logsocket
+
+import (
+	"time"
+	"unsafe"
+)
+
+//go:wasmimport env get_config
+func hostGetConfig(ptr unsafe.Pointer)
+
+//go:wasmimport env get_data
+func hostGetData(ptr unsafe.Pointer)
+
+//go:wasmimport env send
+func hostSend(ptr unsafe.Pointer, length uint32) uint32
+
+//go:wasmimport env send_to
+func hostSendTo(namePtr unsafe.Pointer, nameLength uint32, ptr unsafe.Pointer, length uint32) uint32
+
+//go:wasmimport env error
+func hostError(ptr unsafe.Pointer, length uint32)
+
+//go:wasmimport env get_meta
+func hostGetMeta(keyPtr unsafe.Pointer, keyLength uint32, ptr unsafe.Pointer, capacity uint32) int32
+
+//go:wasmimport env get_received
+func hostGetReceived() int64
+
+//go:wasmexport abi_version
+func abiVersion() int32 {
+	return ABIVersion
+}
+
+//go:wasmexport init
+func initPlugin(length uint32) {
+	config := make([]byte, length)
+	hostGetConfig(unsafe.Pointer(unsafe.SliceData(config)))
+	if err := initializer(config); err != nil {
+		reportError(err)
+	}
+}
+
+//go:wasmexport receive
+func receive(length uint32) {
+	record := make([]byte, length)
+	hostGetData(unsafe.Pointer(unsafe.SliceData(record)))
+	if err := handler(record); err != nil {
+		reportError(err)
+	}
+}
+
+//go:wasmexport tick
+func tick(nowMs int64) {
+	if err := ticker(time.UnixMilli(nowMs)); err != nil {
+		reportError(err)
+	}
+}
+
+//go:wasmexport flush
+func flush() {
+	if err := flusher(); err != nil {
+		reportError(err)
+	}
+}
+
+func reportError(err error) {
+	msg := err.Error()
+	hostError(unsafe.Pointer(unsafe.StringData(msg)), uint32(len(msg)))
+}
+
+func send(record []byte) {
+	hostSend(unsafe.Pointer(unsafe.SliceData(record)), uint32(len(record)))
+}
+
+func sendTo(output string, record []byte) {
+	hostSendTo(unsafe.Pointer(unsafe.StringData(output)), uint32(len(output)), unsafe.Pointer(unsafe.SliceData(record)), uint32(len(record)))
+}
+
+func meta(key string) (string, bool) {
+	buf := make([]byte, 256)
+	for {
+		n := hostGetMeta(unsafe.Pointer(unsafe.StringData(key)), uint32(len(key)), unsafe.Pointer(unsafe.SliceData(buf)), uint32(len(buf)))
+		switch {
+		case n < 0:
+			return "", false
+		case int(n) <= len(buf):
+			return string(buf[:n]), true
+		}
+		// the value didn't fit, try again with a buffer that's large enough
+		buf = make([]byte, n)
+	}
+}
+
+func received() int64 {
+	return hostGetReceived()
+}
@@ -0,0 +1,53 @@
+// Command dropfields is a plugin removing fields from JSON records (configured with the fields key as a comma separated list, nested fields are referenced with dots)
+package main
+
+import (
+	"encoding/json"
+	"strings"
+
+	logsocket "github.com/banzaicloud/log-socket/sdk/go"
+)
+
+var fields = []string{"kubernetes.annotations", "kubernetes.labels", "stream"}
+
+func init() {
+	logsocket.Init(func(data []byte) error {
+		var config struct {
+			Fields *string `json:"fields"`
+		}
+		if err := json.Unmarshal(data, &config); err != nil {
+			return err
+		}
+		if config.Fields != nil {
+			fields = strings.Split(*config.Fields, ",")
+		}
+		return nil
+	})
+	logsocket.Handle(func(record []byte) error {
+		var obj map[string]interface{}
+		if err := json.Unmarshal(record, &obj); err != nil {
+			return err
+		}
+		for _, field := range fields {
+			drop(obj, strings.Split(field, "."))
+		}
+		res, err := json.Marshal(obj)
+		if err != nil {
+			return err
+		}
+		logsocket.Send(res)
+		return nil
+	})
+}
+
+func drop(obj map[string]interface{}, path []string) {
+	if len(path) == 1 {
+		delete(obj, path[0])
+		return
+	}
+	if child, ok := obj[path[0]].(map[string]interface{}); ok {
+		drop(child, path[1:])
+	}
+}
+
+func main() {}
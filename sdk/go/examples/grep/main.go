@@ -0,0 +1,43 @@
+// Command grep is a plugin keeping the records whose message contains a pattern (configured with the pattern key, "error" by default)
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+
+	logsocket "github.com/banzaicloud/log-socket/sdk/go"
+)
+
+var config = struct {
+	Pattern string `json:"pattern"`
+}{
+	Pattern: "error",
+}
+
+func init() {
+	logsocket.Init(func(data []byte) error {
+		if err := json.Unmarshal(data, &config); err != nil {
+			return err
+		}
+		if config.Pattern == "" {
+			return errors.New("pattern must not be empty")
+		}
+		return nil
+	})
+	logsocket.Handle(func(record []byte) error {
+		var rec struct {
+			Message string `json:"message"`
+			Log     string `json:"log"`
+		}
+		if err := json.Unmarshal(record, &rec); err != nil {
+			return err
+		}
+		if strings.Contains(rec.Message, config.Pattern) || strings.Contains(rec.Log, config.Pattern) {
+			logsocket.Send(record)
+		}
+		return nil
+	})
+}
+
+func main() {}
@@ -0,0 +1,62 @@
+// Command levelfilter is a plugin keeping the records with a level of at least the one configured with the min-level key, warning by default (and the ones without a level)
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	logsocket "github.com/banzaicloud/log-socket/sdk/go"
+)
+
+var minLevel = 3
+
+var levels = map[string]int{
+	"trace":    0,
+	"debug":    1,
+	"info":     2,
+	"warn":     3,
+	"warning":  3,
+	"error":    4,
+	"critical": 5,
+	"fatal":    5,
+	"panic":    5,
+}
+
+func init() {
+	logsocket.Init(func(data []byte) error {
+		var config struct {
+			MinLevel string `json:"min-level"`
+		}
+		if err := json.Unmarshal(data, &config); err != nil {
+			return err
+		}
+		if config.MinLevel != "" {
+			level, ok := levels[strings.ToLower(config.MinLevel)]
+			if !ok {
+				return fmt.Errorf("unknown level %q", config.MinLevel)
+			}
+			minLevel = level
+		}
+		return nil
+	})
+	logsocket.Handle(func(record []byte) error {
+		var rec struct {
+			Level    string `json:"level"`
+			Severity string `json:"severity"`
+		}
+		if err := json.Unmarshal(record, &rec); err != nil {
+			return err
+		}
+		name := rec.Level
+		if name == "" {
+			name = rec.Severity
+		}
+		if level, ok := levels[strings.ToLower(name)]; !ok || level >= minLevel {
+			logsocket.Send(record)
+		}
+		return nil
+	})
+}
+
+func main() {}
@@ -0,0 +1,81 @@
+// Command ratesummary is a plugin passing records through unchanged and counting them by namespace, emitting a summary of the counts every interval-seconds key (10 by default) and at the end of the stream.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	logsocket "github.com/banzaicloud/log-socket/sdk/go"
+)
+
+var (
+	interval    = 10 * time.Second
+	windowStart time.Time
+	counts      = make(map[string]int)
+)
+
+func init() {
+	logsocket.Init(func(data []byte) error {
+		// numbers are strings when configured with the query of the plugin reference
+		var config struct {
+			IntervalSeconds json.Number `json:"interval-seconds"`
+		}
+		if err := json.Unmarshal(data, &config); err != nil {
+			return err
+		}
+		if config.IntervalSeconds == "" {
+			return nil
+		}
+		seconds, err := config.IntervalSeconds.Int64()
+		if err != nil || seconds <= 0 {
+			return errors.New("interval-seconds must be a positive integer")
+		}
+		interval = time.Duration(seconds) * time.Second
+		return nil
+	})
+	logsocket.Handle(func(record []byte) error {
+		namespace, ok := logsocket.Meta("namespace")
+		if !ok {
+			namespace = "(none)"
+		}
+		counts[namespace]++
+		logsocket.Send(record)
+		return nil
+	})
+	logsocket.Tick(func(now time.Time) error {
+		if windowStart.IsZero() {
+			windowStart = now
+		}
+		if now.Sub(windowStart) < interval {
+			return nil
+		}
+		windowStart = now
+		return summarize()
+	})
+	logsocket.Flush(summarize)
+}
+
+// summarize emits the counts since the last summary, if there were any records
+func summarize() error {
+	if len(counts) == 0 {
+		return nil
+	}
+	total := 0
+	for _, n := range counts {
+		total += n
+	}
+	data, err := json.Marshal(map[string]interface{}{
+		"counts":  counts,
+		"summary": "records by namespace",
+		"total":   total,
+	})
+	if err != nil {
+		return err
+	}
+	logsocket.Send(data)
+	counts = make(map[string]int)
+	return nil
+}
+
+func main() {}
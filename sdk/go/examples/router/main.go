@@ -0,0 +1,52 @@
+// Command router is a plugin sending the records with an error level to the output named with the output key, errors by default, and the other records to the default output.
+// Routed records get a source field with the namespace and the pod they come from.
+package main
+
+import (
+	"encoding/json"
+	"strings"
+
+	logsocket "github.com/banzaicloud/log-socket/sdk/go"
+)
+
+var output = "errors"
+
+func init() {
+	logsocket.Init(func(data []byte) error {
+		var config struct {
+			Output string `json:"output"`
+		}
+		if err := json.Unmarshal(data, &config); err != nil {
+			return err
+		}
+		if config.Output != "" {
+			output = config.Output
+		}
+		return nil
+	})
+	logsocket.Handle(func(record []byte) error {
+		var rec map[string]interface{}
+		if err := json.Unmarshal(record, &rec); err != nil {
+			return err
+		}
+		level, _ := rec["level"].(string)
+		if level == "" {
+			level, _ = rec["severity"].(string)
+		}
+		if !strings.EqualFold(level, "error") {
+			logsocket.Send(record)
+			return nil
+		}
+		namespace, _ := logsocket.Meta("namespace")
+		pod, _ := logsocket.Meta("pod")
+		rec["source"] = namespace + "/" + pod
+		data, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		logsocket.SendTo(output, data)
+		return nil
+	})
+}
+
+func main() {}
@@ -0,0 +1,3 @@
+module github.com/banzaicloud/log-socket/sdk/go
+
+go 1.24
@@ -0,0 +1,101 @@
+// Package logsocket implements the log-socket plugin ABI (see docs/plugin-abi.md) for plugins written in Go.
+//
+// Plugins register a handler (and optionally a function receiving their configuration) in an init function and are built as WASI reactors, either with Go
+//
+//	GOOS=wasip1 GOARCH=wasm go build -buildmode=c-shared -o plugin.wasm .
+//
+// or with TinyGo
+//
+//	tinygo build -target=wasip1 -buildmode=c-shared -o plugin.wasm .
+package logsocket
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// ABIVersion is the version of the plugin ABI implemented by this package
+const ABIVersion = 1
+
+// Handler processes a record, emitting the resulting records (if any) with Send
+type Handler func(record []byte) error
+
+var handler Handler = func([]byte) error {
+	return errors.New("no handler registered (logsocket.Handle has to be called in an init function)")
+}
+
+// Initializer receives the configuration of the plugin, a JSON object (empty if the plugin is not configured).
+// Returning an error fails loading the plugin.
+type Initializer func(config []byte) error
+
+var initializer Initializer = func([]byte) error {
+	return nil
+}
+
+// Ticker is called periodically with the current time (see k8stail's --tick-interval), emitting records (if any) with Send or SendTo
+type Ticker func(now time.Time) error
+
+var ticker Ticker = func(time.Time) error {
+	return nil
+}
+
+// Flusher is called once at the end of the stream, after the last record and tick, emitting the records the plugin still buffers (if any)
+type Flusher func() error
+
+var flusher Flusher = func() error {
+	return nil
+}
+
+// Init registers the function receiving the configuration of the plugin, which is called once before any records are received
+func Init(i Initializer) {
+	initializer = i
+}
+
+// Handle registers the handler called for each record received by the plugin
+func Handle(h Handler) {
+	handler = h
+}
+
+// Tick registers the function called periodically, which lets the plugin emit records as time passes (e.g. summaries).
+// It is never called while a record is being handled.
+func Tick(t Ticker) {
+	ticker = t
+}
+
+// Flush registers the function called at the end of the stream
+func Flush(f Flusher) {
+	flusher = f
+}
+
+// Send emits a record from the plugin
+func Send(record []byte) {
+	send(record)
+}
+
+// SendTo emits a record from the plugin to a named output, e.g. routed to a file by k8stail's --route flag
+func SendTo(output string, record []byte) {
+	sendTo(output, record)
+}
+
+// Meta returns the value of a metadata key of the record being processed (see docs/plugin-abi.md for the keys), and whether the record has it
+func Meta(key string) (string, bool) {
+	return meta(key)
+}
+
+// Labels returns the labels of the pod the record being processed comes from
+func Labels() map[string]string {
+	var res map[string]string
+	if data, ok := meta("labels"); ok {
+		_ = json.Unmarshal([]byte(data), &res)
+	}
+	return res
+}
+
+// Received returns when the record being processed was received, or the zero time if it is not known
+func Received() time.Time {
+	if ms := received(); ms != 0 {
+		return time.UnixMilli(ms)
+	}
+	return time.Time{}
+}
@@ -0,0 +1,48 @@
+//! A plugin removing fields from JSON records (configured with the fields key as a comma separated list, nested fields are referenced with dots)
+
+use logsocket_plugin::{plugin, send, Result};
+use serde_json::{Map, Value};
+use std::sync::OnceLock;
+
+const DEFAULT_FIELDS: &str = "kubernetes.annotations,kubernetes.labels,stream";
+
+static FIELDS: OnceLock<String> = OnceLock::new();
+
+fn init(config: &[u8]) -> Result {
+    let config: Value = serde_json::from_slice(config)?;
+    let fields = config
+        .get("fields")
+        .and_then(|v| v.as_str())
+        .unwrap_or(DEFAULT_FIELDS);
+    FIELDS.get_or_init(|| fields.to_string());
+    Ok(())
+}
+
+fn handle(record: &[u8]) -> Result {
+    let mut obj: Map<String, Value> = serde_json::from_slice(record)?;
+    for field in FIELDS
+        .get()
+        .map_or(DEFAULT_FIELDS, String::as_str)
+        .split(',')
+    {
+        drop_field(&mut obj, &field.split('.').collect::<Vec<_>>());
+    }
+    send(&serde_json::to_vec(&obj)?);
+    Ok(())
+}
+
+fn drop_field(obj: &mut Map<String, Value>, path: &[&str]) {
+    match path {
+        [name] => {
+            obj.remove(*name);
+        }
+        [name, rest @ ..] => {
+            if let Some(Value::Object(child)) = obj.get_mut(*name) {
+                drop_field(child, rest);
+            }
+        }
+        [] => {}
+    }
+}
+
+plugin!(handle, init);
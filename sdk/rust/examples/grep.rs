@@ -0,0 +1,34 @@
+//! A plugin keeping the records whose message contains a pattern (configured with the pattern key, "error" by default)
+
+use logsocket_plugin::{plugin, send, Result};
+use std::sync::OnceLock;
+
+static PATTERN: OnceLock<String> = OnceLock::new();
+
+fn init(config: &[u8]) -> Result {
+    let config: serde_json::Value = serde_json::from_slice(config)?;
+    let pattern = config
+        .get("pattern")
+        .and_then(|v| v.as_str())
+        .unwrap_or("error");
+    if pattern.is_empty() {
+        return Err("pattern must not be empty".into());
+    }
+    PATTERN.get_or_init(|| pattern.to_string());
+    Ok(())
+}
+
+fn handle(record: &[u8]) -> Result {
+    let pattern = PATTERN.get().map_or("error", String::as_str);
+    let rec: serde_json::Value = serde_json::from_slice(record)?;
+    let matches = ["message", "log"]
+        .iter()
+        .filter_map(|field| rec.get(field).and_then(|v| v.as_str()))
+        .any(|msg| msg.contains(pattern));
+    if matches {
+        send(record);
+    }
+    Ok(())
+}
+
+plugin!(handle, init);
@@ -0,0 +1,48 @@
+//! A plugin keeping the records with a level of at least the one configured with the min-level key, warning by default (and the ones without a level)
+
+use logsocket_plugin::{plugin, send, Result};
+use std::sync::OnceLock;
+
+const DEFAULT_MIN_LEVEL: u8 = 3;
+
+static MIN_LEVEL: OnceLock<u8> = OnceLock::new();
+
+fn init(config: &[u8]) -> Result {
+    let config: serde_json::Value = serde_json::from_slice(config)?;
+    if let Some(name) = config.get("min-level").and_then(|v| v.as_str()) {
+        let min = level(name).ok_or_else(|| format!("unknown level {:?}", name))?;
+        MIN_LEVEL.get_or_init(|| min);
+    }
+    Ok(())
+}
+
+fn level(name: &str) -> Option<u8> {
+    match name.to_lowercase().as_str() {
+        "trace" => Some(0),
+        "debug" => Some(1),
+        "info" => Some(2),
+        "warn" | "warning" => Some(3),
+        "error" => Some(4),
+        "critical" | "fatal" | "panic" => Some(5),
+        _ => None,
+    }
+}
+
+fn handle(record: &[u8]) -> Result {
+    let rec: serde_json::Value = serde_json::from_slice(record)?;
+    let name = ["level", "severity"]
+        .iter()
+        .find_map(|field| {
+            rec.get(field)
+                .and_then(|v| v.as_str())
+                .filter(|s| !s.is_empty())
+        })
+        .unwrap_or("");
+    let min = *MIN_LEVEL.get().unwrap_or(&DEFAULT_MIN_LEVEL);
+    if level(name).map_or(true, |l| l >= min) {
+        send(record);
+    }
+    Ok(())
+}
+
+plugin!(handle, init);
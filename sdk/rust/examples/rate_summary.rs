@@ -0,0 +1,73 @@
+//! A plugin passing records through unchanged and counting them by namespace, emitting a summary of the counts every interval-seconds key (10 by default) and at the end of the stream.
+
+use logsocket_plugin::{flusher, meta, plugin, send, ticker, Result};
+use std::cell::RefCell;
+use std::collections::BTreeMap;
+use std::sync::OnceLock;
+
+const DEFAULT_INTERVAL_MS: i64 = 10_000;
+
+static INTERVAL_MS: OnceLock<i64> = OnceLock::new();
+
+thread_local! {
+    static WINDOW_START: RefCell<Option<i64>> = RefCell::new(None);
+    static COUNTS: RefCell<BTreeMap<String, u64>> = RefCell::new(BTreeMap::new());
+}
+
+fn init(config: &[u8]) -> Result {
+    let config: serde_json::Value = serde_json::from_slice(config)?;
+    // numbers are strings when configured with the query of the plugin reference
+    if let Some(seconds) = config.get("interval-seconds") {
+        let seconds = seconds
+            .as_i64()
+            .or_else(|| seconds.as_str().and_then(|s| s.parse().ok()))
+            .filter(|s| *s > 0)
+            .ok_or("interval-seconds must be a positive integer")?;
+        INTERVAL_MS.get_or_init(|| seconds * 1000);
+    }
+    Ok(())
+}
+
+fn handle(record: &[u8]) -> Result {
+    let namespace = meta("namespace").unwrap_or_else(|| "(none)".to_string());
+    COUNTS.with(|counts| *counts.borrow_mut().entry(namespace).or_insert(0) += 1);
+    send(record);
+    Ok(())
+}
+
+fn tick(now_ms: i64) -> Result {
+    let interval = *INTERVAL_MS.get().unwrap_or(&DEFAULT_INTERVAL_MS);
+    let due = WINDOW_START.with(|start| {
+        let mut start = start.borrow_mut();
+        let since = *start.get_or_insert(now_ms);
+        if now_ms - since < interval {
+            return false;
+        }
+        *start = Some(now_ms);
+        true
+    });
+    if due {
+        summarize()?;
+    }
+    Ok(())
+}
+
+/// Emits the counts since the last summary, if there were any records
+fn summarize() -> Result {
+    let counts = COUNTS.with(|counts| std::mem::take(&mut *counts.borrow_mut()));
+    if counts.is_empty() {
+        return Ok(());
+    }
+    let total: u64 = counts.values().sum();
+    let summary = serde_json::json!({
+        "counts": counts,
+        "summary": "records by namespace",
+        "total": total,
+    });
+    send(&serde_json::to_vec(&summary)?);
+    Ok(())
+}
+
+plugin!(handle, init);
+ticker!(tick);
+flusher!(summarize);
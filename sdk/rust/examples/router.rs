@@ -0,0 +1,44 @@
+//! A plugin sending the records with an error level to the output named with the output key, errors by default, and the other records to the default output.
+//! Routed records get a source field with the namespace and the pod they come from.
+
+use logsocket_plugin::{meta, plugin, send, send_to, Result};
+use std::sync::OnceLock;
+
+static OUTPUT: OnceLock<String> = OnceLock::new();
+
+fn init(config: &[u8]) -> Result {
+    let config: serde_json::Value = serde_json::from_slice(config)?;
+    if let Some(output) = config.get("output").and_then(|v| v.as_str()).filter(|s| !s.is_empty()) {
+        OUTPUT.get_or_init(|| output.to_string());
+    }
+    Ok(())
+}
+
+fn handle(record: &[u8]) -> Result {
+    let mut rec: serde_json::Value = serde_json::from_slice(record)?;
+    let level = ["level", "severity"]
+        .iter()
+        .find_map(|field| {
+            rec.get(field)
+                .and_then(|v| v.as_str())
+                .filter(|s| !s.is_empty())
+        })
+        .unwrap_or("");
+    if !level.eq_ignore_ascii_case("error") {
+        send(record);
+        return Ok(());
+    }
+    let source = format!(
+        "{}/{}",
+        meta("namespace").unwrap_or_default(),
+        meta("pod").unwrap_or_default()
+    );
+    if let Some(obj) = rec.as_object_mut() {
+        obj.insert("source".to_string(), source.into());
+    }
+    let output = OUTPUT.get().map_or("errors", |s| s.as_str());
+    send_to(output, &serde_json::to_vec(&rec)?);
+    Ok(())
+}
+
+plugin!(handle, init);
@@ -0,0 +1,165 @@
+//! Implementation of the log-socket plugin ABI (see docs/plugin-abi.md) for plugins written in Rust.
+//!
+//! Plugins define a handler (and optionally a function receiving their configuration) and register it with the [`plugin!`] macro, then are built with
+//!
+//! ```sh
+//! cargo build --release --target wasm32-unknown-unknown
+//! ```
+//!
+//! (or `wasm32-wasip1` for plugins using the standard library's I/O).
+
+/// The version of the plugin ABI implemented by this crate
+pub const ABI_VERSION: i32 = 1;
+
+/// The result of handling a record
+pub type Result = std::result::Result<(), Box<dyn std::error::Error>>;
+
+mod host {
+    #[link(wasm_import_module = "env")]
+    extern "C" {
+        pub fn get_config(ptr: *mut u8);
+        pub fn get_data(ptr: *mut u8);
+        pub fn send(ptr: *const u8, len: u32) -> i32;
+        pub fn send_to(name_ptr: *const u8, name_len: u32, ptr: *const u8, len: u32) -> i32;
+        pub fn error(ptr: *const u8, len: u32);
+        pub fn get_meta(key_ptr: *const u8, key_len: u32, ptr: *mut u8, cap: u32) -> i32;
+        pub fn get_received() -> i64;
+    }
+}
+
+/// Emits a record from the plugin
+pub fn send(record: &[u8]) {
+    unsafe {
+        host::send(record.as_ptr(), record.len() as u32);
+    }
+}
+
+/// Emits a record from the plugin to a named output, e.g. routed to a file by k8stail's `--route` flag
+pub fn send_to(output: &str, record: &[u8]) {
+    unsafe {
+        host::send_to(output.as_ptr(), output.len() as u32, record.as_ptr(), record.len() as u32);
+    }
+}
+
+/// Returns the value of a metadata key of the record being processed (see docs/plugin-abi.md for the keys), if the record has it
+pub fn meta(key: &str) -> Option<String> {
+    let mut buf = vec![0u8; 256];
+    loop {
+        let len = unsafe { host::get_meta(key.as_ptr(), key.len() as u32, buf.as_mut_ptr(), buf.len() as u32) };
+        if len < 0 {
+            return None;
+        }
+        if len as usize <= buf.len() {
+            buf.truncate(len as usize);
+            return String::from_utf8(buf).ok();
+        }
+        // the value didn't fit, try again with a buffer that's large enough
+        buf = vec![0u8; len as usize];
+    }
+}
+
+/// Returns when the record being processed was received in milliseconds since the Unix epoch, if it is known
+pub fn received_ms() -> Option<i64> {
+    match unsafe { host::get_received() } {
+        0 => None,
+        ms => Some(ms),
+    }
+}
+
+/// Reports an error to the host, which fails processing the current record
+pub fn error(msg: &str) {
+    unsafe {
+        host::error(msg.as_ptr(), msg.len() as u32);
+    }
+}
+
+/// Gets the record being received and passes it to the handler; used by [`plugin!`]
+#[doc(hidden)]
+pub fn receive(len: u32, handler: fn(&[u8]) -> Result) {
+    let mut record = vec![0u8; len as usize];
+    unsafe {
+        host::get_data(record.as_mut_ptr());
+    }
+    if let Err(err) = handler(&record) {
+        error(&err.to_string());
+    }
+}
+
+/// Gets the configuration of the plugin and passes it to the initializer; used by [`plugin!`]
+#[doc(hidden)]
+pub fn init(len: u32, initializer: fn(&[u8]) -> Result) {
+    let mut config = vec![0u8; len as usize];
+    unsafe {
+        host::get_config(config.as_mut_ptr());
+    }
+    if let Err(err) = initializer(&config) {
+        error(&err.to_string());
+    }
+}
+
+/// Passes the time to the ticker; used by [`ticker!`]
+#[doc(hidden)]
+pub fn tick(now_ms: i64, ticker: fn(i64) -> Result) {
+    if let Err(err) = ticker(now_ms) {
+        error(&err.to_string());
+    }
+}
+
+/// Calls the flusher; used by [`flusher!`]
+#[doc(hidden)]
+pub fn flush(flusher: fn() -> Result) {
+    if let Err(err) = flusher() {
+        error(&err.to_string());
+    }
+}
+
+/// Exports the functions of the plugin ABI, calling the handler (a `fn(&[u8]) -> logsocket_plugin::Result`) for each record.
+///
+/// The optional initializer (of the same type) is called once with the configuration of the plugin, a JSON object, before any records are received.
+/// Returning an error from it fails loading the plugin. Plugins without an initializer can't be configured.
+#[macro_export]
+macro_rules! plugin {
+    ($handler:path, $initializer:path) => {
+        $crate::plugin!($handler);
+
+        #[export_name = "init"]
+        pub extern "C" fn __logsocket_init(len: u32) {
+            $crate::init(len, $initializer)
+        }
+    };
+    ($handler:path) => {
+        #[export_name = "abi_version"]
+        pub extern "C" fn __logsocket_abi_version() -> i32 {
+            $crate::ABI_VERSION
+        }
+
+        #[export_name = "receive"]
+        pub extern "C" fn __logsocket_receive(len: u32) {
+            $crate::receive(len, $handler)
+        }
+    };
+}
+
+/// Exports the optional tick function of the plugin ABI, calling the ticker (a `fn(i64) -> logsocket_plugin::Result`) periodically with the time in milliseconds since the Unix epoch.
+///
+/// The ticker lets the plugin emit records as time passes (e.g. summaries); it is never called while a record is being handled.
+#[macro_export]
+macro_rules! ticker {
+    ($ticker:path) => {
+        #[export_name = "tick"]
+        pub extern "C" fn __logsocket_tick(now_ms: i64) {
+            $crate::tick(now_ms, $ticker)
+        }
+    };
+}
+
+/// Exports the optional flush function of the plugin ABI, calling the flusher (a `fn() -> logsocket_plugin::Result`) once at the end of the stream, after the last record and tick.
+#[macro_export]
+macro_rules! flusher {
+    ($flusher:path) => {
+        #[export_name = "flush"]
+        pub extern "C" fn __logsocket_flush() {
+            $crate::flush($flusher)
+        }
+    };
+}
@@ -0,0 +1,41 @@
+#!/usr/bin/env bash
+# Builds the example plugins and runs them through k8stail's pipeline, comparing the results with the golden files in testdata.
+# Rust examples are only tested if the wasm32-unknown-unknown target is installed.
+set -euo pipefail
+
+sdk=$(cd "$(dirname "$0")" && pwd)
+out=$(mktemp -d)
+trap 'rm -rf "$out"' EXIT
+
+(cd "$sdk/.." && go build -o "$out/k8stail" ./cmd/k8stail)
+
+# check PLUGIN EXAMPLE runs the plugin with the default configuration and the configurations listed in configs
+check() {
+	local plugin=$1 example=$2
+	echo "$plugin:"
+	"$out/k8stail" plugins test "$plugin" --input "$sdk/testdata/records.jsonl" --golden "$sdk/testdata/$example.golden.jsonl"
+	for config in ${configs[$example]:-}; do
+		echo "$plugin?${config#*:}:"
+		"$out/k8stail" plugins test "$plugin?${config#*:}" --input "$sdk/testdata/records.jsonl" --golden "$sdk/testdata/$example-${config%%:*}.golden.jsonl"
+	done
+}
+
+# configurations of the examples as GOLDEN_SUFFIX:QUERY
+declare -A configs=(
+	[grep]="panic:pattern=panic"
+	[levelfilter]="error:min-level=error"
+)
+
+for example in grep dropfields levelfilter router ratesummary; do
+	(cd "$sdk/go/examples/$example" && GOOS=wasip1 GOARCH=wasm go build -buildmode=c-shared -o "$out/$example-go.wasm" .)
+	check "$out/$example-go.wasm" "$example"
+done
+
+if rustup target list --installed 2>/dev/null | grep -q wasm32-unknown-unknown; then
+	for example in grep drop_fields level_filter router rate_summary; do
+		(cd "$sdk/rust" && cargo build --quiet --release --target wasm32-unknown-unknown --example "$example")
+		check "$sdk/rust/target/wasm32-unknown-unknown/release/examples/$example.wasm" "${example//_/}"
+	done
+else
+	echo "skipping Rust examples, the wasm32-unknown-unknown target is not installed"
+fi